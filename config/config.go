@@ -9,6 +9,14 @@ type Config struct {
 		IsProductionMode bool `env:"IS_PRODUCTION_MODE" env-default:"false" env-description:"Is in production mode"`
 		Port             int  `env:"HTTP_PORT" env-default:"8081" env-description:"HTTP server port"`
 	}
+	Archive struct {
+		MaxBytes int64 `env:"ARCHIVE_MAX_BYTES" env-default:"104857600" env-description:"Maximum size of an uploaded archive and of its unpacked content"`
+		MaxFiles int   `env:"ARCHIVE_MAX_FILES" env-default:"2000" env-description:"Maximum number of files in an uploaded archive"`
+	}
+	Build struct {
+		Reproducible    bool  `env:"REPRODUCIBLE_BUILDS" env-default:"false" env-description:"Derive the book id and dates from the input so identical inputs give identical files"`
+		SourceDateEpoch int64 `env:"SOURCE_DATE_EPOCH" env-description:"Unix timestamp used as the creation date of reproducible builds"`
+	}
 	Logger struct {
 		Level              string `env:"LOGGER_LEVEL" env-default:"debug" env-description:"Log Level for application log"`
 		SQLTraceLogEnable  bool   `env:"LOGGER_SQL_TRACE_LOG_ENABLE" env-default:"false" env-description:"Does the log print low level SQL logs"`
@@ -0,0 +1,162 @@
+// Package cover draws book covers from the title, subtitle and authors of
+// a book, for books that come without a cover image.
+package cover
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Width and Height are the cover size Kindle recommends, in pixels.
+const (
+	Width  = 1600
+	Height = 2560
+)
+
+// margin is the space kept free around the text.
+const margin = 160
+
+// Background is what the text of a cover is set on: an image if set, else
+// a vertical gradient between the colors, a solid color if there is one.
+type Background struct {
+	Colors []color.Color
+	Image  image.Image
+}
+
+// Options describes a cover.
+type Options struct {
+	Title    string
+	Subtitle string
+	Authors  []string
+	// Language is the BCP 47 tag of the text, used to shape it.
+	Language string
+	// RTL sets the text right to left.
+	RTL        bool
+	Background Background
+}
+
+// Text sizes, in pixels.
+const (
+	titleSize    = 150
+	minTitleSize = 80
+	subtitleSize = 72
+	authorSize   = 76
+	// titleLines is the number of lines the title may take before it is
+	// set smaller.
+	titleLines = 4
+)
+
+// Generate draws a cover.
+func Generate(opts Options) (image.Image, error) {
+	if err := loadFonts(); err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, Width, Height))
+	ink, err := paintBackground(img, opts.Background)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTypesetter(opts.Language, opts.RTL)
+	width := Width - 2*margin
+
+	// Set the title as large as it fits on a few lines
+	size := float64(titleSize)
+	title := t.lines(opts.Title, boldFace, size, width)
+	for len(title) > titleLines && size > minTitleSize {
+		size = math.Max(size*0.85, minTitleSize)
+		title = t.lines(opts.Title, boldFace, size, width)
+	}
+	titleLeading := size * 1.2
+
+	var subtitle []line
+	if opts.Subtitle != "" {
+		subtitle = t.lines(opts.Subtitle, regularFace, subtitleSize, width)
+	}
+	var author []line
+	for _, a := range opts.Authors {
+		author = append(author, t.lines(a, regularFace, authorSize, width)...)
+	}
+
+	// The title block sits in the upper part of the cover, the authors
+	// at the bottom
+	y := float64(Height) * 0.28
+	for _, l := range title {
+		y += titleLeading
+		t.draw(l, y)
+	}
+	y += size * 0.6
+	rule := image.Rect(Width/2-120, int(y), Width/2+120, int(y)+8)
+	draw.Draw(img, rule, image.NewUniform(ink), image.Point{}, draw.Over)
+	y += 20
+	for _, l := range subtitle {
+		y += subtitleSize * 1.3
+		t.draw(l, y)
+	}
+
+	y = float64(Height) - margin - float64(len(author)-1)*authorSize*1.3
+	for _, l := range author {
+		t.draw(l, y)
+		y += authorSize * 1.3
+	}
+
+	t.ras.Draw(img, img.Bounds(), image.NewUniform(ink), image.Point{})
+	return img, nil
+}
+
+// paintBackground fills img with the background and returns the color
+// the text is drawn in: black or white, whichever stands out more.
+func paintBackground(img *image.RGBA, bg Background) (color.Color, error) {
+	bounds := img.Bounds()
+	switch {
+	case bg.Image != nil:
+		fillImage(img, bg.Image)
+		// Wash out the image so the text stays readable on it
+		draw.Draw(img, bounds, image.NewUniform(color.NRGBA{A: 0x70}), image.Point{}, draw.Over)
+		return color.White, nil
+	case len(bg.Colors) == 1:
+		draw.Draw(img, bounds, image.NewUniform(bg.Colors[0]), image.Point{}, draw.Src)
+		return inkFor(bg.Colors[0]), nil
+	case len(bg.Colors) == 2:
+		from, to := color.RGBAModel.Convert(bg.Colors[0]).(color.RGBA), color.RGBAModel.Convert(bg.Colors[1]).(color.RGBA)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			t := float64(y-bounds.Min.Y) / float64(bounds.Dy()-1)
+			c := color.RGBA{
+				R: mix(from.R, to.R, t), G: mix(from.G, to.G, t), B: mix(from.B, to.B, t), A: 0xff,
+			}
+			draw.Draw(img, image.Rect(bounds.Min.X, y, bounds.Max.X, y+1), image.NewUniform(c), image.Point{}, draw.Src)
+		}
+		return inkFor(mixColor(from, to)), nil
+	}
+	return nil, fmt.Errorf("background needs an image or one or two colors")
+}
+
+// fillImage scales src to cover dst entirely, cropping what sticks out.
+func fillImage(dst *image.RGBA, src image.Image) {
+	sb := src.Bounds()
+	scale := math.Max(float64(Width)/float64(sb.Dx()), float64(Height)/float64(sb.Dy()))
+	w, h := int(math.Ceil(float64(sb.Dx())*scale)), int(math.Ceil(float64(sb.Dy())*scale))
+	target := image.Rect((Width-w)/2, (Height-h)/2, (Width-w)/2+w, (Height-h)/2+h)
+	xdraw.CatmullRom.Scale(dst, target, src, sb, draw.Src, nil)
+}
+
+// inkFor returns black for light backgrounds and white for dark ones.
+func inkFor(bg color.Color) color.Color {
+	if color.GrayModel.Convert(bg).(color.Gray).Y > 0x90 {
+		return color.Black
+	}
+	return color.White
+}
+
+func mix(a, b uint8, t float64) uint8 {
+	return uint8(math.Round(float64(a)*(1-t) + float64(b)*t))
+}
+
+func mixColor(a, b color.RGBA) color.Color {
+	return color.RGBA{R: mix(a.R, b.R, 0.5), G: mix(a.G, b.G, 0.5), B: mix(a.B, b.B, 0.5), A: 0xff}
+}
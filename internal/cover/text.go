@@ -0,0 +1,186 @@
+package cover
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/go-text/typesetting/di"
+	"github.com/go-text/typesetting/font"
+	ot "github.com/go-text/typesetting/font/opentype"
+	"github.com/go-text/typesetting/language"
+	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// amiriTTF is the Amiri typeface, which covers the Arabic script, Persian
+// included. See fonts/README.md for its license.
+//
+//go:embed fonts/Amiri-Regular.ttf
+var amiriTTF []byte
+
+// Faces the text is set in. The Go fonts set Latin, Greek and Cyrillic
+// text, Amiri everything they have no glyphs for.
+const (
+	regularFace = iota
+	boldFace
+)
+
+var (
+	fontsOnce sync.Once
+	fontsErr  error
+	goFonts   [2]*font.Font
+	amiri     *font.Font
+)
+
+func loadFonts() error {
+	fontsOnce.Do(func() {
+		for i, ttf := range [][]byte{goregular.TTF, gobold.TTF, amiriTTF} {
+			face, err := font.ParseTTF(bytes.NewReader(ttf))
+			if err != nil {
+				fontsErr = fmt.Errorf("parse font: %w", err)
+				return
+			}
+			if i < len(goFonts) {
+				goFonts[i] = face.Font
+			} else {
+				amiri = face.Font
+			}
+		}
+	})
+	return fontsErr
+}
+
+// fontmap picks the face of every character of a text.
+type fontmap struct {
+	latin, arabic *font.Face
+}
+
+func (m fontmap) ResolveFace(r rune) *font.Face {
+	if language.LookupScript(r) == language.Arabic {
+		return m.arabic
+	}
+	if _, ok := m.latin.NominalGlyph(r); ok {
+		return m.latin
+	}
+	return m.arabic
+}
+
+// typesetter shapes text into lines and rasterizes them. Faces are not
+// safe for concurrent use, so every cover gets its own.
+type typesetter struct {
+	lang      language.Language
+	direction di.Direction
+	fontmaps  [2]fontmap
+	shaper    shaping.HarfbuzzShaper
+	segmenter shaping.Segmenter
+	wrapper   shaping.LineWrapper
+	ras       *vector.Rasterizer
+}
+
+// line is a shaped line of text, its runs in visual order from the left.
+type line struct {
+	runs  []shaping.Output
+	width fixed.Int26_6
+}
+
+func newTypesetter(lang string, rtl bool) *typesetter {
+	t := &typesetter{
+		lang:      language.NewLanguage(lang),
+		direction: di.DirectionLTR,
+		ras:       vector.NewRasterizer(Width, Height),
+	}
+	if rtl {
+		t.direction = di.DirectionRTL
+	}
+	arabic := font.NewFace(amiri)
+	for i, f := range goFonts {
+		t.fontmaps[i] = fontmap{latin: font.NewFace(f), arabic: arabic}
+	}
+	return t
+}
+
+// lines shapes text at size pixels to the em and breaks it into lines no
+// wider than width.
+func (t *typesetter) lines(text string, face int, size float64, width int) []line {
+	runes := []rune(text)
+	input := shaping.Input{
+		Text:      runes,
+		RunEnd:    len(runes),
+		Direction: t.direction,
+		Size:      fixed.Int26_6(size * 64),
+		Language:  t.lang,
+	}
+	var runs []shaping.Output
+	for _, in := range t.segmenter.Split(input, t.fontmaps[face]) {
+		runs = append(runs, t.shaper.Shape(in))
+	}
+
+	config := shaping.WrapConfig{Direction: t.direction}
+	wrapped, _ := t.wrapper.WrapParagraph(config, width, runes, shaping.NewSliceIterator(runs))
+	lines := make([]line, 0, len(wrapped))
+	for _, runs := range wrapped {
+		l := line{runs: append([]shaping.Output(nil), runs...)}
+		sort.Slice(l.runs, func(i, j int) bool { return l.runs[i].VisualIndex < l.runs[j].VisualIndex })
+		for _, run := range l.runs {
+			l.width += run.Advance
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// draw adds the glyphs of a line, centered, with its baseline at y.
+func (t *typesetter) draw(l line, y float64) {
+	x := (float64(Width) - float64(l.width)/64) / 2
+	for _, run := range l.runs {
+		scale := float64(run.Size) / 64 / float64(run.Face.Upem())
+		for _, g := range run.Glyphs {
+			outline, ok := run.Face.GlyphData(g.GlyphID).(font.GlyphOutline)
+			if ok {
+				gx := x + float64(g.XOffset)/64
+				gy := y - float64(g.YOffset)/64
+				t.outline(outline, gx, gy, scale)
+			}
+			x += float64(g.XAdvance) / 64
+		}
+	}
+}
+
+// outline adds a glyph outline in font units to the rasterizer, with its
+// origin at x, y.
+func (t *typesetter) outline(o font.GlyphOutline, x, y, scale float64) {
+	pt := func(p ot.SegmentPoint) (float32, float32) {
+		return float32(x + float64(p.X)*scale), float32(y - float64(p.Y)*scale)
+	}
+	open := false
+	for _, s := range o.Segments {
+		switch s.Op {
+		case ot.SegmentOpMoveTo:
+			if open {
+				t.ras.ClosePath()
+			}
+			t.ras.MoveTo(pt(s.Args[0]))
+			open = true
+		case ot.SegmentOpLineTo:
+			t.ras.LineTo(pt(s.Args[0]))
+		case ot.SegmentOpQuadTo:
+			bx, by := pt(s.Args[0])
+			cx, cy := pt(s.Args[1])
+			t.ras.QuadTo(bx, by, cx, cy)
+		case ot.SegmentOpCubeTo:
+			bx, by := pt(s.Args[0])
+			cx, cy := pt(s.Args[1])
+			dx, dy := pt(s.Args[2])
+			t.ras.CubeTo(bx, by, cx, cy, dx, dy)
+		}
+	}
+	if open {
+		t.ras.ClosePath()
+	}
+}
@@ -0,0 +1,306 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// manifestName is the optional file at the root of an archive that lists
+// the markdown and HTML files of the book in order, one path per line.
+const manifestName = "manifest.txt"
+
+var (
+	errInvalidArchive  = errors.New("invalid archive")
+	errArchiveTooLarge = errors.New("archive is too large")
+)
+
+// archiveLimits bounds what an uploaded archive may unpack to.
+type archiveLimits struct {
+	MaxBytes int64
+	MaxFiles int
+}
+
+// sourceDoc is a markdown or HTML document that becomes part of the book.
+type sourceDoc struct {
+	// Path is the slash separated path of the document inside the
+	// archive, or its file name for a single uploaded file.
+	Path   string
+	Source []byte
+	// HTML marks documents written in HTML rather than markdown.
+	HTML bool
+	// Title names the chapter holding content before the first heading.
+	Title string
+	// Chapter keeps an HTML document as a single chapter instead of
+	// splitting it at its headings, as for the documents of an EPUB.
+	Chapter bool
+	// Front marks title matter, which reading does not start at, and
+	// Auxiliary content out of the reading order, which follows the other
+	// documents.
+	Front     bool
+	Auxiliary bool
+}
+
+// extractArchive unpacks an uploaded zip, tar or tar.gz archive into dir.
+func extractArchive(fh *multipart.FileHeader, dir string, limits archiveLimits) error {
+	if fh.Size > limits.MaxBytes {
+		return errArchiveTooLarge
+	}
+	src, err := fh.Open()
+	if err != nil {
+		return fmt.Errorf("open uploaded file: %w", err)
+	}
+	defer src.Close()
+
+	x := &extractor{dir: dir, limits: limits}
+	br := bufio.NewReader(src)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return x.zip(src, fh.Size)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("%w: %s", errInvalidArchive, err)
+		}
+		defer gz.Close()
+		return x.tar(gz)
+	default:
+		return x.tar(br)
+	}
+}
+
+// extractor writes archive entries below dir while enforcing the limits.
+type extractor struct {
+	dir     string
+	limits  archiveLimits
+	written int64
+	files   int
+}
+
+func (x *extractor) zip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidArchive, err)
+	}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%w: %s", errInvalidArchive, err)
+		}
+		err = x.write(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", errInvalidArchive, err)
+		}
+		// Links are skipped so nothing can point outside the directory
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err = x.write(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// write stores a single archive entry, rejecting paths that would end up
+// outside the target directory.
+func (x *extractor) write(name string, r io.Reader) error {
+	name = strings.TrimPrefix(path.Clean(strings.ReplaceAll(name, `\`, "/")), "./")
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("%w: entry %q escapes the archive", errInvalidArchive, name)
+	}
+	if isIgnoredPath(name) {
+		return nil
+	}
+
+	x.files++
+	if x.files > x.limits.MaxFiles {
+		return errArchiveTooLarge
+	}
+
+	target := filepath.Join(x.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("%w: entry %q: %s", errInvalidArchive, name, err)
+	}
+	defer f.Close()
+
+	remaining := x.limits.MaxBytes - x.written
+	n, err := io.Copy(f, io.LimitReader(r, remaining+1))
+	x.written += n
+	if err != nil {
+		return fmt.Errorf("%w: entry %q: %s", errInvalidArchive, name, err)
+	}
+	if n > remaining {
+		return errArchiveTooLarge
+	}
+	return nil
+}
+
+// isIgnoredPath reports whether an archive entry is metadata added by the
+// archiving tool rather than part of the project, such as dot files or
+// the __MACOSX folder.
+func isIgnoredPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveRoot returns the directory holding the project inside an
+// extracted archive. Archives of a whole folder wrap everything in a
+// single top level directory, which is skipped.
+func archiveRoot(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("read archive directory: %w", err)
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(dir, entries[0].Name()), nil
+	}
+	return dir, nil
+}
+
+// loadArchiveDocs reads the markdown and HTML documents of an extracted
+// project in book order: as listed in the manifest if there is one,
+// otherwise in natural sort order of their paths.
+func loadArchiveDocs(root string) ([]sourceDoc, error) {
+	var paths []string
+	manifest, err := os.ReadFile(filepath.Join(root, manifestName))
+	switch {
+	case err == nil:
+		for _, line := range strings.Split(string(manifest), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			p := path.Clean(line)
+			if !filepath.IsLocal(p) {
+				return nil, fmt.Errorf("%w: manifest entry %q escapes the archive", errInvalidArchive, line)
+			}
+			paths = append(paths, p)
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !(isMarkdownFile(p) || isHTMLFile(p)) {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("walk archive directory: %w", err)
+		}
+		sort.Slice(paths, func(i, j int) bool { return naturalLess(paths[i], paths[j]) })
+	default:
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w: no markdown or HTML files found", errInvalidArchive)
+	}
+
+	docs := make([]sourceDoc, 0, len(paths))
+	for _, p := range paths {
+		src, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(p)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: cannot read %q", errInvalidArchive, p)
+		}
+		docs = append(docs, sourceDoc{
+			Path:   p,
+			Source: src,
+			HTML:   isHTMLFile(p),
+			Title:  replaceExt(path.Base(p), ""),
+		})
+	}
+	return docs, nil
+}
+
+// isMarkdownFile reports whether a file name has a markdown extension.
+func isMarkdownFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// naturalLess compares two strings treating runs of digits as numbers, so
+// that "2-setup.md" sorts before "10-usage.md".
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		ca, cb := a[0], b[0]
+		if isDigit(ca) && isDigit(cb) {
+			na, ra := splitDigits(a)
+			nb, rb := splitDigits(b)
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) < len(tb)
+			}
+			if ta != tb {
+				return ta < tb
+			}
+			a, b = ra, rb
+			continue
+		}
+		la, lb := unicode.ToLower(rune(ca)), unicode.ToLower(rune(cb))
+		if la != lb {
+			return la < lb
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// splitDigits splits s after its leading run of digits.
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2-setup.md", "10-usage.md", true},
+		{"10-usage.md", "2-setup.md", false},
+		{"chapter2.md", "chapter10.md", true},
+		{"chapter02.md", "chapter2.md", false},
+		{"chapter2.md", "chapter02.md", false},
+		{"a.md", "B.md", true},
+		{"B.md", "a.md", false},
+		{"part1/b.md", "part1/c.md", true},
+		{"part9/z.md", "part10/a.md", true},
+		{"intro", "intro.md", true},
+		{"same.md", "same.md", false},
+		{"", "a", true},
+	}
+	for _, tt := range tests {
+		if got := naturalLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	names := []string{"10-end.md", "1-start.md", "2-middle.md", "appendix.md"}
+	sort.Slice(names, func(i, j int) bool { return naturalLess(names[i], names[j]) })
+	if got := strings.Join(names, " "); got != "1-start.md 2-middle.md 10-end.md appendix.md" {
+		t.Errorf("sorted = %s", got)
+	}
+}
+
+// archiveEntry is a file of a test archive.
+type archiveEntry struct {
+	name string
+	body string
+	// link makes the entry a symbolic link to link in tar archives.
+	link string
+}
+
+func zipArchive(t *testing.T, entries []archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarArchive(t *testing.T, entries []archiveEntry, compress bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.link != "" {
+			hdr = &tar.Header{Name: e.name, Mode: 0o777, Linkname: e.link, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+// uploadedFile returns data as a file uploaded in a multipart form.
+func uploadedFile(t *testing.T, name string, data []byte) *multipart.FileHeader {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	w, err := mw.CreateFormFile("archive", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	mw.Close()
+	form, err := multipart.NewReader(&body, mw.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	return form.File["archive"][0]
+}
+
+func TestExtractArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive func(t *testing.T) []byte
+		wantErr error
+		// files are the files expected below the target directory.
+		files []string
+	}{
+		{
+			name: "zip",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, []archiveEntry{{name: "book/one.md", body: "# One"}, {name: "./two.md", body: "# Two"}})
+			},
+			files: []string{"book/one.md", "two.md"},
+		},
+		{
+			name: "tar.gz",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, []archiveEntry{{name: "one.md", body: "# One"}}, true)
+			},
+			files: []string{"one.md"},
+		},
+		{
+			name: "ignored metadata",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, []archiveEntry{{name: "one.md"}, {name: "__MACOSX/._one.md"}, {name: ".git/config"}})
+			},
+			files: []string{"one.md"},
+		},
+		{
+			name: "zip parent path",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, []archiveEntry{{name: "../evil.md", body: "x"}})
+			},
+			wantErr: errInvalidArchive,
+		},
+		{
+			name: "zip nested parent path",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, []archiveEntry{{name: "book/../../evil.md", body: "x"}})
+			},
+			wantErr: errInvalidArchive,
+		},
+		{
+			name: "zip backslash parent path",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, []archiveEntry{{name: `..\evil.md`, body: "x"}})
+			},
+			wantErr: errInvalidArchive,
+		},
+		{
+			name: "zip absolute path",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, []archiveEntry{{name: "/tmp/evil.md", body: "x"}})
+			},
+			wantErr: errInvalidArchive,
+		},
+		{
+			name: "tar parent path",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, []archiveEntry{{name: "../evil.md", body: "x"}}, false)
+			},
+			wantErr: errInvalidArchive,
+		},
+		{
+			name: "tar symbolic link",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, []archiveEntry{{name: "link.md", link: "../evil.md"}, {name: "one.md"}}, false)
+			},
+			files: []string{"one.md"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "archive")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			err := extractArchive(uploadedFile(t, "book.zip", tt.archive(t)), dir, archiveLimits{MaxBytes: 1 << 20, MaxFiles: 10})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("extractArchive error = %v, want %v", err, tt.wantErr)
+			}
+			if _, err := os.Stat(filepath.Join(root, "evil.md")); err == nil {
+				t.Error("an entry was written outside the directory")
+			}
+
+			var files []string
+			filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					rel, _ := filepath.Rel(dir, p)
+					files = append(files, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if strings.Join(files, " ") != strings.Join(tt.files, " ") {
+				t.Errorf("files = %q, want %q", files, tt.files)
+			}
+		})
+	}
+}
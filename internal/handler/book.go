@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"fmt"
+	"image"
+	"regexp"
+	"strconv"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// Output formats of a conversion.
+const (
+	formatAZW3 = "azw3"
+	formatEPUB = "epub"
+)
+
+// formatMIMETypes maps the output formats to their media types, which
+// clients may also ask for in the Accept header.
+var formatMIMETypes = map[string]string{
+	formatAZW3: "application/vnd.amazon.ebook",
+	formatEPUB: "application/epub+zip",
+}
+
+// book is a converted book, independent of the format it is written in.
+// The AZW3 and EPUB writers both take it.
+type book struct {
+	Meta     bookMetadata
+	Language language.Tag
+	RTL      bool
+	// UID is the numeric id of the book and Identifier the id as text.
+	// Both are stable for reproducible builds.
+	UID        uint32
+	Identifier string
+	Created    time.Time
+
+	// Chapters refer to embedded images and to other chapters with the
+	// placeholders of imageRef and chapterRef, which the writers replace
+	// with references of their format. A chapter placeholder may be
+	// followed by the fragment of an id inside that chapter, links to ids
+	// of the chapter itself are plain fragments.
+	Chapters []chapter
+	TOC      []*tocEntry
+	// Start is the chapter reading starts at, past the title matter.
+	Start int
+	// Contents is the chapter holding the generated contents page, or -1
+	// if there is none.
+	Contents int
+	// Stylesheets apply to every chapter, in order. They refer to images
+	// and fonts with placeholders like the chapters.
+	Stylesheets []string
+	// Images holds the embedded images in resource order, Encoded the
+	// data they are stored as.
+	Images  []image.Image
+	Encoded []encodedImage
+	// Fonts holds the embedded fonts, referred to with fontRef.
+	Fonts []embeddedFont
+	// Cover is the cover image, if any, and CoverJPEG its encoded form.
+	Cover     image.Image
+	CoverJPEG []byte
+}
+
+// embeddedFont is a TrueType or OpenType font the stylesheets of a book
+// refer to.
+type embeddedFont struct {
+	Data []byte
+	MIME string
+}
+
+// bookRef matches the placeholders chapters and stylesheets refer to
+// images, fonts and other chapters with.
+var bookRef = regexp.MustCompile(`book:(image|font|chapter):(\d+)`)
+
+// imageRef returns the placeholder of the nth embedded image, counting
+// from one.
+func imageRef(n int) string {
+	return fmt.Sprintf("book:image:%d", n)
+}
+
+// fontRef returns the placeholder of the nth embedded font, counting
+// from one.
+func fontRef(n int) string {
+	return fmt.Sprintf("book:font:%d", n)
+}
+
+// chapterRef returns the placeholder of the start of a chapter.
+func chapterRef(chapter int) string {
+	return fmt.Sprintf("book:chapter:%d", chapter)
+}
+
+// bookRefs holds the references a writer replaces the placeholders with.
+type bookRefs struct {
+	Image   func(n int) string
+	Font    func(n int) string
+	Chapter func(chapter int) string
+}
+
+// replace replaces the placeholders in s with the references of r.
+func (r bookRefs) replace(s string) string {
+	return bookRef.ReplaceAllStringFunc(s, func(ref string) string {
+		m := bookRef.FindStringSubmatch(ref)
+		n, _ := strconv.Atoi(m[2])
+		switch m[1] {
+		case "image":
+			return r.Image(n)
+		case "font":
+			return r.Font(n)
+		}
+		return r.Chapter(n)
+	})
+}
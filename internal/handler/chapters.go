@@ -0,0 +1,250 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// chapter is a single rendered chapter of the book.
+type chapter struct {
+	Title string
+	HTML  string
+	// Level is the heading level the chapter was split at.
+	Level int
+	// NoTOC leaves the chapter itself out of the table of contents.
+	NoTOC bool
+	// Front marks title matter, such as the text before the first chapter
+	// heading of a document, which reading does not start at.
+	Front bool
+	// Auxiliary marks content out of the reading order, such as notes
+	// that are only reached through links. It follows the other chapters.
+	Auxiliary bool
+	// Headings lists the headings inside the chapter.
+	Headings []heading
+}
+
+// section is a run of top level markdown blocks that becomes one chapter.
+type section struct {
+	Title string
+	Doc   *ast.Document
+	// Heading is the heading that starts the section, if any.
+	Heading *ast.Heading
+}
+
+// buildChapters parses the source documents and renders them as the
+// chapters of the book, one per heading of the given level. A level of
+// zero detects it from each document. In book mode the notes, and the
+// addresses of external links, follow in chapters of their own.
+func buildChapters(docs []sourceDoc, level int, opts renderOptions, images *bookImages, report *conversionReport) []chapter {
+	type file struct {
+		path     string
+		level    int
+		notes    map[int]*ast.ListItem
+		sections []section
+		// htmlSections holds the sections of an HTML document instead.
+		htmlSections []htmlSection
+		front        bool
+		auxiliary    bool
+	}
+
+	// Split every document first so links between documents can be
+	// resolved to chapter indexes before rendering
+	var files []file
+	fileChapters := make(map[string]int)
+	count := 0
+	for _, d := range docs {
+		if d.HTML {
+			body := htmlBody(d)
+			embedHTMLImages([]*html.Node{body}, d.Path, images)
+			if opts.Quotes != nil {
+				applyHTMLTypography(body, opts.Quotes)
+			}
+			if opts.Hyphenator != nil {
+				applyHTMLHyphenation(body, opts.Hyphenator)
+			}
+			if opts.DigitZero != 0 {
+				localizeHTMLDigits(body, opts.DigitZero)
+			}
+			fileLevel := level
+			if d.Chapter {
+				fileLevel = 0
+			} else if fileLevel == 0 {
+				fileLevel = detectHTMLChapterLevel(body)
+			}
+			sections := splitHTMLSections(body, fileLevel, d.Title)
+			fileChapters[d.Path] = count
+			count += len(sections)
+			files = append(files, file{path: d.Path, level: fileLevel, htmlSections: sections, front: d.Front, auxiliary: d.Auxiliary})
+			continue
+		}
+
+		doc := parseMarkdown(d.Source, opts.Dialect)
+		embedImages(doc, d.Path, images)
+		if opts.Quotes != nil {
+			applyTypography(doc, opts.Quotes)
+		}
+		if opts.Hyphenator != nil {
+			applyHyphenation(doc, opts.Hyphenator)
+		}
+		embedMath(doc, opts.Math, images, report)
+		layoutTables(doc, opts.Tables, opts.TableColumns, images, report)
+		applyDirection(doc, opts)
+		notes := extractFootnotes(doc)
+
+		fileLevel := level
+		if fileLevel == 0 {
+			fileLevel = detectChapterLevel(doc)
+		}
+		sections := splitSections(doc, fileLevel, d.Title)
+		fileChapters[d.Path] = count
+		count += len(sections)
+		files = append(files, file{path: d.Path, level: fileLevel, notes: notes, sections: sections})
+	}
+
+	var (
+		chapters []chapter
+		sources  []string
+	)
+	opts.notes = newFootnotes(opts.Footnotes, opts.DigitZero)
+	opts.links = newLinkRefs(opts.Links, opts.DigitZero)
+	for i, f := range files {
+		opts.notes.startFile(i, f.notes)
+		for _, sec := range f.sections {
+			resolveFileLinks(sec.Doc, f.path, fileChapters, report)
+
+			// Render first, the renderer settles the final heading ids
+			html := mdToHTML(sec.Doc, opts)
+			html += opts.notes.finishChapter(sec.Title, opts)
+			html += opts.links.finishChapter(sec.Title)
+			chapters = append(chapters, chapter{
+				Title:    sec.Title,
+				HTML:     html,
+				Level:    f.level,
+				NoTOC:    sec.Heading != nil && hasClass(sec.Heading, noTOCClass),
+				Front:    sec.Heading == nil && len(f.sections) > 1,
+				Headings: collectHeadings(sec.Doc, sec.Heading),
+			})
+			sources = append(sources, f.path)
+		}
+		for _, sec := range f.htmlSections {
+			resolveHTMLFileLinks(sec.Nodes, f.path, fileChapters, report)
+			opts.links.replaceHTML(sec.Nodes)
+			chapters = append(chapters, chapter{
+				Title:     sec.Title,
+				HTML:      renderHTML(sec.Nodes) + opts.links.finishChapter(sec.Title),
+				Level:     f.level,
+				NoTOC:     sec.Heading != nil && htmlHeading(sec.Heading).NoTOC,
+				Front:     f.front || (sec.Heading == nil && len(f.htmlSections) > 1),
+				Auxiliary: f.auxiliary,
+				Headings:  collectHTMLHeadings(sec),
+			})
+			sources = append(sources, f.path)
+		}
+	}
+	if notes, ok := opts.notes.notesChapter(opts.Titles.Notes); ok {
+		chapters = append(chapters, notes)
+		sources = append(sources, "")
+	}
+	if links, ok := opts.links.linksChapter(opts.Titles.Links); ok {
+		chapters = append(chapters, links)
+		sources = append(sources, "")
+	}
+	resolveAnchors(chapters, sources, report)
+	return chapters
+}
+
+// firstH1 returns the text of the first top level H1 heading of the
+// documents, or an empty string if there is none.
+func firstH1(docs []sourceDoc, dialect markdownDialect) string {
+	for _, d := range docs {
+		if d.HTML {
+			if h1 := findElement(htmlBody(d), atom.H1); h1 != nil && nodeText(h1) != "" {
+				return nodeText(h1)
+			}
+			continue
+		}
+		for _, child := range parseMarkdown(d.Source, dialect).GetChildren() {
+			if h, ok := child.(*ast.Heading); ok && h.Level == 1 && !h.IsTitleblock {
+				if title := headingText(h); title != "" {
+					return title
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// detectChapterLevel returns the heading level a document should be split
+// at when the request does not ask for one: H1 if the document has any,
+// H2 otherwise. Zero means the document has no usable headings.
+func detectChapterLevel(doc ast.Node) int {
+	level := 0
+	for _, child := range doc.GetChildren() {
+		heading, ok := child.(*ast.Heading)
+		if !ok || heading.IsTitleblock {
+			continue
+		}
+		switch heading.Level {
+		case 1:
+			return 1
+		case 2:
+			level = 2
+		}
+	}
+	return level
+}
+
+// splitSections splits the top level blocks of doc at every heading of the
+// given level. Content before the first such heading becomes a section
+// titled after the book. The result always holds at least one section.
+func splitSections(doc ast.Node, level int, bookTitle string) []section {
+	var sections []section
+	current := section{Title: bookTitle, Doc: &ast.Document{}}
+
+	for _, child := range doc.GetChildren() {
+		if heading, ok := child.(*ast.Heading); ok && level > 0 && heading.Level == level && !heading.IsTitleblock {
+			if len(current.Doc.Children) > 0 {
+				sections = append(sections, current)
+			}
+			current = section{Title: headingText(heading), Doc: &ast.Document{}, Heading: heading}
+			if current.Title == "" {
+				current.Title = bookTitle
+			}
+		}
+		child.SetParent(current.Doc)
+		current.Doc.Children = append(current.Doc.Children, child)
+	}
+
+	if len(current.Doc.Children) > 0 || len(sections) == 0 {
+		sections = append(sections, current)
+	}
+	return sections
+}
+
+// headingText returns the plain text content of a heading.
+func headingText(heading *ast.Heading) string {
+	return plainText(heading)
+}
+
+// plainText returns the text content of a node.
+func plainText(node ast.Node) string {
+	var sb strings.Builder
+	ast.WalkFunc(node, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch n := node.(type) {
+		case *ast.Text:
+			sb.Write(n.Literal)
+		case *ast.Code:
+			sb.Write(n.Literal)
+		case *ast.Softbreak, *ast.Hardbreak:
+			sb.WriteByte(' ')
+		}
+		return ast.GoToNext
+	})
+	return strings.TrimSpace(sb.String())
+}
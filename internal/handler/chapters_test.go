@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitSections(t *testing.T) {
+	dialect := markdownDialect{Extensions: markdownDialects[dialectDefault].Extensions | requiredExtensions}
+	tests := []struct {
+		name   string
+		source string
+		level  int
+		titles []string
+		// headed marks the sections that start at a heading.
+		headed []bool
+	}{
+		{
+			name:   "empty",
+			source: "",
+			level:  1,
+			titles: []string{"Book"},
+			headed: []bool{false},
+		},
+		{
+			name:   "no headings",
+			source: "Some text.\n\nMore text.\n",
+			level:  1,
+			titles: []string{"Book"},
+			headed: []bool{false},
+		},
+		{
+			name:   "text before the first heading",
+			source: "Preface.\n\n# One\n\nText.\n\n# Two\n\nText.\n",
+			level:  1,
+			titles: []string{"Book", "One", "Two"},
+			headed: []bool{false, true, true},
+		},
+		{
+			name:   "deeper headings stay in their chapter",
+			source: "# One\n\n## Part\n\nText.\n\n# Two\n",
+			level:  1,
+			titles: []string{"One", "Two"},
+			headed: []bool{true, true},
+		},
+		{
+			name:   "split at the second level",
+			source: "# Book title\n\n## One\n\nText.\n\n## Two *emphasis*\n\nText.\n",
+			level:  2,
+			titles: []string{"Book", "One", "Two emphasis"},
+			headed: []bool{false, true, true},
+		},
+		{
+			name:   "empty heading takes the book title",
+			source: "# ![](logo.png)\n\nText.\n",
+			level:  1,
+			titles: []string{"Book"},
+			headed: []bool{true},
+		},
+		{
+			name:   "level zero keeps one section",
+			source: "# One\n\n# Two\n",
+			level:  0,
+			titles: []string{"Book"},
+			headed: []bool{false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sections := splitSections(parseMarkdown([]byte(tt.source), dialect), tt.level, "Book")
+			var titles []string
+			var headed []bool
+			for _, sec := range sections {
+				titles = append(titles, sec.Title)
+				headed = append(headed, sec.Heading != nil)
+				for _, child := range sec.Doc.Children {
+					if child.GetParent() != sec.Doc {
+						t.Errorf("section %q holds a block of another parent", sec.Title)
+					}
+				}
+			}
+			if !reflect.DeepEqual(titles, tt.titles) {
+				t.Errorf("titles = %q, want %q", titles, tt.titles)
+			}
+			if !reflect.DeepEqual(headed, tt.headed) {
+				t.Errorf("headed = %v, want %v", headed, tt.headed)
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"image"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
@@ -10,110 +12,460 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/alecthomas/chroma/v2"
 	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
 	"github.com/gomarkdown/markdown/html"
 	"github.com/gomarkdown/markdown/parser"
-	"github.com/leotaku/mobi"
 	"golang.org/x/text/language"
 
+	"github.com/Amin-MAG/md2azw3/config"
+	"github.com/Amin-MAG/md2azw3/internal/hyphen"
 	ravandlog "github.com/Amin-MAG/md2azw3/pkg/log"
 	"github.com/labstack/echo/v4"
 )
 
 // ConvertHandler handles markdown to AZW3 conversion requests.
 type ConvertHandler struct {
+	cfg    config.Config
 	logger *ravandlog.Logger
 }
 
 // NewConvertHandler creates a new ConvertHandler.
-func NewConvertHandler(logger *ravandlog.Logger) *ConvertHandler {
-	return &ConvertHandler{logger: logger}
+func NewConvertHandler(cfg config.Config, logger *ravandlog.Logger) *ConvertHandler {
+	return &ConvertHandler{cfg: cfg, logger: logger}
 }
 
 // Convert handles POST /convert.
 // Accepts multipart form with:
-//   - "markdown": the .md file (required)
+//   - "format": output format, "azw3" or "epub"; the Accept header is used without it (optional)
+//   - "markdown": the .md file; HTML content is detected and taken as such (required unless "html" or "archive" is sent)
+//   - "html": an HTML document, converted without markdown rendering (required unless "markdown" or "archive" is sent)
+//   - "archive": zip, tar or tar.gz of a markdown or HTML project, or of the images of the "html" file (required unless "markdown" or "html" is sent)
+//   - "epub": an EPUB converted with its chapters, table of contents and styles (sent instead of the above)
 //   - "cover": cover image file (optional)
+//   - "cover_template": design of the cover generated without one, "gradient", "solid", "image" or "none" (optional)
+//   - "cover_colors": background colors of the generated cover (optional)
+//   - "cover_background": background image of the "image" cover template (optional)
+//   - "cover_fit": how the cover image is fitted, "scale" or "letterbox" (optional)
+//   - "cover_quality": JPEG quality of the cover, 1 to 100 (optional)
+//   - "image_max_width", "image_max_height": size embedded images are scaled down to fit (optional)
+//   - "image_quality": JPEG quality of embedded images, 1 to 100 (optional)
+//   - "image_grayscale": turn embedded images gray, dithered for e-ink (optional)
+//   - "stylesheet": CSS file styling the book (optional)
+//   - "images": image files referenced by the document (optional, repeatable)
 //   - "title": book title (optional)
 //   - "author": author name (optional)
+//   - "language": BCP 47 language tag of the book (optional)
+//   - "localize_digits": write chapter numbers and list markers in native digits (optional)
+//   - "reproducible": derive the book id and dates from the input (optional)
+//   - "markdown_dialect": markdown syntax of the documents, "default", "commonmark", "gfm" or "pandoc-like" (optional)
+//   - "markdown_extensions": comma separated markdown extensions to turn on, or off with a leading "-" (optional)
+//   - "typography": how quotes and dashes are set, "dialect" or after the book language with "locale" (optional)
+//   - "hyphenate": insert soft hyphens into long words, with the patterns of the book language (optional)
+//   - "highlight": theme fenced code blocks are highlighted with, or "none" (optional)
+//   - "math": how formulas are written, "image" or "mathml" (optional)
+//   - "footnotes": where notes are collected, "chapter" or "book" (optional)
+//   - "links": how external links are handled, "keep", "text", "chapter" or "book" (optional)
+//   - "tables": layout of wide tables, "cards", "image" or "keep" (optional)
+//   - "table_columns": number of columns above which a table is wide (optional)
+//   - "chapter_level": heading level to split chapters at (optional)
+//   - "toc_depth": number of heading levels in the table of contents (optional)
+//   - "toc_page": add a contents page after the title matter (optional)
 func (h *ConvertHandler) Convert(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	// Parse the markdown file
-	mdFile, err := c.FormFile("markdown")
+	opts, err := parseConvertOptions(c, h.cfg)
 	if err != nil {
-		h.logger.WithError(err).Warn(ctx, "missing markdown file in request")
+		h.logger.WithError(err).Warn(ctx, "invalid conversion options")
 		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "markdown file is required",
+			"error": err.Error(),
 		})
 	}
 
-	// Read the markdown content
-	mdContent, err := readUploadedFile(mdFile)
+	tmpDir, err := os.MkdirTemp("", "md2azw3-*")
 	if err != nil {
-		h.logger.WithError(err).Error(ctx, "failed to read markdown file")
+		h.logger.WithError(err).Error(ctx, "failed to create temp directory")
 		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "failed to read markdown file",
+			"error": "internal server error",
 		})
 	}
+	defer os.RemoveAll(tmpDir)
 
-	// Convert markdown to HTML
-	htmlContent := mdToHTML(mdContent)
+	// Collect the documents of the book
+	mdFile, mdErr := c.FormFile("markdown")
+	htmlFile, htmlErr := c.FormFile("html")
+	archiveFile, archiveErr := c.FormFile("archive")
+	epubFile, epubErr := c.FormFile("epub")
 
-	// Build the book
-	title := c.FormValue("title")
-	if title == "" {
-		title = replaceExt(filepath.Base(mdFile.Filename), "")
+	var (
+		docs       []sourceDoc
+		sourceName string
+		root       string
+		source     *epubSource
+	)
+	if mdErr == nil && htmlErr == nil {
+		h.logger.Warn(ctx, "both markdown and HTML file in request")
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "send either a markdown or an HTML file, not both",
+		})
+	}
+	if mdErr == nil && archiveErr == nil {
+		h.logger.Warn(ctx, "both markdown file and archive in request")
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "send either a markdown file or an archive, not both",
+		})
+	}
+	if epubErr == nil && (mdErr == nil || htmlErr == nil || archiveErr == nil) {
+		h.logger.Warn(ctx, "EPUB together with other documents in request")
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "send an EPUB on its own, without markdown, HTML file or archive",
+		})
 	}
 
-	book := mobi.Book{
-		Title:       title,
-		CreatedDate: time.Now(),
-		Language:    language.English,
-		UniqueID:    rand.Uint32(),
-		Chapters: []mobi.Chapter{
-			{
-				Title:  title,
-				Chunks: mobi.Chunks(htmlContent),
-			},
-		},
+	report := &conversionReport{}
+	if epubErr == nil {
+		sourceName = replaceExt(filepath.Base(epubFile.Filename), "")
+		root = filepath.Join(tmpDir, "epub")
+		limits := archiveLimits{MaxBytes: h.cfg.Archive.MaxBytes, MaxFiles: h.cfg.Archive.MaxFiles}
+		err = extractArchive(epubFile, root, limits)
+		switch {
+		case err == nil:
+			source, err = readEPUB(root, report)
+		case errors.Is(err, errInvalidArchive):
+			err = fmt.Errorf("%w: not a readable zip file", errInvalidEPUB)
+		}
+		switch {
+		case errors.Is(err, errArchiveTooLarge):
+			h.logger.WithError(err).Warn(ctx, "EPUB exceeds limits")
+			return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+				"error": fmt.Sprintf("EPUB exceeds the limit of %d bytes or %d files", limits.MaxBytes, limits.MaxFiles),
+			})
+		case errors.Is(err, errInvalidEPUB):
+			h.logger.WithError(err).Warn(ctx, "invalid EPUB in request")
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		case err != nil:
+			h.logger.WithError(err).Error(ctx, "failed to read EPUB")
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "failed to read EPUB",
+			})
+		}
+		docs = source.Docs
 	}
 
-	if author := c.FormValue("author"); author != "" {
-		book.Authors = []string{author}
+	if archiveErr == nil {
+		sourceName = archiveBaseName(filepath.Base(archiveFile.Filename))
+		extractDir := filepath.Join(tmpDir, "archive")
+		limits := archiveLimits{MaxBytes: h.cfg.Archive.MaxBytes, MaxFiles: h.cfg.Archive.MaxFiles}
+		err = extractArchive(archiveFile, extractDir, limits)
+		switch {
+		case err != nil:
+		case htmlErr == nil:
+			// Next to an HTML file the archive only holds its images, laid
+			// out as the file refers to them.
+			root = extractDir
+		default:
+			if root, err = archiveRoot(extractDir); err == nil {
+				docs, err = loadArchiveDocs(root)
+			}
+		}
+		switch {
+		case errors.Is(err, errArchiveTooLarge):
+			h.logger.WithError(err).Warn(ctx, "archive exceeds limits")
+			return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+				"error": fmt.Sprintf("archive exceeds the limit of %d bytes or %d files", limits.MaxBytes, limits.MaxFiles),
+			})
+		case errors.Is(err, errInvalidArchive):
+			h.logger.WithError(err).Warn(ctx, "invalid archive in request")
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		case err != nil:
+			h.logger.WithError(err).Error(ctx, "failed to extract archive")
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "failed to read archive",
+			})
+		}
 	}
 
-	// Handle optional cover image
-	coverFile, coverErr := c.FormFile("cover")
-	if coverErr == nil && coverFile != nil {
-		coverImg, err := decodeUploadedImage(coverFile)
+	switch {
+	case htmlErr == nil || mdErr == nil:
+		docFile := mdFile
+		if htmlErr == nil {
+			docFile = htmlFile
+		}
+		sourceName = replaceExt(filepath.Base(docFile.Filename), "")
+		content, err := readUploadedFile(docFile)
 		if err != nil {
-			h.logger.WithError(err).Error(ctx, "failed to decode cover image")
+			h.logger.WithError(err).Error(ctx, "failed to read document")
 			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "failed to process cover image",
+				"error": "failed to read uploaded document",
 			})
 		}
-		book.CoverImage = coverImg
+		docs = []sourceDoc{{
+			Path:   filepath.Base(docFile.Filename),
+			Source: content,
+			// Markdown uploads that turn out to be HTML are taken as such.
+			HTML: htmlErr == nil || isHTMLUpload(docFile, content),
+		}}
+
+	case archiveErr != nil && epubErr != nil:
+		h.logger.WithError(mdErr).Warn(ctx, "missing document in request")
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "markdown file, HTML file, archive or EPUB is required",
+		})
 	}
 
-	// Realize and write the AZW3 file
-	h.logger.Info(ctx, "generating azw3")
-	db := book.Realize()
+	// Read the book metadata, form fields take precedence over front matter
+	// and the package document of an EPUB
+	var meta bookMetadata
+	if source != nil {
+		meta = source.Meta
+	} else if meta, err = readFrontMatter(docs); err != nil {
+		h.logger.WithError(err).Warn(ctx, "invalid front matter in request")
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
 
-	tmpDir, err := os.MkdirTemp("", "md2azw3-*")
+	// Settle the markdown dialect, form fields again win over front matter
+	dialectName := meta.MarkdownDialect
+	if opts.MarkdownDialect != "" {
+		dialectName = opts.MarkdownDialect
+	}
+	dialect, err := newMarkdownDialect(dialectName, strings.Join(meta.MarkdownExtensions, ","), opts.MarkdownExtensions)
 	if err != nil {
-		h.logger.WithError(err).Error(ctx, "failed to create temp directory")
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "internal server error",
+		// The form fields are checked already, the front matter is at fault
+		h.logger.WithError(err).Warn(ctx, "invalid markdown dialect in front matter")
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("%s: invalid front matter: %s", docs[0].Path, err),
 		})
 	}
-	defer os.RemoveAll(tmpDir)
+	if dialect.Extensions&parser.Titleblock != 0 && !docs[0].HTML {
+		block := titleblockMetadata(docs[0].Source)
+		if meta.Title == "" {
+			meta.Title = block.Title
+		}
+		if len(meta.Authors) == 0 {
+			meta.Authors = block.Authors
+		}
+		if meta.Date.IsZero() {
+			meta.Date = block.Date
+		}
+	}
 
-	mdFilename := filepath.Base(mdFile.Filename)
-	outputFilename := replaceExt(mdFilename, ".azw3")
+	if title := c.FormValue("title"); title != "" {
+		meta.Title = title
+	}
+	if meta.Title == "" {
+		meta.Title = firstH1(docs, dialect)
+	}
+	if meta.Title == "" {
+		meta.Title = sourceName
+	}
+	if author := c.FormValue("author"); author != "" {
+		meta.Authors = []string{author}
+	}
+	if docs[0].Title == "" {
+		docs[0].Title = meta.Title
+	}
+	if lang := c.FormValue("language"); lang != "" {
+		meta.Language = lang
+	}
+
+	// Resolve the book language, guessing it from the text if not given
+	lang := language.English
+	if meta.Language != "" {
+		if lang, err = parseLanguage(meta.Language); err != nil {
+			h.logger.WithError(err).Warn(ctx, "invalid language in request")
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+	} else if detected, ok := detectLanguage(docs, dialect); ok {
+		lang = detected
+		h.logger.With("language", lang.String()).Info(ctx, "detected book language")
+	}
+
+	var uploads []*multipart.FileHeader
+	if form, err := c.MultipartForm(); err == nil {
+		uploads = form.File["images"]
+	}
+	images := newBookImages(root, uploads, imageOptions{
+		MaxWidth:  opts.ImageMaxWidth,
+		MaxHeight: opts.ImageMaxHeight,
+		Quality:   opts.ImageQuality,
+		Grayscale: opts.ImageGrayscale,
+	}, report)
+
+	// Convert markdown to HTML chapters
+	render := renderOptions{RTL: isRTL(lang), Highlight: opts.Highlight, Math: opts.Math, Footnotes: opts.Footnotes,
+		Links: opts.Links, Tables: opts.Tables, TableColumns: opts.TableColumns, Dialect: dialect, Titles: pageTitlesFor(lang)}
+	if opts.Typography == typographyLocale {
+		// The typography pass takes over from the English-only SmartyPants
+		render.Quotes = quoteStyleFor(lang)
+		render.Dialect.Flags &^= smartypantsFlags
+	}
+	if opts.Hyphenate {
+		if hyphenator, ok := hyphen.New(lang); ok {
+			render.Hyphenator = hyphenator
+		} else {
+			report.Warnf("no hyphenation patterns for language %s, words are not hyphenated", lang)
+		}
+	}
+	if opts.LocalizeDigits {
+		if zero, ok := nativeZero(lang); ok {
+			render.DigitZero = zero
+		} else {
+			report.Warnf("language %s has no native digits, keeping Latin digits", lang)
+		}
+	}
+	chapters := buildChapters(docs, opts.ChapterLevel, render, images, report)
+	toc := buildTOC(chapters, opts.TOCDepth)
+	var (
+		epubStylesheets []epubStylesheet
+		fonts           []embeddedFont
+	)
+	if source != nil {
+		// An EPUB brings its own table of contents and styles
+		if len(source.TOC) > 0 {
+			toc = source.TOC
+		}
+		epubStylesheets, fonts = source.embedStylesheets(images, report)
+		if opts.Format == formatAZW3 {
+			source.inlineStyles.report(report, "inline style %s in %s")
+		}
+	}
+	contents := -1
+	if opts.TOCPage {
+		chapters, toc, contents = addContentsPage(chapters, toc, render.Titles.Contents)
+	}
+
+	// Build the book
+	b := book{
+		Meta:       meta,
+		Language:   lang,
+		RTL:        render.RTL,
+		UID:        rand.Uint32(),
+		Identifier: randomUUID(),
+		Created:    time.Now(),
+		Chapters:   chapters,
+		TOC:        toc,
+		Start:      startChapter(chapters),
+		Contents:   contents,
+		Images:     images.Images,
+		Encoded:    images.Encoded,
+		Fonts:      fonts,
+	}
+	if meta.ID != "" || opts.Reproducible {
+		b.UID = bookUID(meta)
+		b.Identifier = bookIdentifier(meta)
+	}
+	if opts.Reproducible {
+		b.Created = buildDate(meta, h.cfg.Build.SourceDateEpoch)
+	}
+	b.Stylesheets = bookStylesheets(render)
+	for _, sheet := range epubStylesheets {
+		if opts.Format == formatAZW3 {
+			for _, problem := range validateStylesheet(sheet.CSS) {
+				report.Warnf("stylesheet %s %s", sheet.Path, problem)
+			}
+		}
+		b.Stylesheets = append(b.Stylesheets, sheet.CSS)
+	}
+
+	// Add the custom stylesheet last so it overrides the defaults, the
+	// uploaded one wins over front matter
+	var css []byte
+	if cssFile, err := c.FormFile("stylesheet"); err == nil {
+		if css, err = readUploadedFile(cssFile); err != nil {
+			h.logger.WithError(err).Error(ctx, "failed to read stylesheet")
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "failed to read stylesheet",
+			})
+		}
+	} else if meta.Stylesheet != "" {
+		if _, css, err = images.load(meta.Stylesheet, path.Dir(docs[0].Path)); err != nil {
+			report.Warnf("stylesheet %q not used: %s", meta.Stylesheet, err)
+		}
+	}
+	if css != nil {
+		if !utf8.Valid(css) {
+			h.logger.Warn(ctx, "stylesheet is not UTF-8")
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "stylesheet must be UTF-8 encoded",
+			})
+		}
+		if opts.Format == formatAZW3 {
+			for _, problem := range validateStylesheet(string(css)) {
+				report.Warnf("stylesheet %s", problem)
+			}
+		}
+		b.Stylesheets = append(b.Stylesheets, string(css))
+	}
+
+	// Handle optional cover image, the uploaded one wins over front matter
+	coverFile, coverErr := c.FormFile("cover")
+	if coverErr == nil && coverFile != nil {
+		coverImg, err := decodeUploadedImage(coverFile)
+		if err != nil {
+			h.logger.WithError(err).Warn(ctx, "invalid cover image")
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "cover: " + err.Error(),
+			})
+		}
+		b.Cover = normalizeCover(coverImg, opts.CoverFit, report)
+	} else if meta.Cover != "" {
+		coverImg, err := images.decode(meta.Cover, path.Dir(docs[0].Path))
+		if err != nil {
+			report.Warnf("cover %q not used: %s", meta.Cover, err)
+		} else {
+			b.Cover = normalizeCover(coverImg, opts.CoverFit, report)
+		}
+	}
+	if b.Cover == nil && opts.CoverTemplate != coverNone {
+		var background image.Image
+		if opts.CoverTemplate == coverImage {
+			backgroundFile, err := c.FormFile("cover_background")
+			if err == nil {
+				background, err = decodeUploadedImage(backgroundFile)
+			}
+			if err != nil {
+				h.logger.WithError(err).Warn(ctx, "invalid cover background")
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error": "cover_background: " + err.Error(),
+				})
+			}
+		}
+		coverImg, err := generateCover(meta, lang, opts, background)
+		if err != nil {
+			h.logger.WithError(err).Error(ctx, "failed to generate cover")
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "failed to generate cover",
+			})
+		}
+		b.Cover = coverImg
+	}
+	if b.Cover != nil {
+		if b.CoverJPEG, err = encodeCover(b.Cover, opts.CoverQuality); err != nil {
+			h.logger.WithError(err).Error(ctx, "failed to encode cover")
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "failed to process cover",
+			})
+		}
+	}
+
+	// Write the book in the requested format
+	h.logger.With("format", opts.Format).Info(ctx, "generating book")
+	outputFilename := sourceName + "." + opts.Format
 	outputPath := filepath.Join(tmpDir, outputFilename)
 
 	f, err := os.Create(outputPath)
@@ -124,25 +476,105 @@ func (h *ConvertHandler) Convert(c echo.Context) error {
 		})
 	}
 
-	if err = db.Write(f); err != nil {
+	write := writeAZW3
+	if opts.Format == formatEPUB {
+		write = writeEPUB
+	}
+	if err = write(f, b); err != nil {
 		f.Close()
-		h.logger.WithError(err).Error(ctx, "failed to write azw3")
+		h.logger.WithError(err).Error(ctx, "failed to write book")
 		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "failed to generate azw3",
+			"error": "failed to generate " + opts.Format,
 		})
 	}
 	f.Close()
 
+	writeReport(ctx, c, h.logger, report)
 	h.logger.Info(ctx, "conversion successful, returning file")
+	c.Response().Header().Set(echo.HeaderContentType, formatMIMETypes[opts.Format])
 	return c.Attachment(outputPath, outputFilename)
 }
 
-func mdToHTML(md []byte) string {
-	extensions := parser.CommonExtensions | parser.AutoHeadingIDs
-	p := parser.NewWithExtensions(extensions)
-	opts := html.RendererOptions{Flags: html.CommonFlags | html.HrefTargetBlank}
-	renderer := html.NewRenderer(opts)
-	return string(markdown.ToHTML(md, p, renderer))
+// renderOptions controls how the markdown of the book is rendered.
+type renderOptions struct {
+	// RTL lays the chapters out right to left.
+	RTL bool
+	// DigitZero is the zero of the native digits chapter numbers and list
+	// markers are written in, or 0 to keep Latin digits.
+	DigitZero rune
+	// Highlight is the style fenced code blocks are highlighted with, or
+	// nil to leave them plain.
+	Highlight *chroma.Style
+	// Math is how formulas are written: mathImage or mathMathML.
+	Math string
+	// Footnotes is where notes are collected: footnotesChapter or
+	// footnotesBook.
+	Footnotes string
+	// Tables is the layout of tables wider than TableColumns columns:
+	// tablesKeep, tablesCards or tablesImage.
+	Tables       string
+	TableColumns int
+	// Dialect is the markdown syntax and typography of the documents.
+	Dialect markdownDialect
+	// Quotes are the quotation marks the text is typeset with, or nil to
+	// leave the typography to the dialect.
+	Quotes *quoteStyle
+	// Hyphenator inserts soft hyphens into long words, or is nil to leave
+	// them whole.
+	Hyphenator *hyphen.Hyphenator
+
+	// Links is how external links are handled: linksKeep, linksText,
+	// linksChapter or linksBook.
+	Links string
+	// Titles are the titles of the pages the converter adds.
+	Titles pageTitles
+
+	// notes numbers the notes while the chapters are rendered.
+	notes *footnotes
+	// links numbers the external links while the chapters are rendered.
+	links *linkRefs
+}
+
+func parseMarkdown(md []byte, dialect markdownDialect) ast.Node {
+	p := parser.NewWithExtensions(dialect.Extensions)
+	if dialect.Extensions&parser.MathJax != 0 {
+		var single parser.InlineParser
+		single = p.RegisterInline('$', func(p *parser.Parser, data []byte, offset int) (int, ast.Node) {
+			return inlineMath(p, data, offset, single)
+		})
+	}
+	return markdown.Parse(md, p)
+}
+
+func mdToHTML(doc ast.Node, opts renderOptions) string {
+	rendererOpts := html.RendererOptions{Flags: opts.Dialect.Flags}
+	rendererOpts.RenderNodeHook = func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		switch n := node.(type) {
+		case *ast.CodeBlock:
+			if opts.Highlight != nil {
+				return ast.GoToNext, highlightCodeBlock(w, n, opts.Highlight)
+			}
+		case *ast.TableCell:
+			if entering {
+				renderTableCell(w, n)
+				return ast.GoToNext, true
+			}
+		case *ast.Link:
+			if n.NoteID != 0 && opts.notes != nil {
+				if entering {
+					io.WriteString(w, opts.notes.ref(n))
+				}
+				return ast.SkipChildren, true
+			}
+			if markup, skip := opts.links.renderLink(n, entering); skip {
+				io.WriteString(w, markup)
+				return ast.GoToNext, true
+			}
+		}
+		return ast.GoToNext, false
+	}
+	renderer := html.NewRenderer(rendererOpts)
+	return string(markdown.Render(doc, renderer))
 }
 
 func readUploadedFile(fh *multipart.FileHeader) ([]byte, error) {
@@ -155,17 +587,22 @@ func readUploadedFile(fh *multipart.FileHeader) ([]byte, error) {
 }
 
 func decodeUploadedImage(fh *multipart.FileHeader) (image.Image, error) {
-	src, err := fh.Open()
+	data, err := readUploadedFile(fh)
 	if err != nil {
-		return nil, fmt.Errorf("open uploaded file: %w", err)
+		return nil, err
 	}
-	defer src.Close()
+	return decodeImage(data)
+}
 
-	img, _, err := image.Decode(src)
-	if err != nil {
-		return nil, fmt.Errorf("decode image: %w", err)
+// archiveBaseName strips the archive extension from a file name.
+func archiveBaseName(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(lower, ext) {
+			return filename[:len(filename)-len(ext)]
+		}
 	}
-	return img, nil
+	return replaceExt(filename, "")
 }
 
 func replaceExt(filename, newExt string) string {
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Amin-MAG/md2azw3/config"
+	ravandlog "github.com/Amin-MAG/md2azw3/pkg/log"
+	"github.com/labstack/echo/v4"
+)
+
+// testConfig returns the configuration of the handler under test.
+func testConfig() config.Config {
+	var cfg config.Config
+	cfg.Archive.MaxBytes = 10 << 20
+	cfg.Archive.MaxFiles = 100
+	return cfg
+}
+
+// convertRequest posts a conversion request with the given form fields
+// and files, keyed by their form field, and returns the response.
+func convertRequest(t *testing.T, cfg config.Config, fields map[string]string, files map[string]archiveEntry) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	for field, f := range files {
+		w, err := mw.CreateFormFile(field, f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.body))
+	}
+	mw.Close()
+
+	logger, err := ravandlog.NewLogger(ravandlog.Config{Level: "panic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/convert", &body)
+	req.Header.Set(echo.HeaderContentType, mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	if err := NewConvertHandler(cfg, logger).Convert(c); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/leotaku/mobi/jfif"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/text/language"
+
+	"github.com/Amin-MAG/md2azw3/internal/cover"
+)
+
+// Cover templates, used for books that come without a cover image.
+const (
+	// coverGradient sets the text on a vertical gradient.
+	coverGradient = "gradient"
+	// coverSolid sets the text on a single color.
+	coverSolid = "solid"
+	// coverImage sets the text on the uploaded "cover_background" image.
+	coverImage = "image"
+	// coverNone leaves the book without a cover.
+	coverNone = "none"
+)
+
+// Cover fits, how cover images that are not in the recommended aspect
+// ratio are handled.
+const (
+	// coverScale keeps the aspect ratio of the image.
+	coverScale = "scale"
+	// coverLetterbox pads the image with white to the recommended ratio.
+	coverLetterbox = "letterbox"
+)
+
+// Cover sizes Kindle recommends, in pixels. cover.Width and cover.Height
+// are the ideal size.
+const (
+	minCoverWidth  = 625
+	minCoverHeight = 1000
+	// coverRatio is the ideal ratio of height to width.
+	coverRatio = 1.6
+	// coverRatioTolerance is how far, relatively, the ratio of a cover may
+	// be off before it is reported.
+	coverRatioTolerance = 0.1
+)
+
+// defaultCoverQuality is the JPEG quality covers are stored at when the
+// request does not set one.
+const defaultCoverQuality = 90
+
+// defaultCoverColors are the background colors of the templates when the
+// request does not set any: a dark blue, lightening downwards.
+var defaultCoverColors = []color.Color{
+	color.RGBA{R: 0x1f, G: 0x2a, B: 0x44, A: 0xff},
+	color.RGBA{R: 0x4a, G: 0x6f, B: 0xa5, A: 0xff},
+}
+
+// coverColorCount returns the number of colors a template takes.
+func coverColorCount(template string) int {
+	switch template {
+	case coverSolid:
+		return 1
+	case coverGradient:
+		return 2
+	}
+	return 0
+}
+
+// generateCover draws a cover for a book without one in the given
+// template. background is only used by coverImage.
+func generateCover(meta bookMetadata, lang language.Tag, opts convertOptions, background image.Image) (image.Image, error) {
+	bg := cover.Background{Colors: opts.CoverColors}
+	if opts.CoverTemplate == coverImage {
+		bg = cover.Background{Image: background}
+	} else if len(bg.Colors) == 0 {
+		bg.Colors = defaultCoverColors[:coverColorCount(opts.CoverTemplate)]
+	}
+	return cover.Generate(cover.Options{
+		Title:      meta.Title,
+		Subtitle:   meta.Subtitle,
+		Authors:    meta.Authors,
+		Language:   lang.String(),
+		RTL:        isRTL(lang),
+		Background: bg,
+	})
+}
+
+// parseCoverColors parses a comma separated list of "#rrggbb" colors.
+func parseCoverColors(s string) ([]color.Color, error) {
+	var colors []color.Color
+	for _, field := range strings.Split(s, ",") {
+		hex := strings.TrimPrefix(strings.TrimSpace(field), "#")
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 6 {
+			return nil, fmt.Errorf("cover_colors must be colors in #rrggbb form, separated by commas")
+		}
+		colors = append(colors, color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff})
+	}
+	return colors, nil
+}
+
+// normalizeCover checks a cover image against the Kindle recommendations,
+// reporting problems as warnings, and scales it down to fit the ideal
+// size. Letterboxing pads it to the ideal aspect ratio.
+func normalizeCover(img image.Image, fit string, report *conversionReport) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w < minCoverWidth || h < minCoverHeight {
+		report.Warnf("cover is %dx%d pixels, Kindle needs at least %dx%d", w, h, minCoverWidth, minCoverHeight)
+	}
+	ratio := float64(h) / float64(w)
+	if math.Abs(ratio-coverRatio)/coverRatio > coverRatioTolerance && fit != coverLetterbox {
+		report.Warnf("cover aspect ratio is 1:%.2f, Kindle recommends 1:%.1f", ratio, coverRatio)
+	}
+
+	scale := math.Min(1, math.Min(float64(cover.Width)/float64(w), float64(cover.Height)/float64(h)))
+	sw, sh := int(math.Round(float64(w)*scale)), int(math.Round(float64(h)*scale))
+	dw, dh := sw, sh
+	if fit == coverLetterbox {
+		if float64(sh)/float64(sw) < coverRatio {
+			dh = int(math.Round(float64(sw) * coverRatio))
+		} else {
+			dw = int(math.Round(float64(sh) / coverRatio))
+		}
+	}
+	if dw == w && dh == h {
+		return img
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	target := image.Rect((dw-sw)/2, (dh-sh)/2, (dw-sw)/2+sw, (dh-sh)/2+sh)
+	xdraw.CatmullRom.Scale(dst, target, img, b, draw.Src, nil)
+	return dst
+}
+
+// encodeCover encodes a cover as baseline JPEG at the given quality.
+func encodeCover(img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jfif.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("encode cover: %w", err)
+	}
+	return buf.Bytes(), nil
+}
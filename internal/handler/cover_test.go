@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/language"
+
+	"github.com/Amin-MAG/md2azw3/internal/cover"
+)
+
+func TestGenerateCover(t *testing.T) {
+	meta := bookMetadata{Title: "A Book About Things", Subtitle: "And Other Things", Authors: []string{"Jane Doe"}}
+	red := color.RGBA{R: 0xff, A: 0xff}
+	tests := []struct {
+		name       string
+		meta       bookMetadata
+		lang       language.Tag
+		template   string
+		colors     []color.Color
+		background image.Image
+		top        color.Color
+		bottom     color.Color
+	}{
+		{
+			name:     "gradient",
+			meta:     meta,
+			lang:     language.English,
+			template: coverGradient,
+			top:      defaultCoverColors[0],
+			bottom:   defaultCoverColors[1],
+		},
+		{
+			name:     "solid",
+			meta:     meta,
+			lang:     language.English,
+			template: coverSolid,
+			top:      defaultCoverColors[0],
+			bottom:   defaultCoverColors[0],
+		},
+		{
+			name:     "colors of the request",
+			meta:     meta,
+			lang:     language.English,
+			template: coverSolid,
+			colors:   []color.Color{red},
+			top:      red,
+			bottom:   red,
+		},
+		{
+			name:       "background image",
+			meta:       meta,
+			lang:       language.English,
+			template:   coverImage,
+			background: whiteImage(800, 1280),
+			// Darkened for the white text
+			top:    color.Gray{Y: 0x8f},
+			bottom: color.Gray{Y: 0x8f},
+		},
+		{
+			name:     "right to left",
+			meta:     bookMetadata{Title: "کتابی درباره‌ی چیزها", Authors: []string{"نویسنده"}},
+			lang:     language.Persian,
+			template: coverGradient,
+			top:      defaultCoverColors[0],
+			bottom:   defaultCoverColors[1],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := convertOptions{CoverTemplate: tt.template, CoverColors: tt.colors}
+			img, err := generateCover(tt.meta, tt.lang, opts, tt.background)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := img.Bounds(); b.Dx() != cover.Width || b.Dy() != cover.Height {
+				t.Fatalf("cover is %v", b)
+			}
+			if got := color.RGBAModel.Convert(img.At(0, 0)); !closeColor(got, tt.top) {
+				t.Errorf("top = %v, want %v", got, tt.top)
+			}
+			if got := color.RGBAModel.Convert(img.At(0, cover.Height-1)); !closeColor(got, tt.bottom) {
+				t.Errorf("bottom = %v, want %v", got, tt.bottom)
+			}
+
+			// The title is set in the upper half in the ink that stands out
+			ink := 0
+			for y := cover.Height / 4; y < cover.Height/2; y += 4 {
+				for x := 0; x < cover.Width; x += 4 {
+					if !closeColor(img.At(x, y), img.At(0, y)) {
+						ink++
+					}
+				}
+			}
+			if ink < 1000 {
+				t.Errorf("%d pixels of the title drawn", ink)
+			}
+		})
+	}
+}
+
+// whiteImage returns a white image of the given size.
+func whiteImage(w, h int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
+
+// closeColor reports whether two colors differ by little more than
+// rounding.
+func closeColor(a, b color.Color) bool {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+	near := func(x, y uint32) bool { return x-y+0x300 <= 0x600 }
+	return near(ar, br) && near(ag, bg) && near(ab, bb)
+}
+
+func TestParseCoverColors(t *testing.T) {
+	colors, err := parseCoverColors("#1f2a44, 4A6FA5")
+	want := []color.Color{color.RGBA{R: 0x1f, G: 0x2a, B: 0x44, A: 0xff}, color.RGBA{R: 0x4a, G: 0x6f, B: 0xa5, A: 0xff}}
+	if err != nil || !reflect.DeepEqual(colors, want) {
+		t.Errorf("colors = %v, %v", colors, err)
+	}
+	for _, s := range []string{"", "#fff", "#1f2a4", "#1f2a44ff", "#gg0000", "#1f2a44;#000000"} {
+		if _, err := parseCoverColors(s); err == nil {
+			t.Errorf("parseCoverColors(%q) accepted", s)
+		}
+	}
+}
+
+func TestConvertCoverOptions(t *testing.T) {
+	markdown := archiveEntry{name: "a.md", body: "# A\n"}
+	tests := []struct {
+		name   string
+		fields map[string]string
+		files  map[string]archiveEntry
+		want   string
+	}{
+		{
+			name:   "unknown template",
+			fields: map[string]string{"cover_template": "marble"},
+			want:   "cover_template must be",
+		},
+		{
+			name:   "image template without background",
+			fields: map[string]string{"cover_template": "image"},
+			want:   "needs a cover_background file",
+		},
+		{
+			name:   "malformed colors",
+			fields: map[string]string{"cover_colors": "blue"},
+			want:   "#rrggbb",
+		},
+		{
+			name:   "colors not matching the template",
+			fields: map[string]string{"cover_template": "solid", "cover_colors": "#000000,#ffffff"},
+			want:   "cover_colors takes 1 colors for cover_template solid",
+		},
+		{
+			name:   "undecodable background",
+			fields: map[string]string{"cover_template": "image"},
+			files:  map[string]archiveEntry{"cover_background": {name: "bg.png", body: "not an image"}},
+			want:   "cover_background: ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]archiveEntry{"markdown": markdown}
+			for field, f := range tt.files {
+				files[field] = f
+			}
+			rec := convertRequest(t, testConfig(), tt.fields, files)
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("response = %d %s, want 400 with %q", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeCover(t *testing.T) {
+	tests := []struct {
+		name     string
+		w, h     int
+		fit      string
+		wantW    int
+		wantH    int
+		warnings []string
+	}{
+		{name: "ideal size", w: cover.Width, h: cover.Height, fit: coverScale, wantW: cover.Width, wantH: cover.Height},
+		{name: "small but in ratio", w: 1000, h: 1600, fit: coverScale, wantW: 1000, wantH: 1600},
+		{
+			name: "too small", w: 500, h: 800, fit: coverScale, wantW: 500, wantH: 800,
+			warnings: []string{"cover is 500x800 pixels, Kindle needs at least 625x1000"},
+		},
+		{name: "too large", w: 3200, h: 5120, fit: coverScale, wantW: cover.Width, wantH: cover.Height},
+		{
+			name: "square", w: 2000, h: 2000, fit: coverScale, wantW: 1600, wantH: 1600,
+			warnings: []string{"cover aspect ratio is 1:1.00, Kindle recommends 1:1.6"},
+		},
+		{name: "square letterboxed", w: 2000, h: 2000, fit: coverLetterbox, wantW: 1600, wantH: 2560},
+		{name: "tall letterboxed", w: 1000, h: 2000, fit: coverLetterbox, wantW: 1250, wantH: 2000},
+		{name: "slightly off", w: 1000, h: 1700, fit: coverScale, wantW: 1000, wantH: 1700},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &conversionReport{}
+			img := normalizeCover(image.NewGray(image.Rect(0, 0, tt.w, tt.h)), tt.fit, report)
+			if b := img.Bounds(); b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+				t.Errorf("cover is %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			}
+			if !reflect.DeepEqual(report.Warnings, tt.warnings) {
+				t.Errorf("warnings = %q, want %q", report.Warnings, tt.warnings)
+			}
+		})
+	}
+
+	// Letterboxing pads with white around the image
+	img := normalizeCover(image.NewGray(image.Rect(0, 0, 1600, 1600)), coverLetterbox, &conversionReport{})
+	if got := color.GrayModel.Convert(img.At(800, 10)).(color.Gray).Y; got != 0xff {
+		t.Errorf("padding is %d, want white", got)
+	}
+	if got := color.GrayModel.Convert(img.At(800, 1280)).(color.Gray).Y; got != 0 {
+		t.Errorf("image is %d, want black", got)
+	}
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// markdownDialect is the markdown syntax documents are parsed with and the
+// typographic conventions they are rendered with.
+type markdownDialect struct {
+	Extensions parser.Extensions
+	Flags      html.Flags
+}
+
+// Names of the markdown dialects.
+const (
+	dialectDefault    = "default"
+	dialectCommonMark = "commonmark"
+	dialectGFM        = "gfm"
+	dialectPandoc     = "pandoc-like"
+)
+
+// requiredExtensions are enabled in every dialect: heading ids anchor the
+// entries of the table of contents.
+const requiredExtensions = parser.AutoHeadingIDs
+
+// markdownDialects are the named presets a dialect starts from.
+var markdownDialects = map[string]markdownDialect{
+	dialectDefault: {
+		Extensions: parser.CommonExtensions | parser.Attributes | parser.Footnotes,
+		Flags:      html.CommonFlags,
+	},
+	dialectCommonMark: {
+		Extensions: parser.NoIntraEmphasis | parser.FencedCode | parser.SpaceHeadings |
+			parser.BackslashLineBreak | parser.OrderedListStart,
+	},
+	dialectGFM: {
+		Extensions: parser.NoIntraEmphasis | parser.FencedCode | parser.SpaceHeadings |
+			parser.BackslashLineBreak | parser.OrderedListStart | parser.Tables | parser.Autolink |
+			parser.Strikethrough | parser.Footnotes | parser.MathJax,
+	},
+	dialectPandoc: {
+		Extensions: parser.NoIntraEmphasis | parser.FencedCode | parser.SpaceHeadings |
+			parser.BackslashLineBreak | parser.OrderedListStart | parser.Tables | parser.Strikethrough |
+			parser.Footnotes | parser.MathJax | parser.HeadingIDs | parser.DefinitionLists |
+			parser.SuperSubscript | parser.Titleblock,
+		Flags: html.Smartypants | html.SmartypantsDashes | html.SmartypantsLatexDashes,
+	},
+}
+
+// markdownExtensions are the parser extensions and renderer flags that can
+// be turned on and off on top of a dialect.
+var markdownExtensions = map[string]markdownDialect{
+	"attributes":                 {Extensions: parser.Attributes},
+	"autolink":                   {Extensions: parser.Autolink},
+	"backslash_line_breaks":      {Extensions: parser.BackslashLineBreak},
+	"definition_lists":           {Extensions: parser.DefinitionLists},
+	"empty_lines_break_list":     {Extensions: parser.EmptyLinesBreakList},
+	"fenced_code":                {Extensions: parser.FencedCode},
+	"footnotes":                  {Extensions: parser.Footnotes},
+	"hard_line_breaks":           {Extensions: parser.HardLineBreak},
+	"heading_ids":                {Extensions: parser.HeadingIDs},
+	"lax_html_blocks":            {Extensions: parser.LaxHTMLBlocks},
+	"math":                       {Extensions: parser.MathJax},
+	"mmark":                      {Extensions: parser.Mmark},
+	"no_empty_line_before_block": {Extensions: parser.NoEmptyLineBeforeBlock},
+	"no_intra_emphasis":          {Extensions: parser.NoIntraEmphasis},
+	"non_breaking_space":         {Extensions: parser.NonBlockingSpace},
+	"ordered_list_start":         {Extensions: parser.OrderedListStart},
+	"space_headings":             {Extensions: parser.SpaceHeadings},
+	"strikethrough":              {Extensions: parser.Strikethrough},
+	"superscript":                {Extensions: parser.SuperSubscript},
+	"tables":                     {Extensions: parser.Tables},
+	"titleblock":                 {Extensions: parser.Titleblock},
+	"smartypants":                {Flags: html.Smartypants},
+	"smart_angled_quotes":        {Flags: html.SmartypantsAngledQuotes},
+	"smart_dashes":               {Flags: html.SmartypantsDashes},
+	"smart_fractions":            {Flags: html.SmartypantsFractions},
+	"smart_latex_dashes":         {Flags: html.SmartypantsLatexDashes},
+	"smart_quotes_nbsp":          {Flags: html.SmartypantsQuotesNBSP},
+}
+
+// newMarkdownDialect returns the named dialect, the default one if name is
+// empty, with the extensions of each list toggled in turn. A list names
+// extensions separated by commas; a name prefixed with "-" turns the
+// extension off.
+func newMarkdownDialect(name string, lists ...string) (markdownDialect, error) {
+	if name == "" {
+		name = dialectDefault
+	}
+	d, ok := markdownDialects[name]
+	if !ok {
+		return d, fmt.Errorf("unknown markdown dialect %q, valid dialects are %s", name, strings.Join(sortedKeys(markdownDialects), ", "))
+	}
+	for _, list := range lists {
+		for _, field := range strings.Split(list, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			ext, ok := markdownExtensions[strings.TrimPrefix(field, "-")]
+			if !ok {
+				return d, fmt.Errorf("unknown markdown extension %q, valid extensions are %s", strings.TrimPrefix(field, "-"), strings.Join(sortedKeys(markdownExtensions), ", "))
+			}
+			if strings.HasPrefix(field, "-") {
+				d.Extensions &^= ext.Extensions
+				d.Flags &^= ext.Flags
+			} else {
+				d.Extensions |= ext.Extensions
+				d.Flags |= ext.Flags
+			}
+		}
+	}
+	d.Extensions |= requiredExtensions
+	return d, nil
+}
+
+// sortedKeys returns the names of m in alphabetical order.
+func sortedKeys(m map[string]markdownDialect) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// titleblockMetadata reads the title, authors and date of the pandoc style
+// title block opening a markdown document:
+//
+//	% Title
+//	% Author One; Author Two
+//	% Date
+//
+// Dates parseDate does not understand are left out.
+func titleblockMetadata(md []byte) bookMetadata {
+	var meta bookMetadata
+	var lines []string
+	for _, line := range strings.Split(strings.TrimLeft(string(md), "\r\n"), "\n") {
+		if !strings.HasPrefix(line, "%") {
+			break
+		}
+		lines = append(lines, strings.TrimSpace(strings.TrimPrefix(line, "%")))
+	}
+	if len(lines) > 0 {
+		meta.Title = lines[0]
+	}
+	if len(lines) > 1 {
+		for _, author := range strings.Split(lines[1], ";") {
+			if author = strings.TrimSpace(author); author != "" {
+				meta.Authors = append(meta.Authors, author)
+			}
+		}
+	}
+	if len(lines) > 2 {
+		if date, err := parseDate(lines[2]); err == nil {
+			meta.Date = date
+		}
+	}
+	return meta
+}
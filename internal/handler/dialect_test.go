@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+func TestNewMarkdownDialect(t *testing.T) {
+	tests := []struct {
+		name      string
+		dialect   string
+		lists     []string
+		on, off   parser.Extensions
+		flags     html.Flags
+		noFlags   html.Flags
+		wantError string
+	}{
+		{name: "default", on: parser.Tables | parser.Footnotes | parser.Attributes, flags: html.CommonFlags},
+		{name: "commonmark", dialect: dialectCommonMark, on: parser.FencedCode, off: parser.Tables | parser.Autolink},
+		{name: "gfm", dialect: dialectGFM, on: parser.Tables | parser.Strikethrough | parser.Autolink, off: parser.DefinitionLists},
+		{name: "pandoc-like", dialect: dialectPandoc, on: parser.DefinitionLists | parser.Titleblock, flags: html.Smartypants},
+		{name: "extension on", dialect: dialectCommonMark, lists: []string{"tables, smartypants"}, on: parser.Tables, flags: html.Smartypants},
+		{name: "extension off", dialect: dialectGFM, lists: []string{"-tables,-autolink"}, on: parser.Strikethrough, off: parser.Tables | parser.Autolink},
+		{name: "later lists win", lists: []string{"-footnotes", "footnotes", "-smartypants"}, on: parser.Footnotes, noFlags: html.Smartypants},
+		{name: "heading ids are required", dialect: dialectCommonMark, lists: []string{"-space_headings"}, on: requiredExtensions, off: parser.SpaceHeadings},
+		{name: "unknown dialect", dialect: "markdown-extra", wantError: `unknown markdown dialect "markdown-extra"`},
+		{name: "unknown extension", lists: []string{"-emoji"}, wantError: `unknown markdown extension "emoji"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newMarkdownDialect(tt.dialect, tt.lists...)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("error = %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Extensions&tt.on != tt.on || d.Extensions&tt.off != 0 {
+				t.Errorf("extensions = %b, want %b on and %b off", d.Extensions, tt.on, tt.off)
+			}
+			if d.Flags&tt.flags != tt.flags || d.Flags&tt.noFlags != 0 {
+				t.Errorf("flags = %b, want %b on and %b off", d.Flags, tt.flags, tt.noFlags)
+			}
+		})
+	}
+}
+
+func TestMarkdownDialectRendering(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  string
+		lists    string
+		source   string
+		want     string
+		unwanted string
+	}{
+		{name: "gfm tables", dialect: dialectGFM, source: "| a |\n|---|\n| b |\n", want: "<table>"},
+		{name: "commonmark has no tables", dialect: dialectCommonMark, source: "| a |\n|---|\n| b |\n", unwanted: "<table>"},
+		{name: "gfm strikethrough", dialect: dialectGFM, source: "~~gone~~\n", want: "<del>gone</del>"},
+		{name: "gfm autolinks", dialect: dialectGFM, source: "see https://example.com\n", want: `<a href="https://example.com">`},
+		{name: "autolinks off", dialect: dialectGFM, lists: "-autolink", source: "see https://example.com\n", unwanted: "<a "},
+		{name: "pandoc definition lists", dialect: dialectPandoc, source: "Term\n: Definition\n", want: "<dl>"},
+		{name: "pandoc smart dashes", dialect: dialectPandoc, source: "a -- b\n", want: "&ndash;"},
+		{name: "hard line breaks", lists: "hard_line_breaks", source: "one\ntwo\n", want: "<br"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newMarkdownDialect(tt.dialect, tt.lists)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := mdToHTML(parseMarkdown([]byte(tt.source), d), renderOptions{Dialect: d})
+			if tt.want != "" && !strings.Contains(got, tt.want) {
+				t.Errorf("got %q, want %q in it", got, tt.want)
+			}
+			if tt.unwanted != "" && strings.Contains(got, tt.unwanted) {
+				t.Errorf("got %q, want no %q in it", got, tt.unwanted)
+			}
+		})
+	}
+}
+
+func TestTitleblockMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   bookMetadata
+	}{
+		{
+			name:   "full",
+			source: "% A Book\n% Jane Doe; John Doe\n% 2024-05-01\n\n# One\n",
+			want: bookMetadata{Title: "A Book", Authors: []string{"Jane Doe", "John Doe"},
+				Date: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{name: "title only", source: "% A Book\n\nText\n", want: bookMetadata{Title: "A Book"}},
+		{name: "unknown date", source: "% A Book\n% Jane Doe\n% Spring\n", want: bookMetadata{Title: "A Book", Authors: []string{"Jane Doe"}}},
+		{name: "none", source: "# One\n% not a title block\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := titleblockMetadata([]byte(tt.source)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertDialectOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+		source string
+		want   string
+	}{
+		{name: "unknown dialect", fields: map[string]string{"markdown_dialect": "markdown-extra"}, want: "unknown markdown dialect"},
+		{name: "unknown extension", fields: map[string]string{"markdown_extensions": "tables,emoji"}, want: "unknown markdown extension"},
+		{
+			name:   "unknown dialect in front matter",
+			source: "---\nmarkdown_dialect: markdown-extra\n---\n",
+			want:   "a.md: invalid front matter: unknown markdown dialect",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]archiveEntry{"markdown": {name: "a.md", body: tt.source + "# A\n"}}
+			rec := convertRequest(t, testConfig(), tt.fields, files)
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("response = %d %s, want 400 with %q", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+}
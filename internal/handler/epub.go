@@ -0,0 +1,399 @@
+package handler
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// containerXML points reading systems at the package document.
+const containerXML = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+// epubTemplates generate the package document and the XHTML documents of
+// an EPUB. Every text they insert is escaped, except for Body, which
+// holds XHTML.
+var epubTemplates = template.Must(template.New("package").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="{{ .Lang }}"{{ if .RTL }} dir="rtl"{{ end }}>
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">{{ .Book.Identifier | html }}</dc:identifier>
+    <dc:title id="title">{{ .Book.Meta.Title | html }}</dc:title>
+    {{- if .Book.Meta.Subtitle }}
+    <meta refines="#title" property="title-type">main</meta>
+    <dc:title id="subtitle">{{ .Book.Meta.Subtitle | html }}</dc:title>
+    <meta refines="#subtitle" property="title-type">subtitle</meta>
+    {{- end }}
+    {{- range .Book.Meta.Authors }}
+    <dc:creator>{{ . | html }}</dc:creator>
+    {{- end }}
+    <dc:language>{{ .Lang }}</dc:language>
+    {{- with .Book.Meta.Publisher }}
+    <dc:publisher>{{ . | html }}</dc:publisher>
+    {{- end }}
+    {{- if not .Book.Meta.Date.IsZero }}
+    <dc:date>{{ .Book.Meta.Date.Format "2006-01-02" }}</dc:date>
+    {{- end }}
+    {{- with .Book.Meta.Description }}
+    <dc:description>{{ . | html }}</dc:description>
+    {{- end }}
+    {{- range .Book.Meta.Subjects }}
+    <dc:subject>{{ . | html }}</dc:subject>
+    {{- end }}
+    {{- with .Book.Meta.Series }}
+    <meta property="belongs-to-collection" id="series">{{ . | html }}</meta>
+    <meta refines="#series" property="collection-type">series</meta>
+    {{- with $.Book.Meta.SeriesIndex }}
+    <meta refines="#series" property="group-position">{{ . | html }}</meta>
+    {{- end }}
+    {{- end }}
+    <meta property="dcterms:modified">{{ .Modified }}</meta>
+    {{- if .Book.Cover }}
+    <meta name="cover" content="cover-image"/>
+    {{- end }}
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    {{- range $i, $_ := .Book.Stylesheets }}
+    <item id="style{{ inc $i }}" href="{{ index $.Stylesheets $i }}" media-type="text/css"/>
+    {{- end }}
+    {{- range $i, $img := .Book.Encoded }}
+    <item id="image{{ inc $i }}" href="{{ index $.Images $i }}" media-type="{{ $img.MIME }}"/>
+    {{- end }}
+    {{- range $i, $font := .Book.Fonts }}
+    <item id="font{{ inc $i }}" href="{{ index $.Fonts $i }}" media-type="{{ $font.MIME }}"/>
+    {{- end }}
+    {{- if .Book.Cover }}
+    <item id="cover-image" href="{{ .CoverImage }}" media-type="image/jpeg" properties="cover-image"/>
+    {{- end }}
+    {{- if .Book.Cover }}
+    <item id="cover" href="{{ .CoverPage }}" media-type="application/xhtml+xml"/>
+    {{- end }}
+    {{- range $i, $chap := .Chapters }}
+    <item id="chapter{{ inc $i }}" href="{{ $chap.Href }}" media-type="application/xhtml+xml"{{ if $chap.MathML }} properties="mathml"{{ end }}/>
+    {{- end }}
+  </manifest>
+  <spine{{ if .RTL }} page-progression-direction="rtl"{{ end }}>
+    {{- if .Book.Cover }}
+    <itemref idref="cover"/>
+    {{- end }}
+    {{- range $i, $chap := .Chapters }}
+    <itemref idref="chapter{{ inc $i }}"{{ if $chap.Auxiliary }} linear="no"{{ end }}/>
+    {{- end }}
+  </spine>
+  {{- if .Landmarks }}
+  <guide>
+    {{- range .Landmarks }}
+    <reference type="{{ .Guide }}" title="{{ .Title | html }}" href="{{ .Href | html }}"/>
+    {{- end }}
+  </guide>
+  {{- end }}
+</package>
+{{ define "xhtml" -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{ .Lang }}" lang="{{ .Lang }}"{{ if .RTL }} dir="rtl"{{ end }}>
+  <head>
+    <title>{{ .Title | html }}</title>
+    {{- range .Stylesheets }}
+    <link rel="stylesheet" type="text/css" href="{{ . }}"/>
+    {{- end }}
+  </head>
+  <body{{ if .RTL }} dir="rtl"{{ end }}>
+{{ .Body }}
+  </body>
+</html>
+{{ end }}`))
+
+// epubPackage is the data of the package document template.
+type epubPackage struct {
+	Book     book
+	Lang     string
+	RTL      bool
+	Modified string
+	// Stylesheets, Images, Fonts and CoverImage hold the paths of the
+	// resources.
+	Stylesheets []string
+	Images      []string
+	Fonts       []string
+	CoverImage  string
+	// CoverPage is the path of the page showing the cover.
+	CoverPage string
+	Chapters  []epubChapter
+	Landmarks []epubLandmark
+}
+
+// epubLandmark is a landmark of the book, listed in the navigation
+// document and in the guide of the package document.
+type epubLandmark struct {
+	// Type is the epub:type of the landmark and Guide the type of its
+	// guide reference.
+	Type, Guide string
+	Title       string
+	Href        string
+}
+
+// epubChapter is a chapter as stored in the EPUB.
+type epubChapter struct {
+	Href string
+	// MathML is set for chapters with formulas written as MathML.
+	MathML bool
+	// Auxiliary leaves the chapter out of the reading order.
+	Auxiliary bool
+}
+
+// epubDocument is the data of the XHTML document template.
+type epubDocument struct {
+	Lang        string
+	RTL         bool
+	Title       string
+	Stylesheets []string
+	Body        string
+}
+
+// writeEPUB writes the book to w as EPUB 3.
+func writeEPUB(w io.Writer, b book) error {
+	pkg := epubPackage{
+		Book:       b,
+		Lang:       b.Language.String(),
+		RTL:        b.RTL,
+		Modified:   b.Created.UTC().Format(time.RFC3339),
+		CoverImage: "images/cover.jpg",
+		CoverPage:  "cover.xhtml",
+	}
+	for i := range b.Stylesheets {
+		pkg.Stylesheets = append(pkg.Stylesheets, fmt.Sprintf("styles/style%d.css", i+1))
+	}
+	for i, img := range b.Encoded {
+		ext := ".jpg"
+		if img.MIME == "image/png" {
+			ext = ".png"
+		}
+		pkg.Images = append(pkg.Images, fmt.Sprintf("images/image%04d%s", i+1, ext))
+	}
+	for i, font := range b.Fonts {
+		ext := ".ttf"
+		if font.MIME == "font/otf" {
+			ext = ".otf"
+		}
+		pkg.Fonts = append(pkg.Fonts, fmt.Sprintf("fonts/font%04d%s", i+1, ext))
+	}
+	for i := range b.Chapters {
+		pkg.Chapters = append(pkg.Chapters, epubChapter{Href: epubChapterHref(i), Auxiliary: b.Chapters[i].Auxiliary})
+	}
+	pkg.Landmarks = epubLandmarks(b, pkg.CoverPage)
+
+	zw := zip.NewWriter(w)
+	// The mimetype file comes first, uncompressed and without the extra
+	// field a modification time adds, so the format can be told from the
+	// first bytes of the file
+	err := writeZipEntry(zw, &zip.FileHeader{Name: "mimetype", Method: zip.Store}, []byte(formatMIMETypes[formatEPUB]))
+	if err != nil {
+		return err
+	}
+	if err = writeZipFile(zw, b.Created, "META-INF/container.xml", []byte(containerXML)); err != nil {
+		return err
+	}
+
+	// Stylesheets sit in a folder of their own, next to the resources
+	// they refer to
+	resource := func(paths []string) func(n int) string {
+		return func(n int) string { return "../" + paths[n-1] }
+	}
+	cssRefs := bookRefs{
+		Image:   resource(pkg.Images),
+		Font:    resource(pkg.Fonts),
+		Chapter: func(chapter int) string { return "../" + epubChapterHref(chapter) },
+	}
+	for i, css := range b.Stylesheets {
+		if err = writeZipFile(zw, b.Created, "OEBPS/"+pkg.Stylesheets[i], []byte(cssRefs.replace(css))); err != nil {
+			return err
+		}
+	}
+	for i, img := range b.Encoded {
+		if err = writeZipFile(zw, b.Created, "OEBPS/"+pkg.Images[i], img.Data); err != nil {
+			return err
+		}
+	}
+	for i, font := range b.Fonts {
+		if err = writeZipFile(zw, b.Created, "OEBPS/"+pkg.Fonts[i], font.Data); err != nil {
+			return err
+		}
+	}
+	if b.Cover != nil {
+		if err = writeZipFile(zw, b.Created, "OEBPS/"+pkg.CoverImage, b.CoverJPEG); err != nil {
+			return err
+		}
+		body := fmt.Sprintf(`<div class="cover"><img src="%s" alt="%s"/></div>`, pkg.CoverImage, html.EscapeString(b.Meta.Title))
+		cover := epubDocument{Lang: pkg.Lang, RTL: b.RTL, Title: pageTitlesFor(b.Language).Cover, Stylesheets: pkg.Stylesheets, Body: body}
+		if err = writeEPUBDocument(zw, b.Created, "OEBPS/"+pkg.CoverPage, cover); err != nil {
+			return err
+		}
+	}
+
+	refs := bookRefs{
+		Image:   func(n int) string { return pkg.Images[n-1] },
+		Font:    func(n int) string { return pkg.Fonts[n-1] },
+		Chapter: epubChapterHref,
+	}
+	for i, chap := range b.Chapters {
+		body := refs.replace(chap.HTML)
+		body, err = toXHTML(body)
+		if err != nil {
+			return fmt.Errorf("chapter %q: %w", chap.Title, err)
+		}
+		pkg.Chapters[i].MathML = strings.Contains(body, "<math")
+		doc := epubDocument{Lang: pkg.Lang, RTL: b.RTL, Title: chap.Title, Stylesheets: pkg.Stylesheets, Body: body}
+		if err = writeEPUBDocument(zw, b.Created, "OEBPS/"+pkg.Chapters[i].Href, doc); err != nil {
+			return err
+		}
+	}
+
+	nav := epubDocument{Lang: pkg.Lang, RTL: b.RTL, Title: pageTitlesFor(b.Language).Contents, Body: navBody(b, pkg.Landmarks)}
+	if err = writeEPUBDocument(zw, b.Created, "OEBPS/nav.xhtml", nav); err != nil {
+		return err
+	}
+
+	var opf strings.Builder
+	if err = epubTemplates.Execute(&opf, pkg); err != nil {
+		return fmt.Errorf("execute package template: %w", err)
+	}
+	if err = writeZipFile(zw, b.Created, "OEBPS/content.opf", []byte(opf.String())); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// epubChapterHref returns the path of a chapter document.
+func epubChapterHref(chapter int) string {
+	return fmt.Sprintf("chapter%03d.xhtml", chapter+1)
+}
+
+// toXHTML rewrites an HTML fragment as XHTML: raw HTML from the markdown
+// need not be well-formed XML, and named character references other than
+// those of XML are resolved.
+func toXHTML(fragment string) (string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(fragment), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return "", fmt.Errorf("parse html: %w", err)
+	}
+	var sb strings.Builder
+	for _, n := range nodes {
+		if err := html.Render(&sb, n); err != nil {
+			return "", fmt.Errorf("render xhtml: %w", err)
+		}
+	}
+	return sb.String(), nil
+}
+
+// epubLandmarks returns the landmarks of the book: its cover page, if it
+// has a cover, its table of contents and the chapter reading starts at.
+// The table of contents is the generated contents page, or else the
+// navigation document.
+func epubLandmarks(b book, coverPage string) []epubLandmark {
+	titles := pageTitlesFor(b.Language)
+	var landmarks []epubLandmark
+	if b.Cover != nil {
+		landmarks = append(landmarks, epubLandmark{Type: "cover", Guide: "cover", Title: titles.Cover, Href: coverPage})
+	}
+	toc := "nav.xhtml#toc"
+	if b.Contents >= 0 {
+		toc = epubChapterHref(b.Contents)
+	}
+	landmarks = append(landmarks, epubLandmark{Type: "toc", Guide: "toc", Title: titles.Contents, Href: toc})
+	if len(b.Chapters) > 0 {
+		landmarks = append(landmarks, epubLandmark{Type: "bodymatter", Guide: "text",
+			Title: b.Chapters[b.Start].Title, Href: epubChapterHref(b.Start)})
+	}
+	return landmarks
+}
+
+// navBody returns the navigation document body: the table of contents as
+// nested lists, followed by the hidden list of landmarks. Without entries
+// every chapter is listed.
+func navBody(b book, landmarks []epubLandmark) string {
+	toc := b.TOC
+	if len(toc) == 0 {
+		for i, chap := range b.Chapters {
+			toc = append(toc, &tocEntry{Title: chap.Title, Chapter: i})
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`<nav epub:type="toc" id="toc">` + "\n<h1>" + html.EscapeString(pageTitlesFor(b.Language).Contents) + "</h1>\n")
+	var list func(entries []*tocEntry)
+	list = func(entries []*tocEntry) {
+		sb.WriteString("<ol>\n")
+		for _, entry := range entries {
+			href := epubChapterHref(entry.Chapter)
+			if entry.ID != "" {
+				href += "#" + entry.ID
+			}
+			fmt.Fprintf(&sb, `<li><a href="%s">%s</a>`, html.EscapeString(href), html.EscapeString(entry.Title))
+			if len(entry.Children) > 0 {
+				sb.WriteString("\n")
+				list(entry.Children)
+			}
+			sb.WriteString("</li>\n")
+		}
+		sb.WriteString("</ol>\n")
+	}
+	list(toc)
+	sb.WriteString("</nav>\n")
+
+	sb.WriteString(`<nav epub:type="landmarks" id="landmarks" hidden="hidden">` + "\n<ol>\n")
+	for _, l := range landmarks {
+		fmt.Fprintf(&sb, `<li><a epub:type="%s" href="%s">%s</a></li>`+"\n", l.Type, html.EscapeString(l.Href), html.EscapeString(l.Title))
+	}
+	sb.WriteString("</ol>\n</nav>")
+	return sb.String()
+}
+
+// writeEPUBDocument adds an XHTML document to the EPUB.
+func writeEPUBDocument(zw *zip.Writer, modified time.Time, name string, doc epubDocument) error {
+	var sb strings.Builder
+	if err := epubTemplates.ExecuteTemplate(&sb, "xhtml", doc); err != nil {
+		return fmt.Errorf("execute xhtml template: %w", err)
+	}
+	return writeZipFile(zw, modified, name, []byte(sb.String()))
+}
+
+// writeZipFile adds a compressed file to the EPUB.
+func writeZipFile(zw *zip.Writer, modified time.Time, name string, data []byte) error {
+	return writeZipEntry(zw, &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: zipTime(modified)}, data)
+}
+
+func writeZipEntry(zw *zip.Writer, fh *zip.FileHeader, data []byte) error {
+	f, err := zw.CreateHeader(fh)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", fh.Name, err)
+	}
+	if _, err = f.Write(data); err != nil {
+		return fmt.Errorf("write %s: %w", fh.Name, err)
+	}
+	return nil
+}
+
+// zipTime clamps t to the dates zip files can hold, which start in 1980.
+func zipTime(t time.Time) time.Time {
+	if first := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC); t.Before(first) {
+		return first
+	}
+	return t
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"image"
+	"io"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+func TestWriteEPUB(t *testing.T) {
+	chapters := []chapter{
+		{Title: "Title & more", HTML: "<h1>Title &amp; more</h1>\n<p>Before</p>\n", Level: 1, Front: true},
+		{Title: "One", HTML: `<h1 id="one">One</h1>` + "\n" + `<p><a href="book:chapter:2#two">Next</a></p>` + "\n", Level: 1},
+		{Title: "Two", HTML: `<h1 id="two">Two</h1>` + "\n" + `<p><img src="book:image:1" alt=""/></p>` + "\n", Level: 1},
+	}
+	encoded := []encodedImage{{Data: []byte("\x89PNG"), MIME: "image/png"}}
+
+	tests := []struct {
+		name string
+		book func(b *book)
+	}{
+		{name: "plain"},
+		{name: "cover", book: func(b *book) {
+			b.Cover = image.NewGray(image.Rect(0, 0, 1, 1))
+			b.CoverJPEG = []byte("\xff\xd8\xff")
+		}},
+		{name: "contents page", book: func(b *book) {
+			b.Chapters, b.TOC, b.Contents = addContentsPage(b.Chapters, b.TOC, englishTitles.Contents)
+			b.Start = startChapter(b.Chapters)
+		}},
+		{name: "right to left", book: func(b *book) {
+			b.Language = language.Arabic
+			b.RTL = true
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := book{
+				Meta:        bookMetadata{Title: "Test <Book>", Authors: []string{"A & B"}},
+				Language:    language.English,
+				Identifier:  "urn:uuid:00000000-0000-0000-0000-000000000000",
+				Created:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+				Chapters:    append([]chapter(nil), chapters...),
+				Start:       1,
+				Contents:    -1,
+				Stylesheets: []string{"body { margin: 0; }"},
+				Images:      []image.Image{image.NewGray(image.Rect(0, 0, 1, 1))},
+				Encoded:     encoded,
+			}
+			b.TOC = buildTOC(b.Chapters, 2)
+			if tt.book != nil {
+				tt.book(&b)
+			}
+
+			var buf bytes.Buffer
+			if err := writeEPUB(&buf, b); err != nil {
+				t.Fatalf("writeEPUB: %v", err)
+			}
+			checkEPUB(t, buf.Bytes())
+		})
+	}
+}
+
+// checkEPUB checks the structure of an EPUB file: the mimetype entry,
+// that the package and navigation documents are well formed, and that
+// the spine and manifest agree.
+func checkEPUB(t *testing.T, data []byte) {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("open zip: %v", err)
+	}
+	if len(zr.File) == 0 {
+		t.Fatal("empty zip")
+	}
+	first := zr.File[0]
+	if first.Name != "mimetype" || first.Method != zip.Store || len(first.Extra) != 0 {
+		t.Errorf("first entry is %q with method %d and %d extra bytes, want uncompressed mimetype",
+			first.Name, first.Method, len(first.Extra))
+	}
+	if got := readZipEntry(t, first); got != "application/epub+zip" {
+		t.Errorf("mimetype is %q", got)
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	decodeXML(t, files, "META-INF/container.xml", &container)
+	if len(container.Rootfiles) != 1 {
+		t.Fatalf("container lists %d root files", len(container.Rootfiles))
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	var opf opfPackage
+	decodeXML(t, files, opfPath, &opf)
+
+	items := make(map[string]string)
+	nav := ""
+	for _, item := range opf.Manifest {
+		href := path.Join(path.Dir(opfPath), item.Href)
+		if _, ok := files[href]; !ok {
+			t.Errorf("manifest item %q points at missing %s", item.ID, href)
+		}
+		items[item.ID] = href
+		if strings.Contains(item.Properties, "nav") {
+			nav = href
+		}
+	}
+	if len(opf.Spine.Itemrefs) == 0 {
+		t.Error("empty spine")
+	}
+	for _, ref := range opf.Spine.Itemrefs {
+		if _, ok := items[ref.IDRef]; !ok {
+			t.Errorf("spine item %q is not in the manifest", ref.IDRef)
+		}
+	}
+	if nav == "" {
+		t.Fatal("no navigation document in the manifest")
+	}
+	decodeXML(t, files, nav, &struct{}{})
+	for _, href := range items {
+		if strings.HasSuffix(href, ".xhtml") {
+			decodeXML(t, files, href, &struct{}{})
+		}
+	}
+}
+
+// decodeXML parses the zip entry name as strict XML into v.
+func decodeXML(t *testing.T, files map[string]*zip.File, name string, v any) {
+	t.Helper()
+	f, ok := files[name]
+	if !ok {
+		t.Fatalf("missing %s", name)
+	}
+	dec := xml.NewDecoder(strings.NewReader(readZipEntry(t, f)))
+	dec.Strict = true
+	if err := dec.Decode(v); err != nil {
+		t.Errorf("parse %s: %v", name, err)
+	}
+}
+
+func readZipEntry(t *testing.T, f *zip.File) string {
+	t.Helper()
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatalf("open %s: %v", f.Name, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read %s: %v", f.Name, err)
+	}
+	return string(data)
+}
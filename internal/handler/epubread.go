@@ -0,0 +1,1000 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+// errInvalidEPUB is returned for uploads that are not an EPUB the book can
+// be built from.
+var errInvalidEPUB = errors.New("invalid EPUB")
+
+// Font obfuscation algorithms, which EPUBs may apply to embedded fonts
+// without encrypting anything else.
+const (
+	idpfFontObfuscation  = "http://www.idpf.org/2008/embedding"
+	adobeFontObfuscation = "http://ns.adobe.com/pdf/enc#RC"
+)
+
+// xmlNamespaces maps the namespaces of EPUB content documents to the
+// prefixes the HTML parser uses for them. XHTML has none.
+var xmlNamespaces = map[string]string{
+	"http://www.w3.org/1999/xhtml":         "",
+	"http://www.w3.org/1998/Math/MathML":   "math",
+	"http://www.w3.org/2000/svg":           "svg",
+	"http://www.w3.org/1999/xlink":         "xlink",
+	"http://www.idpf.org/2007/ops":         "epub",
+	"http://www.w3.org/XML/1998/namespace": "xml",
+}
+
+// epubSource is an uploaded EPUB, read into the parts a book is built
+// from.
+type epubSource struct {
+	Meta bookMetadata
+	// Docs holds the content documents of the spine in reading order, as
+	// HTML. Each becomes exactly one chapter.
+	Docs []sourceDoc
+	// TOC is the table of contents of the navigation document or the NCX,
+	// pointing into Docs. It is empty if the EPUB has neither.
+	TOC []*tocEntry
+
+	// root is the directory the EPUB is extracted to.
+	root string
+	// stylesheets lists the stylesheets the documents use in the order
+	// they are first linked.
+	stylesheets []epubStylesheet
+	// linked holds the paths of the stylesheets already linked or
+	// imported.
+	linked map[string]bool
+	// obfuscated maps the paths of obfuscated fonts to the algorithm.
+	obfuscated map[string]string
+	// identifiers holds the unique identifier of the package first, then
+	// the other identifiers, as the font obfuscation keys derive from them.
+	identifiers []string
+	// inlineStyles collects the problems of the inline styles with the
+	// Kindle CSS subset, with the documents they are found in.
+	inlineStyles *epubUnsupported
+}
+
+// epubStylesheet is a stylesheet of an EPUB, linked or inside a document.
+type epubStylesheet struct {
+	// Path is the file the stylesheet is read from, which its URLs are
+	// relative to.
+	Path string
+	CSS  string
+}
+
+// ocfContainer is META-INF/container.xml, which points at the package
+// document.
+type ocfContainer struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// ocfEncryption is META-INF/encryption.xml, which lists the encrypted
+// and obfuscated files.
+type ocfEncryption struct {
+	Data []struct {
+		Method struct {
+			Algorithm string `xml:"Algorithm,attr"`
+		} `xml:"EncryptionMethod"`
+		Reference struct {
+			URI string `xml:"URI,attr"`
+		} `xml:"CipherData>CipherReference"`
+	} `xml:"EncryptedData"`
+}
+
+// opfPackage is the package document of an EPUB 2 or 3.
+type opfPackage struct {
+	UniqueIdentifier string `xml:"unique-identifier,attr"`
+	Metadata         struct {
+		Titles       []opfElement `xml:"title"`
+		Creators     []opfElement `xml:"creator"`
+		Identifiers  []opfElement `xml:"identifier"`
+		Languages    []opfElement `xml:"language"`
+		Publishers   []opfElement `xml:"publisher"`
+		Dates        []opfElement `xml:"date"`
+		Descriptions []opfElement `xml:"description"`
+		Subjects     []opfElement `xml:"subject"`
+		Metas        []opfMeta    `xml:"meta"`
+	} `xml:"metadata"`
+	Manifest []opfItem `xml:"manifest>item"`
+	Spine    struct {
+		TOC      string `xml:"toc,attr"`
+		Itemrefs []struct {
+			IDRef  string `xml:"idref,attr"`
+			Linear string `xml:"linear,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+	// Guide holds the landmarks of EPUB 2.
+	Guide []struct {
+		Type string `xml:"type,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"guide>reference"`
+}
+
+// opfElement is a Dublin Core element of the package metadata. Role and
+// Event are the EPUB 2 attributes, EPUB 3 refines elements with meta.
+type opfElement struct {
+	ID    string `xml:"id,attr"`
+	Role  string `xml:"role,attr"`
+	Event string `xml:"event,attr"`
+	Value string `xml:",chardata"`
+}
+
+// opfMeta is an EPUB 2 name and content pair or an EPUB 3 property.
+type opfMeta struct {
+	Name     string `xml:"name,attr"`
+	Content  string `xml:"content,attr"`
+	Property string `xml:"property,attr"`
+	Refines  string `xml:"refines,attr"`
+	ID       string `xml:"id,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// opfItem is a file of the manifest.
+type opfItem struct {
+	ID           string `xml:"id,attr"`
+	Href         string `xml:"href,attr"`
+	MediaType    string `xml:"media-type,attr"`
+	Properties   string `xml:"properties,attr"`
+	MediaOverlay string `xml:"media-overlay,attr"`
+}
+
+// ncxNavPoint is an entry of the EPUB 2 table of contents.
+type ncxNavPoint struct {
+	Label   string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	Children []ncxNavPoint `xml:"navPoint"`
+}
+
+// epubNavPoint is an entry of the table of contents or the landmarks of
+// an EPUB, with its target resolved to a path from the root.
+type epubNavPoint struct {
+	Title    string
+	Path     string
+	Fragment string
+	// Type is the epub:type of a landmark, such as "bodymatter".
+	Type     string
+	Children []epubNavPoint
+}
+
+// guideTypes maps the EPUB 2 guide reference types to the landmark types
+// of EPUB 3.
+var guideTypes = map[string]string{
+	"cover": "cover",
+	"toc":   "toc",
+	"text":  "bodymatter",
+}
+
+// readEPUB reads the EPUB extracted to root. Constructs that cannot be
+// converted are reported; DRM protected books are refused.
+func readEPUB(root string, report *conversionReport) (*epubSource, error) {
+	src := &epubSource{root: root, linked: make(map[string]bool), obfuscated: make(map[string]string),
+		inlineStyles: &epubUnsupported{}}
+
+	var container ocfContainer
+	if err := readEPUBXML(root, "META-INF/container.xml", &container); err != nil {
+		return nil, err
+	}
+	var opfPath string
+	for _, rootfile := range container.Rootfiles {
+		if rootfile.MediaType == "" || rootfile.MediaType == "application/oebps-package+xml" {
+			opfPath = path.Clean(rootfile.FullPath)
+			break
+		}
+	}
+	if opfPath == "" || !filepath.IsLocal(opfPath) {
+		return nil, fmt.Errorf("%w: container.xml names no package document", errInvalidEPUB)
+	}
+
+	var encryption ocfEncryption
+	if _, err := os.Stat(filepath.Join(root, "META-INF", "encryption.xml")); err == nil {
+		if err = readEPUBXML(root, "META-INF/encryption.xml", &encryption); err != nil {
+			return nil, err
+		}
+	}
+	for _, data := range encryption.Data {
+		switch data.Method.Algorithm {
+		case idpfFontObfuscation, adobeFontObfuscation:
+			if p, _, ok := epubPath("", data.Reference.URI); ok {
+				src.obfuscated[p] = data.Method.Algorithm
+			}
+		default:
+			return nil, fmt.Errorf("%w: the book is DRM protected", errInvalidEPUB)
+		}
+	}
+
+	var pkg opfPackage
+	if err := readEPUBXML(root, opfPath, &pkg); err != nil {
+		return nil, err
+	}
+	items := make(map[string]opfItem, len(pkg.Manifest))
+	for _, item := range pkg.Manifest {
+		items[item.ID] = item
+	}
+	src.Meta = opfMetadata(pkg, opfPath, items)
+	for _, id := range pkg.Metadata.Identifiers {
+		if id.ID == pkg.UniqueIdentifier {
+			src.identifiers = append([]string{strings.TrimSpace(id.Value)}, src.identifiers...)
+		} else {
+			src.identifiers = append(src.identifiers, strings.TrimSpace(id.Value))
+		}
+	}
+	for _, m := range pkg.Metadata.Metas {
+		if (m.Property == "rendition:layout" && strings.TrimSpace(m.Value) == "pre-paginated") ||
+			(m.Name == "fixed-layout" && m.Content == "true") {
+			report.Warnf("fixed layout is not supported, the book is converted as reflowable text")
+			break
+		}
+	}
+
+	// The table of contents comes from the navigation document of EPUB 3,
+	// or the NCX of EPUB 2, the landmarks from the navigation document or
+	// the guide of EPUB 2
+	var nav, landmarks []epubNavPoint
+	for _, item := range pkg.Manifest {
+		if hasProperty(item.Properties, "nav") {
+			if navPath, _, ok := epubPath(opfPath, item.Href); ok {
+				nav, landmarks = readNavDocument(root, navPath)
+			}
+			break
+		}
+	}
+	if len(nav) == 0 {
+		ncx, ok := items[pkg.Spine.TOC]
+		for _, item := range pkg.Manifest {
+			if !ok && item.MediaType == "application/x-dtbncx+xml" {
+				ncx, ok = item, true
+			}
+		}
+		if ncxPath, _, found := epubPath(opfPath, ncx.Href); ok && found {
+			nav = readNCX(root, ncxPath)
+		}
+	}
+	if len(landmarks) == 0 {
+		for _, ref := range pkg.Guide {
+			if p, fragment, ok := epubPath(opfPath, ref.Href); ok {
+				landmarks = append(landmarks, epubNavPoint{Path: p, Fragment: fragment, Type: guideTypes[strings.ToLower(ref.Type)]})
+			}
+		}
+	}
+	landmark := func(kind string) string {
+		for _, point := range landmarks {
+			if hasProperty(point.Type, kind) {
+				return point.Path
+			}
+		}
+		return ""
+	}
+
+	// Read the documents of the spine, which become the chapters. The
+	// documents out of the reading order follow the others, and the page
+	// wrapping the cover is left to the writers
+	unsupported := &epubUnsupported{}
+	var docs, auxiliary []sourceDoc
+	var titles, auxiliaryTitles []string
+	for _, ref := range pkg.Spine.Itemrefs {
+		item, ok := items[ref.IDRef]
+		if !ok {
+			report.Warnf("spine entry %q is not in the manifest, skipped", truncate(ref.IDRef, 64))
+			continue
+		}
+		docPath, _, ok := epubPath(opfPath, item.Href)
+		if !ok {
+			report.Warnf("spine entry %q points outside the book, skipped", truncate(item.Href, 64))
+			continue
+		}
+		if item.MediaType != "application/xhtml+xml" && item.MediaType != "text/html" {
+			report.Warnf("%s: %s documents are not supported, skipped", docPath, item.MediaType)
+			continue
+		}
+		if item.MediaOverlay != "" {
+			unsupported.add("media overlays", docPath)
+		}
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(docPath)))
+		if err != nil {
+			report.Warnf("%s: document is missing, skipped", docPath)
+			continue
+		}
+
+		doc, err := parseXHTML(data)
+		if err != nil {
+			report.Warnf("%s: not well-formed XHTML, read as HTML", docPath)
+			doc = parseHTML(data)
+		}
+		if src.Meta.Cover != "" && isCoverPage(doc, docPath, src.Meta.Cover, landmark("cover")) {
+			continue
+		}
+		unsupported.scan(doc, docPath, src.inlineStyles)
+		src.addStylesheets(doc, docPath, report)
+		var buf bytes.Buffer
+		if err = html.Render(&buf, doc); err == nil {
+			data = buf.Bytes()
+		}
+
+		d := sourceDoc{Path: docPath, Source: data, HTML: true, Chapter: true}
+		if strings.TrimSpace(ref.Linear) == "no" {
+			d.Auxiliary = true
+			auxiliary = append(auxiliary, d)
+			auxiliaryTitles = append(auxiliaryTitles, documentTitle(doc))
+			continue
+		}
+		docs = append(docs, d)
+		titles = append(titles, documentTitle(doc))
+	}
+	src.Docs = append(docs, auxiliary...)
+	titles = append(titles, auxiliaryTitles...)
+	if len(src.Docs) == 0 {
+		return nil, fmt.Errorf("%w: no XHTML documents in the spine", errInvalidEPUB)
+	}
+	unsupported.report(report, "%s removed as unsupported in %s")
+
+	// The documents before the body matter are title matter
+	docIndex := make(map[string]int)
+	for i, d := range src.Docs {
+		docIndex[d.Path] = i
+	}
+	if start, ok := docIndex[landmark("bodymatter")]; ok && start < len(docs) {
+		for i := range src.Docs[:start] {
+			src.Docs[i].Front = true
+		}
+	}
+	src.TOC = epubTOC(nav, docIndex)
+
+	// Chapters are titled after their first entry in the table of
+	// contents, their first heading or their title, in that order
+	var entryTitle func(entries []*tocEntry)
+	entryTitle = func(entries []*tocEntry) {
+		for _, entry := range entries {
+			if doc := &src.Docs[entry.Chapter]; doc.Title == "" {
+				doc.Title = entry.Title
+			}
+			entryTitle(entry.Children)
+		}
+	}
+	entryTitle(src.TOC)
+	for i := range src.Docs {
+		if src.Docs[i].Title == "" {
+			src.Docs[i].Title = titles[i]
+		}
+	}
+	return src, nil
+}
+
+// readEPUBXML decodes the XML file at name, a path from the root of the
+// EPUB, into v.
+func readEPUBXML(root, name string, v interface{}) error {
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s is missing", errInvalidEPUB, name)
+		}
+		return fmt.Errorf("open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	d := xml.NewDecoder(f)
+	d.CharsetReader = charset.NewReaderLabel
+	d.Entity = xml.HTMLEntity
+	if err = d.Decode(v); err != nil {
+		return fmt.Errorf("%w: %s: %s", errInvalidEPUB, name, err)
+	}
+	return nil
+}
+
+// epubPath resolves an href found in the file at base to a path from the
+// root of the EPUB and the fragment it points at. References to other
+// sites and outside the EPUB are not resolved.
+func epubPath(base, href string) (string, string, bool) {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "", "", false
+	}
+	p := base
+	if u.Path != "" {
+		p = path.Join(path.Dir(base), u.Path)
+	}
+	if p == "" || !filepath.IsLocal(p) {
+		return "", "", false
+	}
+	return p, u.Fragment, true
+}
+
+// hasProperty reports whether a space separated list of properties holds
+// the given one.
+func hasProperty(properties, property string) bool {
+	for _, p := range strings.Fields(properties) {
+		if p == property {
+			return true
+		}
+	}
+	return false
+}
+
+// opfMetadata maps the metadata of a package document onto the book
+// metadata. EPUB 3 refines the Dublin Core elements with meta properties
+// where EPUB 2 uses attributes.
+func opfMetadata(pkg opfPackage, opfPath string, items map[string]opfItem) bookMetadata {
+	md := pkg.Metadata
+	refines := make(map[string]map[string]string)
+	for _, m := range md.Metas {
+		if id := strings.TrimPrefix(m.Refines, "#"); m.Refines != "" {
+			if refines[id] == nil {
+				refines[id] = make(map[string]string)
+			}
+			refines[id][m.Property] = strings.TrimSpace(m.Value)
+		}
+	}
+
+	var meta bookMetadata
+	for _, title := range md.Titles {
+		value := strings.TrimSpace(title.Value)
+		switch refines[title.ID]["title-type"] {
+		case "subtitle":
+			if meta.Subtitle == "" {
+				meta.Subtitle = value
+			}
+		case "main":
+			meta.Title = value
+		default:
+			if meta.Title == "" {
+				meta.Title = value
+			}
+		}
+	}
+	for _, creator := range md.Creators {
+		role := creator.Role
+		if role == "" {
+			role = refines[creator.ID]["role"]
+		}
+		if value := strings.TrimSpace(creator.Value); value != "" && (role == "" || role == "aut") {
+			meta.Authors = append(meta.Authors, value)
+		}
+	}
+	for _, id := range md.Identifiers {
+		if id.ID == pkg.UniqueIdentifier || meta.ID == "" {
+			meta.ID = strings.TrimSpace(id.Value)
+		}
+	}
+	if len(md.Languages) > 0 {
+		meta.Language = strings.TrimSpace(md.Languages[0].Value)
+	}
+	if len(md.Publishers) > 0 {
+		meta.Publisher = strings.TrimSpace(md.Publishers[0].Value)
+	}
+	for _, date := range md.Dates {
+		// Dates other than the publication date are only found in EPUB 2
+		if date.Event != "" && date.Event != "publication" {
+			continue
+		}
+		value := strings.TrimSpace(date.Value)
+		parsed, err := parseDate(value)
+		if err != nil && len(value) > 10 {
+			parsed, err = parseDate(value[:10])
+		}
+		if err == nil {
+			meta.Date = parsed
+			break
+		}
+	}
+	if len(md.Descriptions) > 0 {
+		// Descriptions are often HTML
+		meta.Description = nodeText(parseHTML([]byte(md.Descriptions[0].Value)))
+	}
+	for _, subject := range md.Subjects {
+		if value := strings.TrimSpace(subject.Value); value != "" {
+			meta.Subjects = append(meta.Subjects, value)
+		}
+	}
+
+	var coverID string
+	for _, m := range md.Metas {
+		switch {
+		case m.Property == "belongs-to-collection" && meta.Series == "":
+			if kind := refines[m.ID]["collection-type"]; kind == "" || kind == "series" {
+				meta.Series = strings.TrimSpace(m.Value)
+				meta.SeriesIndex = refines[m.ID]["group-position"]
+			}
+		case m.Name == "calibre:series" && meta.Series == "":
+			meta.Series = strings.TrimSpace(m.Content)
+		case m.Name == "calibre:series_index" && meta.SeriesIndex == "":
+			meta.SeriesIndex = strings.TrimSpace(m.Content)
+		case m.Name == "cover":
+			coverID = m.Content
+		}
+	}
+
+	// Covers are paths from the root, which resolve from any document
+	cover, ok := items[coverID]
+	for _, item := range pkg.Manifest {
+		if hasProperty(item.Properties, "cover-image") {
+			cover, ok = item, true
+		}
+	}
+	if p, _, found := epubPath(opfPath, cover.Href); ok && found {
+		meta.Cover = "/" + p
+	}
+	return meta
+}
+
+// parseXHTML parses an XHTML document into the tree the HTML parser
+// builds. Parsing XHTML as HTML would go wrong at self-closing elements
+// other than the void ones, which XHTML allows anywhere.
+func parseXHTML(src []byte) (*html.Node, error) {
+	d := xml.NewDecoder(bytes.NewReader(src))
+	d.CharsetReader = charset.NewReaderLabel
+	d.Entity = xml.HTMLEntity
+
+	doc := &html.Node{Type: html.DocumentNode}
+	current := doc
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &html.Node{
+				Type:      html.ElementNode,
+				Data:      t.Name.Local,
+				DataAtom:  atom.Lookup([]byte(t.Name.Local)),
+				Namespace: xmlNamespaces[t.Name.Space],
+			}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns"):
+					// Declarations are added back where needed
+				case a.Name.Space == "http://www.w3.org/XML/1998/namespace" && a.Name.Local == "lang":
+					if attr(n, "lang") == "" {
+						setAttr(n, "lang", a.Value)
+					}
+				default:
+					n.Attr = append(n.Attr, html.Attribute{Namespace: xmlNamespaces[a.Name.Space], Key: a.Name.Local, Val: a.Value})
+				}
+			}
+			current.AppendChild(n)
+			current = n
+		case xml.EndElement:
+			if current.Parent != nil {
+				current = current.Parent
+			}
+		case xml.CharData:
+			current.AppendChild(&html.Node{Type: html.TextNode, Data: string(t)})
+		}
+	}
+	if findElement(doc, atom.Html) == nil {
+		return nil, fmt.Errorf("no html element")
+	}
+	return doc, nil
+}
+
+// isCoverPage reports whether a document only shows the cover image, for
+// which the writers add a page of their own: it has no text and a single
+// image, which is the cover image or which coverPage, the cover landmark,
+// points at.
+func isCoverPage(doc *html.Node, docPath, cover, coverPage string) bool {
+	body := findElement(doc, atom.Body)
+	if body == nil || strings.TrimSpace(nodeText(body)) != "" {
+		return false
+	}
+	var images []string
+	walkElements(body, func(e *html.Node) {
+		switch {
+		case e.DataAtom == atom.Img && e.Namespace == "":
+			images = append(images, attr(e, "src"))
+		case e.Data == "image" && e.Namespace == "svg":
+			for _, a := range e.Attr {
+				if a.Key == "href" {
+					images = append(images, a.Val)
+				}
+			}
+		}
+	})
+	if len(images) != 1 {
+		return false
+	}
+	p, _, ok := epubPath(docPath, images[0])
+	return docPath == coverPage || (ok && "/"+p == cover)
+}
+
+// documentTitle returns the text of the first heading of a document, or
+// its title if it has no heading.
+func documentTitle(doc *html.Node) string {
+	var title string
+	walkElements(doc, func(e *html.Node) {
+		if title == "" && headingLevel(e) > 0 {
+			title = nodeText(e)
+		}
+	})
+	if title == "" {
+		if t := findElement(doc, atom.Title); t != nil {
+			title = nodeText(t)
+		}
+	}
+	return title
+}
+
+// addStylesheets collects the stylesheets a document links and the ones
+// inside it. Every stylesheet applies to the whole book.
+func (s *epubSource) addStylesheets(doc *html.Node, docPath string, report *conversionReport) {
+	walkElements(doc, func(e *html.Node) {
+		switch {
+		case e.DataAtom == atom.Link && e.Namespace == "" && hasProperty(strings.ToLower(attr(e, "rel")), "stylesheet"):
+			s.linkStylesheet(docPath, attr(e, "href"), 0, report)
+		case e.DataAtom == atom.Style && e.Namespace == "":
+			var css strings.Builder
+			for c := e.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type == html.TextNode {
+					css.WriteString(c.Data)
+				}
+			}
+			s.addStylesheet(docPath, css.String(), 0, report)
+		}
+	})
+}
+
+// cssImport matches the @import rules of a stylesheet.
+var cssImport = regexp.MustCompile(`@import\s+(?:url\(\s*)?["']?([^"')\s;]+)["']?\s*\)?[^;]*;`)
+
+// maxImportDepth bounds how deeply stylesheets may import each other.
+const maxImportDepth = 8
+
+// addStylesheet adds a stylesheet read from the file at base, after the
+// stylesheets it imports, which Kindle readers do not follow.
+func (s *epubSource) addStylesheet(base, css string, depth int, report *conversionReport) {
+	css = cssImport.ReplaceAllStringFunc(css, func(rule string) string {
+		if depth < maxImportDepth {
+			s.linkStylesheet(base, cssImport.FindStringSubmatch(rule)[1], depth+1, report)
+		}
+		return ""
+	})
+	s.stylesheets = append(s.stylesheets, epubStylesheet{Path: base, CSS: css})
+}
+
+// linkStylesheet adds the stylesheet at href, relative to the file at
+// base, unless it is already part of the book.
+func (s *epubSource) linkStylesheet(base, href string, depth int, report *conversionReport) {
+	cssPath, _, ok := epubPath(base, href)
+	if !ok {
+		report.Warnf("%s: stylesheet %q not used: remote stylesheets are not fetched", base, truncate(href, 64))
+		return
+	}
+	if s.linked[cssPath] {
+		return
+	}
+	s.linked[cssPath] = true
+	data, err := os.ReadFile(filepath.Join(s.root, filepath.FromSlash(cssPath)))
+	if err != nil {
+		report.Warnf("%s: stylesheet %q is missing", base, cssPath)
+		return
+	}
+	s.addStylesheet(cssPath, string(data), depth, report)
+}
+
+// cssURL matches the URLs of a stylesheet, quoted or not.
+var cssURL = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)`)
+
+// embedStylesheets returns the stylesheets of the EPUB, with the images
+// and fonts they refer to embedded. References that cannot be embedded
+// are reported and replaced with none.
+func (s *epubSource) embedStylesheets(images *bookImages, report *conversionReport) ([]epubStylesheet, []embeddedFont) {
+	var fonts []embeddedFont
+	fontRefs := make(map[string]string)
+	sheets := make([]epubStylesheet, len(s.stylesheets))
+	for i, sheet := range s.stylesheets {
+		sheets[i] = sheet
+		sheets[i].CSS = cssURL.ReplaceAllStringFunc(sheet.CSS, func(match string) string {
+			m := cssURL.FindStringSubmatch(match)
+			ref := m[1] + m[2] + m[3]
+			target, _, ok := epubPath(sheet.Path, ref)
+			switch {
+			case ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "data:"):
+				return match
+			case !ok:
+				report.Warnf("%s: %q not embedded: remote resources are not fetched", sheet.Path, truncate(ref, 64))
+				return "none"
+			case strings.EqualFold(path.Ext(target), ".css"):
+				return match
+			}
+
+			switch strings.ToLower(path.Ext(target)) {
+			case ".ttf", ".otf", ".woff", ".woff2":
+				if font, ok := fontRefs[target]; ok {
+					return "url(" + font + ")"
+				}
+				font, err := s.font(target)
+				if err != nil {
+					report.Warnf("font %q not embedded: %s", target, err)
+					return "none"
+				}
+				fonts = append(fonts, font)
+				fontRefs[target] = fontRef(len(fonts))
+				return "url(" + fontRefs[target] + ")"
+			}
+			if img, ok := images.resolve("/"+target, ""); ok {
+				return "url(" + img + ")"
+			}
+			return "none"
+		})
+	}
+	return sheets, fonts
+}
+
+// font reads an embedded font, removing its obfuscation. Only TrueType
+// and OpenType fonts can be embedded.
+func (s *epubSource) font(name string) (embeddedFont, error) {
+	data, err := os.ReadFile(filepath.Join(s.root, filepath.FromSlash(name)))
+	if err != nil {
+		return embeddedFont{}, fmt.Errorf("file is missing")
+	}
+	if algorithm, ok := s.obfuscated[name]; ok {
+		if data, err = deobfuscateFont(data, algorithm, s.identifiers); err != nil {
+			return embeddedFont{}, err
+		}
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("\x00\x01\x00\x00")), bytes.HasPrefix(data, []byte("true")):
+		return embeddedFont{Data: data, MIME: "font/ttf"}, nil
+	case bytes.HasPrefix(data, []byte("OTTO")):
+		return embeddedFont{Data: data, MIME: "font/otf"}, nil
+	case bytes.HasPrefix(data, []byte("wOFF")), bytes.HasPrefix(data, []byte("wOF2")):
+		return embeddedFont{}, fmt.Errorf("WOFF fonts are not supported")
+	}
+	return embeddedFont{}, fmt.Errorf("not a TrueType or OpenType font")
+}
+
+// deobfuscateFont reverses the font obfuscation of the IDPF or Adobe,
+// which XOR the start of the font with a key derived from an identifier
+// of the book.
+func deobfuscateFont(data []byte, algorithm string, identifiers []string) ([]byte, error) {
+	var key []byte
+	length := 0
+	switch algorithm {
+	case idpfFontObfuscation:
+		if len(identifiers) == 0 {
+			return nil, fmt.Errorf("obfuscated font in a book without identifier")
+		}
+		sum := sha1.Sum([]byte(strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, identifiers[0])))
+		key, length = sum[:], 1040
+	case adobeFontObfuscation:
+		for _, id := range identifiers {
+			hexID := strings.ReplaceAll(strings.TrimPrefix(strings.TrimPrefix(id, "urn:uuid:"), "uuid:"), "-", "")
+			if k, err := hex.DecodeString(hexID); err == nil && len(k) == 16 {
+				key = k
+				break
+			}
+		}
+		if key == nil {
+			return nil, fmt.Errorf("obfuscated font in a book without UUID")
+		}
+		length = 1024
+	}
+
+	plain := append([]byte{}, data...)
+	for i := 0; i < length && i < len(plain); i++ {
+		plain[i] ^= key[i%len(key)]
+	}
+	return plain, nil
+}
+
+// readNavDocument reads the table of contents of an EPUB 3 navigation
+// document, the toc nav or the first nav if none is marked as such, and
+// its landmarks.
+func readNavDocument(root, navPath string) ([]epubNavPoint, []epubNavPoint) {
+	data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(navPath)))
+	if err != nil {
+		return nil, nil
+	}
+	doc, err := parseXHTML(data)
+	if err != nil {
+		doc = parseHTML(data)
+	}
+
+	var navs []*html.Node
+	walkElements(doc, func(e *html.Node) {
+		if e.DataAtom == atom.Nav && e.Namespace == "" {
+			navs = append(navs, e)
+		}
+	})
+	var toc, landmarks []epubNavPoint
+	for _, nav := range navs {
+		switch kind := epubType(nav); {
+		case hasProperty(kind, "toc") && toc == nil:
+			toc = navList(findElement(nav, atom.Ol), navPath)
+		case hasProperty(kind, "landmarks") && landmarks == nil:
+			landmarks = navList(findElement(nav, atom.Ol), navPath)
+		}
+	}
+	if toc == nil && len(navs) > 0 {
+		toc = navList(findElement(navs[0], atom.Ol), navPath)
+	}
+	return toc, landmarks
+}
+
+// epubType returns the epub:type attribute of an element.
+func epubType(e *html.Node) string {
+	for _, a := range e.Attr {
+		if (a.Namespace == "epub" && a.Key == "type") || a.Key == "epub:type" {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// navList reads the entries of a list of a navigation document.
+func navList(ol *html.Node, navPath string) []epubNavPoint {
+	if ol == nil {
+		return nil
+	}
+	var points []epubNavPoint
+	for li := ol.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || li.DataAtom != atom.Li {
+			continue
+		}
+		var point epubNavPoint
+		for c := li.FirstChild; c != nil; c = c.NextSibling {
+			switch {
+			case c.Type != html.ElementNode:
+			case c.DataAtom == atom.A || c.DataAtom == atom.Span:
+				point.Title = nodeText(c)
+				point.Type = epubType(c)
+				point.Path, point.Fragment, _ = epubPath(navPath, attr(c, "href"))
+			case c.DataAtom == atom.Ol:
+				point.Children = navList(c, navPath)
+			}
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// readNCX reads the table of contents of an EPUB 2 NCX file.
+func readNCX(root, ncxPath string) []epubNavPoint {
+	var ncx struct {
+		NavPoints []ncxNavPoint `xml:"navMap>navPoint"`
+	}
+	if err := readEPUBXML(root, ncxPath, &ncx); err != nil {
+		return nil
+	}
+	var convert func(points []ncxNavPoint) []epubNavPoint
+	convert = func(points []ncxNavPoint) []epubNavPoint {
+		var converted []epubNavPoint
+		for _, point := range points {
+			p, fragment, _ := epubPath(ncxPath, point.Content.Src)
+			converted = append(converted, epubNavPoint{
+				Title:    strings.Join(strings.Fields(point.Label), " "),
+				Path:     p,
+				Fragment: fragment,
+				Children: convert(point.Children),
+			})
+		}
+		return converted
+	}
+	return convert(ncx.NavPoints)
+}
+
+// epubTOC turns the table of contents of an EPUB into the one of the
+// book. Entries pointing at documents outside the spine are dropped, and
+// their children take their place.
+func epubTOC(points []epubNavPoint, docIndex map[string]int) []*tocEntry {
+	var entries []*tocEntry
+	for _, point := range points {
+		children := epubTOC(point.Children, docIndex)
+		chapter, ok := docIndex[point.Path]
+		if !ok || point.Title == "" {
+			entries = append(entries, children...)
+			continue
+		}
+		entries = append(entries, &tocEntry{Title: point.Title, Chapter: chapter, ID: point.Fragment, Children: children})
+	}
+	return entries
+}
+
+// epubUnsupported collects the constructs of the documents that are
+// dropped in the conversion, with the documents they are found in.
+type epubUnsupported struct {
+	kinds []string
+	docs  map[string][]string
+}
+
+// Elements that are dropped, by the construct they belong to.
+var unsupportedElements = map[atom.Atom]string{
+	atom.Script: "scripts",
+	atom.Form:   "forms", atom.Input: "forms", atom.Button: "forms", atom.Select: "forms", atom.Textarea: "forms",
+	atom.Audio: "audio and video", atom.Video: "audio and video",
+	atom.Iframe: "embedded content", atom.Object: "embedded content", atom.Embed: "embedded content",
+	atom.Canvas: "canvas",
+}
+
+// add records a construct found in a document.
+func (u *epubUnsupported) add(kind, docPath string) {
+	if u.docs == nil {
+		u.docs = make(map[string][]string)
+	}
+	docs := u.docs[kind]
+	if len(docs) > 0 && docs[len(docs)-1] == docPath {
+		return
+	}
+	if len(docs) == 0 {
+		u.kinds = append(u.kinds, kind)
+	}
+	u.docs[kind] = append(docs, docPath)
+}
+
+// scan records the unsupported constructs of a document, and the problems
+// of its inline styles in styles, and reduces epub:switch elements to
+// their default content, as readers without support for any of the cases
+// do.
+func (u *epubUnsupported) scan(doc *html.Node, docPath string, styles *epubUnsupported) {
+	var switches []*html.Node
+	walkElements(doc, func(e *html.Node) {
+		switch {
+		case e.Namespace == "epub" && e.Data == "switch":
+			switches = append(switches, e)
+			u.add("epub:switch alternatives", docPath)
+		case e.Namespace != "":
+		case unsupportedElements[e.DataAtom] != "":
+			u.add(unsupportedElements[e.DataAtom], docPath)
+		case attr(e, "style") != "":
+			for _, problem := range validateStylesheet("*{" + attr(e, "style") + "}") {
+				_, problem, _ = strings.Cut(problem, ": ")
+				styles.add(problem, docPath)
+			}
+		}
+	})
+	for _, sw := range switches {
+		if sw.Parent == nil {
+			continue
+		}
+		for c := sw.FirstChild; c != nil; c = c.NextSibling {
+			if c.Namespace == "epub" && c.Data == "default" {
+				for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+					c.RemoveChild(gc)
+					sw.Parent.InsertBefore(gc, sw)
+				}
+			}
+		}
+		sw.Parent.RemoveChild(sw)
+	}
+}
+
+// report lists the collected constructs as warnings, one per construct,
+// formatted with the construct and the documents it is found in.
+func (u *epubUnsupported) report(report *conversionReport, format string) {
+	for _, kind := range u.kinds {
+		docs := u.docs[kind]
+		where := docs[0]
+		if len(docs) > 1 {
+			where = fmt.Sprintf("%s and %d more documents", docs[0], len(docs)-1)
+		}
+		report.Warnf(format, kind, where)
+	}
+}
@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+const testContainer = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`
+
+// testOPF returns a package document with the given metadata, manifest
+// items and spine entries.
+func testOPF(meta, manifest, spine string) string {
+	return `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:uuid:0b7c5a4e-8f43-4a8e-9d0c-1f6a2b3c4d5e</dc:identifier>
+    <dc:title>Test</dc:title><dc:language>en</dc:language>` + meta + `
+  </metadata>
+  <manifest>` + manifest + `</manifest>
+  <spine>` + spine + `</spine>
+</package>`
+}
+
+// testXHTML returns an XHTML document with the given body.
+func testXHTML(body string) string {
+	return `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><head><title>T</title></head><body>` + body + `</body></html>`
+}
+
+// extractedEPUB writes the files of an EPUB to a directory, as
+// extractArchive leaves them.
+func extractedEPUB(t *testing.T, entries []archiveEntry) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, e := range entries {
+		p := filepath.Join(root, filepath.FromSlash(e.name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(e.body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestReadEPUB(t *testing.T) {
+	manifest := `
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="cover-img" href="images/cover.png" media-type="image/png"/>
+    <item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>
+    <item id="a" href="text/a.xhtml" media-type="application/xhtml+xml"/>
+    <item id="b" href="text/b.xhtml" media-type="application/xhtml+xml"/>
+    <item id="notes" href="text/notes.xhtml" media-type="application/xhtml+xml"/>`
+	spine := `
+    <itemref idref="cover"/>
+    <itemref idref="notes" linear="no"/>
+    <itemref idref="b"/>
+    <itemref idref="a"/>`
+	root := extractedEPUB(t, []archiveEntry{
+		{name: "mimetype", body: "application/epub+zip"},
+		{name: "META-INF/container.xml", body: testContainer},
+		{name: "OEBPS/content.opf", body: testOPF(`<meta name="cover" content="cover-img"/>`, manifest, spine)},
+		{name: "OEBPS/nav.xhtml", body: testXHTML(`<nav epub:type="toc"><ol><li><a href="text/a.xhtml">Chapter A</a></li></ol></nav>`)},
+		{name: "OEBPS/images/cover.png", body: "png"},
+		{name: "OEBPS/cover.xhtml", body: testXHTML(`<div><img src="images/cover.png" alt=""/></div>`)},
+		{name: "OEBPS/text/a.xhtml", body: testXHTML(`<p>a</p>`)},
+		{name: "OEBPS/text/b.xhtml", body: testXHTML(`<h1>B</h1><nav><ol><li><a href="a.xhtml">A</a></li></ol></nav>`)},
+		{name: "OEBPS/text/notes.xhtml", body: testXHTML(`<h1>Notes</h1>`)},
+	})
+
+	report := &conversionReport{}
+	src, err := readEPUB(root, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Warnings) > 0 {
+		t.Errorf("warnings = %q", report.Warnings)
+	}
+	if src.Meta.Cover != "/OEBPS/images/cover.png" {
+		t.Errorf("cover = %q", src.Meta.Cover)
+	}
+
+	// The cover page is left out and the documents out of the reading
+	// order follow the others
+	var paths, titles []string
+	for _, d := range src.Docs {
+		paths = append(paths, d.Path)
+		titles = append(titles, d.Title)
+		if !d.HTML || !d.Chapter {
+			t.Errorf("%s is not read as a single HTML chapter", d.Path)
+		}
+		if d.Auxiliary != (d.Path == "OEBPS/text/notes.xhtml") {
+			t.Errorf("%s auxiliary = %v", d.Path, d.Auxiliary)
+		}
+	}
+	if got := strings.Join(paths, " "); got != "OEBPS/text/b.xhtml OEBPS/text/a.xhtml OEBPS/text/notes.xhtml" {
+		t.Errorf("documents = %s", got)
+	}
+	if got := strings.Join(titles, "|"); got != "B|Chapter A|Notes" {
+		t.Errorf("titles = %s", got)
+	}
+	if got := formatTOC(src.TOC); got != "Chapter A 1#\n" {
+		t.Errorf("toc = %q", got)
+	}
+
+	// The navigation inside an EPUB document is part of the book, that of
+	// a web page is not
+	if got := bodyHTML(src.Docs[0]); !strings.Contains(got, "<nav>") {
+		t.Errorf("navigation of an EPUB document dropped: %s", got)
+	}
+	page := sourceDoc{Path: "b.html", Source: src.Docs[0].Source, HTML: true}
+	if got := bodyHTML(page); strings.Contains(got, "<nav>") {
+		t.Errorf("navigation of a web page kept: %s", got)
+	}
+}
+
+// bodyHTML returns the sanitized body of an HTML document.
+func bodyHTML(d sourceDoc) string {
+	var nodes []*html.Node
+	for c := htmlBody(d).FirstChild; c != nil; c = c.NextSibling {
+		nodes = append(nodes, c)
+	}
+	return renderHTML(nodes)
+}
+
+func TestReadEPUBErrors(t *testing.T) {
+	doc := archiveEntry{name: "OEBPS/a.xhtml", body: testXHTML(`<p>a</p>`)}
+	opf := testOPF("", `<item id="a" href="a.xhtml" media-type="application/xhtml+xml"/>`, `<itemref idref="a"/>`)
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+		want    string
+	}{
+		{
+			name:    "no container",
+			entries: []archiveEntry{{name: "OEBPS/content.opf", body: opf}, doc},
+			want:    "META-INF/container.xml is missing",
+		},
+		{
+			name:    "malformed container",
+			entries: []archiveEntry{{name: "META-INF/container.xml", body: "<container><rootfiles>"}, {name: "OEBPS/content.opf", body: opf}, doc},
+			want:    "META-INF/container.xml: XML syntax error",
+		},
+		{
+			name:    "container without package",
+			entries: []archiveEntry{{name: "META-INF/container.xml", body: `<container><rootfiles/></container>`}, doc},
+			want:    "container.xml names no package document",
+		},
+		{
+			name:    "package outside the book",
+			entries: []archiveEntry{{name: "META-INF/container.xml", body: strings.Replace(testContainer, "OEBPS/content.opf", "../content.opf", 1)}, doc},
+			want:    "container.xml names no package document",
+		},
+		{
+			name:    "no package",
+			entries: []archiveEntry{{name: "META-INF/container.xml", body: testContainer}, doc},
+			want:    "OEBPS/content.opf is missing",
+		},
+		{
+			name:    "malformed package",
+			entries: []archiveEntry{{name: "META-INF/container.xml", body: testContainer}, {name: "OEBPS/content.opf", body: opf[:len(opf)/2]}, doc},
+			want:    "OEBPS/content.opf: XML syntax error",
+		},
+		{
+			name:    "empty spine",
+			entries: []archiveEntry{{name: "META-INF/container.xml", body: testContainer}, {name: "OEBPS/content.opf", body: testOPF("", "", "")}},
+			want:    "no XHTML documents in the spine",
+		},
+		{
+			name: "DRM",
+			entries: []archiveEntry{
+				{name: "META-INF/container.xml", body: testContainer},
+				{name: "META-INF/encryption.xml", body: `<encryption><EncryptedData><EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes128-cbc"/><CipherData><CipherReference URI="OEBPS/a.xhtml"/></CipherData></EncryptedData></encryption>`},
+				{name: "OEBPS/content.opf", body: opf}, doc,
+			},
+			want: "the book is DRM protected",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readEPUB(extractedEPUB(t, tt.entries), &conversionReport{})
+			if !errors.Is(err, errInvalidEPUB) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+
+			// The upload is refused as a bad request
+			rec := convertRequest(t, testConfig(), nil, map[string]archiveEntry{
+				"epub": {name: "book.epub", body: string(zipArchive(t, tt.entries))},
+			})
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("response = %d %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
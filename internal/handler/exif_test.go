@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestExifOrientation(t *testing.T) {
+	// An APP1 segment holding a big endian TIFF directory with the
+	// orientation tag set to 6
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08,
+		0x00, 0x01,
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+	exif := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xff, 0xe1, 0x00, byte(len(exif) + 2)}, exif...)
+	app0 := []byte{0xff, 0xe0, 0x00, 0x04, 0x00, 0x00}
+	soi := []byte{0xff, 0xd8}
+	sos := []byte{0xff, 0xda, 0x00, 0x02}
+	jpeg := func(parts ...[]byte) []byte {
+		return bytes.Join(append([][]byte{soi}, parts...), nil)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{name: "not a jpeg", data: []byte("\x89PNG\r\n\x1a\n"), want: 1},
+		{name: "no exif", data: jpeg(app0, sos), want: 1},
+		{name: "exif", data: jpeg(app0, app1, sos), want: 6},
+		{name: "exif after the image data", data: jpeg(sos, app1), want: 1},
+		{name: "fill bytes", data: jpeg([]byte{0xff, 0xff, 0xff}, app1), want: 6},
+		{name: "padding", data: jpeg([]byte{0xff, 0x00}, app1), want: 6},
+		{name: "zero length segment", data: jpeg([]byte{0xff, 0xe0, 0x00, 0x00}, app1), want: 1},
+		{name: "one byte segment", data: jpeg([]byte{0xff, 0xe0, 0x00, 0x01}, app1), want: 1},
+		{name: "truncated segment", data: jpeg(app1[:len(app1)-4]), want: 1},
+		{name: "truncated length", data: jpeg([]byte{0xff, 0xe1, 0x00}), want: 1},
+		{name: "padding and zero length", data: []byte{0xff, 0xd8, 0xff, 0x00, 0x00, 0x00}, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exifOrientation(tt.data); got != tt.want {
+				t.Errorf("exifOrientation = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3×2 image with a black pixel in the top left corner
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+	src.Set(0, 0, color.Black)
+
+	tests := []struct {
+		orientation int
+		w, h        int
+		// x and y are where the black pixel ends up.
+		x, y int
+	}{
+		{0, 3, 2, 0, 0},
+		{1, 3, 2, 0, 0},
+		{2, 3, 2, 2, 0},
+		{3, 3, 2, 2, 1},
+		{4, 3, 2, 0, 1},
+		{5, 2, 3, 0, 0},
+		{6, 2, 3, 1, 0},
+		{7, 2, 3, 1, 2},
+		{8, 2, 3, 0, 2},
+		{9, 3, 2, 0, 0},
+	}
+	for _, tt := range tests {
+		img := applyOrientation(src, tt.orientation)
+		if b := img.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: image is %v", tt.orientation, b)
+			continue
+		}
+		if r, _, _, _ := img.At(tt.x, tt.y).RGBA(); r != 0 {
+			t.Errorf("orientation %d: pixel at %d,%d is not black", tt.orientation, tt.x, tt.y)
+		}
+	}
+}
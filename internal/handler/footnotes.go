@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+)
+
+// Footnote placements.
+const (
+	// footnotesChapter collects the notes at the end of the chapter that
+	// references them, numbered per chapter.
+	footnotesChapter = "chapter"
+	// footnotesBook collects the notes of the whole book in a final
+	// chapter, numbered through the book.
+	footnotesBook = "book"
+)
+
+// footnote is a note referenced from the book.
+type footnote struct {
+	// ID numbers the notes through the book for their element ids.
+	ID int
+	// Number is the number shown for the note.
+	Number string
+	Item   *ast.ListItem
+	// refs counts the references to the note so far.
+	refs int
+}
+
+// noteKey identifies a note: the document it is defined in and its id
+// in there.
+type noteKey struct {
+	file int
+	id   int
+}
+
+// footnotes numbers the notes of the book as their references are
+// rendered and renders the notes themselves. Kindle readers show notes
+// marked up as asides with a noteref link pointing at them in a pop-up.
+type footnotes struct {
+	mode string
+	zero rune
+	// items maps the note ids of the document being rendered to the notes.
+	items map[int]*ast.ListItem
+	file  int
+	count int
+	// notes holds the notes numbered so far. In chapter mode it only holds
+	// those of the current chapter, as every chapter repeats its notes.
+	notes map[noteKey]*footnote
+	// pending lists the notes of the current chapter not rendered yet.
+	pending []*footnote
+	// chapterCount numbers the notes of the current chapter.
+	chapterCount int
+	// sections holds the rendered notes of every chapter in book mode.
+	sections []noteSection
+}
+
+// noteSection holds the rendered notes of one chapter.
+type noteSection struct {
+	Title string
+	HTML  string
+}
+
+// newFootnotes creates a footnotes for the given placement.
+func newFootnotes(mode string, zero rune) *footnotes {
+	return &footnotes{mode: mode, zero: zero, notes: make(map[noteKey]*footnote)}
+}
+
+// extractFootnotes removes the footnote list the parser appends to doc and
+// returns its notes by note id.
+func extractFootnotes(doc ast.Node) map[int]*ast.ListItem {
+	items := make(map[int]*ast.ListItem)
+	var children []ast.Node
+	for _, child := range doc.GetChildren() {
+		switch n := child.(type) {
+		case *ast.Footnotes:
+			continue
+		case *ast.List:
+			if n.IsFootnotesList {
+				for i, item := range n.Children {
+					if item, ok := item.(*ast.ListItem); ok {
+						items[i+1] = item
+					}
+				}
+				continue
+			}
+		}
+		children = append(children, child)
+	}
+	doc.SetChildren(children)
+	return items
+}
+
+// startFile sets the notes of the document whose sections are rendered
+// next.
+func (f *footnotes) startFile(file int, items map[int]*ast.ListItem) {
+	f.file = file
+	f.items = items
+}
+
+// ref returns the markup of a note reference, numbering the note on its
+// first reference. References to undefined notes are dropped.
+func (f *footnotes) ref(link *ast.Link) string {
+	key := noteKey{file: f.file, id: link.NoteID}
+	note, ok := f.notes[key]
+	if !ok {
+		item, found := f.items[link.NoteID]
+		if !found {
+			return ""
+		}
+		f.count++
+		f.chapterCount++
+		number := f.chapterCount
+		if f.mode == footnotesBook {
+			number = f.count
+		}
+		note = &footnote{ID: f.count, Number: strconv.Itoa(number), Item: item}
+		if f.zero != 0 {
+			note.Number = localizeDigits(note.Number, f.zero)
+		}
+		f.notes[key] = note
+		f.pending = append(f.pending, note)
+	}
+	note.refs++
+
+	return fmt.Sprintf(`<sup><a epub:type="noteref" class="noteref" href="#%s" id="%s">%s</a></sup>`,
+		noteID(note), refID(note, note.refs), note.Number)
+}
+
+// finishChapter renders the notes referenced by the chapter just
+// rendered. In chapter mode it returns them to be appended to the
+// chapter, in book mode they are kept for the notes chapter.
+func (f *footnotes) finishChapter(title string, opts renderOptions) string {
+	epubType := "footnote"
+	if f.mode == footnotesBook {
+		epubType = "endnote"
+	}
+
+	// Notes may reference other notes, which are appended while rendering
+	var sb strings.Builder
+	for i := 0; i < len(f.pending); i++ {
+		note := f.pending[i]
+		fmt.Fprintf(&sb, "<aside epub:type=\"%s\" class=\"footnote\" id=\"%s\">\n%s</aside>\n",
+			epubType, noteID(note), f.renderNote(note, opts))
+	}
+	f.pending = nil
+	f.chapterCount = 0
+	if f.mode == footnotesChapter {
+		f.notes = make(map[noteKey]*footnote)
+	}
+
+	if sb.Len() == 0 {
+		return ""
+	}
+	if f.mode == footnotesBook {
+		f.sections = append(f.sections, noteSection{Title: title, HTML: sb.String()})
+		return ""
+	}
+	return "<div class=\"footnotes\">\n<hr/>\n" + sb.String() + "</div>\n"
+}
+
+// renderNote renders the content of a note, starting with a link back to
+// its first reference.
+func (f *footnotes) renderNote(note *footnote, opts renderOptions) string {
+	body := &ast.Document{}
+	children := note.Item.GetChildren()
+	if len(children) > 0 && !isBlock(children[0]) {
+		para := &ast.Paragraph{}
+		para.SetChildren(children)
+		children = []ast.Node{para}
+	}
+	for _, child := range children {
+		child.SetParent(body)
+	}
+	body.SetChildren(children)
+	content := mdToHTML(body, opts)
+
+	back := fmt.Sprintf(`<a class="noteback" href="#%s">%s.</a> `, refID(note, 1), note.Number)
+	if strings.HasPrefix(content, "<p") {
+		if end := strings.Index(content, ">"); end >= 0 {
+			return content[:end+1] + back + content[end+1:]
+		}
+	}
+	return "<p>" + strings.TrimSpace(back) + "</p>\n" + content
+}
+
+// notesChapter returns the chapter holding the notes of the book in book
+// mode under title, with a subheading per chapter when notes come from
+// several.
+func (f *footnotes) notesChapter(title string) (chapter, bool) {
+	if len(f.sections) == 0 {
+		return chapter{}, false
+	}
+	var sb strings.Builder
+	var heading bytes.Buffer
+	html.EscapeHTML(&heading, []byte(title))
+	sb.WriteString("<h1>" + heading.String() + "</h1>\n")
+	for _, sec := range f.sections {
+		if len(f.sections) > 1 {
+			var title bytes.Buffer
+			html.EscapeHTML(&title, []byte(sec.Title))
+			sb.WriteString("<h2>" + title.String() + "</h2>\n")
+		}
+		sb.WriteString(sec.HTML)
+	}
+	return chapter{Title: title, HTML: sb.String(), Level: 1}, true
+}
+
+// noteID returns the element id of a note. The underscore keeps it apart
+// from the generated heading ids, which never contain one.
+func noteID(note *footnote) string {
+	return fmt.Sprintf("fn_%d", note.ID)
+}
+
+// refID returns the element id of the nth reference to a note.
+func refID(note *footnote, n int) string {
+	if n == 1 {
+		return fmt.Sprintf("fnref_%d", note.ID)
+	}
+	return fmt.Sprintf("fnref_%d_%d", note.ID, n)
+}
+
+// isBlock reports whether node is a block rather than inline content.
+func isBlock(node ast.Node) bool {
+	switch node.(type) {
+	case *ast.Paragraph, *ast.List, *ast.CodeBlock, *ast.BlockQuote, *ast.Heading,
+		*ast.Table, *ast.HTMLBlock, *ast.HorizontalRule, *ast.MathBlock:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFootnotes(t *testing.T) {
+	dialect := markdownDialect{Extensions: markdownDialects[dialectDefault].Extensions | requiredExtensions}
+	source := "# One\n\nA[^x], b[^y] and a again[^x].\n\n# Two\n\nC[^z] and undefined[^none].\n\n" +
+		"[^x]: Note *x*.\n[^y]: Note y.\n[^z]: Note z, see[^x].\n"
+	tests := []struct {
+		name  string
+		mode  string
+		zero  rune
+		want  [][]string
+		notes string
+	}{
+		{
+			name: "chapter",
+			mode: footnotesChapter,
+			want: [][]string{
+				{
+					`A<sup><a epub:type="noteref" class="noteref" href="#fn_1" id="fnref_1">1</a></sup>`,
+					`b<sup><a epub:type="noteref" class="noteref" href="#fn_2" id="fnref_2">2</a></sup>`,
+					`again<sup><a epub:type="noteref" class="noteref" href="#fn_1" id="fnref_1_2">1</a></sup>`,
+					"<div class=\"footnotes\">\n<hr/>\n<aside epub:type=\"footnote\" class=\"footnote\" id=\"fn_1\">\n" +
+						"<p><a class=\"noteback\" href=\"#fnref_1\">1.</a> Note <em>x</em>.</p>\n</aside>\n" +
+						"<aside epub:type=\"footnote\" class=\"footnote\" id=\"fn_2\">\n" +
+						"<p><a class=\"noteback\" href=\"#fnref_2\">2.</a> Note y.</p>\n</aside>\n</div>\n",
+				},
+				{
+					// Numbers start over, and notes referenced again are
+					// repeated in every chapter
+					`C<sup><a epub:type="noteref" class="noteref" href="#fn_3" id="fnref_3">1</a></sup> and undefined[^none].`,
+					`<p><a class="noteback" href="#fnref_3">1.</a> Note z, see<sup><a epub:type="noteref" class="noteref" href="#fn_4" id="fnref_4">2</a></sup>.</p>`,
+					`<aside epub:type="footnote" class="footnote" id="fn_4">` + "\n" + `<p><a class="noteback" href="#fnref_4">2.</a> Note <em>x</em>.</p>`,
+				},
+			},
+		},
+		{
+			name: "book",
+			mode: footnotesBook,
+			want: [][]string{
+				{
+					`A<sup><a epub:type="noteref" class="noteref" href="book:chapter:2#fn_1" id="fnref_1">1</a></sup>`,
+					`again<sup><a epub:type="noteref" class="noteref" href="book:chapter:2#fn_1" id="fnref_1_2">1</a></sup>`,
+				},
+				{
+					// Numbers run through the book
+					`C<sup><a epub:type="noteref" class="noteref" href="book:chapter:2#fn_3" id="fnref_3">3</a></sup>`,
+				},
+			},
+			notes: "<h1>Notes</h1>\n<h2>One</h2>\n" +
+				"<aside epub:type=\"endnote\" class=\"footnote\" id=\"fn_1\">\n<p><a class=\"noteback\" href=\"book:chapter:0#fnref_1\">1.</a> Note <em>x</em>.</p>\n</aside>\n" +
+				"<aside epub:type=\"endnote\" class=\"footnote\" id=\"fn_2\">\n<p><a class=\"noteback\" href=\"book:chapter:0#fnref_2\">2.</a> Note y.</p>\n</aside>\n" +
+				"<h2>Two</h2>\n" +
+				"<aside epub:type=\"endnote\" class=\"footnote\" id=\"fn_3\">\n<p><a class=\"noteback\" href=\"book:chapter:1#fnref_3\">3.</a> Note z, see<sup><a epub:type=\"noteref\" class=\"noteref\" href=\"#fn_1\" id=\"fnref_1_3\">1</a></sup>.</p>\n</aside>\n",
+		},
+		{
+			name: "native digits",
+			mode: footnotesBook,
+			zero: '۰',
+			want: [][]string{
+				{`id="fnref_2">۲</a></sup>`},
+				{`id="fnref_3">۳</a></sup>`},
+			},
+			notes: `<a class="noteback" href="book:chapter:1#fnref_3">۳.</a>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &conversionReport{}
+			opts := renderOptions{Dialect: dialect, DigitZero: tt.zero, Footnotes: tt.mode, Links: linksKeep, Tables: tablesKeep, Math: mathMathML, Titles: englishTitles}
+			docs := []sourceDoc{{Path: "a.md", Source: []byte(source)}}
+			chapters := buildChapters(docs, 0, opts, newBookImages("", nil, testImageOptions, report), report)
+
+			wantChapters := len(tt.want)
+			if tt.notes != "" {
+				wantChapters++
+			}
+			if len(chapters) != wantChapters {
+				t.Fatalf("%d chapters, want %d", len(chapters), wantChapters)
+			}
+			for i, want := range tt.want {
+				for _, w := range want {
+					if !strings.Contains(chapters[i].HTML, w) {
+						t.Errorf("chapter %d = %s\nwant it to contain %s", i, chapters[i].HTML, w)
+					}
+				}
+			}
+			if tt.notes != "" {
+				notes := chapters[len(chapters)-1]
+				if notes.Title != "Notes" || !strings.Contains(notes.HTML, tt.notes) {
+					t.Errorf("notes chapter %q = %s\nwant it to contain %s", notes.Title, notes.HTML, tt.notes)
+				}
+				if tt.mode == footnotesBook && strings.Contains(chapters[0].HTML, "<aside") {
+					t.Errorf("notes left in the chapter: %s", chapters[0].HTML)
+				}
+			}
+		})
+	}
+}
+
+func TestNotesChapter(t *testing.T) {
+	f := newFootnotes(footnotesBook, 0)
+	if _, ok := f.notesChapter("Notes"); ok {
+		t.Errorf("notes chapter without notes")
+	}
+	f.sections = []noteSection{{Title: "One", HTML: "<aside>1</aside>\n"}}
+	notes, ok := f.notesChapter("Notes & Sources")
+	if want := "<h1>Notes &amp; Sources</h1>\n<aside>1</aside>\n"; !ok || notes.HTML != want || notes.Title != "Notes & Sources" {
+		t.Errorf("notes chapter %q = %q, want %q", notes.Title, notes.HTML, want)
+	}
+}
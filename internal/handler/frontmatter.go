@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// bookMetadata describes the book as a whole.
+type bookMetadata struct {
+	// ID is a stable identifier of the book, such as an ISBN or a UUID.
+	ID          string
+	Title       string
+	Subtitle    string
+	Authors     []string
+	Language    string
+	Publisher   string
+	Date        time.Time
+	Description string
+	Subjects    []string
+	Series      string
+	SeriesIndex string
+	// Cover is the path of the cover image, relative to the document
+	// the metadata was read from.
+	Cover string
+	// Stylesheet is the path of a CSS file styling the book, resolved
+	// like Cover.
+	Stylesheet string
+	// MarkdownDialect and MarkdownExtensions set the markdown syntax of
+	// the documents, like the form fields of the same name.
+	MarkdownDialect    string
+	MarkdownExtensions []string
+}
+
+// readFrontMatter strips the front matter from every document and returns
+// the metadata found in the first one, which describes the whole book. An
+// HTML document is described by its head instead.
+func readFrontMatter(docs []sourceDoc) (bookMetadata, error) {
+	var meta bookMetadata
+	for i := range docs {
+		if docs[i].HTML {
+			if i == 0 {
+				meta = htmlMetadata(parseHTML(docs[i].Source))
+			}
+			continue
+		}
+		fm, body, err := splitFrontMatter(docs[i].Source)
+		if err == nil && i == 0 && fm != nil {
+			meta, err = parseFrontMatter(fm)
+		}
+		if err != nil {
+			return meta, fmt.Errorf("%s: %w", docs[i].Path, err)
+		}
+		docs[i].Source = body
+	}
+	return meta, nil
+}
+
+// splitFrontMatter separates a YAML ("---") or TOML ("+++") front matter
+// block at the very start of a markdown document from its body. Documents
+// without front matter are returned unchanged with a nil map.
+func splitFrontMatter(md []byte) (map[string]interface{}, []byte, error) {
+	md = bytes.TrimPrefix(md, []byte("\xef\xbb\xbf"))
+
+	var fence string
+	switch {
+	case bytes.HasPrefix(md, []byte("---\n")), bytes.HasPrefix(md, []byte("---\r\n")):
+		fence = "---"
+	case bytes.HasPrefix(md, []byte("+++\n")), bytes.HasPrefix(md, []byte("+++\r\n")):
+		fence = "+++"
+	default:
+		return nil, md, nil
+	}
+
+	// Find the closing fence on a line of its own
+	rest := md[bytes.IndexByte(md, '\n')+1:]
+	var block []byte
+	found := false
+	for offset := 0; offset < len(rest); {
+		end := bytes.IndexByte(rest[offset:], '\n')
+		next := len(rest)
+		if end >= 0 {
+			next = offset + end + 1
+		}
+		line := strings.TrimRight(string(rest[offset:next]), "\r\n")
+		if line == fence || (fence == "---" && line == "...") {
+			block, rest, found = rest[:offset], rest[next:], true
+			break
+		}
+		offset = next
+	}
+	if !found {
+		return nil, md, nil
+	}
+
+	meta := make(map[string]interface{})
+	var err error
+	if fence == "---" {
+		err = yaml.Unmarshal(block, &meta)
+	} else {
+		err = toml.Unmarshal(block, &meta)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid front matter: %w", err)
+	}
+	return meta, rest, nil
+}
+
+// parseFrontMatter maps the keys of a front matter block onto the book
+// metadata. Unknown keys are ignored so documents can carry keys meant
+// for other tools.
+func parseFrontMatter(fm map[string]interface{}) (bookMetadata, error) {
+	var meta bookMetadata
+	meta.ID = stringValue(fm["id"])
+	meta.Title = stringValue(fm["title"])
+	meta.Subtitle = stringValue(fm["subtitle"])
+	meta.Authors = append(stringList(fm["author"]), stringList(fm["authors"])...)
+	meta.Language = stringValue(fm["language"])
+	if meta.Language == "" {
+		meta.Language = stringValue(fm["lang"])
+	}
+	meta.Publisher = stringValue(fm["publisher"])
+	meta.Description = stringValue(fm["description"])
+	meta.Subjects = append(stringList(fm["subjects"]), stringList(fm["subject"])...)
+	meta.Series = stringValue(fm["series"])
+	meta.SeriesIndex = stringValue(fm["series_index"])
+	meta.Cover = stringValue(fm["cover"])
+	meta.Stylesheet = stringValue(fm["stylesheet"])
+	meta.MarkdownDialect = stringValue(fm["markdown_dialect"])
+	meta.MarkdownExtensions = stringList(fm["markdown_extensions"])
+
+	switch date := fm["date"].(type) {
+	case nil:
+	case time.Time:
+		meta.Date = date
+	default:
+		parsed, err := parseDate(stringValue(date))
+		if err != nil {
+			return meta, err
+		}
+		meta.Date = parsed
+	}
+	return meta, nil
+}
+
+// parseDate parses a publication date given as a full timestamp, a day,
+// a month or a year.
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid front matter: date %q is not in YYYY-MM-DD form", s)
+}
+
+// stringValue converts a scalar front matter value to a string.
+func stringValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format("2006-01-02")
+	default:
+		return strings.TrimSpace(fmt.Sprint(v))
+	}
+}
+
+// stringList converts a front matter value holding either a single
+// string or a list of strings to a list.
+func stringList(v interface{}) []string {
+	var list []string
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s := stringValue(item); s != "" {
+				list = append(list, s)
+			}
+		}
+	default:
+		if s := stringValue(v); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
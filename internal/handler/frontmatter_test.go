@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadFrontMatter(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   bookMetadata
+		body   string
+	}{
+		{
+			name: "YAML",
+			source: "---\n" +
+				"title: A Book\nsubtitle: With a Subtitle\nauthor: Jane Doe\nauthors: [John Doe]\nlanguage: de\n" +
+				"publisher: Press\ndate: 2024-05-01\ndescription: About it.\nsubjects: [Go, Kindle]\n" +
+				"series: Books\nseries_index: 2\nid: isbn:9780000000000\ncover: cover.png\n" +
+				"---\n# One\n",
+			want: bookMetadata{
+				ID: "isbn:9780000000000", Title: "A Book", Subtitle: "With a Subtitle",
+				Authors: []string{"Jane Doe", "John Doe"}, Language: "de", Publisher: "Press",
+				Date: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), Description: "About it.",
+				Subjects: []string{"Go", "Kindle"}, Series: "Books", SeriesIndex: "2", Cover: "cover.png",
+			},
+			body: "# One\n",
+		},
+		{
+			name: "TOML",
+			source: "+++\n" +
+				"title = \"A Book\"\nauthors = [\"Jane Doe\", \"John Doe\"]\nlang = \"fa\"\ndate = 2024-05-01T10:00:00Z\n" +
+				"series_index = 1.5\nmarkdown_dialect = \"gfm\"\nmarkdown_extensions = [\"-tables\"]\n" +
+				"+++\n# One\n",
+			want: bookMetadata{
+				Title: "A Book", Authors: []string{"Jane Doe", "John Doe"}, Language: "fa",
+				Date: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), SeriesIndex: "1.5",
+				MarkdownDialect: "gfm", MarkdownExtensions: []string{"-tables"},
+			},
+			body: "# One\n",
+		},
+		{
+			name:   "YAML ended by dots",
+			source: "---\ntitle: A Book\n...\nText\n",
+			want:   bookMetadata{Title: "A Book"},
+			body:   "Text\n",
+		},
+		{
+			name:   "byte order mark and CRLF",
+			source: "\xef\xbb\xbf---\r\ntitle: A Book\r\ndate: 2024-05\r\n---\r\nText\r\n",
+			want:   bookMetadata{Title: "A Book", Date: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+			body:   "Text\r\n",
+		},
+		{
+			name:   "year as a date",
+			source: "---\ndate: \"2024\"\n---\n",
+			want:   bookMetadata{Date: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:   "unknown keys",
+			source: "---\ntitle: A Book\nlayout: post\ntags: [a]\n---\nText\n",
+			want:   bookMetadata{Title: "A Book"},
+			body:   "Text\n",
+		},
+		{
+			name:   "no closing fence",
+			source: "---\ntitle: A Book\n\nText\n",
+			body:   "---\ntitle: A Book\n\nText\n",
+		},
+		{
+			name:   "rule not at the start",
+			source: "Text\n\n---\ntitle: A Book\n---\n",
+			body:   "Text\n\n---\ntitle: A Book\n---\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs := []sourceDoc{{Path: "a.md", Source: []byte(tt.source)}}
+			meta, err := readFrontMatter(docs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(meta, tt.want) {
+				t.Errorf("metadata = %+v\nwant       %+v", meta, tt.want)
+			}
+			if got := string(docs[0].Source); got != tt.body {
+				t.Errorf("body = %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestReadFrontMatterDocuments(t *testing.T) {
+	docs := []sourceDoc{
+		{Path: "1.md", Source: []byte("---\ntitle: Book\n---\nOne\n")},
+		{Path: "2.md", Source: []byte("+++\ntitle = \"Chapter\"\n+++\nTwo\n")},
+	}
+	meta, err := readFrontMatter(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first document describes the book, the front matter of the
+	// others is stripped
+	if meta.Title != "Book" {
+		t.Errorf("title = %q", meta.Title)
+	}
+	if string(docs[0].Source) != "One\n" || string(docs[1].Source) != "Two\n" {
+		t.Errorf("bodies = %q, %q", docs[0].Source, docs[1].Source)
+	}
+
+	page := []sourceDoc{{Path: "a.html", HTML: true, Source: []byte(`<html><head><title>Page</title><meta name="author" content="Jane Doe"></head><body>---</body></html>`)}}
+	if meta, err := readFrontMatter(page); err != nil || meta.Title != "Page" || len(meta.Authors) != 1 {
+		t.Errorf("HTML metadata = %+v, %v", meta, err)
+	}
+}
+
+func TestReadFrontMatterErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		docs []string
+		want string
+	}{
+		{"bad date", []string{"---\ndate: 1st of May\n---\n"}, `a.md: invalid front matter: date "1st of May" is not in YYYY-MM-DD form`},
+		{"impossible date", []string{"---\ndate: \"2024-02-30\"\n---\n"}, `date "2024-02-30"`},
+		{"malformed YAML", []string{"---\ntitle: [A\n---\n"}, "a.md: invalid front matter: yaml"},
+		{"malformed TOML", []string{"+++\ntitle = \n+++\n"}, "a.md: invalid front matter: toml"},
+		{"malformed in a later document", []string{"# A\n", "---\n: :\n  - [\n---\n"}, "b.md: invalid front matter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var docs []sourceDoc
+			for i, source := range tt.docs {
+				docs = append(docs, sourceDoc{Path: string(rune('a'+i)) + ".md", Source: []byte(source)})
+			}
+			if _, err := readFrontMatter(docs); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	rec := convertRequest(t, testConfig(), nil, map[string]archiveEntry{
+		"markdown": {name: "a.md", body: "---\ndate: soon\n---\n# A\n"},
+	})
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "date") {
+		t.Errorf("response = %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+)
+
+// Highlight themes with a special meaning, besides the chroma styles.
+const (
+	highlightNone = "none"
+	highlightEInk = "eink"
+)
+
+// einkStyle is a monochrome theme for e-ink screens. It sets code apart
+// with bold and italic type only, as colors turn into hard to read shades
+// of grey.
+var einkStyle = chroma.MustNewStyle(highlightEInk, chroma.StyleEntries{
+	chroma.Background:       "#000000 bg:#ffffff",
+	chroma.Comment:          "italic",
+	chroma.CommentPreproc:   "noitalic bold",
+	chroma.Keyword:          "bold",
+	chroma.KeywordType:      "nobold italic",
+	chroma.OperatorWord:     "bold",
+	chroma.NameFunction:     "bold",
+	chroma.NameClass:        "bold",
+	chroma.NameTag:          "bold",
+	chroma.NameAttribute:    "italic",
+	chroma.NameDecorator:    "italic",
+	chroma.LiteralStringDoc: "italic",
+	chroma.GenericHeading:   "bold",
+	chroma.GenericEmph:      "italic",
+	chroma.GenericStrong:    "bold",
+	chroma.GenericPrompt:    "bold",
+	chroma.GenericDeleted:   "italic",
+	chroma.Error:            "underline",
+})
+
+// highlightStyle returns the chroma style of a highlight theme, or nil
+// if code is not highlighted.
+func highlightStyle(theme string) (*chroma.Style, error) {
+	switch theme {
+	case highlightNone:
+		return nil, nil
+	case highlightEInk:
+		return einkStyle, nil
+	}
+	if style, ok := styles.Registry[theme]; ok {
+		return style, nil
+	}
+	return nil, fmt.Errorf("unknown highlight theme %q, valid themes are %s", theme, strings.Join(highlightThemes(), ", "))
+}
+
+// highlightThemes lists the names accepted by highlightStyle.
+func highlightThemes() []string {
+	names := styles.Names()
+	sort.Strings(names)
+	return append([]string{highlightNone, highlightEInk}, names...)
+}
+
+// highlightStylesheet returns the CSS rules of the classes emitted by
+// highlightCodeBlock for style. Only colors, weight, slant and underline
+// are written: the layout rules chroma adds for line numbers and line
+// wrappers use properties Kindle readers do not support.
+func highlightStylesheet(style *chroma.Style) string {
+	var sb strings.Builder
+	bg := style.Get(chroma.Background)
+	writeRule := func(tt chroma.TokenType, selector string, entry chroma.StyleEntry) {
+		var decls []string
+		if entry.Colour.IsSet() {
+			decls = append(decls, "color: "+entry.Colour.String())
+		}
+		if entry.Background.IsSet() {
+			decls = append(decls, "background-color: "+entry.Background.String())
+		}
+		if entry.Bold == chroma.Yes {
+			decls = append(decls, "font-weight: bold")
+		}
+		if entry.Italic == chroma.Yes {
+			decls = append(decls, "font-style: italic")
+		}
+		if entry.Underline == chroma.Yes {
+			decls = append(decls, "text-decoration: underline")
+		}
+		if len(decls) > 0 {
+			fmt.Fprintf(&sb, "/* %s */ %s { %s; }\n", tt, selector, strings.Join(decls, "; "))
+		}
+	}
+
+	writeRule(chroma.Background, ".chroma", bg)
+	types := make([]int, 0, len(chroma.StandardTypes))
+	for tt := range chroma.StandardTypes {
+		types = append(types, int(tt))
+	}
+	sort.Ints(types)
+	for _, ti := range types {
+		tt := chroma.TokenType(ti)
+		class := chroma.StandardTypes[tt]
+		if tt == chroma.Background || tt == chroma.PreWrapper || tt == chroma.Line || class == "" {
+			continue
+		}
+		writeRule(tt, ".chroma ."+class, style.Get(tt).Sub(bg))
+	}
+	return sb.String()
+}
+
+// highlightCodeBlock writes a fenced code block with a known language as
+// highlighted HTML, using classes styled by highlightStylesheet. It
+// reports false if the block is left to the default renderer.
+func highlightCodeBlock(w io.Writer, block *ast.CodeBlock, style *chroma.Style) bool {
+	lang := strings.Fields(string(block.Info))
+	if len(lang) == 0 {
+		return false
+	}
+	lexer := lexers.Get(lang[0])
+	if lexer == nil {
+		return false
+	}
+	tokens, err := chroma.Coalesce(lexer).Tokenise(nil, string(block.Literal))
+	if err != nil {
+		return false
+	}
+
+	var class bytes.Buffer
+	html.EscapeHTML(&class, []byte(lang[0]))
+	attrs := append([]string{fmt.Sprintf(`class="language-%s"`, class.String())}, html.BlockAttrs(block)...)
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithPreWrapper(codePreWrapper{attrs: attrs}),
+	)
+	var buf bytes.Buffer
+	if err = formatter.Format(&buf, style, tokens); err != nil {
+		return false
+	}
+	buf.WriteByte('\n')
+	w.Write(buf.Bytes())
+	return true
+}
+
+// codePreWrapper wraps highlighted code in the same pre and code elements
+// the markdown renderer uses, keeping the attributes of the block.
+type codePreWrapper struct {
+	attrs []string
+}
+
+func (p codePreWrapper) Start(code bool, styleAttr string) string {
+	return "<pre" + styleAttr + ">" + html.TagWithAttributes("<code", p.attrs)
+}
+
+func (p codePreWrapper) End(code bool) string {
+	return "</code></pre>"
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+func TestHighlightStyle(t *testing.T) {
+	if style, err := highlightStyle(highlightNone); style != nil || err != nil {
+		t.Errorf("none = %v, %v", style, err)
+	}
+	if style, err := highlightStyle(highlightEInk); style != einkStyle || err != nil {
+		t.Errorf("eink = %v, %v", style, err)
+	}
+	if style, err := highlightStyle("monokai"); style == nil || err != nil {
+		t.Errorf("monokai = %v, %v", style, err)
+	}
+	if _, err := highlightStyle("neon"); err == nil || !strings.Contains(err.Error(), "none, eink, ") {
+		t.Errorf("unknown theme error = %v", err)
+	}
+
+	rec := convertRequest(t, testConfig(), map[string]string{"highlight": "neon"}, map[string]archiveEntry{
+		"markdown": {name: "a.md", body: "# A\n"},
+	})
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `unknown highlight theme \"neon\"`) {
+		t.Errorf("response = %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestHighlightStylesheet(t *testing.T) {
+	// The stylesheets of all themes stay within what Kindle supports
+	for _, theme := range highlightThemes()[1:] {
+		style, err := highlightStyle(theme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		css := highlightStylesheet(style)
+		if problems := validateStylesheet(css); len(problems) > 0 {
+			t.Errorf("%s: %q", theme, problems)
+		}
+		for _, property := range []string{"display", "padding", "margin", "width", "user-select"} {
+			if strings.Contains(css, property+":") {
+				t.Errorf("%s: stylesheet sets %s", theme, property)
+			}
+		}
+	}
+
+	css := highlightStylesheet(einkStyle)
+	for _, rule := range []string{
+		".chroma { color: #000000; background-color: #ffffff; }",
+		".chroma .k { font-weight: bold; }",
+		".chroma .c { font-style: italic; }",
+		".chroma .err { text-decoration: underline; }",
+	} {
+		if !strings.Contains(css, rule) {
+			t.Errorf("eink stylesheet lacks %s:\n%s", rule, css)
+		}
+	}
+	// Token types that look like the background get no rule
+	if strings.Contains(css, ".chroma .n ") || strings.Contains(css, ".chroma .p ") {
+		t.Errorf("eink stylesheet has rules without declarations:\n%s", css)
+	}
+}
+
+func TestHighlightCodeBlock(t *testing.T) {
+	tests := []struct {
+		name  string
+		info  string
+		want  []string
+		plain bool
+	}{
+		{
+			name: "known language",
+			info: "go {.listing}",
+			want: []string{`<pre class="chroma"><code class="language-go">`, `<span class="kd">func</span>`, `</code></pre>`},
+		},
+		{name: "unknown language", info: "klingon", plain: true},
+		{name: "no language", plain: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := &ast.CodeBlock{IsFenced: true, Info: []byte(tt.info)}
+			block.Literal = []byte("func main() {}\n")
+			var buf bytes.Buffer
+			if ok := highlightCodeBlock(&buf, block, einkStyle); ok == tt.plain {
+				t.Fatalf("highlighted = %v, want %v", ok, !tt.plain)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("html = %s, want it to contain %s", buf.String(), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,711 @@
+package handler
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/Amin-MAG/md2azw3/internal/hyphen"
+)
+
+// htmlSection is a run of top level HTML nodes that becomes one chapter.
+type htmlSection struct {
+	Title string
+	Nodes []*html.Node
+	// Heading is the heading that starts the section, if any.
+	Heading *html.Node
+}
+
+// isHTMLFile reports whether a file name has an HTML extension.
+func isHTMLFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".html", ".htm", ".xhtml":
+		return true
+	}
+	return false
+}
+
+// isHTMLUpload reports whether an uploaded document is HTML: by its name,
+// the content type it was sent with or, failing those, its content.
+func isHTMLUpload(fh *multipart.FileHeader, data []byte) bool {
+	if isHTMLFile(fh.Filename) {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(strings.Split(fh.Header.Get("Content-Type"), ";")[0])) {
+	case "text/html", "application/xhtml+xml":
+		return true
+	case "text/markdown", "text/x-markdown":
+		return false
+	}
+	return strings.HasPrefix(http.DetectContentType(data), "text/html")
+}
+
+// parseHTML parses an HTML document. The parser recovers from any markup,
+// as browsers do.
+func parseHTML(src []byte) *html.Node {
+	doc, err := html.Parse(bytes.NewReader(src))
+	if err != nil {
+		// Only read errors are reported, which a byte slice does not have
+		return &html.Node{Type: html.DocumentNode}
+	}
+	return doc
+}
+
+// htmlBody returns the sanitized body of an HTML document. The navigation
+// of a web page is dropped, that of an EPUB document is part of the book.
+func htmlBody(d sourceDoc) *html.Node {
+	body := findElement(parseHTML(d.Source), atom.Body)
+	if body == nil {
+		return &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	}
+	dropped := droppedElements
+	if !d.Chapter {
+		dropped = droppedPageElements
+	}
+	sanitizeHTML(body, dropped)
+	return body
+}
+
+// findElement returns the first element below n with the given tag.
+func findElement(n *html.Node, tag atom.Atom) *html.Node {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == tag {
+			return c
+		}
+		if found := findElement(c, tag); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// attr returns the value of an attribute of n.
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// setAttr sets an attribute of n, replacing a present one.
+func setAttr(n *html.Node, key, val string) {
+	for i, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+// nodeText returns the text content of a node with runs of white space
+// collapsed.
+func nodeText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// htmlMetadata reads the book metadata from the head of an HTML document:
+// the title, the language of the document and the common author,
+// description, keywords and Dublin Core meta tags.
+func htmlMetadata(doc *html.Node) bookMetadata {
+	var meta bookMetadata
+	if title := findElement(doc, atom.Title); title != nil {
+		meta.Title = nodeText(title)
+	}
+	if root := findElement(doc, atom.Html); root != nil {
+		meta.Language = attr(root, "lang")
+	}
+
+	head := findElement(doc, atom.Head)
+	if head == nil {
+		return meta
+	}
+	for c := head.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Meta {
+			continue
+		}
+		name := strings.ToLower(attr(c, "name"))
+		if name == "" {
+			name = strings.ToLower(attr(c, "property"))
+		}
+		content := strings.TrimSpace(attr(c, "content"))
+		if content == "" {
+			continue
+		}
+		switch name {
+		case "author", "dc.creator", "dcterms.creator":
+			meta.Authors = append(meta.Authors, content)
+		case "description", "dc.description", "og:description":
+			if meta.Description == "" {
+				meta.Description = content
+			}
+		case "keywords":
+			for _, keyword := range strings.Split(content, ",") {
+				if keyword = strings.TrimSpace(keyword); keyword != "" {
+					meta.Subjects = append(meta.Subjects, keyword)
+				}
+			}
+		case "dc.subject":
+			meta.Subjects = append(meta.Subjects, content)
+		case "dc.publisher", "publisher":
+			meta.Publisher = content
+		case "dc.identifier":
+			meta.ID = content
+		case "dc.language", "language":
+			if meta.Language == "" {
+				meta.Language = content
+			}
+		case "dc.title", "og:title":
+			if meta.Title == "" {
+				meta.Title = content
+			}
+		case "date", "dc.date", "dcterms.created", "article:published_time":
+			// Pages carry all kinds of dates, ignore those that do not parse
+			if date, err := parseDate(content); err == nil && meta.Date.IsZero() {
+				meta.Date = date
+			}
+		}
+	}
+	return meta
+}
+
+// Elements dropped together with their content: scripts, embedded
+// content and forms, which e-readers cannot run, and the head.
+var droppedElements = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Noscript: true, atom.Style: true, atom.Template: true,
+	atom.Link: true, atom.Meta: true, atom.Base: true, atom.Title: true,
+	atom.Iframe: true, atom.Frame: true, atom.Frameset: true, atom.Object: true, atom.Embed: true,
+	atom.Applet: true, atom.Canvas: true, atom.Audio: true, atom.Video: true, atom.Source: true,
+	atom.Track: true, atom.Form: true, atom.Input: true, atom.Button: true, atom.Select: true,
+	atom.Textarea: true, atom.Dialog: true,
+}
+
+// droppedPageElements adds the site navigation of web pages to
+// droppedElements.
+var droppedPageElements = func() map[atom.Atom]bool {
+	dropped := map[atom.Atom]bool{atom.Nav: true}
+	for a := range droppedElements {
+		dropped[a] = true
+	}
+	return dropped
+}()
+
+// keptElements lists the elements Kindle readers render. Other elements
+// are replaced by their content.
+var keptElements = map[atom.Atom]bool{
+	atom.A: true, atom.Abbr: true, atom.Address: true, atom.Article: true, atom.Aside: true,
+	atom.B: true, atom.Bdi: true, atom.Bdo: true, atom.Blockquote: true, atom.Br: true,
+	atom.Caption: true, atom.Cite: true, atom.Code: true, atom.Col: true, atom.Colgroup: true,
+	atom.Dd: true, atom.Del: true, atom.Dfn: true, atom.Div: true, atom.Dl: true, atom.Dt: true,
+	atom.Em: true, atom.Figcaption: true, atom.Figure: true, atom.Footer: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Header: true, atom.Hr: true, atom.I: true, atom.Img: true, atom.Ins: true, atom.Kbd: true,
+	atom.Li: true, atom.Mark: true, atom.Nav: true, atom.Ol: true, atom.P: true, atom.Pre: true,
+	atom.Q: true, atom.Rp: true, atom.Rt: true, atom.Ruby: true, atom.S: true, atom.Samp: true,
+	atom.Section: true, atom.Small: true, atom.Span: true, atom.Strong: true, atom.Sub: true,
+	atom.Sup: true, atom.Table: true, atom.Tbody: true, atom.Td: true, atom.Tfoot: true,
+	atom.Th: true, atom.Thead: true, atom.Time: true, atom.Tr: true, atom.U: true, atom.Ul: true,
+	atom.Var: true, atom.Wbr: true,
+}
+
+// keptAttrs lists the attributes kept on HTML elements. Presentational
+// attributes are dropped, the stylesheets and inline styles style the
+// content.
+var keptAttrs = map[string]bool{
+	"id": true, "class": true, "style": true, "title": true, "lang": true, "dir": true, "epub:type": true,
+	"href": true, "src": true, "alt": true, "width": true, "height": true,
+	"colspan": true, "rowspan": true, "headers": true, "scope": true, "span": true,
+	"start": true, "reversed": true, "type": true, "value": true, "cite": true, "datetime": true,
+}
+
+// sanitizeHTML strips n down to markup Kindle readers render safely:
+// unsupported elements are unwrapped, scripts, forms and embedded content
+// removed, and so are event handlers and script links. MathML and SVG are
+// kept as they are, apart from scripts. Elements in dropped are removed
+// together with their content.
+func sanitizeHTML(n *html.Node, dropped map[atom.Atom]bool) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch {
+		case c.Type == html.CommentNode || c.Type == html.DoctypeNode:
+			n.RemoveChild(c)
+		case c.Type != html.ElementNode:
+		case c.DataAtom == atom.Script || (c.Namespace == "" && dropped[c.DataAtom]):
+			n.RemoveChild(c)
+		case c.Namespace != "":
+			// MathML and SVG, which need their namespace spelled out in
+			// XHTML
+			c.Attr = safeAttrs(c.Attr, nil)
+			if c.Namespace != n.Namespace {
+				for _, a := range foreignNamespaces[c.Namespace] {
+					setAttr(c, a.Key, a.Val)
+				}
+			}
+			sanitizeHTML(c, dropped)
+		case !keptElements[c.DataAtom]:
+			sanitizeHTML(c, dropped)
+			for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+				c.RemoveChild(gc)
+				n.InsertBefore(gc, c)
+			}
+			n.RemoveChild(c)
+		default:
+			// Old anchors name their target instead of giving it an id
+			if c.DataAtom == atom.A && attr(c, "id") == "" && attr(c, "name") != "" {
+				setAttr(c, "id", attr(c, "name"))
+			}
+			c.Attr = safeAttrs(c.Attr, keptAttrs)
+			sanitizeHTML(c, dropped)
+		}
+		c = next
+	}
+}
+
+// foreignNamespaces holds the namespace declarations of the MathML and
+// SVG elements embedded in HTML.
+var foreignNamespaces = map[string][]html.Attribute{
+	"math": {{Key: "xmlns", Val: "http://www.w3.org/1998/Math/MathML"}},
+	"svg": {
+		{Key: "xmlns", Val: "http://www.w3.org/2000/svg"},
+		{Key: "xmlns:xlink", Val: "http://www.w3.org/1999/xlink"},
+	},
+}
+
+// safeAttrs returns the attributes in keep, or all if keep is nil, without
+// event handlers and links to scripts.
+func safeAttrs(attrs []html.Attribute, keep map[string]bool) []html.Attribute {
+	var kept []html.Attribute
+	for _, a := range attrs {
+		key := a.Key
+		if a.Namespace != "" {
+			key = a.Namespace + ":" + a.Key
+		}
+		if strings.HasPrefix(strings.ToLower(key), "on") || (keep != nil && !keep[key]) {
+			continue
+		}
+		if value := strings.ToLower(strings.TrimSpace(a.Val)); strings.HasPrefix(value, "javascript:") || strings.HasPrefix(value, "vbscript:") {
+			continue
+		}
+		kept = append(kept, a)
+	}
+	return kept
+}
+
+// headingLevel returns the level of a heading element, or zero for other
+// nodes.
+func headingLevel(n *html.Node) int {
+	if n.Type != html.ElementNode || n.Namespace != "" {
+		return 0
+	}
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		return int(n.Data[1] - '0')
+	}
+	return 0
+}
+
+// detectHTMLChapterLevel returns the heading level an HTML document is
+// split at when the request does not ask for one, like
+// detectChapterLevel, counting headings at any depth.
+func detectHTMLChapterLevel(body *html.Node) int {
+	level := 0
+	var walk func(n *html.Node) bool
+	walk = func(n *html.Node) bool {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch headingLevel(c) {
+			case 1:
+				return true
+			case 2:
+				level = 2
+			}
+			if walk(c) {
+				return true
+			}
+		}
+		return false
+	}
+	if walk(body) {
+		return 1
+	}
+	return level
+}
+
+// sectionContainers are the elements that are unwrapped when they hold a
+// heading the document is split at, so the heading can start a chapter.
+var sectionContainers = map[atom.Atom]bool{
+	atom.Div: true, atom.Section: true, atom.Article: true, atom.Header: true,
+	atom.Footer: true, atom.Aside: true,
+}
+
+// hoistHeadings unwraps the containers below n that hold headings of the
+// given level, as exported pages wrap their content in layers of them.
+// An id of an unwrapped container is kept on an empty element in its
+// place, so links to it still work.
+func hoistHeadings(n *html.Node, level int) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode && c.Namespace == "" && sectionContainers[c.DataAtom] && holdsHeading(c, level) {
+			if id := attr(c, "id"); id != "" {
+				n.InsertBefore(&html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div,
+					Attr: []html.Attribute{{Key: "id", Val: id}}}, c)
+			}
+			first := c.FirstChild
+			for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+				c.RemoveChild(gc)
+				n.InsertBefore(gc, c)
+			}
+			n.RemoveChild(c)
+			if first != nil {
+				next = first
+			}
+		}
+		c = next
+	}
+}
+
+// holdsHeading reports whether a heading of the given level is below n.
+func holdsHeading(n *html.Node, level int) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if headingLevel(c) == level || holdsHeading(c, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitHTMLSections splits the children of body at every heading of the
+// given level, like splitSections. Headings without an id get one, so
+// the table of contents can point at them.
+func splitHTMLSections(body *html.Node, level int, bookTitle string) []htmlSection {
+	if level > 0 {
+		hoistHeadings(body, level)
+	}
+	assignHeadingIDs(body)
+
+	var sections []htmlSection
+	current := htmlSection{Title: bookTitle}
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		if level > 0 && headingLevel(c) == level {
+			if hasContent(current.Nodes) {
+				sections = append(sections, current)
+			}
+			current = htmlSection{Title: nodeText(c), Heading: c}
+			if current.Title == "" {
+				current.Title = bookTitle
+			}
+		}
+		current.Nodes = append(current.Nodes, c)
+	}
+	if hasContent(current.Nodes) || len(sections) == 0 {
+		sections = append(sections, current)
+	}
+	return sections
+}
+
+// hasContent reports whether nodes hold more than white space.
+func hasContent(nodes []*html.Node) bool {
+	for _, n := range nodes {
+		if n.Type != html.TextNode || strings.TrimSpace(n.Data) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// assignHeadingIDs gives every heading below n without an id one derived
+// from its text, unique within the document.
+func assignHeadingIDs(n *html.Node) {
+	used := make(map[string]bool)
+	var headings []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode {
+				if id := attr(c, "id"); id != "" {
+					used[id] = true
+				}
+				if headingLevel(c) > 0 && attr(c, "id") == "" {
+					headings = append(headings, c)
+				}
+			}
+			walk(c)
+		}
+	}
+	walk(n)
+
+	for _, h := range headings {
+		base := slugify(nodeText(h))
+		if base == "" {
+			base = "section"
+		}
+		id := base
+		for i := 1; used[id]; i++ {
+			id = base + "-" + strconv.Itoa(i)
+		}
+		used[id] = true
+		setAttr(h, "id", id)
+	}
+}
+
+// slugify turns a heading text into an id: lower case letters and digits
+// joined by dashes.
+func slugify(s string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return sb.String()
+}
+
+// embedHTMLImages rewrites the image sources of nodes from the document at
+// docPath to embedded book resources, including the images of SVG
+// drawings. Images that cannot be embedded are replaced by their alt text
+// and reported as warnings.
+func embedHTMLImages(nodes []*html.Node, docPath string, images *bookImages) {
+	var imgs []*html.Node
+	for _, n := range nodes {
+		walkElements(n, func(e *html.Node) {
+			if (e.DataAtom == atom.Img && e.Namespace == "") || (e.Namespace == "svg" && e.Data == "image") {
+				imgs = append(imgs, e)
+			}
+		})
+	}
+	for _, img := range imgs {
+		src := &html.Attribute{}
+		for i, a := range img.Attr {
+			if (img.Namespace == "" && a.Namespace == "" && a.Key == "src") ||
+				(img.Namespace == "svg" && a.Key == "href" && (a.Namespace == "xlink" || a.Namespace == "")) {
+				src = &img.Attr[i]
+			}
+		}
+		if ref, ok := images.resolve(src.Val, path.Dir(docPath)); ok {
+			src.Val = ref
+		} else if img.Parent != nil {
+			img.Parent.InsertBefore(&html.Node{Type: html.TextNode, Data: attr(img, "alt")}, img)
+			img.Parent.RemoveChild(img)
+		}
+	}
+}
+
+// verbatimElements hold text the passes over the text of a document leave
+// as written, like code and math in markdown.
+var verbatimElements = map[atom.Atom]bool{
+	atom.Code: true, atom.Kbd: true, atom.Pre: true, atom.Samp: true, atom.Var: true,
+}
+
+// textBlockElements start a new run of text for the typography pass.
+var textBlockElements = map[atom.Atom]bool{
+	atom.Blockquote: true, atom.Caption: true, atom.Dd: true, atom.Div: true, atom.Dt: true,
+	atom.Figcaption: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true,
+	atom.H5: true, atom.H6: true, atom.Li: true, atom.P: true, atom.Td: true, atom.Th: true,
+}
+
+// walkHTMLText calls fn for the text nodes below n and enter for the
+// elements, skipping verbatim elements, MathML, SVG and links that spell
+// out their address. The children of an element are skipped when enter
+// returns false.
+func walkHTMLText(n *html.Node, enter func(e *html.Node) bool, fn func(t *html.Node)) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.TextNode:
+			fn(c)
+		case c.Type != html.ElementNode:
+		case c.Namespace != "" || verbatimElements[c.DataAtom] || isBareHTMLLink(c):
+			enter(c)
+		default:
+			if enter(c) {
+				walkHTMLText(c, enter, fn)
+			}
+		}
+	}
+}
+
+// isBareHTMLLink reports whether n is a link whose text is its address.
+func isBareHTMLLink(n *html.Node) bool {
+	if n.DataAtom != atom.A || n.Namespace != "" {
+		return false
+	}
+	text := nodeText(n)
+	return text != "" && text == strings.TrimPrefix(attr(n, "href"), "mailto:")
+}
+
+// applyHTMLTypography sets the quotes, dashes and ellipses of the text of
+// an HTML document like applyTypography.
+func applyHTMLTypography(body *html.Node, style *quoteStyle) {
+	t := typesetter{style: style, prev: ' '}
+	walkHTMLText(body, func(e *html.Node) bool {
+		switch {
+		case e.Namespace != "" || verbatimElements[e.DataAtom]:
+			t.prev = 'x'
+			return false
+		case e.DataAtom == atom.Br:
+			t.prev = ' '
+		case textBlockElements[e.DataAtom]:
+			t.prev, t.inner = ' ', false
+		}
+		return true
+	}, func(text *html.Node) {
+		text.Data = t.typeset(text.Data)
+	})
+}
+
+// applyHTMLHyphenation inserts soft hyphens into the long words of an
+// HTML document like applyHyphenation, leaving headings and tables whole.
+func applyHTMLHyphenation(body *html.Node, h *hyphen.Hyphenator) {
+	walkHTMLText(body, func(e *html.Node) bool {
+		return headingLevel(e) == 0 && e.DataAtom != atom.Table
+	}, func(text *html.Node) {
+		text.Data = hyphenateText(text.Data, h)
+	})
+}
+
+// localizeHTMLDigits writes the numbers in the headings of an HTML
+// document and the markers of its numbered lists in the digits starting
+// at zero, like applyDirection does for markdown.
+func localizeHTMLDigits(body *html.Node, zero rune) {
+	walkElements(body, func(e *html.Node) {
+		switch {
+		case headingLevel(e) > 0:
+			walkHTMLText(e, func(*html.Node) bool { return true }, func(text *html.Node) {
+				text.Data = localizeDigits(text.Data, zero)
+			})
+		case e.DataAtom == atom.Ol && e.Namespace == "" && (attr(e, "type") == "" || attr(e, "type") == "1"):
+			localizeHTMLListMarkers(e, zero)
+		}
+	})
+}
+
+// localizeHTMLListMarkers writes the markers of the ordered list ol as
+// text, honouring its start, reversed and item value attributes.
+func localizeHTMLListMarkers(ol *html.Node, zero rune) {
+	var items []*html.Node
+	for c := ol.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Li {
+			items = append(items, c)
+		}
+	}
+	reversed := false
+	for _, a := range ol.Attr {
+		reversed = reversed || (a.Namespace == "" && a.Key == "reversed")
+	}
+	step, number := 1, 1
+	if reversed {
+		step, number = -1, len(items)
+	}
+	if start, err := strconv.Atoi(attr(ol, "start")); err == nil {
+		number = start
+	}
+	setAttr(ol, "class", strings.TrimSpace(attr(ol, "class")+" "+nativeDigitsClass))
+	for _, li := range items {
+		if value, err := strconv.Atoi(attr(li, "value")); err == nil {
+			number = value
+		}
+		marker := &html.Node{Type: html.TextNode, Data: localizeDigits(strconv.Itoa(number), zero) + ". "}
+		number += step
+
+		// Put the marker inside a leading paragraph, as for markdown lists
+		parent := li
+		first := li.FirstChild
+		for first != nil && first.Type == html.TextNode && strings.TrimSpace(first.Data) == "" {
+			first = first.NextSibling
+		}
+		if first != nil && first.Type == html.ElementNode && first.DataAtom == atom.P {
+			parent = first
+		}
+		parent.InsertBefore(marker, parent.FirstChild)
+	}
+}
+
+// resolveHTMLFileLinks rewrites links from the HTML document at docPath to
+// other documents of the book, like resolveFileLinks.
+func resolveHTMLFileLinks(nodes []*html.Node, docPath string, fileChapters map[string]int, report *conversionReport) {
+	for _, n := range nodes {
+		walkElements(n, func(e *html.Node) {
+			if e.DataAtom != atom.A || e.Namespace != "" {
+				return
+			}
+			if href, ok := fileLink(attr(e, "href"), docPath, fileChapters, report); ok {
+				setAttr(e, "href", href)
+			}
+		})
+	}
+}
+
+// collectHTMLHeadings returns the headings of a section in order. The
+// heading that starts the chapter itself is skipped.
+func collectHTMLHeadings(sec htmlSection) []heading {
+	var headings []heading
+	for _, n := range sec.Nodes {
+		if n.Type != html.ElementNode {
+			continue
+		}
+		if n != sec.Heading && headingLevel(n) > 0 {
+			headings = append(headings, htmlHeading(n))
+		}
+		walkElements(n, func(e *html.Node) {
+			if e != n && headingLevel(e) > 0 {
+				headings = append(headings, htmlHeading(e))
+			}
+		})
+	}
+	return headings
+}
+
+func htmlHeading(n *html.Node) heading {
+	noTOC := false
+	for _, class := range strings.Fields(attr(n, "class")) {
+		noTOC = noTOC || class == noTOCClass
+	}
+	return heading{Level: headingLevel(n), Title: nodeText(n), ID: attr(n, "id"), NoTOC: noTOC}
+}
+
+// walkElements calls fn for n, if it is an element, and every element
+// below it.
+func walkElements(n *html.Node, fn func(e *html.Node)) {
+	if n.Type == html.ElementNode {
+		fn(n)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walkElements(c, fn)
+	}
+}
+
+// renderHTML serializes nodes as XHTML.
+func renderHTML(nodes []*html.Node) string {
+	var sb strings.Builder
+	for _, n := range nodes {
+		// Writing to a strings.Builder does not fail
+		_ = html.Render(&sb, n)
+	}
+	return sb.String()
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "scripts",
+			src:  `<p>a<script>alert(1)</script>b</p><noscript>c</noscript>`,
+			want: `<p>ab</p>`,
+		},
+		{
+			name: "event handlers",
+			src:  `<p onclick="alert(1)" ONMOUSEOVER="x()" class="c">a</p><img src="a.png" onerror="alert(1)" alt="a"/>`,
+			want: `<p class="c">a</p><img src="a.png" alt="a"/>`,
+		},
+		{
+			name: "script links",
+			src:  `<a href="javascript:alert(1)">a</a> <a href=" JavaScript:x()">b</a> <a href="vbscript:x">c</a> <a href="https://example.com">d</a>`,
+			want: `<a>a</a> <a>b</a> <a>c</a> <a href="https://example.com">d</a>`,
+		},
+		{
+			name: "forms and embedded content",
+			src:  `<form action="/x"><input name="q"/><button>Go</button></form><p>a</p><iframe src="x"></iframe><video src="v.mp4">v</video>`,
+			want: `<p>a</p>`,
+		},
+		{
+			name: "unsupported elements unwrapped",
+			src:  `<main><center><font color="red">a</font></center></main>`,
+			want: `a`,
+		},
+		{
+			name: "presentational attributes",
+			src:  `<table border="1" bgcolor="red"><tbody><tr><td align="left" colspan="2">a</td></tr></tbody></table>`,
+			want: `<table><tbody><tr><td colspan="2">a</td></tr></tbody></table>`,
+		},
+		{
+			name: "comments",
+			src:  `<p>a<!-- b --></p>`,
+			want: `<p>a</p>`,
+		},
+		{
+			name: "named anchor",
+			src:  `<a name="top"></a><a name="x" id="y"></a>`,
+			want: `<a id="top"></a><a id="y"></a>`,
+		},
+		{
+			name: "MathML",
+			src:  `<math display="block" onclick="x()"><mi>x</mi><script>alert(1)</script></math>`,
+			want: `<math display="block" xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi></math>`,
+		},
+		{
+			name: "SVG",
+			src:  `<svg viewBox="0 0 1 1" onload="x()"><a xlink:href="javascript:x()"><rect width="1"></rect></a><script>alert(1)</script></svg>`,
+			want: `<svg viewBox="0 0 1 1" xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><a><rect width="1"></rect></a></svg>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := htmlBody(sourceDoc{Source: []byte(tt.src)})
+			var nodes []*html.Node
+			for c := body.FirstChild; c != nil; c = c.NextSibling {
+				nodes = append(nodes, c)
+			}
+			if got := renderHTML(nodes); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/gomarkdown/markdown/ast"
+
+	"github.com/Amin-MAG/md2azw3/internal/hyphen"
+)
+
+// softHyphen marks a point a word may be broken at. It is only shown when
+// the reader breaks the line there.
+const softHyphen = "\u00ad"
+
+// hyphenMinWord is the number of letters a word needs to be hyphenated,
+// shorter words rarely leave gaps worth closing.
+const hyphenMinWord = 6
+
+// applyHyphenation inserts soft hyphens into the long words of the text of
+// doc, so readers can justify narrow lines without wide gaps. Headings,
+// tables, code, math, raw HTML and links that spell out their address are
+// left untouched.
+func applyHyphenation(doc ast.Node, h *hyphen.Hyphenator) {
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch n := node.(type) {
+		case *ast.Heading, *ast.Table, *ast.MathBlock, *ast.Image:
+			return ast.SkipChildren
+		case *ast.Link:
+			if len(n.Children) == 1 && isBareLink(n) {
+				return ast.SkipChildren
+			}
+		case *ast.Text:
+			n.Literal = []byte(hyphenateText(string(n.Literal), h))
+		}
+		return ast.GoToNext
+	})
+}
+
+// hyphenateText hyphenates the words of text, skipping anything that looks
+// like a web or e-mail address.
+func hyphenateText(text string, h *hyphen.Hyphenator) string {
+	var sb strings.Builder
+	for len(text) > 0 {
+		// Split off the next run of spaces and the field after it
+		start := strings.IndexFunc(text, func(r rune) bool { return !unicode.IsSpace(r) })
+		if start < 0 {
+			sb.WriteString(text)
+			break
+		}
+		end := strings.IndexFunc(text[start:], unicode.IsSpace)
+		if end < 0 {
+			end = len(text)
+		} else {
+			end += start
+		}
+		sb.WriteString(text[:start])
+		sb.WriteString(hyphenateField(text[start:end], h))
+		text = text[end:]
+	}
+	return sb.String()
+}
+
+// hyphenateField hyphenates the words of a field of text without spaces.
+func hyphenateField(field string, h *hyphen.Hyphenator) string {
+	if strings.Contains(field, "://") || strings.Contains(field, "@") || strings.HasPrefix(field, "www.") {
+		return field
+	}
+	var sb strings.Builder
+	var word []rune
+	flush := func() {
+		if len(word) >= hyphenMinWord {
+			sb.WriteString(h.Hyphenate(string(word), softHyphen))
+		} else {
+			sb.WriteString(string(word))
+		}
+		word = word[:0]
+	}
+	for _, r := range field {
+		if unicode.IsLetter(r) || unicode.Is(unicode.Mn, r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		sb.WriteRune(r)
+	}
+	flush()
+	return sb.String()
+}
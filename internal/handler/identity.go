@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// bookUID derives the unique id of the book from its metadata: from the
+// "id" front matter key if there is one, from the title and authors
+// otherwise. Kindle readers use it to tell books apart, so a book sent
+// again with the same id replaces the copy on the device.
+func bookUID(meta bookMetadata) uint32 {
+	sum := sha256.Sum256([]byte(identityKey(meta)))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// bookIdentifier returns the identifier EPUB readers tell books apart by:
+// the "id" front matter key if there is one, a UUID derived like bookUID
+// otherwise.
+func bookIdentifier(meta bookMetadata) string {
+	if meta.ID != "" {
+		return meta.ID
+	}
+	sum := sha256.Sum256([]byte(identityKey(meta)))
+	return formatUUID(sum[:16])
+}
+
+// randomUUID returns a random identifier for books without a stable one.
+func randomUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return formatUUID(b[:])
+}
+
+// formatUUID formats 16 bytes as a version 4 UUID URN.
+func formatUUID(b []byte) string {
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// identityKey is the text the stable ids of a book are derived from.
+func identityKey(meta bookMetadata) string {
+	if meta.ID != "" {
+		return "id:" + meta.ID
+	}
+	return "book:" + meta.Title + "\x00" + strings.Join(meta.Authors, "\x00")
+}
+
+// buildDate returns the creation date of a reproducible build: the time
+// given by SOURCE_DATE_EPOCH if set, the publication date of the book
+// otherwise, falling back to the Unix epoch.
+func buildDate(meta bookMetadata, sourceDateEpoch int64) time.Time {
+	switch {
+	case sourceDateEpoch != 0:
+		return time.Unix(sourceDateEpoch, 0).UTC()
+	case !meta.Date.IsZero():
+		return meta.Date.UTC()
+	default:
+		return time.Unix(0, 0).UTC()
+	}
+}
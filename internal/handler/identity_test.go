@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReproducibleBuild(t *testing.T) {
+	book := func(title string) map[string]archiveEntry {
+		md := "---\ntitle: " + title + "\nauthor: Jane Doe\ndate: 2024-05-01\n---\n\n# One\n\nText.\n\n# Two\n\nMore text.\n"
+		return map[string]archiveEntry{"markdown": {name: "book.md", body: md}}
+	}
+	convert := func(format, title string, reproducible bool) []byte {
+		t.Helper()
+		fields := map[string]string{"format": format}
+		if reproducible {
+			fields["reproducible"] = "true"
+		}
+		rec := convertRequest(t, testConfig(), fields, book(title))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: response %d %s", format, rec.Code, rec.Body)
+		}
+		return rec.Body.Bytes()
+	}
+
+	for _, format := range []string{"azw3", "epub"} {
+		t.Run(format, func(t *testing.T) {
+			first := convert(format, "A Book", true)
+			if second := convert(format, "A Book", true); !bytes.Equal(first, second) {
+				t.Errorf("reproducible builds of the same input differ")
+			}
+			if other := convert(format, "Another Book", true); bytes.Equal(first, other) {
+				t.Errorf("reproducible builds of different books are equal")
+			}
+			if random := convert(format, "A Book", false); bytes.Equal(first, random) {
+				t.Errorf("build with a random id equals the reproducible one")
+			}
+		})
+	}
+
+	// The identifier is derived from the book
+	want := bookIdentifier(bookMetadata{Title: "A Book", Authors: []string{"Jane Doe"}})
+	if got := epubIdentifier(t, convert("epub", "A Book", true)); got != want {
+		t.Errorf("identifier = %q, want %q", got, want)
+	}
+	if got := epubIdentifier(t, convert("epub", "Another Book", true)); got == want {
+		t.Errorf("identifier of another book = %q, the same", got)
+	}
+}
+
+func TestBookIdentity(t *testing.T) {
+	book := bookMetadata{Title: "A Book", Authors: []string{"Jane Doe"}}
+	tests := []struct {
+		name string
+		meta bookMetadata
+		same bool
+	}{
+		{"same book", bookMetadata{Title: "A Book", Authors: []string{"Jane Doe"}}, true},
+		{"other title", bookMetadata{Title: "Another Book", Authors: []string{"Jane Doe"}}, false},
+		{"other author", bookMetadata{Title: "A Book", Authors: []string{"John Doe"}}, false},
+		{"title and author run together", bookMetadata{Title: "A BookJane Doe"}, false},
+		{"id", bookMetadata{ID: "isbn:9780000000000", Title: "A Book", Authors: []string{"Jane Doe"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bookUID(tt.meta) == bookUID(book); got != tt.same {
+				t.Errorf("same UID = %v, want %v", got, tt.same)
+			}
+			if got := bookIdentifier(tt.meta) == bookIdentifier(book); got != tt.same {
+				t.Errorf("same identifier = %v, want %v", got, tt.same)
+			}
+		})
+	}
+
+	// An id of the book is its identifier, and titles change without
+	// changing the book
+	withID := bookMetadata{ID: "isbn:9780000000000", Title: "A Book"}
+	if got := bookIdentifier(withID); got != withID.ID {
+		t.Errorf("identifier = %q, want %q", got, withID.ID)
+	}
+	retitled := bookMetadata{ID: withID.ID, Title: "A Book, Revised"}
+	if bookUID(retitled) != bookUID(withID) {
+		t.Errorf("UID changes with the title of a book with an id")
+	}
+}
+
+func TestBuildDate(t *testing.T) {
+	published := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("", 2*3600))
+	tests := []struct {
+		name  string
+		date  time.Time
+		epoch int64
+		want  time.Time
+	}{
+		{"SOURCE_DATE_EPOCH", published, 1700000000, time.Unix(1700000000, 0).UTC()},
+		{"publication date", published, 0, published.UTC()},
+		{"neither", time.Time{}, 0, time.Unix(0, 0).UTC()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildDate(bookMetadata{Date: tt.date}, tt.epoch); !got.Equal(tt.want) || got.Location() != time.UTC {
+				t.Errorf("buildDate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// epubIdentifier returns the unique identifier of an EPUB.
+func epubIdentifier(t *testing.T, data []byte) string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("open zip: %v", err)
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	var container ocfContainer
+	decodeXML(t, files, "META-INF/container.xml", &container)
+	if len(container.Rootfiles) != 1 {
+		t.Fatalf("container lists %d root files", len(container.Rootfiles))
+	}
+	var opf opfPackage
+	decodeXML(t, files, container.Rootfiles[0].FullPath, &opf)
+	for _, id := range opf.Metadata.Identifiers {
+		if id.ID == opf.UniqueIdentifier {
+			return id.Value
+		}
+	}
+	t.Fatal("no unique identifier")
+	return ""
+}
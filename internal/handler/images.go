@@ -0,0 +1,277 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// bookImages collects the images embedded into the book and maps the
+// image references of the markdown onto them.
+type bookImages struct {
+	// root is the directory of an extracted archive, if any.
+	root    string
+	uploads map[string]*multipart.FileHeader
+	opts    imageOptions
+	report  *conversionReport
+
+	// Images holds the embedded images in resource order, Encoded the
+	// data they are stored as.
+	Images  []image.Image
+	Encoded []encodedImage
+	// refs maps an already resolved src to its embedded reference.
+	refs map[string]string
+}
+
+// newBookImages creates a bookImages that resolves references against the
+// files of an extracted archive below root, if set, and the given uploads,
+// and prepares the images for the device after opts.
+func newBookImages(root string, uploads []*multipart.FileHeader, opts imageOptions, report *conversionReport) *bookImages {
+	b := &bookImages{
+		root:    root,
+		uploads: make(map[string]*multipart.FileHeader),
+		opts:    opts,
+		report:  report,
+		refs:    make(map[string]string),
+	}
+	for _, fh := range uploads {
+		b.uploads[path.Clean(fh.Filename)] = fh
+	}
+	return b
+}
+
+// embedImages rewrites the image references of the document at docPath to
+// embedded book resources. Images that cannot be embedded are replaced by
+// their alt text and reported as warnings.
+func embedImages(doc ast.Node, docPath string, images *bookImages) {
+	var missing []*ast.Image
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		img, ok := node.(*ast.Image)
+		if !ok || !entering {
+			return ast.GoToNext
+		}
+		if ref, ok := images.resolve(string(img.Destination), path.Dir(docPath)); ok {
+			img.Destination = []byte(ref)
+		} else {
+			missing = append(missing, img)
+		}
+		return ast.GoToNext
+	})
+
+	for _, img := range missing {
+		replaceWithChildren(img)
+	}
+}
+
+// resolve returns the embedded reference for an image src found in a
+// document in directory dir, embedding the image on first use.
+func (b *bookImages) resolve(src, dir string) (string, bool) {
+	key, data, err := b.load(src, dir)
+	if err == nil {
+		if ref, ok := b.refs[key]; ok {
+			return ref, true
+		}
+	}
+
+	var img image.Image
+	if err == nil {
+		img, err = decodeImage(data)
+	}
+	var ref string
+	if err == nil {
+		ref, err = b.embed(key, img)
+	}
+	if err != nil {
+		b.report.Warnf("image %q not embedded: %s", truncate(src, 64), err)
+		return "", false
+	}
+	return ref, true
+}
+
+// embed prepares an image for the device, adds it to the book and returns
+// its reference. Images with the same key are embedded only once.
+func (b *bookImages) embed(key string, img image.Image) (string, error) {
+	if ref, ok := b.refs[key]; ok {
+		return ref, nil
+	}
+	img = optimizeImage(img, b.opts)
+	encoded, err := encodeImage(img, b.opts)
+	if err != nil {
+		return "", err
+	}
+	b.Images = append(b.Images, img)
+	b.Encoded = append(b.Encoded, encoded)
+	ref := imageRef(len(b.Images))
+	b.refs[key] = ref
+	return ref, nil
+}
+
+// embedded returns the image embedded under ref, as prepared for the
+// device, or nil if ref is not an image reference of the book.
+func (b *bookImages) embedded(ref string) image.Image {
+	var n int
+	if _, err := fmt.Sscanf(ref, "book:image:%d", &n); err != nil || n < 1 || n > len(b.Images) {
+		return nil
+	}
+	return b.Images[n-1]
+}
+
+// decode loads and decodes the image an src found in a document in
+// directory dir points at, without embedding it.
+func (b *bookImages) decode(src, dir string) (image.Image, error) {
+	_, data, err := b.load(src, dir)
+	if err != nil {
+		return nil, err
+	}
+	return decodeImage(data)
+}
+
+// load reads the encoded image an src points at. The returned key
+// identifies the image so it is embedded only once.
+func (b *bookImages) load(src, dir string) (string, []byte, error) {
+	if strings.HasPrefix(src, "data:") {
+		data, err := decodeDataURI(src)
+		return src, data, err
+	}
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return src, nil, fmt.Errorf("invalid reference")
+	}
+	if u.Scheme != "" || u.Host != "" {
+		return src, nil, fmt.Errorf("remote images are not fetched")
+	}
+
+	name := path.Clean(strings.TrimPrefix(u.Path, "/"))
+	if !strings.HasPrefix(u.Path, "/") {
+		name = path.Join(dir, u.Path)
+	}
+	if b.root != "" && filepath.IsLocal(name) {
+		data, err := os.ReadFile(filepath.Join(b.root, filepath.FromSlash(name)))
+		if err == nil {
+			return name, data, nil
+		}
+	}
+
+	fh, ok := b.uploads[name]
+	if !ok {
+		fh, ok = b.uploads[path.Base(name)]
+	}
+	if !ok {
+		return name, nil, fmt.Errorf("file was not uploaded")
+	}
+	data, err := readUploadedFile(fh)
+	return name, data, err
+}
+
+// decodeDataURI returns the payload of a data: URI.
+func decodeDataURI(uri string) ([]byte, error) {
+	meta, payload, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok {
+		return nil, fmt.Errorf("malformed data URI")
+	}
+	if strings.HasSuffix(meta, ";base64") {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(payload))
+		if err != nil {
+			return nil, fmt.Errorf("decode data URI: %w", err)
+		}
+		return data, nil
+	}
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, fmt.Errorf("decode data URI: %w", err)
+	}
+	return []byte(data), nil
+}
+
+// maxImagePixels is the largest number of pixels an image may have to be
+// decoded. The size of a compressed image says little about the memory
+// its pixels take, so the dimensions are checked first.
+const maxImagePixels = 40_000_000
+
+// decodeImage decodes an encoded image and turns photos upright after
+// their EXIF orientation. Transparent areas are flattened onto white as
+// images may be stored as JPEG. Images with more than maxImagePixels
+// pixels are refused before they are decoded.
+func decodeImage(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return nil, fmt.Errorf("image of %d×%d pixels is larger than the limit of %d megapixels", cfg.Width, cfg.Height, maxImagePixels/1_000_000)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	return flattenAlpha(applyOrientation(img, exifOrientation(data))), nil
+}
+
+// flattenAlpha draws images that may be transparent onto a white
+// background.
+func flattenAlpha(img image.Image) image.Image {
+	switch img.(type) {
+	case *image.YCbCr, *image.Gray, *image.CMYK:
+		return img
+	}
+	bounds := img.Bounds()
+	flat := image.NewRGBA(bounds)
+	draw.Draw(flat, bounds, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, bounds, img, bounds.Min, draw.Over)
+	return flat
+}
+
+// replaceWithChildren replaces node in its parent by its own children.
+func replaceWithChildren(node ast.Node) {
+	replaceNode(node, node.GetChildren())
+}
+
+// prependChild inserts child as the first child of parent.
+func prependChild(parent ast.Node, child ast.Node) {
+	child.SetParent(parent)
+	parent.SetChildren(append([]ast.Node{child}, parent.GetChildren()...))
+}
+
+// replaceNode replaces node with nodes in its parent.
+func replaceNode(node ast.Node, nodes []ast.Node) {
+	parent := node.GetParent()
+	if parent == nil {
+		return
+	}
+	var children []ast.Node
+	for _, child := range parent.GetChildren() {
+		if child != node {
+			children = append(children, child)
+			continue
+		}
+		for _, n := range nodes {
+			n.SetParent(parent)
+			children = append(children, n)
+		}
+	}
+	parent.SetChildren(children)
+}
+
+// truncate shortens s to at most n bytes for use in messages.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testImageOptions prepares images the way requests without image options
+// do.
+var testImageOptions = imageOptions{MaxWidth: defaultImageMaxWidth, MaxHeight: defaultImageMaxHeight, Quality: defaultImageQuality}
+
+// encodePNG returns img as a PNG file.
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngHeader returns the start of a grayscale PNG of the given size, enough
+// to read its dimensions but not its pixels.
+func pngHeader(width, height uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 0, 0, 0, 0)
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)-4))
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestDecodeImage(t *testing.T) {
+	transparent := image.NewNRGBA(image.Rect(0, 0, 4, 3))
+	transparent.Set(0, 0, color.NRGBA{R: 255, A: 255})
+
+	img, err := decodeImage(encodePNG(t, transparent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 4 || b.Dy() != 3 {
+		t.Errorf("image is %v", b)
+	}
+	// Transparent pixels are flattened onto white
+	if r, g, b, a := img.At(1, 1).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff || a != 0xffff {
+		t.Errorf("transparent pixel = %v", img.At(1, 1))
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r != 0xffff || g != 0 || b != 0 {
+		t.Errorf("opaque pixel = %v", img.At(0, 0))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"not an image", []byte("GIF89a?"), "decode image"},
+		{"over the pixel budget", pngHeader(8000, 5001), "larger than the limit of 40 megapixels"},
+		{"header only", pngHeader(100, 100), "decode image"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeImage(tt.data); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBookImagesResolve(t *testing.T) {
+	red := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	red.Set(0, 0, color.RGBA{R: 255, A: 255})
+	redPNG := encodePNG(t, red)
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "img"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "img", "archived.png"), redPNG, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	uploads := []*multipart.FileHeader{
+		uploadedFile(t, "img/a.png", redPNG),
+		uploadedFile(t, "b.png", redPNG),
+		uploadedFile(t, "huge.png", pngHeader(8000, 5001)),
+	}
+	report := &conversionReport{}
+	images := newBookImages(root, uploads, testImageOptions, report)
+
+	tests := []struct {
+		name     string
+		src, dir string
+		want     string
+		warning  string
+	}{
+		{name: "uploaded file", src: "img/a.png", want: "book:image:1"},
+		{name: "same file again", src: "img/a.png", want: "book:image:1"},
+		{name: "same file from another directory", src: "../img/a.png", dir: "chapters", want: "book:image:1"},
+		{name: "same file from the root", src: "/img/a.png", dir: "chapters", want: "book:image:1"},
+		{name: "uploaded by its base name", src: "pics/b.png", want: "book:image:2"},
+		{name: "file of the archive", src: "img/archived.png", want: "book:image:3"},
+		{name: "base64 data URI", src: "data:image/png;base64," + base64.StdEncoding.EncodeToString(redPNG), want: "book:image:4"},
+		{name: "remote image", src: "https://example.com/a.png", warning: "remote images are not fetched"},
+		{name: "missing file", src: "c.png", warning: "file was not uploaded"},
+		{name: "outside of the archive", src: "../../etc/passwd", warning: "file was not uploaded"},
+		{name: "broken data URI", src: "data:image/png;base64", warning: "malformed data URI"},
+		{name: "over the pixel budget", src: "huge.png", warning: "larger than the limit of 40 megapixels"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report.Warnings = nil
+			ref, ok := images.resolve(tt.src, tt.dir)
+			if ok != (tt.want != "") || ref != tt.want {
+				t.Errorf("resolve(%q) = %q, %v, want %q", tt.src, ref, ok, tt.want)
+			}
+			switch {
+			case tt.warning == "" && len(report.Warnings) > 0:
+				t.Errorf("warnings = %q", report.Warnings)
+			case tt.warning != "" && (len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], tt.warning)):
+				t.Errorf("warnings = %q, want %q", report.Warnings, tt.warning)
+			}
+		})
+	}
+	if len(images.Images) != 4 || len(images.Encoded) != 4 {
+		t.Errorf("%d images embedded, %d encoded, want 4", len(images.Images), len(images.Encoded))
+	}
+	if images.embedded("book:image:2") == nil || images.embedded("book:image:5") != nil {
+		t.Errorf("embedded does not match the images of the book")
+	}
+}
+
+func TestEmbedImages(t *testing.T) {
+	dialect := markdownDialect{Extensions: markdownDialects[dialectDefault].Extensions | requiredExtensions}
+	doc := parseMarkdown([]byte("![A cat](../img/cat.png)\n\n![A missing dog](dog.png)\n"), dialect)
+	report := &conversionReport{}
+	cat := encodePNG(t, image.NewGray(image.Rect(0, 0, 3, 3)))
+	images := newBookImages("", []*multipart.FileHeader{uploadedFile(t, "img/cat.png", cat)}, testImageOptions, report)
+	embedImages(doc, "text/book.md", images)
+
+	got := mdToHTML(doc, renderOptions{Dialect: dialect})
+	want := "<p><img src=\"book:image:1\" alt=\"A cat\" /></p>\n\n<p>A missing dog</p>\n"
+	if got != want {
+		t.Errorf("html = %q, want %q", got, want)
+	}
+	if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], `"dog.png"`) {
+		t.Errorf("warnings = %q", report.Warnings)
+	}
+}
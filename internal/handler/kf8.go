@@ -0,0 +1,572 @@
+package handler
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sort"
+	"text/template"
+
+	"github.com/leotaku/mobi"
+	"github.com/leotaku/mobi/pdb"
+	"github.com/leotaku/mobi/records"
+	"github.com/leotaku/mobi/types"
+)
+
+// skeletonTemplate generates the skeleton section of every KF8 chunk. It
+// extends the default template of the mobi package with the language and
+// direction of the book and declares the epub namespace notes are marked
+// up with; it is set explicitly so positions inside the generated text can
+// be computed.
+var skeletonTemplate = template.Must(template.New("skeleton").Funcs(template.FuncMap{
+	"inc":    func(i int) int { return i + 1 },
+	"base32": records.To32,
+	"rtl":    isRTL,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{ .Mobi.Language }}"{{ if rtl .Mobi.Language }} dir="rtl"{{ end }}>
+  <head>
+    <title>{{ .Mobi.Title | html }}</title>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+    {{- range $i, $_ := .Mobi.CSSFlows }}
+    <link rel="stylesheet" type="text/css" href="kindle:flow:{{ $i | inc | base32 }}?mime=text/css"/>
+    {{- end }}
+  </head>
+  <body aid="{{ .Chunk.ID | base32 }}"{{ if rtl .Mobi.Language }} dir="rtl"{{ end }}>
+  </body>
+</html>`))
+
+// writeAZW3 writes the book to w as AZW3.
+func writeAZW3(w io.Writer, b book) error {
+	// Fonts follow the images in the resources of the book
+	refs := bookRefs{
+		Image: func(n int) string {
+			return fmt.Sprintf("kindle:embed:%s?mime=%s", records.To32(n), b.Encoded[n-1].MIME)
+		},
+		Font: func(n int) string {
+			return fmt.Sprintf("kindle:embed:%s?mime=%s", records.To32(len(b.Encoded)+n), b.Fonts[n-1].MIME)
+		},
+		// Links to chapters are resolved with the links to ids below
+		Chapter: chapterRef,
+	}
+	chapters := make([]chapter, len(b.Chapters))
+	copy(chapters, b.Chapters)
+	for i := range chapters {
+		chapters[i].HTML = refs.replace(chapters[i].HTML)
+	}
+	resolvePositions(chapters)
+	stylesheets := make([]string, len(b.Stylesheets))
+	for i, css := range b.Stylesheets {
+		stylesheets[i] = refs.replace(css)
+	}
+
+	// The mobi package only stores images, so every font takes the place
+	// of a blank one that is replaced once the book is realized
+	images := append([]image.Image{}, b.Images...)
+	for range b.Fonts {
+		images = append(images, image.NewGray(image.Rect(0, 0, 1, 1)))
+	}
+
+	book := mobi.Book{
+		Title:         b.Meta.Title,
+		Authors:       b.Meta.Authors,
+		Publisher:     b.Meta.Publisher,
+		CreatedDate:   b.Created,
+		PublishedDate: b.Meta.Date,
+		Language:      b.Language,
+		UniqueID:      b.UID,
+		RightToLeft:   b.RTL,
+		CSSFlows:      stylesheets,
+		Images:        images,
+		CoverImage:    b.Cover,
+	}
+	book.OverrideTemplate(*skeletonTemplate)
+	for _, chap := range chapters {
+		book.Chapters = append(book.Chapters, mobi.Chapter{
+			Title:  chap.Title,
+			Chunks: mobi.Chunks(chap.HTML),
+		})
+	}
+
+	db := book.Realize()
+	if err := writeEXTH(&db, b.Meta); err != nil {
+		return fmt.Errorf("write metadata: %w", err)
+	}
+	if err := writeImages(&db, b.Encoded); err != nil {
+		return fmt.Errorf("write images: %w", err)
+	}
+	if err := writeFonts(&db, len(b.Encoded), b.Fonts); err != nil {
+		return fmt.Errorf("write fonts: %w", err)
+	}
+	if b.Cover != nil {
+		if err := writeCoverImage(&db, book, b.CoverJPEG); err != nil {
+			return fmt.Errorf("write cover: %w", err)
+		}
+	}
+	if err := writeNCX(&db, book, chapters, b.TOC); err != nil {
+		return fmt.Errorf("write table of contents: %w", err)
+	}
+	if err := writeGuide(&db, book, b.Start, b.Contents); err != nil {
+		return fmt.Errorf("write guide: %w", err)
+	}
+	return db.Write(w)
+}
+
+// skeletonInventory mirrors the data the mobi package passes to the
+// skeleton template.
+type skeletonInventory struct {
+	Mobi    mobi.Book
+	Chapter struct {
+		Title string
+		ID    int
+	}
+	Chunk struct {
+		ID int
+	}
+}
+
+// kf8Layout describes where the chapters end up in the KF8 text flow.
+type kf8Layout struct {
+	// ChapterStarts holds the position of each chapter, skeleton included.
+	ChapterStarts []int
+	// ContentStarts holds the position of the first chunk body of each chapter.
+	ContentStarts []int
+	// TextLength is the length of the whole text flow without stylesheets.
+	TextLength int
+}
+
+// layoutKF8 computes the text positions mobi.Book.Realize assigns to the
+// chapters of book when it uses skeletonTemplate.
+func layoutKF8(book mobi.Book) (kf8Layout, error) {
+	var layout kf8Layout
+	pos, chunkID := 0, 0
+	for chapID, chap := range book.Chapters {
+		layout.ChapterStarts = append(layout.ChapterStarts, pos)
+		layout.ContentStarts = append(layout.ContentStarts, pos)
+		for i, chunk := range chap.Chunks {
+			var inv skeletonInventory
+			inv.Mobi = book
+			inv.Chapter.Title = chap.Title
+			inv.Chapter.ID = chapID
+			inv.Chunk.ID = chunkID
+
+			var head bytes.Buffer
+			if err := skeletonTemplate.Execute(&head, inv); err != nil {
+				return kf8Layout{}, fmt.Errorf("execute skeleton template: %w", err)
+			}
+			if i == 0 {
+				layout.ContentStarts[chapID] = pos + head.Len()
+			}
+			pos += head.Len() + len(chunk.Body)
+			chunkID++
+		}
+	}
+	layout.TextLength = pos
+	return layout, nil
+}
+
+// writeEXTH adds the metadata the mobi package has no fields for to the
+// EXTH header of the book.
+func writeEXTH(db *pdb.Database, meta bookMetadata) error {
+	null, ok := db.Records[0].(records.NullRecord)
+	if !ok {
+		return fmt.Errorf("unexpected first record %T", db.Records[0])
+	}
+	null.EXTHSection.AddString(types.EXTHDescription, meta.Description)
+	null.EXTHSection.AddString(types.EXTHSubject, meta.Subjects...)
+	db.ReplaceRecord(0, null)
+	return nil
+}
+
+// writeImages stores the embedded images as encoded by bookImages, as the
+// mobi package always encodes them as JPEG at the default quality.
+func writeImages(db *pdb.Database, images []encodedImage) error {
+	null, ok := db.Records[0].(records.NullRecord)
+	if !ok {
+		return fmt.Errorf("unexpected first record %T", db.Records[0])
+	}
+	for i, img := range images {
+		db.ReplaceRecord(int(null.MOBIHeader.FirstImageIndex)+i, pdb.RawRecord(img.Data))
+	}
+	return nil
+}
+
+// writeFonts stores the fonts of the book in the resource records that
+// follow the first images.
+func writeFonts(db *pdb.Database, images int, fonts []embeddedFont) error {
+	null, ok := db.Records[0].(records.NullRecord)
+	if !ok {
+		return fmt.Errorf("unexpected first record %T", db.Records[0])
+	}
+	for i, font := range fonts {
+		record, err := fontRecord(font.Data)
+		if err != nil {
+			return err
+		}
+		db.ReplaceRecord(int(null.MOBIHeader.FirstImageIndex)+images+i, record)
+	}
+	return nil
+}
+
+// fontRecord packs a font into a KF8 font resource: a header giving the
+// size and layout of the data, followed by the zlib compressed font.
+func fontRecord(data []byte) (pdb.RawRecord, error) {
+	var compressed bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("compress font: %w", err)
+	}
+	if _, err = zw.Write(data); err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("compress font: %w", err)
+	}
+
+	const headerSize = 24
+	header := make([]byte, headerSize)
+	copy(header, "FONT")
+	pdb.Endian.PutUint32(header[4:], uint32(len(data)))
+	pdb.Endian.PutUint32(header[8:], 1) // compressed, not obfuscated
+	pdb.Endian.PutUint32(header[12:], headerSize)
+	pdb.Endian.PutUint32(header[16:], 0) // no obfuscation key
+	pdb.Endian.PutUint32(header[20:], headerSize)
+	return append(header, compressed.Bytes()...), nil
+}
+
+// writeCoverImage stores the cover of the book as the given JPEG, as the
+// mobi package always encodes it at the default quality.
+func writeCoverImage(db *pdb.Database, book mobi.Book, jpeg []byte) error {
+	null, ok := db.Records[0].(records.NullRecord)
+	if !ok {
+		return fmt.Errorf("unexpected first record %T", db.Records[0])
+	}
+	db.ReplaceRecord(int(null.MOBIHeader.FirstImageIndex)+len(book.Images), pdb.RawRecord(jpeg))
+	return nil
+}
+
+// ncxEntry is a flattened entry of the hierarchical NCX index.
+type ncxEntry struct {
+	title    string
+	offset   int
+	length   int
+	depth    int
+	parent   *ncxEntry
+	children []*ncxEntry
+}
+
+// ncxTAGXTable describes the tags of a hierarchical NCX index entry.
+var ncxTAGXTable = types.TAGXTagTable{
+	types.TAGXTagEntryPosition,
+	types.TAGXTagEntryLength,
+	types.TAGXTagEntryNameOffset,
+	types.TAGXTagEntryDepthLevel,
+	types.TAGXTagEntryParent,
+	types.TAGXTagEntryChild1,
+	types.TAGXTagEntryChildN,
+	types.TAGXTagEnd,
+}
+
+// writeNCX replaces the flat NCX index that mobi.Book.Realize generates
+// with a hierarchical one built from toc. The book must have been realized
+// with skeletonTemplate.
+func writeNCX(db *pdb.Database, book mobi.Book, chapters []chapter, toc []*tocEntry) error {
+	null, ok := db.Records[0].(records.NullRecord)
+	if !ok {
+		return fmt.Errorf("unexpected first record %T", db.Records[0])
+	}
+	layout, err := layoutKF8(book)
+	if err != nil {
+		return err
+	}
+
+	// Flatten the tree, resolving every entry to its text position
+	var entries []*ncxEntry
+	var flatten func(nodes []*tocEntry, parent *ncxEntry, depth int)
+	flatten = func(nodes []*tocEntry, parent *ncxEntry, depth int) {
+		for _, node := range nodes {
+			entry := &ncxEntry{
+				title:  node.Title,
+				offset: tocEntryOffset(node, chapters, layout),
+				depth:  depth,
+				parent: parent,
+			}
+			entries = append(entries, entry)
+			if parent != nil {
+				parent.children = append(parent.children, entry)
+			}
+			flatten(node.Children, entry, depth+1)
+		}
+	}
+	flatten(toc, nil, 0)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Kindle expects the entries sorted by depth, then by position
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].depth != entries[j].depth {
+			return entries[i].depth < entries[j].depth
+		}
+		return entries[i].offset < entries[j].offset
+	})
+	index := make(map[*ncxEntry]int, len(entries))
+	for i, entry := range entries {
+		index[entry] = i
+	}
+
+	titles := make([]string, len(entries))
+	for i, entry := range entries {
+		titles[i] = entry.title
+	}
+	cncx, offsets := cncxRecords(titles)
+
+	// Labels are compared as strings, so they must all be as wide
+	width := max(3, len(fmt.Sprintf("%x", len(entries)-1)))
+	labels := make([]string, len(entries))
+	var idxt [][]byte
+	for i, entry := range entries {
+		entry.length = layout.TextLength - entry.offset
+		for _, other := range entries {
+			if other.depth <= entry.depth && other.offset > entry.offset && other.offset-entry.offset < entry.length {
+				entry.length = other.offset - entry.offset
+			}
+		}
+
+		control := types.CBNCXSingle
+		values := [][]byte{
+			encodeVWI(entry.offset),
+			encodeVWI(entry.length),
+			encodeVWI(offsets[i]),
+			encodeVWI(entry.depth),
+		}
+		if entry.parent != nil {
+			control |= 0x10
+			values = append(values, encodeVWI(index[entry.parent]))
+		}
+		if len(entry.children) > 0 {
+			control |= 0x60
+			values = append(values,
+				encodeVWI(index[entry.children[0]]),
+				encodeVWI(index[entry.children[len(entry.children)-1]]),
+			)
+		}
+
+		labels[i] = fmt.Sprintf("%0*x", width, i)
+		raw := append([]byte{byte(len(labels[i]))}, labels[i]...)
+		raw = append(raw, control)
+		for _, v := range values {
+			raw = append(raw, v...)
+		}
+		idxt = append(idxt, raw)
+	}
+
+	// The index realized with the book takes a header, an entries and a
+	// CNCX record, the others go after them
+	headerIdx := int(null.MOBIHeader.INDXRecordOffset)
+	recs, header := indexRecords(idxt, labels)
+	db.ReplaceRecord(headerIdx, records.IndexRecord{
+		TAGXTable:     ncxTAGXTable,
+		Type:          2,
+		IDXTEntries:   header,
+		SubEntryCount: uint32(len(entries)),
+		CNCXCount:     uint32(len(cncx)),
+	})
+	recs = append(recs, cncx...)
+	db.ReplaceRecord(headerIdx+1, recs[0])
+	db.ReplaceRecord(headerIdx+2, recs[1])
+	for i, rec := range recs[2:] {
+		insertRecord(db, &null, headerIdx+3+i, rec)
+	}
+	db.ReplaceRecord(0, null)
+	return nil
+}
+
+// writeGuide adds the guide index to the book, pointing Kindle readers at
+// the chapter reading starts at, which "Go to Beginning" leads to, and at
+// the contents page at index contents, if it is not negative. Kindle
+// readers take the cover from the EXTH header, so the guide leaves it
+// out. The book must have been realized with skeletonTemplate.
+func writeGuide(db *pdb.Database, book mobi.Book, start, contents int) error {
+	null, ok := db.Records[0].(records.NullRecord)
+	if !ok {
+		return fmt.Errorf("unexpected first record %T", db.Records[0])
+	}
+	if len(book.Chapters) == 0 {
+		return nil
+	}
+	layout, err := layoutKF8(book)
+	if err != nil {
+		return err
+	}
+
+	// Kindle expects the entries sorted by type
+	type guideRef struct {
+		kind    string
+		chapter int
+	}
+	refs := []guideRef{{kind: "text", chapter: start}}
+	if contents >= 0 {
+		refs = append(refs, guideRef{kind: "toc", chapter: contents})
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].kind < refs[j].kind })
+
+	titles := make([]string, len(refs))
+	for i, ref := range refs {
+		titles[i] = book.Chapters[ref.chapter].Title
+	}
+	cncx, offsets := cncxRecords(titles)
+
+	var idxt [][]byte
+	labels := make([]string, len(refs))
+	for i, ref := range refs {
+		labels[i] = ref.kind
+		// Every chapter is a single chunk, so the chunk id of its start is
+		// the chapter index
+		raw := append([]byte{byte(len(ref.kind))}, ref.kind...)
+		raw = append(raw, 0x03)
+		raw = append(raw, encodeVWI(offsets[i])...)
+		raw = append(raw, encodeVWI(ref.chapter)...)
+		raw = append(raw, encodeVWI(0)...)
+		idxt = append(idxt, raw)
+	}
+
+	recs, header := indexRecords(idxt, labels)
+
+	// The index goes before the end of file record, so the records the
+	// header points at keep their place
+	eof := db.Records[len(db.Records)-1]
+	db.Records = db.Records[:len(db.Records)-1]
+	null.MOBIHeader.GuideIndex = uint32(db.AddRecord(records.IndexRecord{
+		TAGXTable:     types.TAGXTableGuide,
+		Type:          2,
+		IDXTEntries:   header,
+		SubEntryCount: uint32(len(refs)),
+		CNCXCount:     uint32(len(cncx)),
+	}))
+	for _, rec := range recs {
+		db.AddRecord(rec)
+	}
+	for _, rec := range cncx {
+		db.AddRecord(rec)
+	}
+	db.AddRecord(eof)
+
+	null.EXTHSection.AddInt(types.EXTHStartReading, layout.ContentStarts[start])
+	db.ReplaceRecord(0, null)
+	return nil
+}
+
+// tocEntryOffset returns the text position a navigation entry points at.
+func tocEntryOffset(entry *tocEntry, chapters []chapter, layout kf8Layout) int {
+	if entry.ID == "" {
+		return layout.ChapterStarts[entry.Chapter]
+	}
+	offset := idOffset(chapters[entry.Chapter].HTML, entry.ID)
+	if offset < 0 {
+		return layout.ChapterStarts[entry.Chapter]
+	}
+	return layout.ContentStarts[entry.Chapter] + offset
+}
+
+// indexRecordSize is the most the entries of an index record may take
+// with their offsets, leaving room for its header and padding within the
+// 64 KiB records are limited to.
+const indexRecordSize = 0x10000 - 0x100
+
+// indexRecords packs the given entries into index records, starting a new
+// record where an entry would not fit the current one. It returns the
+// records and the entries of the index header describing them: the label
+// of the last entry of every record, given by labels, and their count.
+func indexRecords(idxt [][]byte, labels []string) ([]pdb.Record, [][]byte) {
+	var recs []pdb.Record
+	var header [][]byte
+	first, size := 0, 0
+	flush := func(end int) {
+		recs = append(recs, records.IndexRecord{
+			Type:        0,
+			HeaderType:  1,
+			IDXTEntries: idxt[first:end],
+		})
+		last := labels[end-1]
+		entry := append([]byte{byte(len(last))}, last...)
+		count := make([]byte, 5)
+		pdb.Endian.PutUint16(count, uint16(end-first))
+		header = append(header, append(entry, count...))
+		first, size = end, 0
+	}
+	for i, raw := range idxt {
+		if i > first && size+len(raw)+2 > indexRecordSize {
+			flush(i)
+		}
+		// Every entry takes its offset in the IDXT as well
+		size += len(raw) + 2
+	}
+	flush(len(idxt))
+	return recs, header
+}
+
+// cncxRecordSize is the most a CNCX record may hold, leaving room for the
+// padding within the 64 KiB records are limited to.
+const cncxRecordSize = 0x10000 - 4
+
+// cncxRecords packs the given strings into padded CNCX records, starting a
+// new record where a string would not fit the current one. It returns the
+// records and the offset of every string, which carries the number of its
+// record in the upper 16 bits.
+func cncxRecords(strs []string) ([]pdb.Record, []int) {
+	var recs []pdb.Record
+	var buf []byte
+	offsets := make([]int, len(strs))
+	for i, str := range strs {
+		entry := append(encodeVWI(len(str)), str...)
+		if len(buf) > 0 && len(buf)+len(entry) > cncxRecordSize {
+			recs = append(recs, padRecord(buf))
+			buf = nil
+		}
+		offsets[i] = len(recs)<<16 | len(buf)
+		buf = append(buf, entry...)
+	}
+	return append(recs, padRecord(buf)), offsets
+}
+
+// padRecord pads buf to a multiple of four bytes.
+func padRecord(buf []byte) pdb.RawRecord {
+	return append(buf, make([]byte, (4-len(buf)%4)%4)...)
+}
+
+// insertRecord inserts rec into db at index i, and moves the indices of
+// the records following it in the header of null along.
+func insertRecord(db *pdb.Database, null *records.NullRecord, i int, rec pdb.Record) {
+	db.Records = append(db.Records[:i], append([]pdb.Record{rec}, db.Records[i:]...)...)
+	header := &null.MOBIHeader
+	for _, index := range []*uint32{
+		&header.FirstNonBookIndex, &header.FirstImageIndex, &header.INDXRecordOffset,
+		&header.FCISRecordNumber, &header.FLISRecordNumber,
+		&header.ChunkIndex, &header.SkeletonIndex, &header.GuideIndex,
+	} {
+		if *index != math.MaxUint32 && *index >= uint32(i) {
+			*index++
+		}
+	}
+	if int(header.LastContentRecordNumberOrFDSTNumberLSB) >= i {
+		header.LastContentRecordNumberOrFDSTNumberLSB++
+	}
+}
+
+// encodeVWI encodes x as a forward variable width integer, the last byte
+// carrying the stop bit.
+func encodeVWI(x int) []byte {
+	var buf []byte
+	for {
+		buf = append([]byte{byte(x) & 0x7f}, buf...)
+		x >>= 7
+		if x == 0 {
+			break
+		}
+	}
+	buf[len(buf)-1] |= 0x80
+	return buf
+}
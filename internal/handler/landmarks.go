@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// contentsClass marks the list of the generated contents page.
+const contentsClass = "contents"
+
+// pageTitles are the titles of the pages the converter adds to a book, in
+// the language of the book.
+type pageTitles struct {
+	Contents string
+	Cover    string
+	Notes    string
+	Links    string
+}
+
+// englishTitles are the page titles of books in languages without titles
+// of their own.
+var englishTitles = pageTitles{Contents: "Contents", Cover: "Cover", Notes: "Notes", Links: "Links"}
+
+// pageTitlesFor returns the page titles of a book in the given language.
+func pageTitlesFor(tag language.Tag) pageTitles {
+	base, _ := tag.Base()
+	region, _ := tag.Region()
+	switch base.String() {
+	case "de":
+		return pageTitles{Contents: "Inhalt", Cover: "Umschlag", Notes: "Anmerkungen", Links: "Links"}
+	case "fr":
+		return pageTitles{Contents: "Table des matières", Cover: "Couverture", Notes: "Notes", Links: "Liens"}
+	case "es":
+		return pageTitles{Contents: "Índice", Cover: "Cubierta", Notes: "Notas", Links: "Enlaces"}
+	case "it":
+		return pageTitles{Contents: "Indice", Cover: "Copertina", Notes: "Note", Links: "Collegamenti"}
+	case "pt":
+		if region.String() == "BR" {
+			return pageTitles{Contents: "Sumário", Cover: "Capa", Notes: "Notas", Links: "Links"}
+		}
+		return pageTitles{Contents: "Índice", Cover: "Capa", Notes: "Notas", Links: "Ligações"}
+	case "nl":
+		return pageTitles{Contents: "Inhoud", Cover: "Omslag", Notes: "Noten", Links: "Links"}
+	case "da":
+		return pageTitles{Contents: "Indhold", Cover: "Omslag", Notes: "Noter", Links: "Links"}
+	case "nb", "nn", "no":
+		return pageTitles{Contents: "Innhold", Cover: "Omslag", Notes: "Noter", Links: "Lenker"}
+	case "sv":
+		return pageTitles{Contents: "Innehåll", Cover: "Omslag", Notes: "Noter", Links: "Länkar"}
+	case "pl":
+		return pageTitles{Contents: "Spis treści", Cover: "Okładka", Notes: "Przypisy", Links: "Linki"}
+	case "ru":
+		return pageTitles{Contents: "Содержание", Cover: "Обложка", Notes: "Примечания", Links: "Ссылки"}
+	case "uk":
+		return pageTitles{Contents: "Зміст", Cover: "Обкладинка", Notes: "Примітки", Links: "Посилання"}
+	case "tr":
+		return pageTitles{Contents: "İçindekiler", Cover: "Kapak", Notes: "Notlar", Links: "Bağlantılar"}
+	case "fa":
+		return pageTitles{Contents: "فهرست مطالب", Cover: "جلد", Notes: "یادداشت‌ها", Links: "پیوندها"}
+	case "ar":
+		return pageTitles{Contents: "المحتويات", Cover: "الغلاف", Notes: "الحواشي", Links: "الروابط"}
+	case "he":
+		return pageTitles{Contents: "תוכן העניינים", Cover: "כריכה", Notes: "הערות", Links: "קישורים"}
+	}
+	return englishTitles
+}
+
+// startChapter returns the chapter reading starts at: the first one past
+// the title matter, or the first chapter if all of them are title matter.
+func startChapter(chapters []chapter) int {
+	for i, chap := range chapters {
+		if !chap.Front {
+			return i
+		}
+	}
+	return 0
+}
+
+// addContentsPage inserts a page with the given title listing the entries
+// of toc after the title matter of the book, and an entry for the page
+// itself into toc. Without entries every chapter is listed and becomes an
+// entry. It returns the chapters and entries with the following chapters
+// renumbered, and the index of the page. The page counts as title matter,
+// so reading starts after it.
+func addContentsPage(chapters []chapter, toc []*tocEntry, title string) ([]chapter, []*tocEntry, int) {
+	at := startChapter(chapters)
+	listed := toc
+	if len(listed) == 0 {
+		for i, chap := range chapters {
+			listed = append(listed, &tocEntry{Title: chap.Title, Chapter: i})
+		}
+	}
+
+	// Shift the chapters following the page, and the links to them
+	shifted := make([]chapter, 0, len(chapters)+1)
+	for _, chap := range chapters {
+		chap.HTML = bookRef.ReplaceAllStringFunc(chap.HTML, func(ref string) string {
+			m := bookRef.FindStringSubmatch(ref)
+			n, _ := strconv.Atoi(m[2])
+			if m[1] != "chapter" || n < at {
+				return ref
+			}
+			return chapterRef(n + 1)
+		})
+		shifted = append(shifted, chap)
+	}
+	var shift func(entries []*tocEntry)
+	shift = func(entries []*tocEntry) {
+		for _, entry := range entries {
+			if entry.Chapter >= at {
+				entry.Chapter++
+			}
+			shift(entry.Children)
+		}
+	}
+	shift(listed)
+
+	page := chapter{Title: title, HTML: contentsHTML(listed, title), Level: 1, Front: true}
+	shifted = append(shifted[:at], append([]chapter{page}, shifted[at:]...)...)
+
+	entry := &tocEntry{Title: title, Chapter: at}
+	pos := len(listed)
+	for i, e := range listed {
+		if e.Chapter > at {
+			pos = i
+			break
+		}
+	}
+	return shifted, append(listed[:pos], append([]*tocEntry{entry}, listed[pos:]...)...), at
+}
+
+// contentsHTML renders the entries of toc as nested lists of links under
+// the heading title.
+func contentsHTML(toc []*tocEntry, title string) string {
+	var sb strings.Builder
+	sb.WriteString("<h1>" + html.EscapeString(title) + "</h1>\n")
+	var list func(entries []*tocEntry, class string)
+	list = func(entries []*tocEntry, class string) {
+		if class != "" {
+			sb.WriteString(`<ul class="` + class + `">` + "\n")
+		} else {
+			sb.WriteString("<ul>\n")
+		}
+		for _, entry := range entries {
+			href := chapterRef(entry.Chapter)
+			if entry.ID != "" {
+				href += "#" + entry.ID
+			}
+			fmt.Fprintf(&sb, `<li><a href="%s">%s</a>`, html.EscapeString(href), html.EscapeString(entry.Title))
+			if len(entry.Children) > 0 {
+				sb.WriteString("\n")
+				list(entry.Children, "")
+			}
+			sb.WriteString("</li>\n")
+		}
+		sb.WriteString("</ul>\n")
+	}
+	list(toc, contentsClass)
+	return sb.String()
+}
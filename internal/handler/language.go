@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"golang.org/x/text/language"
+
+	"github.com/Amin-MAG/md2azw3/internal/langdetect"
+)
+
+// detectSampleSize caps the amount of text language detection looks at.
+const detectSampleSize = 64 << 10
+
+// parseLanguage parses a BCP 47 language tag such as "en", "de-AT" or "fa-IR".
+func parseLanguage(tag string) (language.Tag, error) {
+	t, err := language.Parse(tag)
+	if err != nil {
+		return language.Und, fmt.Errorf("invalid language %q: expected a BCP 47 tag such as \"en\" or \"fa-IR\"", tag)
+	}
+	return t, nil
+}
+
+// detectLanguage guesses the language of the book from the prose of its
+// documents. Code is left out as it would skew the guess towards English.
+func detectLanguage(docs []sourceDoc, dialect markdownDialect) (language.Tag, bool) {
+	var sb strings.Builder
+	for _, d := range docs {
+		if d.HTML {
+			sb.WriteString(nodeText(htmlBody(d)))
+			sb.WriteByte(' ')
+			continue
+		}
+		ast.WalkFunc(parseMarkdown(d.Source, dialect), func(node ast.Node, entering bool) ast.WalkStatus {
+			if sb.Len() >= detectSampleSize {
+				return ast.Terminate
+			}
+			switch n := node.(type) {
+			case *ast.Text:
+				sb.Write(n.Literal)
+			case *ast.Softbreak, *ast.Hardbreak, *ast.Paragraph, *ast.Heading:
+				sb.WriteByte(' ')
+			}
+			return ast.GoToNext
+		})
+		if sb.Len() >= detectSampleSize {
+			break
+		}
+	}
+	return langdetect.Detect(sb.String())
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	dialect := markdownDialect{Extensions: markdownDialects[dialectDefault].Extensions | requiredExtensions}
+	german := "Der schnelle braune Fuchs springt über den faulen Hund, und das ist nicht die Geschichte des Fuchses.\n"
+	code := "```go\n" + strings.Repeat("// the function returns the value of the thing and it is for this\n", 30) + "```\n"
+	tests := []struct {
+		name string
+		docs []sourceDoc
+		want string
+	}{
+		{
+			name: "markdown",
+			docs: []sourceDoc{{Path: "a.md", Source: []byte("# Einleitung\n\n" + german)}},
+			want: "de",
+		},
+		{
+			name: "code left out",
+			docs: []sourceDoc{{Path: "a.md", Source: []byte(german + "\n" + code + "\n    the code of the indented block is for this and that\n")}},
+			want: "de",
+		},
+		{
+			name: "HTML",
+			docs: []sourceDoc{{Path: "a.html", HTML: true, Source: []byte("<html><head><title>The</title><script>var the = this</script></head><body><p>" + german + "</p></body></html>")}},
+			want: "de",
+		},
+		{
+			name: "all documents",
+			docs: []sourceDoc{
+				{Path: "a.md", Source: []byte("# Kapitel\n")},
+				{Path: "b.md", Source: []byte(german)},
+			},
+			want: "de",
+		},
+		{
+			name: "too little text",
+			docs: []sourceDoc{{Path: "a.md", Source: []byte("# Hallo\n\n" + code)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := detectLanguage(tt.docs, dialect)
+			switch {
+			case tt.want == "" && ok:
+				t.Errorf("detectLanguage = %v, want no guess", got)
+			case tt.want != "" && (!ok || got.String() != tt.want):
+				t.Errorf("detectLanguage = %v, %v, want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLanguage(t *testing.T) {
+	for _, tag := range []string{"en", "de-AT", "fa-IR", "pt_BR", "zh-Hant"} {
+		if _, err := parseLanguage(tag); err != nil {
+			t.Errorf("parseLanguage(%q) error: %v", tag, err)
+		}
+	}
+	for _, tag := range []string{"english please", "x", "en-"} {
+		if _, err := parseLanguage(tag); err == nil {
+			t.Errorf("parseLanguage(%q) accepted", tag)
+		}
+	}
+
+	rec := convertRequest(t, testConfig(), map[string]string{"language": "english please"}, map[string]archiveEntry{
+		"markdown": {name: "a.md", body: "# A\n"},
+	})
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "BCP 47") {
+		t.Errorf("response = %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	mdhtml "github.com/gomarkdown/markdown/html"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Link handling modes.
+const (
+	// linksKeep leaves external links as they are.
+	linksKeep = "keep"
+	// linksText strips external links down to their text.
+	linksText = "text"
+	// linksChapter replaces external links with numbered references,
+	// their addresses listed at the end of the chapter and numbered per
+	// chapter.
+	linksChapter = "chapter"
+	// linksBook lists the addresses of the whole book in a final chapter,
+	// numbered through the book.
+	linksBook = "book"
+)
+
+// externalSchemes are the schemes of the links that lead out of the book.
+var externalSchemes = map[string]bool{"http": true, "https": true, "ftp": true, "mailto": true}
+
+// isExternalLink reports whether dest leads out of the book.
+func isExternalLink(dest string) bool {
+	u, err := url.Parse(strings.TrimSpace(dest))
+	return err == nil && externalSchemes[strings.ToLower(u.Scheme)]
+}
+
+// linkRef is an external address referenced from the book.
+type linkRef struct {
+	// ID numbers the addresses through the book for their element ids.
+	ID int
+	// Number is the number shown for the address.
+	Number string
+	URL    string
+}
+
+// linkRefs numbers the external links of the book as they are rendered,
+// since e-ink readers cannot follow them, and lists their addresses.
+type linkRefs struct {
+	mode  string
+	zero  rune
+	count int
+	// refs maps the addresses numbered so far to their references. In
+	// chapter mode it only holds those of the current chapter.
+	refs map[string]*linkRef
+	// pending lists the addresses of the current chapter not listed yet.
+	pending []*linkRef
+	// chapterCount numbers the addresses of the current chapter.
+	chapterCount int
+	// sections holds the listed addresses of every chapter in book mode.
+	sections []noteSection
+}
+
+// newLinkRefs creates a linkRefs for the given mode.
+func newLinkRefs(mode string, zero rune) *linkRefs {
+	return &linkRefs{mode: mode, zero: zero, refs: make(map[string]*linkRef)}
+}
+
+// numbered reports whether links are replaced with numbered references.
+func (l *linkRefs) numbered() bool {
+	return l.mode == linksChapter || l.mode == linksBook
+}
+
+// ref returns the markup of a reference to dest, numbering the address on
+// its first reference. Later references to the same address repeat its
+// number.
+func (l *linkRefs) ref(dest string) string {
+	link, ok := l.refs[dest]
+	if ok {
+		return fmt.Sprintf(`<sup><a class="linkref" href="#%s">[%s]</a></sup>`, linkID(link), link.Number)
+	}
+
+	l.count++
+	l.chapterCount++
+	number := l.chapterCount
+	if l.mode == linksBook {
+		number = l.count
+	}
+	link = &linkRef{ID: l.count, Number: strconv.Itoa(number), URL: dest}
+	if l.zero != 0 {
+		link.Number = localizeDigits(link.Number, l.zero)
+	}
+	l.refs[dest] = link
+	l.pending = append(l.pending, link)
+	return fmt.Sprintf(`<sup><a class="linkref" href="#%s" id="%s">[%s]</a></sup>`, linkID(link), linkRefID(link), link.Number)
+}
+
+// renderLink returns whether the markdown renderer should skip writing a
+// link, and what to write in its place when leaving it.
+func (l *linkRefs) renderLink(link *ast.Link, entering bool) (string, bool) {
+	if l == nil || l.mode == linksKeep || !isExternalLink(string(link.Destination)) {
+		return "", false
+	}
+	if l.numbered() && len(link.Children) == 1 && isBareLink(link) {
+		// The address is already there to read
+		return "", false
+	}
+	if !entering && l.numbered() {
+		return l.ref(string(link.Destination)), true
+	}
+	return "", true
+}
+
+// replaceHTML strips or numbers the external links of HTML nodes, like
+// the markdown renderer does.
+func (l *linkRefs) replaceHTML(nodes []*html.Node) {
+	if l == nil || l.mode == linksKeep {
+		return
+	}
+	var links []*html.Node
+	for _, n := range nodes {
+		walkElements(n, func(e *html.Node) {
+			if e.DataAtom == atom.A && e.Namespace == "" && isExternalLink(attr(e, "href")) {
+				links = append(links, e)
+			}
+		})
+	}
+
+	for _, a := range links {
+		href := strings.TrimSpace(attr(a, "href"))
+		if l.numbered() && nodeText(a) == strings.TrimPrefix(href, "mailto:") {
+			continue
+		}
+		parent := a.Parent
+		if parent == nil {
+			continue
+		}
+		for c := a.FirstChild; c != nil; c = a.FirstChild {
+			a.RemoveChild(c)
+			parent.InsertBefore(c, a)
+		}
+		if l.numbered() {
+			marker, err := html.ParseFragment(strings.NewReader(l.ref(href)), parent)
+			if err == nil {
+				for _, m := range marker {
+					parent.InsertBefore(m, a)
+				}
+			}
+		}
+		if id := attr(a, "id"); id != "" {
+			// Keep the anchor links may point at
+			span := &html.Node{Type: html.ElementNode, Data: "span", DataAtom: atom.Span,
+				Attr: []html.Attribute{{Key: "id", Val: id}}}
+			parent.InsertBefore(span, a)
+		}
+		parent.RemoveChild(a)
+	}
+}
+
+// finishChapter lists the addresses referenced by the chapter just
+// rendered. In chapter mode it returns them to be appended to the
+// chapter, in book mode they are kept for the links chapter.
+func (l *linkRefs) finishChapter(title string) string {
+	var sb strings.Builder
+	for _, link := range l.pending {
+		var text bytes.Buffer
+		mdhtml.EscapeHTML(&text, []byte(strings.TrimPrefix(link.URL, "mailto:")))
+		var href bytes.Buffer
+		mdhtml.EscapeHTML(&href, []byte(link.URL))
+		fmt.Fprintf(&sb, "<p class=\"link\" id=\"%s\"><a class=\"linkback\" href=\"#%s\">[%s]</a> <a href=\"%s\">%s</a></p>\n",
+			linkID(link), linkRefID(link), link.Number, href.String(), text.String())
+	}
+	l.pending = nil
+	l.chapterCount = 0
+	if l.mode == linksChapter {
+		l.refs = make(map[string]*linkRef)
+	}
+
+	if sb.Len() == 0 {
+		return ""
+	}
+	if l.mode == linksBook {
+		l.sections = append(l.sections, noteSection{Title: title, HTML: sb.String()})
+		return ""
+	}
+	return "<div class=\"links\">\n<hr/>\n" + sb.String() + "</div>\n"
+}
+
+// linksChapter returns the chapter listing the addresses of the book in
+// book mode under title, with a subheading per chapter when they come from
+// several.
+func (l *linkRefs) linksChapter(title string) (chapter, bool) {
+	if len(l.sections) == 0 {
+		return chapter{}, false
+	}
+	var sb strings.Builder
+	var heading bytes.Buffer
+	mdhtml.EscapeHTML(&heading, []byte(title))
+	sb.WriteString("<h1>" + heading.String() + "</h1>\n<div class=\"links\">\n")
+	for _, sec := range l.sections {
+		if len(l.sections) > 1 {
+			var title bytes.Buffer
+			mdhtml.EscapeHTML(&title, []byte(sec.Title))
+			sb.WriteString("<h2>" + title.String() + "</h2>\n")
+		}
+		sb.WriteString(sec.HTML)
+	}
+	sb.WriteString("</div>\n")
+	return chapter{Title: title, HTML: sb.String(), Level: 1}, true
+}
+
+// linkID returns the element id of a listed address.
+func linkID(link *linkRef) string {
+	return fmt.Sprintf("link_%d", link.ID)
+}
+
+// linkRefID returns the element id of the first reference to an address.
+func linkRefID(link *linkRef) string {
+	return fmt.Sprintf("linkref_%d", link.ID)
+}
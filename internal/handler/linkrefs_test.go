@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLinkModes(t *testing.T) {
+	dialect := markdownDialect{Extensions: markdownDialects[dialectDefault].Extensions | requiredExtensions}
+	docs := []sourceDoc{
+		{Path: "a.md", Source: []byte("# One\n\nSee [Go](https://go.dev), [again](https://go.dev), <https://example.com>, " +
+			"[mail](mailto:a@b.c) and [two](#two).\n\n# Two\n\nAlso [Go](https://go.dev) & [x](https://x.org/?a=1&b=2).\n")},
+		{Path: "b.html", HTML: true, Source: []byte(`<h1>Three</h1><p><a href="https://go.dev" id="g">Go</a> <a href="https://go.dev">https://go.dev</a></p>`)},
+	}
+	tests := []struct {
+		name  string
+		mode  string
+		zero  rune
+		want  [][]string
+		links string
+	}{
+		{
+			name: "keep",
+			mode: linksKeep,
+			want: [][]string{
+				{`See <a href="https://go.dev">Go</a>, <a href="https://go.dev">again</a>`, `<a href="mailto:a@b.c">mail</a>`},
+				{`<a href="https://x.org/?a=1&amp;b=2">x</a>`},
+				{`<a href="https://go.dev" id="g">Go</a>`},
+			},
+		},
+		{
+			name: "text",
+			mode: linksText,
+			want: [][]string{
+				// Links within the book stay
+				{`See Go, again, https://example.com, mail and <a href="book:chapter:1#two">two</a>.`},
+				{`Also Go &amp; x.`},
+				{`<p>Go<span id="g"></span> https://go.dev</p>`},
+			},
+		},
+		{
+			name: "chapter",
+			mode: linksChapter,
+			want: [][]string{
+				{
+					`See Go<sup><a class="linkref" href="#link_1" id="linkref_1">[1]</a></sup>`,
+					`again<sup><a class="linkref" href="#link_1">[1]</a></sup>`,
+					// Bare links already show their address
+					`<a href="https://example.com">https://example.com</a>`,
+					`mail<sup><a class="linkref" href="#link_2" id="linkref_2">[2]</a></sup>`,
+					"<div class=\"links\">\n<hr/>\n" +
+						"<p class=\"link\" id=\"link_1\"><a class=\"linkback\" href=\"#linkref_1\">[1]</a> <a href=\"https://go.dev\">https://go.dev</a></p>\n" +
+						"<p class=\"link\" id=\"link_2\"><a class=\"linkback\" href=\"#linkref_2\">[2]</a> <a href=\"mailto:a@b.c\">a@b.c</a></p>\n</div>\n",
+				},
+				{
+					// Numbers start over, and addresses are listed again
+					`Go<sup><a class="linkref" href="#link_3" id="linkref_3">[1]</a></sup>`,
+					`<p class="link" id="link_4"><a class="linkback" href="#linkref_4">[2]</a> <a href="https://x.org/?a=1&amp;b=2">https://x.org/?a=1&amp;b=2</a></p>`,
+				},
+				{
+					`Go<sup><a class="linkref" href="#link_5" id="linkref_5">[1]</a></sup><span id="g"></span> <a href="https://go.dev">https://go.dev</a>`,
+					`<p class="link" id="link_5">`,
+				},
+			},
+		},
+		{
+			name: "book",
+			mode: linksBook,
+			want: [][]string{
+				{`See Go<sup><a class="linkref" href="book:chapter:3#link_1" id="linkref_1">[1]</a></sup>`},
+				{
+					// Numbers run through the book, addresses keep theirs
+					`Go<sup><a class="linkref" href="book:chapter:3#link_1">[1]</a></sup>`,
+					`x<sup><a class="linkref" href="book:chapter:3#link_3" id="linkref_3">[3]</a></sup>`,
+				},
+				{`Go<sup><a class="linkref" href="book:chapter:3#link_1">[1]</a></sup><span id="g"></span>`},
+			},
+			links: "<h1>Links</h1>\n<div class=\"links\">\n<h2>One</h2>\n" +
+				"<p class=\"link\" id=\"link_1\"><a class=\"linkback\" href=\"book:chapter:0#linkref_1\">[1]</a> <a href=\"https://go.dev\">https://go.dev</a></p>\n" +
+				"<p class=\"link\" id=\"link_2\"><a class=\"linkback\" href=\"book:chapter:0#linkref_2\">[2]</a> <a href=\"mailto:a@b.c\">a@b.c</a></p>\n" +
+				"<h2>Two</h2>\n" +
+				"<p class=\"link\" id=\"link_3\"><a class=\"linkback\" href=\"book:chapter:1#linkref_3\">[3]</a> <a href=\"https://x.org/?a=1&amp;b=2\">https://x.org/?a=1&amp;b=2</a></p>\n</div>\n",
+		},
+		{
+			name: "native digits",
+			mode: linksBook,
+			zero: '۰',
+			want: [][]string{
+				{`id="linkref_2">[۲]</a></sup>`},
+				{`id="linkref_3">[۳]</a></sup>`},
+				{},
+			},
+			links: `href="book:chapter:1#linkref_3">[۳]</a>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &conversionReport{}
+			opts := renderOptions{Dialect: dialect, DigitZero: tt.zero, Footnotes: footnotesChapter, Links: tt.mode, Tables: tablesKeep, Math: mathMathML, Titles: englishTitles}
+			chapters := buildChapters(docs, 0, opts, newBookImages("", nil, testImageOptions, report), report)
+
+			wantChapters := len(tt.want)
+			if tt.links != "" {
+				wantChapters++
+			}
+			if len(chapters) != wantChapters {
+				t.Fatalf("%d chapters, want %d", len(chapters), wantChapters)
+			}
+			for i, want := range tt.want {
+				for _, w := range want {
+					if !strings.Contains(chapters[i].HTML, w) {
+						t.Errorf("chapter %d = %s\nwant it to contain %s", i, chapters[i].HTML, w)
+					}
+				}
+				if tt.mode != linksChapter && strings.Contains(chapters[i].HTML, `class="links"`) {
+					t.Errorf("addresses listed in chapter %d: %s", i, chapters[i].HTML)
+				}
+			}
+			if tt.links != "" {
+				links := chapters[len(chapters)-1]
+				if links.Title != "Links" || !strings.Contains(links.HTML, tt.links) {
+					t.Errorf("links chapter %q = %s\nwant it to contain %s", links.Title, links.HTML, tt.links)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertLinksOption(t *testing.T) {
+	files := map[string]archiveEntry{"markdown": {name: "a.md", body: "# A\n"}}
+	rec := convertRequest(t, testConfig(), map[string]string{"links": "footnotes"}, files)
+	if want := "links must be keep, text, chapter or book"; rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("response = %d %s, want 400 with %q", rec.Code, rec.Body, want)
+	}
+}
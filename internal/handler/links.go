@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/leotaku/mobi/records"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// kindlePos returns a KF8 link to a position inside the book. Every
+// chapter is a single chunk, so the chunk id equals the chapter index and
+// offset counts bytes from the start of the chapter body.
+func kindlePos(chapter, offset int) string {
+	off := strings.ToUpper(strconv.FormatInt(int64(offset), 32))
+	return fmt.Sprintf("kindle:pos:fid:%s:off:%010s", records.To32(chapter), off)
+}
+
+// resolveFileLinks rewrites links from the document at docPath to other
+// documents of the book so they point at the first chapter of the target.
+// fileChapters maps document paths to that chapter index.
+func resolveFileLinks(doc ast.Node, docPath string, fileChapters map[string]int, report *conversionReport) {
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		link, ok := node.(*ast.Link)
+		if !ok || !entering || link.NoteID != 0 {
+			return ast.GoToNext
+		}
+		if dest, ok := fileLink(string(link.Destination), docPath, fileChapters, report); ok {
+			link.Destination = []byte(dest)
+		}
+		return ast.GoToNext
+	})
+}
+
+// fileLink returns the chapter reference a link from the document at
+// docPath to another document of the book is rewritten to, keeping the
+// fragment for resolveAnchors. Links to documents that are not part of
+// the book are reported.
+func fileLink(dest, docPath string, fileChapters map[string]int, report *conversionReport) (string, bool) {
+	u, err := url.Parse(dest)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+
+	target := path.Clean(strings.TrimPrefix(u.Path, "/"))
+	if !strings.HasPrefix(u.Path, "/") {
+		target = path.Join(path.Dir(docPath), u.Path)
+	}
+	if chapter, ok := fileChapters[target]; ok {
+		if u.Fragment != "" {
+			return chapterRef(chapter) + "#" + u.EscapedFragment(), true
+		}
+		return chapterRef(chapter), true
+	}
+	if isMarkdownFile(target) || isHTMLFile(target) {
+		report.Warnf("%s: link to %q points at a file that is not part of the book", docPath, truncate(dest, 64))
+	}
+	return "", false
+}
+
+var (
+	idAttr = regexp.MustCompile(` id="([^"]+)"`)
+	// anchorHref matches the links to an id, in the chapter itself or in
+	// the document starting at a chapter.
+	anchorHref = regexp.MustCompile(`href="(?:book:chapter:(\d+))?#([^"]+)"`)
+	// positionHref matches the links resolveAnchors leaves: to an id of
+	// the chapter itself, or to the start of or an id in another chapter.
+	positionHref = regexp.MustCompile(`href="(?:book:chapter:(\d+))?(?:#([^"]+))?"`)
+)
+
+// resolveAnchors points the links to ids at the chapter holding the id,
+// as the documents are split into chapters. sources holds the path of the
+// document every chapter comes from. A link to an id within a document is
+// looked up in its own chapter, then in the other chapters of its document
+// and at last in the whole book; a link to an id in another document only
+// in that document. Links to ids that do not exist are reported; those to
+// another document are pointed at its start and the others are replaced
+// by their text, as readers cannot follow them.
+func resolveAnchors(chapters []chapter, sources []string, report *conversionReport) {
+	ids := make([]map[string]bool, len(chapters))
+	for i := range chapters {
+		ids[i] = make(map[string]bool)
+		for _, m := range idAttr.FindAllStringSubmatch(chapters[i].HTML, -1) {
+			ids[i][m[1]] = true
+		}
+	}
+
+	// find returns the first chapter with the id among those coming from
+	// the document at source, all chapters if source is nil.
+	find := func(id string, source *string) (string, int, bool) {
+		for _, candidate := range []string{id, unescapeFragment(id)} {
+			for i := range chapters {
+				if (source == nil || sources[i] == *source) && ids[i][candidate] {
+					return candidate, i, true
+				}
+			}
+		}
+		return "", 0, false
+	}
+
+	for i := range chapters {
+		dangling := make(map[string]bool)
+		chapters[i].HTML = anchorHref.ReplaceAllStringFunc(chapters[i].HTML, func(href string) string {
+			m := anchorHref.FindStringSubmatch(href)
+			id := m[2]
+			if m[1] != "" {
+				start, _ := strconv.Atoi(m[1])
+				if id, target, ok := find(id, &sources[start]); ok {
+					return fmt.Sprintf(`href="%s#%s"`, chapterRef(target), id)
+				}
+				report.Warnf("%s: link to %q points at an anchor that does not exist", sources[i], truncate(sources[start]+"#"+id, 64))
+				return fmt.Sprintf(`href="%s"`, chapterRef(start))
+			}
+
+			if ids[i][id] {
+				return href
+			}
+			target, ok := 0, false
+			if id, target, ok = find(id, &sources[i]); !ok {
+				id, target, ok = find(m[2], nil)
+			}
+			switch {
+			case !ok:
+				report.Warnf("%s: link to %q points at an anchor that does not exist", sources[i], truncate("#"+m[2], 64))
+				dangling[html.UnescapeString("#"+m[2])] = true
+				return href
+			case target == i:
+				return fmt.Sprintf(`href="#%s"`, id)
+			}
+			return fmt.Sprintf(`href="%s#%s"`, chapterRef(target), id)
+		})
+		if len(dangling) > 0 {
+			chapters[i].HTML = unwrapLinks(chapters[i].HTML, dangling)
+		}
+	}
+}
+
+// unwrapLinks replaces the links of the HTML fragment s to the given
+// addresses by their content, keeping their id for links to them.
+func unwrapLinks(s string, hrefs map[string]bool) string {
+	context := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(s), context)
+	if err != nil {
+		return s
+	}
+	for _, n := range nodes {
+		context.AppendChild(n)
+	}
+	var links []*html.Node
+	walkElements(context, func(e *html.Node) {
+		if e.DataAtom == atom.A && e.Namespace == "" && hrefs[attr(e, "href")] {
+			links = append(links, e)
+		}
+	})
+	for _, a := range links {
+		parent := a.Parent
+		if id := attr(a, "id"); id != "" {
+			span := &html.Node{Type: html.ElementNode, Data: "span", DataAtom: atom.Span,
+				Attr: []html.Attribute{{Key: "id", Val: id}}}
+			parent.InsertBefore(span, a)
+		}
+		for c := a.FirstChild; c != nil; c = a.FirstChild {
+			a.RemoveChild(c)
+			parent.InsertBefore(c, a)
+		}
+		parent.RemoveChild(a)
+	}
+
+	var sb strings.Builder
+	for c := context.FirstChild; c != nil; c = c.NextSibling {
+		// Writing to a strings.Builder does not fail
+		_ = html.Render(&sb, c)
+	}
+	return sb.String()
+}
+
+// unescapeFragment decodes the percent escapes of a link fragment, ids
+// are written as they are.
+func unescapeFragment(fragment string) string {
+	if unescaped, err := url.PathUnescape(fragment); err == nil {
+		return unescaped
+	}
+	return fragment
+}
+
+// resolvePositions rewrites the links resolveAnchors leaves to KF8
+// positions.
+func resolvePositions(chapters []chapter) {
+	// Position links have a fixed length, so put placeholders in first to
+	// settle the offsets of the targets
+	type link struct {
+		at      int
+		chapter int
+		id      string
+	}
+	placeholder := kindlePos(0, 0)
+	links := make([][]link, len(chapters))
+	for i := range chapters {
+		html := chapters[i].HTML
+		var sb strings.Builder
+		last := 0
+		for _, m := range positionHref.FindAllStringSubmatchIndex(html, -1) {
+			l := link{chapter: i}
+			if m[4] >= 0 {
+				l.id = html[m[4]:m[5]]
+			}
+			switch {
+			case m[2] >= 0:
+				l.chapter, _ = strconv.Atoi(html[m[2]:m[3]])
+			case l.id == "" || idOffset(html, l.id) < 0:
+				// Links to ids that do not exist are left alone
+				continue
+			}
+			sb.WriteString(html[last:m[0]])
+			sb.WriteString(`href="`)
+			l.at = sb.Len()
+			links[i] = append(links[i], l)
+			sb.WriteString(placeholder + `"`)
+			last = m[1]
+		}
+		if links[i] == nil {
+			continue
+		}
+		sb.WriteString(html[last:])
+		chapters[i].HTML = sb.String()
+	}
+
+	for i := range chapters {
+		if links[i] == nil {
+			continue
+		}
+		html := []byte(chapters[i].HTML)
+		for _, l := range links[i] {
+			offset := 0
+			if l.id != "" {
+				offset = max(idOffset(chapters[l.chapter].HTML, l.id), 0)
+			}
+			copy(html[l.at:], kindlePos(l.chapter, offset))
+		}
+		chapters[i].HTML = string(html)
+	}
+}
+
+// idOffset returns the offset of the element with the given id in html,
+// or -1 if there is none.
+func idOffset(html, id string) int {
+	idx := strings.Index(html, ` id="`+id+`"`)
+	if idx < 0 {
+		return -1
+	}
+	return strings.LastIndex(html[:idx], "<")
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"testing"
+)
+
+func TestResolveAnchors(t *testing.T) {
+	tests := []struct {
+		name     string
+		chapters []string
+		sources  []string
+		want     []string
+		warnings int
+	}{
+		{
+			name:     "id of the chapter itself",
+			chapters: []string{`<h1 id="a">A</h1><a href="#a">A</a>`},
+			sources:  []string{"a.md"},
+			want:     []string{`<h1 id="a">A</h1><a href="#a">A</a>`},
+		},
+		{
+			name:     "id in another chapter of the document",
+			chapters: []string{`<a href="#b">B</a>`, `<h1 id="b">B</h1>`},
+			sources:  []string{"a.md", "a.md"},
+			want:     []string{`<a href="book:chapter:1#b">B</a>`, `<h1 id="b">B</h1>`},
+		},
+		{
+			name:     "id in the document itself first",
+			chapters: []string{`<h1 id="x">X</h1>`, `<a href="#x">X</a>`, `<h1 id="x">X</h1>`},
+			sources:  []string{"a.md", "b.md", "b.md"},
+			want:     []string{`<h1 id="x">X</h1>`, `<a href="book:chapter:2#x">X</a>`, `<h1 id="x">X</h1>`},
+		},
+		{
+			name:     "id in another document",
+			chapters: []string{`<a href="book:chapter:1#y">Y</a>`, `<h1 id="x">X</h1>`, `<h1 id="y">Y</h1>`},
+			sources:  []string{"a.md", "b.md", "b.md"},
+			want:     []string{`<a href="book:chapter:2#y">Y</a>`, `<h1 id="x">X</h1>`, `<h1 id="y">Y</h1>`},
+		},
+		{
+			name:     "escaped fragment",
+			chapters: []string{`<a href="#caf%C3%A9">Café</a>`, `<h1 id="café">Café</h1>`},
+			sources:  []string{"a.md", "a.md"},
+			want:     []string{`<a href="book:chapter:1#café">Café</a>`, `<h1 id="café">Café</h1>`},
+		},
+		{
+			name:     "dangling link",
+			chapters: []string{`<p>See <a href="#nowhere">the <em>missing</em> part</a>.</p>`},
+			sources:  []string{"a.md"},
+			want:     []string{`<p>See the <em>missing</em> part.</p>`},
+			warnings: 1,
+		},
+		{
+			name:     "dangling link with an id",
+			chapters: []string{`<p><a id="back" href="#nowhere">?</a> <a href="#back">back</a></p>`},
+			sources:  []string{"a.md"},
+			want:     []string{`<p><span id="back"></span>? <a href="#back">back</a></p>`},
+			warnings: 1,
+		},
+		{
+			name:     "dangling link among valid ones",
+			chapters: []string{`<h1 id="a">A</h1>` + "\n" + `<p><a href="#a">A</a> <a href="#x&amp;y">?</a></p>` + "\n"},
+			sources:  []string{"a.md"},
+			want:     []string{`<h1 id="a">A</h1>` + "\n" + `<p><a href="#a">A</a> ?</p>` + "\n"},
+			warnings: 1,
+		},
+		{
+			name:     "dangling link to another document",
+			chapters: []string{`<a href="book:chapter:1#nowhere">?</a>`, `<h1 id="x">X</h1>`},
+			sources:  []string{"a.md", "b.md"},
+			want:     []string{`<a href="book:chapter:1">?</a>`, `<h1 id="x">X</h1>`},
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chapters := make([]chapter, len(tt.chapters))
+			for i, h := range tt.chapters {
+				chapters[i].HTML = h
+			}
+			report := &conversionReport{}
+			resolveAnchors(chapters, tt.sources, report)
+			for i, chap := range chapters {
+				if chap.HTML != tt.want[i] {
+					t.Errorf("chapter %d = %s, want %s", i, chap.HTML, tt.want[i])
+				}
+			}
+			if len(report.Warnings) != tt.warnings {
+				t.Errorf("warnings = %q, want %d", report.Warnings, tt.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+
+	"github.com/Amin-MAG/md2azw3/internal/mathtex"
+)
+
+// Math output modes.
+const (
+	// mathImage embeds every formula as an image, which all Kindle
+	// readers can show.
+	mathImage = "image"
+	// mathMathML writes formulas as MathML for readers that support it,
+	// with the image as fallback.
+	mathMathML = "mathml"
+)
+
+// mathSize is the em size formulas are rasterized at, in pixels. It is
+// larger than the text on most readers, so formulas stay sharp when
+// scaled down to the size of the text.
+const mathSize = 48
+
+// embedMath replaces the $...$ and $$...$$ formulas of doc by images of
+// them, embedded into the book, or by MathML in mathml mode. A $$...$$
+// formula within a paragraph is set in display style on a line of its
+// own. Formulas that cannot be parsed are kept as text and reported as
+// warnings.
+func embedMath(doc ast.Node, mode string, images *bookImages, report *conversionReport) {
+	var formulas []ast.Node
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch node.(type) {
+		case *ast.Math, *ast.MathBlock:
+			if entering {
+				formulas = append(formulas, node)
+			}
+		}
+		return ast.GoToNext
+	})
+
+	// Change the nodes after the walk so it does not see the new ones
+	for _, node := range formulas {
+		var tex string
+		display, block := false, false
+		switch n := node.(type) {
+		case *ast.Math:
+			tex = strings.TrimSpace(string(n.Literal))
+			display = isDisplayMath(n)
+		case *ast.MathBlock:
+			tex = strings.TrimSpace(string(n.Literal))
+			display, block = true, true
+		}
+		markup, err := renderMath(tex, display, mode, images)
+		if err != nil {
+			report.Warnf("math %q not rendered: %s", truncate(tex, 64), err)
+			replaceNode(node, []ast.Node{mathSource(tex, display, block)})
+			continue
+		}
+		switch {
+		case block:
+			markup = `<div class="` + mathDisplayClass + `">` + markup + "</div>\n"
+			replaceNode(node, []ast.Node{&ast.HTMLBlock{Leaf: ast.Leaf{Literal: []byte(markup)}}})
+		case display:
+			markup = `<span class="` + mathDisplayClass + `">` + markup + "</span>"
+			replaceNode(node, []ast.Node{&ast.HTMLSpan{Leaf: ast.Leaf{Literal: []byte(markup)}}})
+		default:
+			replaceNode(node, []ast.Node{&ast.HTMLSpan{Leaf: ast.Leaf{Literal: []byte(markup)}}})
+		}
+	}
+}
+
+// mathDisplayClass marks the inline formulas written between double
+// dollar signs, which are set in display style.
+const mathDisplayClass = "math-display"
+
+// inlineMath parses a formula within a paragraph. Those between single
+// dollar signs are left to single, the parser's own, while those between
+// double dollar signs, which it would pair up as single ones, are marked
+// with mathDisplayClass.
+func inlineMath(p *parser.Parser, data []byte, offset int, single parser.InlineParser) (int, ast.Node) {
+	rest := data[offset:]
+	if !bytes.HasPrefix(rest, []byte("$$")) {
+		return single(p, data, offset)
+	}
+	end := bytes.Index(rest[2:], []byte("$$"))
+	if end <= 0 {
+		return 0, nil
+	}
+	math := &ast.Math{}
+	math.Literal = rest[2 : 2+end]
+	math.Attribute = &ast.Attribute{Classes: [][]byte{[]byte(mathDisplayClass)}}
+	return end + 4, math
+}
+
+// isDisplayMath reports whether an inline formula was written between
+// double dollar signs.
+func isDisplayMath(math *ast.Math) bool {
+	if math.Attribute == nil {
+		return false
+	}
+	for _, class := range math.Attribute.Classes {
+		if string(class) == mathDisplayClass {
+			return true
+		}
+	}
+	return false
+}
+
+// renderMath returns the markup of a formula: an image of it, embedded
+// into the book, or MathML pointing at the image.
+func renderMath(tex string, display bool, mode string, images *bookImages) (string, error) {
+	formula, err := mathtex.Parse(tex)
+	if err != nil {
+		return "", err
+	}
+	img, depth, err := mathtex.Render(formula, display, mathSize)
+	if err != nil {
+		return "", err
+	}
+	ref, err := images.embed(fmt.Sprintf("math:%t:%s", display, tex), img)
+	if err != nil {
+		return "", err
+	}
+	// The image may have been scaled down to fit the screen, size it
+	// after the embedded one
+	scale := 1.0
+	if embedded := images.embedded(ref); embedded != nil && img.Bounds().Dy() > 0 {
+		scale = float64(embedded.Bounds().Dy()) / float64(img.Bounds().Dy())
+	}
+	if mode == mathMathML {
+		return mathtex.MathML(formula, tex, display, ref), nil
+	}
+
+	var alt bytes.Buffer
+	html.EscapeHTML(&alt, []byte(tex))
+	height := float64(img.Bounds().Dy()) * scale / mathSize
+	return fmt.Sprintf(`<img class="math" src="%s" alt="%s" style="height: %.2fem; vertical-align: -%.2fem"/>`,
+		ref, alt.String(), height, float64(depth)*scale/mathSize), nil
+}
+
+// mathSource returns the node a formula that cannot be rendered is kept
+// as: its source between dollar signs.
+func mathSource(tex string, display, block bool) ast.Node {
+	switch {
+	case display && !block:
+		return &ast.Text{Leaf: ast.Leaf{Literal: []byte("$$" + tex + "$$")}}
+	case !display:
+		return &ast.Text{Leaf: ast.Leaf{Literal: []byte("$" + tex + "$")}}
+	}
+	para := &ast.Paragraph{}
+	prependChild(para, &ast.Text{Leaf: ast.Leaf{Literal: []byte("$$" + tex + "$$")}})
+	return para
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+
+	"github.com/leotaku/mobi/jfif"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Image limits used when the request does not set them: the screen of
+// the larger Kindle Paperwhite and Oasis models, in pixels.
+const (
+	defaultImageMaxWidth  = 1264
+	defaultImageMaxHeight = 1680
+	defaultImageQuality   = 80
+)
+
+// grayLevels is the number of gray shades e-ink screens show. Grayscale
+// images are dithered down to them.
+const grayLevels = 16
+
+// imageOptions describes how the images of a book are prepared for the
+// device.
+type imageOptions struct {
+	// MaxWidth and MaxHeight are the size images are scaled down to fit.
+	MaxWidth, MaxHeight int
+	// Quality is the JPEG quality images are stored at.
+	Quality int
+	// Grayscale turns images gray, dithered to the shades of e-ink.
+	Grayscale bool
+}
+
+// encodedImage is an image ready to be stored in the book.
+type encodedImage struct {
+	Data []byte
+	MIME string
+}
+
+// optimizeImage scales img down to fit the device and turns it gray if
+// requested.
+func optimizeImage(img image.Image, opts imageOptions) image.Image {
+	b := img.Bounds()
+	scale := math.Min(1, math.Min(float64(opts.MaxWidth)/float64(b.Dx()), float64(opts.MaxHeight)/float64(b.Dy())))
+	if scale < 1 {
+		w := max(1, int(math.Round(float64(b.Dx())*scale)))
+		h := max(1, int(math.Round(float64(b.Dy())*scale)))
+		scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+		xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), img, b, draw.Src, nil)
+		img = scaled
+	}
+	if _, ok := img.(*image.Gray); opts.Grayscale && !ok {
+		b := img.Bounds()
+		gray := image.NewGray(b)
+		draw.Draw(gray, b, img, b.Min, draw.Src)
+		img = gray
+	}
+	return img
+}
+
+// grayPalette holds the shades of an e-ink screen, evenly spread from
+// black to white.
+var grayPalette = func() color.Palette {
+	p := make(color.Palette, grayLevels)
+	for i := range p {
+		p[i] = color.Gray{Y: uint8(i * 0xff / (grayLevels - 1))}
+	}
+	return p
+}()
+
+// ditherGray dithers img to the shades of e-ink, so gradients do not
+// band on the device.
+func ditherGray(img image.Image) *image.Paletted {
+	b := img.Bounds()
+	dithered := image.NewPaletted(b, grayPalette)
+	draw.FloydSteinberg.Draw(dithered, b, img, b.Min)
+	return dithered
+}
+
+// encodeImage encodes img as both JPEG and PNG and returns the smaller:
+// JPEG usually wins for photos, PNG for screenshots and diagrams. Neither
+// carries over metadata of the uploaded file. For grayscale books the PNG
+// is dithered to the shades of e-ink, which keeps it small; the JPEG is
+// not, as dithering noise is what JPEG compresses worst.
+func encodeImage(img image.Image, opts imageOptions) (encodedImage, error) {
+	var jpg bytes.Buffer
+	if err := jfif.Encode(&jpg, img, &jpeg.Options{Quality: opts.Quality}); err != nil {
+		return encodedImage{}, fmt.Errorf("encode jpeg: %w", err)
+	}
+
+	pngImg := img
+	if opts.Grayscale {
+		pngImg = ditherGray(img)
+	}
+	var pngBuf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&pngBuf, pngImg); err != nil {
+		return encodedImage{}, fmt.Errorf("encode png: %w", err)
+	}
+
+	if pngBuf.Len() < jpg.Len() {
+		return encodedImage{Data: pngBuf.Bytes(), MIME: "image/png"}, nil
+	}
+	return encodedImage{Data: jpg.Bytes(), MIME: "image/jpeg"}, nil
+}
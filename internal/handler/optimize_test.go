@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// photo returns an image of noise, which PNG compresses badly.
+func photo(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	r := rand.New(rand.NewSource(1))
+	r.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
+
+// diagram returns an image of a few flat colors, which PNG compresses
+// well.
+func diagram(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+			if x%40 < 2 || y%40 < 2 {
+				c = color.RGBA{A: 0xff}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestOptimizeImage(t *testing.T) {
+	tests := []struct {
+		name      string
+		w, h      int
+		grayscale bool
+		wantW     int
+		wantH     int
+	}{
+		{name: "fits", w: 800, h: 600, wantW: 800, wantH: 600},
+		{name: "too wide", w: 2528, h: 1000, wantW: 1264, wantH: 500},
+		{name: "too high", w: 1000, h: 3360, wantW: 500, wantH: 1680},
+		{name: "a line", w: 5000, h: 1, wantW: 1264, wantH: 1},
+		{name: "grayscale", w: 300, h: 200, grayscale: true, wantW: 300, wantH: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testImageOptions
+			opts.Grayscale = tt.grayscale
+			img := optimizeImage(photo(tt.w, tt.h), opts)
+			if b := img.Bounds(); b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+				t.Errorf("image is %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			}
+			if _, gray := img.(*image.Gray); gray != tt.grayscale {
+				t.Errorf("image is %T", img)
+			}
+		})
+	}
+}
+
+func TestEncodeImage(t *testing.T) {
+	tests := []struct {
+		name      string
+		img       image.Image
+		grayscale bool
+		want      string
+	}{
+		{name: "photo", img: photo(200, 200), want: "image/jpeg"},
+		{name: "diagram", img: diagram(400, 300), want: "image/png"},
+		{name: "grayscale diagram", img: diagram(400, 300), grayscale: true, want: "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testImageOptions
+			opts.Grayscale = tt.grayscale
+			encoded, err := encodeImage(optimizeImage(tt.img, opts), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoded.MIME != tt.want {
+				t.Errorf("encoded as %s, want %s", encoded.MIME, tt.want)
+			}
+
+			var decoded image.Image
+			if encoded.MIME == "image/png" {
+				decoded, err = png.Decode(bytes.NewReader(encoded.Data))
+			} else {
+				decoded, err = jpeg.Decode(bytes.NewReader(encoded.Data))
+			}
+			if err != nil {
+				t.Fatalf("decode %s: %v", encoded.MIME, err)
+			}
+			if decoded.Bounds() != tt.img.Bounds() {
+				t.Errorf("decoded image is %v", decoded.Bounds())
+			}
+
+			// Grayscale PNGs are dithered to the shades of e-ink
+			if p, ok := decoded.(*image.Paletted); tt.grayscale && (!ok || len(p.Palette) > grayLevels) {
+				t.Errorf("grayscale image decoded as %T", decoded)
+			}
+		})
+	}
+}
+
+func TestDitherGray(t *testing.T) {
+	// A gradient keeps its average brightness with the few shades of e-ink
+	gradient := image.NewGray(image.Rect(0, 0, 256, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 256; x++ {
+			gradient.SetGray(x, y, color.Gray{Y: uint8(x)})
+		}
+	}
+	dithered := ditherGray(gradient)
+	var before, after int
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 256; x++ {
+			before += int(gradient.GrayAt(x, y).Y)
+			after += int(color.GrayModel.Convert(dithered.At(x, y)).(color.Gray).Y)
+		}
+	}
+	if diff := before - after; diff < -256*16 || diff > 256*16 {
+		t.Errorf("brightness %d before dithering, %d after", before, after)
+	}
+	if len(dithered.Palette) != grayLevels {
+		t.Errorf("%d shades", len(dithered.Palette))
+	}
+}
+
+func TestConvertImageOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+		want   string
+	}{
+		{name: "zero width", fields: map[string]string{"image_max_width": "0"}, want: "image_max_width must be"},
+		{name: "malformed height", fields: map[string]string{"image_max_height": "tall"}, want: "image_max_height must be"},
+		{name: "quality out of range", fields: map[string]string{"image_quality": "101"}, want: "image_quality must be"},
+		{name: "malformed grayscale", fields: map[string]string{"image_grayscale": "maybe"}, want: "image_grayscale must be"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]archiveEntry{"markdown": {name: "a.md", body: "# A\n"}}
+			rec := convertRequest(t, testConfig(), tt.fields, files)
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("response = %d %s, want 400 with %q", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package handler
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/labstack/echo/v4"
+
+	"github.com/Amin-MAG/md2azw3/config"
+)
+
+// convertOptions holds the optional settings of a conversion request.
+type convertOptions struct {
+	// Format is the output format: formatAZW3 or formatEPUB.
+	Format string
+	// ChapterLevel is the heading level the document is split into
+	// chapters at. Zero picks the level from the document itself.
+	ChapterLevel int
+	// TOCDepth is the number of heading levels shown in the table of
+	// contents, chapters included.
+	TOCDepth int
+	// TOCPage adds a page listing the table of contents after the title
+	// matter of the book.
+	TOCPage bool
+	// LocalizeDigits writes chapter numbers and list markers in the
+	// native digits of the book language, such as Persian digits.
+	LocalizeDigits bool
+	// Reproducible derives the book id and creation date from the input,
+	// so converting the same input twice gives the same file.
+	Reproducible bool
+	// Highlight is the style fenced code blocks are highlighted with, or
+	// nil to leave them plain.
+	Highlight *chroma.Style
+	// Math is how formulas are written: mathImage or mathMathML.
+	Math string
+	// Footnotes is where notes are collected: footnotesChapter or
+	// footnotesBook.
+	Footnotes string
+	// Links is how external links are handled: linksKeep, linksText,
+	// linksChapter or linksBook.
+	Links string
+	// Tables is the layout of tables wider than TableColumns columns:
+	// tablesKeep, tablesCards or tablesImage.
+	Tables       string
+	TableColumns int
+	// CoverTemplate is the design of the cover generated for books without
+	// one, or coverNone.
+	CoverTemplate string
+	// CoverColors are the background colors of the cover template, or nil
+	// for the defaults.
+	CoverColors []color.Color
+	// CoverFit is how cover images are fitted to the recommended size:
+	// coverScale or coverLetterbox.
+	CoverFit string
+	// CoverQuality is the JPEG quality the cover is stored at.
+	CoverQuality int
+	// ImageMaxWidth and ImageMaxHeight are the size embedded images are
+	// scaled down to fit.
+	ImageMaxWidth  int
+	ImageMaxHeight int
+	// ImageQuality is the JPEG quality embedded images are stored at.
+	ImageQuality int
+	// ImageGrayscale turns embedded images gray, dithered for e-ink.
+	ImageGrayscale bool
+	// Typography is how quotes, dashes and ellipses are set:
+	// typographyDialect or typographyLocale.
+	Typography string
+	// Hyphenate inserts soft hyphens into long words so justified lines
+	// get fewer gaps.
+	Hyphenate bool
+	// MarkdownDialect names the markdown dialect of the documents, or is
+	// empty to leave it to the front matter.
+	MarkdownDialect string
+	// MarkdownExtensions lists the extensions toggled on top of the
+	// dialect, after those of the front matter.
+	MarkdownExtensions string
+}
+
+// defaultTOCDepth is the table of contents depth used when the request
+// does not set one: chapters and two levels of sections below them.
+const defaultTOCDepth = 3
+
+// parseConvertOptions reads the conversion options from the form fields
+// of the request. The returned error is meant to be shown to the client.
+func parseConvertOptions(c echo.Context, cfg config.Config) (convertOptions, error) {
+	opts := convertOptions{Format: formatAZW3, TOCDepth: defaultTOCDepth, Reproducible: cfg.Build.Reproducible, Highlight: einkStyle, Math: mathImage, Footnotes: footnotesChapter,
+		Links: linksKeep, Tables: tablesCards, TableColumns: defaultTableColumns, CoverTemplate: coverGradient,
+		CoverFit: coverScale, CoverQuality: defaultCoverQuality,
+		ImageMaxWidth: defaultImageMaxWidth, ImageMaxHeight: defaultImageMaxHeight, ImageQuality: defaultImageQuality,
+		Typography: typographyDialect}
+
+	if v := c.FormValue("format"); v != "" {
+		if _, ok := formatMIMETypes[v]; !ok {
+			return opts, fmt.Errorf("format must be %s or %s", formatAZW3, formatEPUB)
+		}
+		opts.Format = v
+	} else if format, ok := acceptedFormat(c.Request().Header.Get(echo.HeaderAccept)); ok {
+		opts.Format = format
+	}
+
+	if v := c.FormValue("chapter_level"); v != "" {
+		level, err := strconv.Atoi(v)
+		if err != nil || level < 1 || level > 6 {
+			return opts, fmt.Errorf("chapter_level must be a number between 1 and 6")
+		}
+		opts.ChapterLevel = level
+	}
+
+	if v := c.FormValue("toc_depth"); v != "" {
+		depth, err := strconv.Atoi(v)
+		if err != nil || depth < 1 || depth > 6 {
+			return opts, fmt.Errorf("toc_depth must be a number between 1 and 6")
+		}
+		opts.TOCDepth = depth
+	}
+
+	if v := c.FormValue("toc_page"); v != "" {
+		page, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("toc_page must be true or false")
+		}
+		opts.TOCPage = page
+	}
+
+	if v := c.FormValue("localize_digits"); v != "" {
+		localize, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("localize_digits must be true or false")
+		}
+		opts.LocalizeDigits = localize
+	}
+
+	if v := c.FormValue("reproducible"); v != "" {
+		reproducible, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("reproducible must be true or false")
+		}
+		opts.Reproducible = reproducible
+	}
+
+	if v := c.FormValue("highlight"); v != "" {
+		style, err := highlightStyle(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Highlight = style
+	}
+
+	if v := c.FormValue("math"); v != "" {
+		if v != mathImage && v != mathMathML {
+			return opts, fmt.Errorf("math must be %s or %s", mathImage, mathMathML)
+		}
+		opts.Math = v
+	}
+
+	if v := c.FormValue("footnotes"); v != "" {
+		if v != footnotesChapter && v != footnotesBook {
+			return opts, fmt.Errorf("footnotes must be %s or %s", footnotesChapter, footnotesBook)
+		}
+		opts.Footnotes = v
+	}
+
+	if v := c.FormValue("links"); v != "" {
+		if v != linksKeep && v != linksText && v != linksChapter && v != linksBook {
+			return opts, fmt.Errorf("links must be %s, %s, %s or %s", linksKeep, linksText, linksChapter, linksBook)
+		}
+		opts.Links = v
+	}
+
+	if v := c.FormValue("tables"); v != "" {
+		if v != tablesCards && v != tablesImage && v != tablesKeep {
+			return opts, fmt.Errorf("tables must be %s, %s or %s", tablesCards, tablesImage, tablesKeep)
+		}
+		opts.Tables = v
+	}
+
+	if v := c.FormValue("table_columns"); v != "" {
+		columns, err := strconv.Atoi(v)
+		if err != nil || columns < 1 {
+			return opts, fmt.Errorf("table_columns must be a positive number")
+		}
+		opts.TableColumns = columns
+	}
+
+	if v := c.FormValue("cover_template"); v != "" {
+		switch v {
+		case coverGradient, coverSolid, coverImage, coverNone:
+			opts.CoverTemplate = v
+		default:
+			return opts, fmt.Errorf("cover_template must be %s, %s, %s or %s", coverGradient, coverSolid, coverImage, coverNone)
+		}
+	}
+	if opts.CoverTemplate == coverImage {
+		if _, err := c.FormFile("cover_background"); err != nil {
+			return opts, fmt.Errorf("cover_template %s needs a cover_background file", coverImage)
+		}
+	}
+
+	if v := c.FormValue("cover_colors"); v != "" {
+		colors, err := parseCoverColors(v)
+		if err != nil {
+			return opts, err
+		}
+		if n := coverColorCount(opts.CoverTemplate); len(colors) != n {
+			return opts, fmt.Errorf("cover_colors takes %d colors for cover_template %s", n, opts.CoverTemplate)
+		}
+		opts.CoverColors = colors
+	}
+
+	if v := c.FormValue("cover_fit"); v != "" {
+		if v != coverScale && v != coverLetterbox {
+			return opts, fmt.Errorf("cover_fit must be %s or %s", coverScale, coverLetterbox)
+		}
+		opts.CoverFit = v
+	}
+
+	if v := c.FormValue("cover_quality"); v != "" {
+		quality, err := strconv.Atoi(v)
+		if err != nil || quality < 1 || quality > 100 {
+			return opts, fmt.Errorf("cover_quality must be a number between 1 and 100")
+		}
+		opts.CoverQuality = quality
+	}
+
+	if v := c.FormValue("image_max_width"); v != "" {
+		width, err := strconv.Atoi(v)
+		if err != nil || width < 1 {
+			return opts, fmt.Errorf("image_max_width must be a positive number")
+		}
+		opts.ImageMaxWidth = width
+	}
+
+	if v := c.FormValue("image_max_height"); v != "" {
+		height, err := strconv.Atoi(v)
+		if err != nil || height < 1 {
+			return opts, fmt.Errorf("image_max_height must be a positive number")
+		}
+		opts.ImageMaxHeight = height
+	}
+
+	if v := c.FormValue("image_quality"); v != "" {
+		quality, err := strconv.Atoi(v)
+		if err != nil || quality < 1 || quality > 100 {
+			return opts, fmt.Errorf("image_quality must be a number between 1 and 100")
+		}
+		opts.ImageQuality = quality
+	}
+
+	if v := c.FormValue("image_grayscale"); v != "" {
+		grayscale, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("image_grayscale must be true or false")
+		}
+		opts.ImageGrayscale = grayscale
+	}
+
+	if v := c.FormValue("typography"); v != "" {
+		if v != typographyDialect && v != typographyLocale {
+			return opts, fmt.Errorf("typography must be %s or %s", typographyDialect, typographyLocale)
+		}
+		opts.Typography = v
+	}
+
+	if v := c.FormValue("hyphenate"); v != "" {
+		hyphenate, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("hyphenate must be true or false")
+		}
+		opts.Hyphenate = hyphenate
+	}
+
+	// The dialect is settled once the front matter is read, check the
+	// names now
+	opts.MarkdownDialect = c.FormValue("markdown_dialect")
+	opts.MarkdownExtensions = c.FormValue("markdown_extensions")
+	if _, err := newMarkdownDialect(opts.MarkdownDialect, opts.MarkdownExtensions); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// acceptedFormat returns the first output format an Accept header asks
+// for, if any. Media ranges such as */* leave the choice to the server.
+func acceptedFormat(accept string) (string, bool) {
+	for _, field := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(field, ";")
+		for format, mime := range formatMIMETypes {
+			if strings.EqualFold(strings.TrimSpace(mediaType), mime) {
+				return format, true
+			}
+		}
+	}
+	return "", false
+}
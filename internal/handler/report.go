@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	ravandlog "github.com/Amin-MAG/md2azw3/pkg/log"
+	"github.com/labstack/echo/v4"
+)
+
+// headerConversionWarning is the response header that carries one
+// conversion warning per value, and headerConversionWarningCount the
+// number of warnings, including those left out of the headers.
+const (
+	headerConversionWarning      = "X-Conversion-Warning"
+	headerConversionWarningCount = "X-Conversion-Warning-Count"
+)
+
+// maxHeaderWarnings bounds the warnings sent as headers, as servers and
+// proxies limit the size of the response headers.
+const maxHeaderWarnings = 20
+
+// conversionReport collects the problems found during a conversion that
+// do not stop the book from being generated.
+type conversionReport struct {
+	Warnings []string
+}
+
+// Warnf records a warning.
+func (r *conversionReport) Warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// writeReport logs the warnings of a conversion and adds the first
+// maxHeaderWarnings of them and their count to the response headers.
+func writeReport(ctx context.Context, c echo.Context, logger *ravandlog.Logger, report *conversionReport) {
+	header := c.Response().Header()
+	for i, warning := range report.Warnings {
+		logger.With("warning", warning).Warn(ctx, "conversion warning")
+		if i < maxHeaderWarnings {
+			header.Add(headerConversionWarning, sanitizeHeaderValue(truncate(warning, 512)))
+		}
+	}
+	if len(report.Warnings) > maxHeaderWarnings {
+		header.Add(headerConversionWarning, fmt.Sprintf("%d more warnings not listed", len(report.Warnings)-maxHeaderWarnings))
+	}
+	if len(report.Warnings) > 0 {
+		header.Set(headerConversionWarningCount, strconv.Itoa(len(report.Warnings)))
+	}
+}
+
+// sanitizeHeaderValue replaces the characters that cannot appear in an
+// HTTP header value.
+func sanitizeHeaderValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/bidi"
+)
+
+// nativeDigitsClass marks ordered lists whose markers are written out as
+// text in the native digits of the book language.
+const nativeDigitsClass = "native-digits"
+
+// rtlStylesheet mirrors the indentation of lists, block quotes and table
+// cards and the alignment of headings and table cells for right-to-left
+// books, and keeps code left-to-right.
+const rtlStylesheet = `ul, ol {
+  margin-left: 0;
+  margin-right: 1.5em;
+  padding-left: 0;
+  padding-right: 0;
+}
+ul.contents ul {
+  margin-left: 0;
+  margin-right: 1.5em;
+}
+ol.native-digits {
+  list-style-type: none;
+  margin-right: 0;
+}
+h1, h2, h3, h4, h5, h6, th, td {
+  text-align: right;
+}
+dl.table-card dd {
+  margin: 0 1em 0.25em 0;
+}
+blockquote {
+  margin-left: 0;
+  margin-right: 1.5em;
+  padding-left: 0;
+  padding-right: 0.75em;
+  border-left: none;
+  border-right: 2px solid #999;
+}
+pre, code {
+  direction: ltr;
+  text-align: left;
+  unicode-bidi: embed;
+}
+span[dir="ltr"] {
+  unicode-bidi: isolate;
+}
+`
+
+// isRTL reports whether a language is written right to left.
+func isRTL(tag language.Tag) bool {
+	script, _ := tag.Script()
+	switch script.String() {
+	case "Arab", "Hebr", "Thaa", "Syrc", "Nkoo", "Adlm", "Rohg":
+		return true
+	}
+	return false
+}
+
+// nativeZero returns the digit zero of the language's native digits, for
+// languages that do not use Latin digits in running text.
+func nativeZero(tag language.Tag) (rune, bool) {
+	base, _ := tag.Base()
+	switch base.String() {
+	case "fa", "ur", "ps", "sd":
+		return '۰', true
+	case "ar", "ckb":
+		return '٠', true
+	}
+	return 0, false
+}
+
+// applyDirection prepares doc for the writing direction and the digits of
+// the book.
+func applyDirection(doc ast.Node, opts renderOptions) {
+	if opts.DigitZero != 0 {
+		localizeHeadingDigits(doc, opts.DigitZero)
+		localizeListMarkers(doc, opts.DigitZero)
+	}
+	if opts.RTL {
+		isolateLTR(doc)
+	}
+}
+
+// localizeDigits replaces the ASCII digits of s with the digits starting
+// at zero.
+func localizeDigits(s string, zero rune) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return zero + r - '0'
+		}
+		return r
+	}, s)
+}
+
+// localizeHeadingDigits writes the numbers in the headings of doc, such as
+// chapter numbers, in native digits.
+func localizeHeadingDigits(doc ast.Node, zero rune) {
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		heading, ok := node.(*ast.Heading)
+		if !ok || !entering {
+			return ast.GoToNext
+		}
+		ast.WalkFunc(heading, func(node ast.Node, entering bool) ast.WalkStatus {
+			if text, ok := node.(*ast.Text); ok {
+				text.Literal = []byte(localizeDigits(string(text.Literal), zero))
+			}
+			return ast.GoToNext
+		})
+		return ast.SkipChildren
+	})
+}
+
+// localizeListMarkers writes the markers of the ordered lists in doc as
+// text in native digits, as Kindle readers number lists in Latin digits
+// whatever the book language.
+func localizeListMarkers(doc ast.Node, zero rune) {
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		list, ok := node.(*ast.List)
+		if !ok || !entering || list.ListFlags&ast.ListTypeOrdered == 0 || list.IsFootnotesList {
+			return ast.GoToNext
+		}
+		if list.Attribute == nil {
+			list.Attribute = &ast.Attribute{}
+		}
+		list.Classes = append(list.Classes, []byte(nativeDigitsClass))
+
+		number := list.Start
+		if number == 0 {
+			number = 1
+		}
+		for _, item := range list.Children {
+			marker := localizeDigits(fmt.Sprintf("%d", number), zero) + ". "
+			number++
+			if children := item.GetChildren(); len(children) > 0 {
+				if para, ok := children[0].(*ast.Paragraph); ok {
+					prependChild(para, &ast.Text{Leaf: ast.Leaf{Literal: []byte(marker)}})
+					continue
+				}
+			}
+			prependChild(item, &ast.HTMLSpan{Leaf: ast.Leaf{Literal: []byte(marker)}})
+		}
+		return ast.GoToNext
+	})
+}
+
+// isolateLTR marks the left-to-right runs of a right-to-left document,
+// such as Latin words and code, so the bidi algorithm does not move the
+// surrounding punctuation.
+func isolateLTR(doc ast.Node) {
+	var texts []*ast.Text
+	var codes []*ast.Code
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch n := node.(type) {
+		case *ast.Image:
+			// The alt text is rendered into an attribute, which cannot hold markup
+			return ast.SkipChildren
+		case *ast.CodeBlock:
+			if n.Attribute == nil {
+				n.Attribute = &ast.Attribute{}
+			}
+			if n.Attrs == nil {
+				n.Attrs = make(map[string][]byte)
+			}
+			n.Attrs["dir"] = []byte("ltr")
+		case *ast.Code:
+			codes = append(codes, n)
+		case *ast.Text:
+			texts = append(texts, n)
+		}
+		return ast.GoToNext
+	})
+
+	// Change the nodes after the walk so it does not see the new ones
+	for _, code := range codes {
+		var buf bytes.Buffer
+		buf.WriteString(`<code dir="ltr">`)
+		html.EscapeHTML(&buf, code.Literal)
+		buf.WriteString(`</code>`)
+		replaceNode(code, []ast.Node{&ast.HTMLSpan{Leaf: ast.Leaf{Literal: buf.Bytes()}}})
+	}
+
+	for _, text := range texts {
+		runs := ltrRuns(string(text.Literal))
+		if len(runs) == 0 {
+			continue
+		}
+		var nodes []ast.Node
+		s, pos := string(text.Literal), 0
+		for _, run := range runs {
+			if run[0] > pos {
+				nodes = append(nodes, &ast.Text{Leaf: ast.Leaf{Literal: []byte(s[pos:run[0]])}})
+			}
+			nodes = append(nodes,
+				&ast.HTMLSpan{Leaf: ast.Leaf{Literal: []byte(`<span dir="ltr">`)}},
+				&ast.Text{Leaf: ast.Leaf{Literal: []byte(s[run[0]:run[1]])}},
+				&ast.HTMLSpan{Leaf: ast.Leaf{Literal: []byte(`</span>`)}},
+			)
+			pos = run[1]
+		}
+		if pos < len(s) {
+			nodes = append(nodes, &ast.Text{Leaf: ast.Leaf{Literal: []byte(s[pos:])}})
+		}
+		replaceNode(text, nodes)
+	}
+}
+
+// ltrRuns returns the byte ranges of the left-to-right runs in s. A run
+// starts and ends with a strong left-to-right character and may span the
+// spaces, digits and punctuation between them.
+func ltrRuns(s string) [][2]int {
+	var runs [][2]int
+	start, end := -1, -1
+	for i, r := range s {
+		props, _ := bidi.LookupRune(r)
+		switch props.Class() {
+		case bidi.L:
+			if start < 0 {
+				start = i
+			}
+			end = i + len(string(r))
+		case bidi.R, bidi.AL:
+			if start >= 0 {
+				runs = append(runs, [2]int{start, end})
+				start = -1
+			}
+		}
+	}
+	if start >= 0 {
+		runs = append(runs, [2]int{start, end})
+	}
+	return runs
+}
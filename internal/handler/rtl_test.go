@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBookStylesheetsRTL(t *testing.T) {
+	tests := []struct {
+		rtl      bool
+		selector string
+		property string
+		want     string
+	}{
+		{rtl: true, selector: "h1", property: "text-align", want: "right"},
+		{rtl: true, selector: "h6", property: "text-align", want: "right"},
+		{rtl: true, selector: "th", property: "text-align", want: "right"},
+		{rtl: true, selector: "td", property: "text-align", want: "right"},
+		{rtl: true, selector: "dl.table-card dd", property: "margin", want: "0 1em 0.25em 0"},
+		{rtl: true, selector: "pre", property: "text-align", want: "left"},
+		{rtl: false, selector: "h1", property: "text-align", want: ""},
+		{rtl: false, selector: "td", property: "text-align", want: ""},
+		{rtl: false, selector: "dl.table-card dd", property: "margin", want: "0 0 0.25em 1em"},
+	}
+	for _, tt := range tests {
+		sheets := bookStylesheets(renderOptions{RTL: tt.rtl})
+		if got := cssValue(sheets, tt.selector, tt.property); got != tt.want {
+			t.Errorf("rtl %t: %s { %s } = %q, want %q", tt.rtl, tt.selector, tt.property, got, tt.want)
+		}
+	}
+	for _, sheet := range bookStylesheets(renderOptions{RTL: true}) {
+		if problems := validateStylesheet(sheet); len(problems) > 0 {
+			t.Errorf("stylesheet has unsupported rules: %v", problems)
+		}
+	}
+}
+
+// cssValue returns the value the last rule of sheets naming selector gives
+// property. It reads the flat stylesheets of the converter, without
+// at-rules or comments.
+func cssValue(sheets []string, selector, property string) string {
+	value := ""
+	for _, sheet := range sheets {
+		for _, rule := range strings.Split(sheet, "}") {
+			selectors, decls, ok := strings.Cut(rule, "{")
+			if !ok {
+				continue
+			}
+			named := false
+			for _, s := range strings.Split(selectors, ",") {
+				named = named || strings.TrimSpace(s) == selector
+			}
+			if !named {
+				continue
+			}
+			for _, decl := range strings.Split(decls, ";") {
+				if name, val, ok := strings.Cut(decl, ":"); ok && strings.TrimSpace(name) == property {
+					value = strings.TrimSpace(val)
+				}
+			}
+		}
+	}
+	return value
+}
@@ -0,0 +1,396 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultStylesheet is linked from every chapter. It is tuned for e-ink
+// screens: black text, indented paragraphs without gaps and a compact
+// monospaced font for code.
+const defaultStylesheet = `body {
+  margin: 0 2%;
+}
+p {
+  margin: 0;
+  text-indent: 1.5em;
+  text-align: justify;
+}
+h1 + p, h2 + p, h3 + p, h4 + p, h5 + p, h6 + p,
+hr + p, blockquote p, li p, table p {
+  text-indent: 0;
+}
+h1, h2, h3, h4, h5, h6 {
+  margin: 1.5em 0 0.75em 0;
+  line-height: 1.2;
+  font-weight: bold;
+  page-break-after: avoid;
+}
+h1 {
+  font-size: 1.6em;
+}
+h2 {
+  font-size: 1.35em;
+}
+h3 {
+  font-size: 1.15em;
+}
+h4, h5, h6 {
+  font-size: 1em;
+}
+a {
+  color: #000;
+  text-decoration: underline;
+}
+code {
+  font-family: monospace;
+  font-size: 0.85em;
+}
+pre {
+  margin: 1em 0;
+  padding: 0.5em;
+  border: 1px solid #999;
+  white-space: pre-wrap;
+  text-align: left;
+  text-indent: 0;
+}
+pre code {
+  font-size: 0.8em;
+}
+blockquote {
+  margin: 1em 0 1em 1.5em;
+  padding-left: 0.75em;
+  border-left: 2px solid #999;
+}
+ul, ol {
+  margin: 0.5em 0 0.5em 1.5em;
+  padding-left: 0;
+}
+img {
+  max-width: 100%;
+}
+table {
+  border-collapse: collapse;
+  margin: 1em 0;
+  max-width: 100%;
+  font-size: 0.9em;
+}
+th, td {
+  padding: 0.25em 0.5em;
+  border: 1px solid #999;
+  vertical-align: top;
+}
+th {
+  font-weight: bold;
+}
+dl.table-card {
+  margin: 0.75em 0;
+  padding-top: 0.5em;
+  border-top: 1px solid #999;
+}
+dl.table-card dt {
+  font-weight: bold;
+}
+dl.table-card dd {
+  margin: 0 0 0.25em 1em;
+}
+div.table-image {
+  margin: 1em 0;
+  text-align: center;
+  text-indent: 0;
+}
+hr {
+  margin: 1.5em 25%;
+  border: none;
+  border-top: 1px solid #999;
+}
+.math-display {
+  display: block;
+  margin: 1em 0;
+  text-align: center;
+  text-indent: 0;
+}
+a.noteref, a.noteback {
+  text-decoration: none;
+}
+aside.footnote {
+  margin: 0.5em 0;
+  font-size: 0.9em;
+}
+aside.footnote p {
+  text-indent: 0;
+}
+a.linkref, a.linkback {
+  text-decoration: none;
+}
+div.links p {
+  margin: 0.25em 0;
+  font-size: 0.9em;
+  text-indent: 0;
+  word-wrap: break-word;
+}
+ul.contents, ul.contents ul {
+  list-style-type: none;
+  margin: 0;
+  padding: 0;
+}
+ul.contents ul {
+  margin-left: 1.5em;
+}
+ul.contents li {
+  margin: 0.3em 0;
+}
+ul.contents a {
+  text-decoration: none;
+}
+div.cover {
+  margin: 0;
+  text-align: center;
+  text-indent: 0;
+}
+div.cover img {
+  max-width: 100%;
+  max-height: 100%;
+}
+`
+
+// bookStylesheets returns the stylesheets every chapter links ahead of
+// the custom ones: the default stylesheet, the highlighting of code and the
+// right-to-left overrides.
+func bookStylesheets(opts renderOptions) []string {
+	sheets := []string{defaultStylesheet}
+	if opts.Highlight != nil {
+		sheets = append(sheets, highlightStylesheet(opts.Highlight))
+	}
+	if opts.RTL {
+		sheets = append(sheets, rtlStylesheet)
+	}
+	return sheets
+}
+
+// kindleProperties lists the CSS properties supported by Kindle readers
+// for KF8 books.
+var kindleProperties = map[string]bool{
+	"background-color": true, "background-image": true, "background-position": true,
+	"background-repeat": true, "background-size": true,
+	"border": true, "border-bottom": true, "border-bottom-color": true, "border-bottom-style": true,
+	"border-bottom-width": true, "border-collapse": true, "border-color": true, "border-left": true,
+	"border-left-color": true, "border-left-style": true, "border-left-width": true, "border-radius": true,
+	"border-right": true, "border-right-color": true, "border-right-style": true, "border-right-width": true,
+	"border-spacing": true, "border-style": true, "border-top": true, "border-top-color": true,
+	"border-top-style": true, "border-top-width": true, "border-width": true,
+	"box-sizing": true, "caption-side": true, "clear": true, "color": true, "content": true,
+	"direction": true, "display": true, "empty-cells": true, "float": true,
+	"font": true, "font-family": true, "font-size": true, "font-style": true, "font-variant": true,
+	"font-weight": true, "height": true, "hyphens": true, "-webkit-hyphens": true,
+	"letter-spacing": true, "line-height": true,
+	"list-style": true, "list-style-image": true, "list-style-position": true, "list-style-type": true,
+	"margin": true, "margin-bottom": true, "margin-left": true, "margin-right": true, "margin-top": true,
+	"max-height": true, "max-width": true, "min-height": true, "min-width": true,
+	"orphans": true, "overflow": true,
+	"padding": true, "padding-bottom": true, "padding-left": true, "padding-right": true, "padding-top": true,
+	"page-break-after": true, "page-break-before": true, "page-break-inside": true, "position": true,
+	"src": true, "table-layout": true, "text-align": true, "text-decoration": true, "text-indent": true,
+	"text-transform": true, "unicode-bidi": true, "vertical-align": true, "visibility": true,
+	"white-space": true, "widows": true, "width": true, "word-break": true, "word-spacing": true,
+	"word-wrap": true,
+}
+
+// kindleValues lists the values Kindle readers support for properties
+// that only accept some of the values allowed by CSS.
+var kindleValues = map[string][]string{
+	"position": {"static", "relative"},
+	"display":  {"none", "inline", "block", "inline-block", "list-item", "table", "table-row", "table-cell", "table-header-group", "table-footer-group", "table-row-group", "table-caption", "table-column", "table-column-group"},
+}
+
+// kindleAtRules lists the at-rules Kindle readers support, and whether
+// their block holds rules rather than declarations.
+var kindleAtRules = map[string]bool{
+	"media":     true,
+	"font-face": false,
+	"page":      false,
+	"charset":   false,
+}
+
+// validateStylesheet checks css against the subset of CSS supported by
+// Kindle readers and describes every construct that will be ignored. The
+// stylesheet is embedded as is; the problems are only reported.
+func validateStylesheet(css string) []string {
+	v := &cssValidator{src: css}
+	v.rules(0, false)
+	return v.problems
+}
+
+// cssValidator walks a stylesheet without building a syntax tree.
+type cssValidator struct {
+	src      string
+	pos      int
+	problems []string
+}
+
+func (v *cssValidator) problemf(at int, format string, args ...interface{}) {
+	line := strings.Count(v.src[:at], "\n") + 1
+	v.problems = append(v.problems, fmt.Sprintf("line %d: %s", line, fmt.Sprintf(format, args...)))
+}
+
+// rules reads rules until the end of the enclosing block or stylesheet.
+func (v *cssValidator) rules(depth int, nested bool) {
+	for {
+		start := v.skipSpace()
+		prelude, end := v.until("{;}")
+		switch {
+		case end == 0:
+			return
+		case end == '}':
+			if !nested {
+				v.problemf(start, "unexpected }")
+				continue
+			}
+			return
+		}
+
+		prelude = strings.TrimSpace(prelude)
+		if !strings.HasPrefix(prelude, "@") {
+			if end == ';' {
+				v.problemf(start, "unexpected ; after %q", truncate(prelude, 32))
+				continue
+			}
+			v.declarations()
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimPrefix(strings.Fields(prelude)[0], "@"))
+		holdsRules, supported := kindleAtRules[name]
+		if !supported {
+			v.problemf(start, "@%s is not supported by Kindle", name)
+		}
+		if end == ';' {
+			continue
+		}
+		if holdsRules && depth < 8 {
+			v.rules(depth+1, true)
+		} else if supported {
+			v.declarations()
+		} else {
+			v.skipBlock()
+		}
+	}
+}
+
+// declarations reads the declarations of a block up to its closing brace.
+func (v *cssValidator) declarations() {
+	for {
+		start := v.skipSpace()
+		decl, end := v.until(";}")
+		if decl = strings.TrimSpace(decl); decl != "" {
+			v.declaration(start, decl)
+		}
+		if end != ';' {
+			return
+		}
+	}
+}
+
+func (v *cssValidator) declaration(at int, decl string) {
+	prop, value, ok := strings.Cut(decl, ":")
+	if !ok {
+		v.problemf(at, "malformed declaration %q", truncate(decl, 32))
+		return
+	}
+	prop = strings.ToLower(strings.TrimSpace(prop))
+	value = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important")))
+	if strings.HasPrefix(prop, "--") {
+		v.problemf(at, "custom property %s is not supported by Kindle", prop)
+		return
+	}
+	if !kindleProperties[prop] {
+		v.problemf(at, "property %s is not supported by Kindle", prop)
+		return
+	}
+	if allowed, ok := kindleValues[prop]; ok {
+		for _, a := range allowed {
+			if value == a || value == "inherit" {
+				return
+			}
+		}
+		v.problemf(at, "%s: %s is not supported by Kindle", prop, value)
+	}
+}
+
+// skipBlock skips a block whose opening brace has been read.
+func (v *cssValidator) skipBlock() {
+	for depth := 1; depth > 0; {
+		_, end := v.until("{}")
+		switch end {
+		case 0:
+			return
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+	}
+}
+
+// skipSpace skips whitespace and comments and returns the new position.
+func (v *cssValidator) skipSpace() int {
+	for v.pos < len(v.src) {
+		switch {
+		case strings.HasPrefix(v.src[v.pos:], "/*"):
+			end := strings.Index(v.src[v.pos+2:], "*/")
+			if end < 0 {
+				v.pos = len(v.src)
+				return v.pos
+			}
+			v.pos += end + 4
+		case strings.ContainsRune(" \t\r\n\f", rune(v.src[v.pos])):
+			v.pos++
+		default:
+			return v.pos
+		}
+	}
+	return v.pos
+}
+
+// until reads up to the first of the stop characters outside strings,
+// comments and parentheses, and returns the text read and the stop
+// character, which is consumed. At the end of the input it returns 0.
+func (v *cssValidator) until(stops string) (string, byte) {
+	var sb strings.Builder
+	parens := 0
+	for v.pos < len(v.src) {
+		c := v.src[v.pos]
+		switch {
+		case strings.HasPrefix(v.src[v.pos:], "/*"):
+			end := strings.Index(v.src[v.pos+2:], "*/")
+			if end < 0 {
+				v.pos = len(v.src)
+				return sb.String(), 0
+			}
+			v.pos += end + 4
+			continue
+		case c == '"' || c == '\'':
+			end := v.pos + 1
+			for end < len(v.src) && v.src[end] != c && v.src[end] != '\n' {
+				if v.src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(v.src))
+			sb.WriteString(v.src[v.pos:end])
+			v.pos = end
+			continue
+		case c == '(':
+			parens++
+		case c == ')' && parens > 0:
+			parens--
+		case parens == 0 && strings.IndexByte(stops, c) >= 0:
+			v.pos++
+			return sb.String(), c
+		}
+		sb.WriteByte(c)
+		v.pos++
+	}
+	return sb.String(), 0
+}
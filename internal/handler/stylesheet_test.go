@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateStylesheet(t *testing.T) {
+	tests := []struct {
+		name string
+		css  string
+		want []string
+	}{
+		{
+			name: "supported",
+			css:  "@charset \"utf-8\";\np, li { margin: 0 0 1em; text-indent: 1.5em !important; }\n/* a comment { */\n@media amzn-kf8 { h1 { font-size: 2em } }\n",
+		},
+		{
+			name: "unsupported property",
+			css:  "p {\n  color: red;\n  transform: rotate(3deg);\n}\n",
+			want: []string{"line 3: property transform is not supported by Kindle"},
+		},
+		{
+			name: "unsupported value",
+			css:  "div { display: flex; position: fixed; display: INHERIT; }",
+			want: []string{"line 1: display: flex is not supported by Kindle", "line 1: position: fixed is not supported by Kindle"},
+		},
+		{
+			name: "custom property",
+			css:  ":root { --accent: #333; }",
+			want: []string{"line 1: custom property --accent is not supported by Kindle"},
+		},
+		{
+			name: "unsupported at-rules",
+			css:  "@import url(\"a.css\");\n@keyframes spin { from { color: red } to { color: blue } }\np { colour: red }\n",
+			want: []string{
+				"line 1: @import is not supported by Kindle",
+				"line 2: @keyframes is not supported by Kindle",
+				"line 3: property colour is not supported by Kindle",
+			},
+		},
+		{
+			name: "rules inside media queries",
+			css:  "@media print {\n  p { float: left; }\n  pre { tab-size: 4 }\n}\n",
+			want: []string{"line 3: property tab-size is not supported by Kindle"},
+		},
+		{
+			name: "font face",
+			css:  "@font-face { font-family: \"A;B\"; src: url(\"a{b}.ttf\"); }",
+		},
+		{
+			name: "malformed",
+			css:  "p { color }\n}\nh1;\n",
+			want: []string{
+				"line 1: malformed declaration \"color\"",
+				"line 2: unexpected }",
+				"line 3: unexpected ; after \"h1\"",
+			},
+		},
+		{
+			name: "unterminated",
+			css:  "p { color: red; /* a comment",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateStylesheet(tt.css); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("problems = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultStylesheetIsValid(t *testing.T) {
+	if problems := validateStylesheet(defaultStylesheet); len(problems) > 0 {
+		t.Errorf("default stylesheet: %q", problems)
+	}
+}
+
+func TestConvertStylesheet(t *testing.T) {
+	markdown := archiveEntry{name: "a.md", body: "# A\n\nText.\n"}
+	rec := convertRequest(t, testConfig(), nil, map[string]archiveEntry{
+		"markdown":   markdown,
+		"stylesheet": {name: "style.css", body: "p { display: grid }\n"},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("response = %d %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Values(headerConversionWarning); len(got) != 1 || !strings.Contains(got[0], "display: grid") {
+		t.Errorf("warnings = %q", got)
+	}
+
+	rec = convertRequest(t, testConfig(), nil, map[string]archiveEntry{
+		"markdown":   markdown,
+		"stylesheet": {name: "style.css", body: "p { font-family: \"Caf\xe9\" }\n"},
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("response to a stylesheet in Latin-1 = %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+
+	"github.com/Amin-MAG/md2azw3/internal/tableimg"
+)
+
+// Table layouts. A table can ask for one with a block attribute such as
+// "{.cards}" on the line before it.
+const (
+	// tablesKeep leaves tables as they are.
+	tablesKeep = "keep"
+	// tablesCards writes every row of a table as a card: a definition
+	// list pairing the column headers with the cells of the row.
+	tablesCards = "cards"
+	// tablesImage draws tables as images, with their text as alt text.
+	tablesImage = "image"
+)
+
+// defaultTableColumns is the number of columns a table may have before it
+// is considered too wide for the screen of an e-ink reader.
+const defaultTableColumns = 4
+
+// tableCardClass marks the definition lists tables are turned into.
+const tableCardClass = "table-card"
+
+// tableSize is the em size tables are drawn at, in pixels.
+const tableSize = 32
+
+// layoutTables rewrites the tables of doc that are too wide for the screen
+// of an e-ink reader, those with more than maxColumns columns, in the given
+// layout. The layout a table asks for itself wins over both. Tables that
+// cannot be drawn as images become cards and are reported as warnings.
+func layoutTables(doc ast.Node, layout string, maxColumns int, images *bookImages, report *conversionReport) {
+	var tables []*ast.Table
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if table, ok := node.(*ast.Table); ok && entering {
+			tables = append(tables, table)
+			return ast.SkipChildren
+		}
+		return ast.GoToNext
+	})
+
+	// Change the nodes after the walk so it does not see the new ones
+	for _, table := range tables {
+		switch tableLayout(table, layout, maxColumns) {
+		case tablesImage:
+			markup, err := tableImage(table, images)
+			if err == nil {
+				replaceNode(table, []ast.Node{&ast.HTMLBlock{Leaf: ast.Leaf{Literal: []byte(markup)}}})
+				continue
+			}
+			report.Warnf("table %q not drawn as an image, written as cards: %s", truncate(tableText(table), 64), err)
+			replaceNode(table, tableCards(table))
+		case tablesCards:
+			replaceNode(table, tableCards(table))
+		}
+	}
+}
+
+// tableLayout returns the layout of a table: the one it asks for, else
+// layout if it is wider than maxColumns.
+func tableLayout(table *ast.Table, layout string, maxColumns int) string {
+	for _, l := range []string{tablesKeep, tablesCards, tablesImage} {
+		if hasClass(table, l) {
+			return l
+		}
+	}
+	if tableColumns(table) > maxColumns {
+		return layout
+	}
+	return tablesKeep
+}
+
+// tableRows returns the rows of a table, header rows first.
+func tableRows(table *ast.Table) (header, body []*ast.TableRow) {
+	for _, part := range table.GetChildren() {
+		for _, child := range part.GetChildren() {
+			row, ok := child.(*ast.TableRow)
+			if !ok {
+				continue
+			}
+			if _, ok := part.(*ast.TableHeader); ok {
+				header = append(header, row)
+			} else {
+				body = append(body, row)
+			}
+		}
+	}
+	return header, body
+}
+
+// tableColumns returns the number of columns of a table.
+func tableColumns(table *ast.Table) int {
+	header, body := tableRows(table)
+	columns := 0
+	for _, row := range append(header, body...) {
+		n := 0
+		for _, cell := range row.GetChildren() {
+			n += cellSpan(cell)
+		}
+		columns = max(columns, n)
+	}
+	return columns
+}
+
+func cellSpan(cell ast.Node) int {
+	if c, ok := cell.(*ast.TableCell); ok && c.ColSpan > 1 {
+		return c.ColSpan
+	}
+	return 1
+}
+
+// columnHeaders returns the text of the last header row of a table by
+// column, spanning headers repeated for every column they cover.
+func columnHeaders(table *ast.Table) []string {
+	header, _ := tableRows(table)
+	if len(header) == 0 {
+		return nil
+	}
+	var headers []string
+	for _, cell := range header[len(header)-1].GetChildren() {
+		for i := 0; i < cellSpan(cell); i++ {
+			headers = append(headers, plainText(cell))
+		}
+	}
+	return headers
+}
+
+// tableCards returns the cards a table is written as, one definition list
+// per body row. Cells are moved into the cards, headers are copied as text.
+func tableCards(table *ast.Table) []ast.Node {
+	headers := columnHeaders(table)
+	_, body := tableRows(table)
+
+	var cards []ast.Node
+	for _, row := range body {
+		card := &ast.List{ListFlags: ast.ListTypeDefinition, Tight: true}
+		card.Attribute = &ast.Attribute{Classes: [][]byte{[]byte(tableCardClass)}}
+		col := 0
+		for _, cell := range row.GetChildren() {
+			header := ""
+			if col < len(headers) {
+				header = headers[col]
+			}
+			col += cellSpan(cell)
+			if len(cell.GetChildren()) == 0 {
+				continue
+			}
+			if header != "" {
+				term := &ast.ListItem{ListFlags: ast.ListTypeDefinition | ast.ListTypeTerm}
+				prependChild(term, &ast.Text{Leaf: ast.Leaf{Literal: []byte(header)}})
+				term.SetParent(card)
+				card.Children = append(card.Children, term)
+			}
+			def := &ast.ListItem{ListFlags: ast.ListTypeDefinition}
+			children := cell.GetChildren()
+			for _, child := range children {
+				child.SetParent(def)
+			}
+			def.SetChildren(children)
+			def.SetParent(card)
+			card.Children = append(card.Children, def)
+		}
+		if len(card.Children) > 0 {
+			cards = append(cards, card)
+		}
+	}
+	return cards
+}
+
+// tableImage draws a table, embeds the image into the book and returns
+// the markup showing it. The alt text reads the table row by row.
+func tableImage(table *ast.Table, images *bookImages) (string, error) {
+	header, body := tableRows(table)
+	var rows [][]tableimg.Cell
+	for _, row := range append(header, body...) {
+		var cells []tableimg.Cell
+		for _, node := range row.GetChildren() {
+			cell, ok := node.(*ast.TableCell)
+			if !ok {
+				continue
+			}
+			c := tableimg.Cell{Text: plainText(cell), Header: cell.IsHeader, Span: cell.ColSpan}
+			switch cell.Align {
+			case ast.TableAlignmentCenter:
+				c.Align = tableimg.Center
+			case ast.TableAlignmentRight:
+				c.Align = tableimg.Right
+			}
+			cells = append(cells, c)
+		}
+		rows = append(rows, cells)
+	}
+
+	img, err := tableimg.Render(rows, tableSize)
+	if err != nil {
+		return "", err
+	}
+	text := tableText(table)
+	ref, err := images.embed("table:"+text, img)
+	if err != nil {
+		return "", err
+	}
+
+	var alt bytes.Buffer
+	html.EscapeHTML(&alt, []byte(text))
+	return fmt.Sprintf("<div class=\"table-image\"><img src=\"%s\" alt=\"%s\"/></div>\n", ref, alt.String()), nil
+}
+
+// tableText returns the text of a table read row by row, every cell
+// prefixed with its column header.
+func tableText(table *ast.Table) string {
+	headers := columnHeaders(table)
+	_, body := tableRows(table)
+
+	var rows []string
+	if len(body) == 0 {
+		rows = append(rows, strings.Join(headers, ", "))
+	}
+	for _, row := range body {
+		var cells []string
+		col := 0
+		for _, cell := range row.GetChildren() {
+			text := plainText(cell)
+			if col < len(headers) && headers[col] != "" {
+				text = headers[col] + ": " + text
+			}
+			col += cellSpan(cell)
+			cells = append(cells, text)
+		}
+		rows = append(rows, strings.Join(cells, ", ")+".")
+	}
+	return strings.Join(rows, " ")
+}
+
+// renderTableCell writes the opening tag of a table cell. The alignment
+// is set as a style, as the align attribute loses against the text-align
+// of the stylesheet.
+func renderTableCell(w io.Writer, cell *ast.TableCell) {
+	tag := "td"
+	if cell.IsHeader {
+		tag = "th"
+	}
+	fmt.Fprintf(w, "<%s", tag)
+	if align := cell.Align.String(); align != "" {
+		fmt.Fprintf(w, ` style="text-align: %s"`, align)
+	}
+	if cell.ColSpan > 1 {
+		fmt.Fprintf(w, ` colspan="%d"`, cell.ColSpan)
+	}
+	io.WriteString(w, ">")
+}
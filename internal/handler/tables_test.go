@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLayoutTables(t *testing.T) {
+	dialect := markdownDialect{Extensions: markdownDialects[dialectDefault].Extensions | requiredExtensions}
+	narrow := "| A | B |\n|---|--:|\n| 1 | 2 |\n"
+	wide := "| A | B | C |\n|---|---|---|\n| 1 | *2* | 3 |\n| 4 | | 6 |\n"
+	wideCards := "<dl class=\"table-card\">\n<dt>A</dt>\n<dd>1</dd>\n<dt>B</dt>\n<dd><em>2</em></dd>\n<dt>C</dt>\n<dd>3</dd>\n</dl>\n\n" +
+		"<dl class=\"table-card\">\n<dt>A</dt>\n<dd>4</dd>\n<dt>C</dt>\n<dd>6</dd>\n</dl>\n"
+	wideImage := "<div class=\"table-image\"><img src=\"book:image:1\" alt=\"A: 1, B: 2, C: 3. A: 4, "
+	tests := []struct {
+		name    string
+		source  string
+		layout  string
+		want    string
+		images  int
+		warning string
+	}{
+		{
+			name:   "narrow table kept",
+			source: narrow,
+			layout: tablesCards,
+			want:   "<table>\n<thead>\n<tr><th>A</th>\n<th style=\"text-align: right\">B</th>\n</tr>\n</thead>\n\n<tbody>\n<tr><td>1</td>\n<td style=\"text-align: right\">2</td>\n</tr>\n</tbody>\n</table>\n",
+		},
+		{
+			name:   "wide table as cards",
+			source: wide,
+			layout: tablesCards,
+			want:   wideCards,
+		},
+		{
+			name:   "wide table as an image",
+			source: wide,
+			layout: tablesImage,
+			want:   wideImage,
+			images: 1,
+		},
+		{
+			name:   "wide table kept",
+			source: wide,
+			layout: tablesKeep,
+			want:   "<table>\n",
+		},
+		{
+			name:   "layout asked for by the table",
+			source: "{.cards}\n" + narrow,
+			layout: tablesImage,
+			want:   "<dl class=\"table-card\">\n<dt>A</dt>\n<dd>1</dd>\n<dt>B</dt>\n<dd>2</dd>\n</dl>\n",
+		},
+		{
+			name:   "wide table kept on request",
+			source: "{.keep}\n" + wide,
+			layout: tablesCards,
+			want:   "<table class=\"keep\">\n",
+		},
+		{
+			name:    "text the fonts cannot draw",
+			source:  "| A | B | C |\n|---|---|---|\n| ۱ | ۲ | ۳ |\n",
+			layout:  tablesImage,
+			want:    "<dl class=\"table-card\">\n<dt>A</dt>\n<dd>۱</dd>\n",
+			warning: `table "A: ۱, B: ۲, C: ۳." not drawn as an image, written as cards: no glyph for '۱'`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &conversionReport{}
+			images := newBookImages("", nil, testImageOptions, report)
+			doc := parseMarkdown([]byte(tt.source), dialect)
+			layoutTables(doc, tt.layout, 2, images, report)
+			if got := mdToHTML(doc, renderOptions{Dialect: dialect}); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("html = %q, want it to start with %q", got, tt.want)
+			}
+			if len(images.Images) != tt.images {
+				t.Errorf("%d images embedded, want %d", len(images.Images), tt.images)
+			}
+			switch {
+			case tt.warning == "" && len(report.Warnings) > 0:
+				t.Errorf("warnings = %q", report.Warnings)
+			case tt.warning != "" && (len(report.Warnings) != 1 || report.Warnings[0] != tt.warning):
+				t.Errorf("warnings = %q, want %q", report.Warnings, tt.warning)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// noTOCClass marks a heading that is left out of the table of contents,
+// e.g. with a "{.notoc}" block attribute on the line before it.
+const noTOCClass = "notoc"
+
+// heading is a heading found inside a rendered chapter.
+type heading struct {
+	Level int
+	Title string
+	ID    string
+	NoTOC bool
+}
+
+// tocEntry is a node of the book's navigation tree.
+type tocEntry struct {
+	Title string
+	// Chapter is the index of the chapter the entry points into.
+	Chapter int
+	// ID is the element id the entry points at inside its chapter.
+	// It is empty for entries that point at the start of the chapter.
+	ID       string
+	Children []*tocEntry
+}
+
+// collectHeadings returns the headings of a section document in order.
+// The heading that starts the chapter itself is skipped.
+func collectHeadings(doc *ast.Document, chapterHeading *ast.Heading) []heading {
+	var headings []heading
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		h, ok := node.(*ast.Heading)
+		if !ok || !entering {
+			return ast.GoToNext
+		}
+		if h != chapterHeading && !h.IsTitleblock {
+			headings = append(headings, heading{
+				Level: h.Level,
+				Title: headingText(h),
+				ID:    h.HeadingID,
+				NoTOC: hasClass(h, noTOCClass),
+			})
+		}
+		return ast.SkipChildren
+	})
+	return headings
+}
+
+// buildTOC arranges the chapters and their headings into a tree that
+// mirrors the heading hierarchy, at most maxDepth levels deep.
+func buildTOC(chapters []chapter, maxDepth int) []*tocEntry {
+	type level struct {
+		entry *tocEntry
+		level int
+	}
+
+	root := &tocEntry{}
+	for i, chap := range chapters {
+		stack := []level{{entry: root}}
+		if !chap.NoTOC {
+			entry := &tocEntry{Title: chap.Title, Chapter: i}
+			root.Children = append(root.Children, entry)
+			stack = append(stack, level{entry: entry, level: chap.Level})
+		}
+
+		for _, h := range chap.Headings {
+			if h.NoTOC || h.ID == "" || h.Title == "" {
+				continue
+			}
+			for len(stack) > 1 && stack[len(stack)-1].level >= h.Level {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack)-1 >= maxDepth {
+				continue
+			}
+			entry := &tocEntry{Title: h.Title, Chapter: i, ID: h.ID}
+			parent := stack[len(stack)-1].entry
+			parent.Children = append(parent.Children, entry)
+			stack = append(stack, level{entry: entry, level: h.Level})
+		}
+	}
+	return root.Children
+}
+
+// hasClass reports whether a block node carries the given attribute class.
+func hasClass(node ast.Node, class string) bool {
+	var attr *ast.Attribute
+	if c := node.AsContainer(); c != nil {
+		attr = c.Attribute
+	}
+	if l := node.AsLeaf(); l != nil && attr == nil {
+		attr = l.Attribute
+	}
+	if attr == nil {
+		return false
+	}
+	for _, c := range attr.Classes {
+		if string(c) == class {
+			return true
+		}
+	}
+	return false
+}
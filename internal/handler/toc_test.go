@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// formatTOC writes the entries of toc one per line, indented by depth.
+func formatTOC(toc []*tocEntry) string {
+	var sb strings.Builder
+	var write func(entries []*tocEntry, depth int)
+	write = func(entries []*tocEntry, depth int) {
+		for _, e := range entries {
+			fmt.Fprintf(&sb, "%s%s %d#%s\n", strings.Repeat("  ", depth), e.Title, e.Chapter, e.ID)
+			write(e.Children, depth+1)
+		}
+	}
+	write(toc, 0)
+	return sb.String()
+}
+
+func TestBuildTOC(t *testing.T) {
+	chapters := []chapter{
+		{Title: "Preface", Level: 1},
+		{Title: "One", Level: 1, Headings: []heading{
+			{Level: 2, Title: "A", ID: "a"},
+			{Level: 3, Title: "A.1", ID: "a1"},
+			{Level: 4, Title: "A.1.1", ID: "a11"},
+			{Level: 2, Title: "B", ID: "b"},
+			{Level: 2, Title: "Hidden", ID: "hidden", NoTOC: true},
+			{Level: 2, Title: "No id"},
+		}},
+		{Title: "Appendix", Level: 1, NoTOC: true, Headings: []heading{
+			{Level: 2, Title: "C", ID: "c"},
+			{Level: 3, Title: "C.1", ID: "c1"},
+		}},
+	}
+	tests := []struct {
+		name     string
+		maxDepth int
+		want     string
+	}{
+		{
+			name:     "chapters only",
+			maxDepth: 1,
+			want: "Preface 0#\n" +
+				"One 1#\n" +
+				"C 2#c\n",
+		},
+		{
+			name:     "two levels",
+			maxDepth: 2,
+			want: "Preface 0#\n" +
+				"One 1#\n" +
+				"  A 1#a\n" +
+				"  B 1#b\n" +
+				"C 2#c\n" +
+				"  C.1 2#c1\n",
+		},
+		{
+			name:     "all levels",
+			maxDepth: 6,
+			want: "Preface 0#\n" +
+				"One 1#\n" +
+				"  A 1#a\n" +
+				"    A.1 1#a1\n" +
+				"      A.1.1 1#a11\n" +
+				"  B 1#b\n" +
+				"C 2#c\n" +
+				"  C.1 2#c1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatTOC(buildTOC(chapters, tt.maxDepth)); got != tt.want {
+				t.Errorf("buildTOC:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+	"golang.org/x/text/language"
+)
+
+// Typography modes.
+const (
+	// typographyDialect leaves quotes and dashes to the markdown dialect.
+	typographyDialect = "dialect"
+	// typographyLocale sets quotes and dashes after the book language.
+	typographyLocale = "locale"
+)
+
+// smartypantsFlags are the renderer flags of the English typography the
+// typography pass replaces.
+const smartypantsFlags = html.Smartypants | html.SmartypantsFractions | html.SmartypantsDashes |
+	html.SmartypantsLatexDashes | html.SmartypantsAngledQuotes | html.SmartypantsQuotesNBSP
+
+// Narrow and regular no-break spaces, which keep French punctuation on
+// the line of the word it belongs to.
+const (
+	narrowNBSP = "\u202f"
+	nbsp       = "\u00a0"
+)
+
+// quoteStyle holds the quotation marks of a language, with the inner pair
+// used for quotes within quotes.
+type quoteStyle struct {
+	Open, Close           string
+	InnerOpen, InnerClose string
+	// French sets a narrow no-break space before the high punctuation
+	// marks ; ! ? and a no-break space before the colon.
+	French bool
+}
+
+var (
+	englishQuotes = quoteStyle{Open: "“", Close: "”", InnerOpen: "‘", InnerClose: "’"}
+	germanQuotes  = quoteStyle{Open: "„", Close: "“", InnerOpen: "‚", InnerClose: "‘"}
+	swissQuotes   = quoteStyle{Open: "«", Close: "»", InnerOpen: "‹", InnerClose: "›"}
+	frenchQuotes  = quoteStyle{Open: "«" + narrowNBSP, Close: narrowNBSP + "»", InnerOpen: "“", InnerClose: "”", French: true}
+	russianQuotes = quoteStyle{Open: "«", Close: "»", InnerOpen: "„", InnerClose: "“"}
+	polishQuotes  = quoteStyle{Open: "„", Close: "”", InnerOpen: "«", InnerClose: "»"}
+	swedishQuotes = quoteStyle{Open: "”", Close: "”", InnerOpen: "’", InnerClose: "’"}
+	// Guillemets without spaces, with English quotes inside, as used in
+	// Persian, Arabic and the Romance languages other than French.
+	guillemetQuotes = quoteStyle{Open: "«", Close: "»", InnerOpen: "“", InnerClose: "”"}
+)
+
+// quoteStyleFor returns the quotation marks of the language, English ones
+// for languages without a style of their own.
+func quoteStyleFor(tag language.Tag) *quoteStyle {
+	base, _ := tag.Base()
+	region, _ := tag.Region()
+	switch base.String() {
+	case "de":
+		if region.String() == "CH" || region.String() == "LI" {
+			return &swissQuotes
+		}
+		return &germanQuotes
+	case "fr":
+		if region.String() == "CH" {
+			return &swissQuotes
+		}
+		return &frenchQuotes
+	case "ru", "uk", "be":
+		return &russianQuotes
+	case "pl", "cs", "sk", "hu", "ro", "bg", "hr", "sl", "lt":
+		return &polishQuotes
+	case "sv", "fi":
+		return &swedishQuotes
+	case "fa", "ar", "ur", "ckb", "ps", "es", "it", "pt", "ca", "el", "tr", "uz":
+		return &guillemetQuotes
+	}
+	return &englishQuotes
+}
+
+// applyTypography replaces the straight quotes, double and triple hyphens
+// and three dots in the text of doc with the quotation marks of style,
+// dashes and ellipses. Code, math, raw HTML and the text of bare links are
+// left untouched.
+func applyTypography(doc ast.Node, style *quoteStyle) {
+	t := typesetter{style: style, prev: ' '}
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch n := node.(type) {
+		case *ast.Paragraph, *ast.Heading, *ast.TableCell, *ast.ListItem, *ast.BlockQuote, *ast.Caption:
+			t.prev, t.inner = ' ', false
+		case *ast.Softbreak, *ast.Hardbreak:
+			t.prev = ' '
+		case *ast.Code, *ast.Math:
+			t.prev = 'x'
+		case *ast.MathBlock:
+			return ast.SkipChildren
+		case *ast.Link:
+			if len(n.Children) == 1 && isBareLink(n) {
+				return ast.SkipChildren
+			}
+		case *ast.Text:
+			n.Literal = []byte(t.typeset(string(n.Literal)))
+		}
+		return ast.GoToNext
+	})
+}
+
+// isBareLink reports whether the text of link is its destination, as for
+// autolinked URLs and e-mail addresses.
+func isBareLink(link *ast.Link) bool {
+	text, ok := link.Children[0].(*ast.Text)
+	if !ok {
+		return false
+	}
+	dest := strings.TrimPrefix(string(link.Destination), "mailto:")
+	return string(text.Literal) == dest
+}
+
+// typesetter carries the context of the text typeset so far across the
+// text nodes of a block, so a quote opened in one node is closed in
+// another.
+type typesetter struct {
+	style *quoteStyle
+	// prev is the last character written, or the straight quote for a
+	// closing quotation mark or apostrophe.
+	prev rune
+	// inner is set while an inner quote is open.
+	inner bool
+}
+
+func (t *typesetter) typeset(s string) string {
+	runes := []rune(s)
+	var sb strings.Builder
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		var next rune
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		switch {
+		case r == '"':
+			// A closing mark is remembered as the straight quote, as some
+			// languages close with a mark others open with
+			if opensQuote(t.prev) {
+				sb.WriteString(t.style.Open)
+				r, _ = utf8.DecodeLastRuneInString(t.style.Open)
+			} else {
+				sb.WriteString(t.style.Close)
+			}
+		case r == '\'':
+			switch {
+			case isWordRune(t.prev) && isWordRune(next):
+				// An apostrophe within a word, such as "don't"
+				sb.WriteRune('’')
+			case opensQuote(t.prev) && isWordRune(next) && !unicode.IsDigit(next):
+				sb.WriteString(t.style.InnerOpen)
+				r, _ = utf8.DecodeLastRuneInString(t.style.InnerOpen)
+				t.inner = true
+			case t.inner:
+				sb.WriteString(t.style.InnerClose)
+				t.inner = false
+			default:
+				// An elided beginning or end, such as "'90s" or "goin'"
+				sb.WriteRune('’')
+			}
+		case r == '-' && next == '-':
+			if i+2 < len(runes) && runes[i+2] == '-' {
+				sb.WriteRune('—')
+				i += 2
+			} else {
+				sb.WriteRune('–')
+				i++
+			}
+			r = '—'
+		case r == '.' && next == '.' && i+2 < len(runes) && runes[i+2] == '.':
+			sb.WriteRune('…')
+			i += 2
+			r = '…'
+		case t.style.French && r == ' ' && strings.ContainsRune(";!?", next):
+			sb.WriteString(narrowNBSP)
+		case t.style.French && r == ' ' && next == ':':
+			sb.WriteString(nbsp)
+		case t.style.French && r == ' ' && t.prev == '«':
+			// Typed spaces inside guillemets become the narrow ones
+			sb.WriteString(narrowNBSP)
+		case t.style.French && r == ' ' && next == '»':
+			sb.WriteString(narrowNBSP)
+		default:
+			sb.WriteRune(r)
+		}
+		t.prev = r
+	}
+	return sb.String()
+}
+
+// opensQuote reports whether a quote following prev opens a quotation:
+// at the start of a block, after a space, an opening bracket or a dash.
+func opensQuote(prev rune) bool {
+	return unicode.IsSpace(prev) || strings.ContainsRune("([{<“‘«„‚‹—–-/", prev)
+}
+
+// isWordRune reports whether r is part of a word.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/language"
+)
+
+func TestQuoteStyleFor(t *testing.T) {
+	tests := []struct {
+		lang string
+		want *quoteStyle
+	}{
+		{"en", &englishQuotes},
+		{"en-GB", &englishQuotes},
+		{"ja", &englishQuotes},
+		{"de", &germanQuotes},
+		{"de-AT", &germanQuotes},
+		{"de-CH", &swissQuotes},
+		{"fr", &frenchQuotes},
+		{"fr-CA", &frenchQuotes},
+		{"fr-CH", &swissQuotes},
+		{"ru", &russianQuotes},
+		{"pl", &polishQuotes},
+		{"sv", &swedishQuotes},
+		{"fa", &guillemetQuotes},
+		{"es", &guillemetQuotes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lang, func(t *testing.T) {
+			if got := quoteStyleFor(language.MustParse(tt.lang)); got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyTypography(t *testing.T) {
+	tests := []struct {
+		name   string
+		lang   string
+		source string
+		want   string
+	}{
+		{name: "english quotes", lang: "en", source: `"Hello," she said.`, want: "“Hello,” she said."},
+		{name: "inner quotes", lang: "en", source: `"He said 'no' twice."`, want: "“He said ‘no’ twice.”"},
+		{name: "apostrophes", lang: "en", source: `Don't stop in the '90s, goin' on.`, want: "Don’t stop in the ’90s, goin’ on."},
+		{name: "dashes and ellipsis", lang: "en", source: "1990--2000 --- and so on...", want: "1990–2000 — and so on…"},
+		{name: "german quotes", lang: "de", source: `"Ja 'so' ist es"`, want: "„Ja ‚so‘ ist es“"},
+		{name: "swiss quotes", lang: "de-CH", source: `"Ja"`, want: "«Ja»"},
+		{name: "swedish quotes", lang: "sv", source: `"Ja"`, want: "”Ja”"},
+		{name: "persian quotes", lang: "fa", source: `"سلام"`, want: "«سلام»"},
+		{
+			name:   "french spacing",
+			lang:   "fr",
+			source: `"Oui" ! Vraiment ? Voici : ceci ; cela`,
+			want:   "«" + narrowNBSP + "Oui" + narrowNBSP + "»" + narrowNBSP + "! Vraiment" + narrowNBSP + "? Voici" + nbsp + ": ceci" + narrowNBSP + "; cela",
+		},
+		{name: "quote across emphasis", lang: "en", source: `"*Stop*," he said`, want: "“<em>Stop</em>,” he said"},
+		{name: "code untouched", lang: "en", source: "`\"a\" -- b` and \"c\"", want: "<code>&quot;a&quot; -- b</code> and “c”"},
+		{name: "bare links untouched", lang: "en", source: "<https://example.com/a--b...>", want: ">https://example.com/a--b...</a>"},
+		{name: "each paragraph starts afresh", lang: "en", source: "a\"\n\n\"b", want: "<p>a”</p>\n\n<p>“b</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialect := markdownDialect{Extensions: markdownDialects[dialectDefault].Extensions | requiredExtensions}
+			doc := parseMarkdown([]byte(tt.source), dialect)
+			applyTypography(doc, quoteStyleFor(language.MustParse(tt.lang)))
+			if got := mdToHTML(doc, renderOptions{Dialect: dialect}); !strings.Contains(got, tt.want) {
+				t.Errorf("got  %q\nwant %q in it", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyHTMLTypography(t *testing.T) {
+	tests := []struct {
+		name string
+		lang string
+		src  string
+		want string
+	}{
+		{name: "quotes across elements", lang: "en", src: `<p>"<em>Stop</em>," he said -- twice...</p>`, want: `<p>“<em>Stop</em>,” he said – twice…</p>`},
+		{name: "each block starts afresh", lang: "de", src: `<p>a"</p><p>"b</p>`, want: `<p>a“</p><p>„b</p>`},
+		{name: "code untouched", lang: "en", src: `<p><code>"a" -- b</code> and "c"</p><pre>"d"</pre>`, want: `<p><code>&#34;a&#34; -- b</code> and “c”</p><pre>&#34;d&#34;</pre>`},
+		{name: "math untouched", lang: "en", src: `<p><math><mi>"</mi></math> "a"</p>`, want: `<mi>&#34;</mi></math> “a”</p>`},
+		{name: "bare links untouched", lang: "en", src: `<p><a href="https://example.com/a--b">https://example.com/a--b</a></p>`, want: `>https://example.com/a--b</a>`},
+		{name: "french spacing", lang: "fr", src: `<p>Oui !</p>`, want: "<p>Oui" + narrowNBSP + "!</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := htmlBody(sourceDoc{Source: []byte(tt.src)})
+			applyHTMLTypography(body, quoteStyleFor(language.MustParse(tt.lang)))
+			var nodes []*html.Node
+			for c := body.FirstChild; c != nil; c = c.NextSibling {
+				nodes = append(nodes, c)
+			}
+			if got := renderHTML(nodes); !strings.Contains(got, tt.want) {
+				t.Errorf("got  %s\nwant %s in it", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertTypographyOption(t *testing.T) {
+	files := map[string]archiveEntry{"markdown": {name: "a.md", body: "# A\n"}}
+	rec := convertRequest(t, testConfig(), map[string]string{"typography": "smart"}, files)
+	if want := "typography must be dialect or locale"; rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("response = %d %s, want 400 with %q", rec.Code, rec.Body, want)
+	}
+}
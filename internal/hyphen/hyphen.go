@@ -0,0 +1,220 @@
+// Package hyphen finds the points words can be broken at, with the TeX
+// hyphenation patterns of their language and Liang's algorithm.
+package hyphen
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/language"
+)
+
+// patternFS holds the hyph-utf8 patterns and exceptions of every language.
+// See patterns/README.md for their origin.
+//
+//go:embed patterns/*.txt
+var patternFS embed.FS
+
+// patternSet names the pattern file of a language and the number of
+// letters that must stay on either side of a break.
+type patternSet struct {
+	name              string
+	leftMin, rightMin int
+}
+
+// patternSets maps language tags, with or without a region, to their
+// patterns. The region specific entries are tried first.
+var patternSets = map[string]patternSet{
+	"da":    {"da", 2, 2},
+	"de":    {"de-1996", 2, 2},
+	"de-CH": {"de-ch-1901", 2, 2},
+	"de-LI": {"de-ch-1901", 2, 2},
+	"en":    {"en-us", 2, 3},
+	"en-GB": {"en-gb", 2, 3},
+	"en-AU": {"en-gb", 2, 3},
+	"en-IE": {"en-gb", 2, 3},
+	"en-IN": {"en-gb", 2, 3},
+	"en-NZ": {"en-gb", 2, 3},
+	"en-ZA": {"en-gb", 2, 3},
+	"es":    {"es", 2, 2},
+	"fr":    {"fr", 2, 3},
+	"it":    {"it", 2, 2},
+	"nb":    {"nb", 2, 2},
+	"nn":    {"nb", 2, 2},
+	"no":    {"nb", 2, 2},
+	"nl":    {"nl", 2, 2},
+	"pt":    {"pt", 2, 3},
+	"ru":    {"ru", 2, 2},
+	"sv":    {"sv", 2, 2},
+}
+
+// Hyphenator breaks the words of one language.
+type Hyphenator struct {
+	set patternSet
+	// patterns maps the letters of a pattern to the values between them,
+	// one more than there are letters.
+	patterns map[string][]byte
+	// exceptions maps words to their break points, overriding patterns.
+	exceptions map[string][]int
+	// maxLen is the number of letters of the longest pattern.
+	maxLen int
+}
+
+var (
+	mu          sync.Mutex
+	hyphenators = make(map[string]*Hyphenator)
+)
+
+// New returns the hyphenator of the language. It reports false if there
+// are no patterns for the language.
+func New(tag language.Tag) (*Hyphenator, bool) {
+	base, _ := tag.Base()
+	region, _ := tag.Region()
+	set, ok := patternSets[base.String()+"-"+region.String()]
+	if !ok {
+		if set, ok = patternSets[base.String()]; !ok {
+			return nil, false
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if h, ok := hyphenators[set.name]; ok {
+		return h, true
+	}
+	h := &Hyphenator{set: set, patterns: make(map[string][]byte), exceptions: make(map[string][]int)}
+	h.loadPatterns(set.name)
+	h.loadExceptions(set.name)
+	hyphenators[set.name] = h
+	return h, true
+}
+
+// loadPatterns reads patterns such as "a1b2c", digits giving the value of
+// the point between the letters around them.
+func (h *Hyphenator) loadPatterns(name string) {
+	data, err := patternFS.ReadFile("patterns/hyph-" + name + ".pat.txt")
+	if err != nil {
+		return
+	}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		var letters []rune
+		values := []byte{0}
+		for _, r := range strings.TrimSpace(s.Text()) {
+			if r >= '0' && r <= '9' {
+				values[len(values)-1] = byte(r - '0')
+				continue
+			}
+			letters = append(letters, r)
+			values = append(values, 0)
+		}
+		if len(letters) == 0 {
+			continue
+		}
+		h.patterns[string(letters)] = values
+		if len(letters) > h.maxLen {
+			h.maxLen = len(letters)
+		}
+	}
+}
+
+// loadExceptions reads words with their break points marked by hyphens,
+// such as "ta-ble".
+func (h *Hyphenator) loadExceptions(name string) {
+	data, err := patternFS.ReadFile("patterns/hyph-" + name + ".hyp.txt")
+	if err != nil {
+		return
+	}
+	for _, word := range strings.Fields(string(data)) {
+		var points []int
+		n := 0
+		for _, r := range word {
+			if r == '-' {
+				points = append(points, n)
+				continue
+			}
+			n++
+		}
+		h.exceptions[strings.ReplaceAll(word, "-", "")] = points
+	}
+}
+
+// Points returns the indexes of the runes of word a break may be inserted
+// before, in increasing order.
+func (h *Hyphenator) Points(word string) []int {
+	runes := []rune(strings.Map(normalize, word))
+	if len(runes) < h.set.leftMin+h.set.rightMin {
+		return nil
+	}
+	if points, ok := h.exceptions[string(runes)]; ok {
+		return h.trim(points, len(runes))
+	}
+
+	// Match the patterns at every position of the word marked off with
+	// dots, keeping the highest value of every point
+	padded := append(append([]rune{'.'}, runes...), '.')
+	values := make([]byte, len(padded)+1)
+	for i := range padded {
+		for j := i + 1; j <= len(padded) && j-i <= h.maxLen; j++ {
+			pattern, ok := h.patterns[string(padded[i:j])]
+			if !ok {
+				continue
+			}
+			for k, v := range pattern {
+				if v > values[i+k] {
+					values[i+k] = v
+				}
+			}
+		}
+	}
+
+	// Odd values allow a break, values[i+1] is the point before runes[i]
+	var points []int
+	for i := 1; i < len(runes); i++ {
+		if values[i+1]%2 == 1 {
+			points = append(points, i)
+		}
+	}
+	return h.trim(points, len(runes))
+}
+
+// trim drops the points too close to either end of a word of n runes.
+func (h *Hyphenator) trim(points []int, n int) []int {
+	var kept []int
+	for _, p := range points {
+		if p >= h.set.leftMin && p <= n-h.set.rightMin {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// Hyphenate returns word with hyphen inserted at every break point.
+func (h *Hyphenator) Hyphenate(word, hyphen string) string {
+	points := h.Points(word)
+	if len(points) == 0 {
+		return word
+	}
+	var sb strings.Builder
+	for i, r := range []rune(word) {
+		if len(points) > 0 && points[0] == i {
+			sb.WriteString(hyphen)
+			points = points[1:]
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// normalize lowercases r and spells the typographic apostrophe the way the
+// patterns do.
+func normalize(r rune) rune {
+	if r == '’' {
+		return '\''
+	}
+	return unicode.ToLower(r)
+}
@@ -0,0 +1,61 @@
+package hyphen
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+func TestPoints(t *testing.T) {
+	tests := []struct {
+		lang string
+		word string
+		want []int
+	}{
+		// Patterns
+		{"en", "computer", []int{3}},
+		{"de", "Silbentrennung", []int{3, 6, 10}},
+		{"fr", "ordinateur", []int{2, 4, 6}},
+		{"ru", "компьютер", []int{3, 6}},
+		// Exceptions override the patterns
+		{"en", "hyphenation", []int{2, 6, 7}},
+		{"en", "table", []int{2}},
+		// Capitals match lower case patterns and exceptions
+		{"en", "Hyphenation", []int{2, 6, 7}},
+		// Points too close to the end are dropped, three letters must stay
+		// at the end of English words
+		{"en", "associate", []int{2, 4}},
+		// Words shorter than the letters kept on either side
+		{"en", "a", nil},
+		{"en", "tab", nil},
+		// Regions use their own patterns
+		{"en-GB", "computer", []int{3}},
+		{"de-CH", "Silbentrennung", []int{3, 6, 10}},
+	}
+	for _, tt := range tests {
+		h, ok := New(language.MustParse(tt.lang))
+		if !ok {
+			t.Fatalf("no hyphenator for %s", tt.lang)
+		}
+		if got := h.Points(tt.word); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Points(%q) = %v, want %v", tt.lang, tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestHyphenate(t *testing.T) {
+	h, _ := New(language.English)
+	if got := h.Hyphenate("hyphenation", "-"); got != "hy-phen-a-tion" {
+		t.Errorf("Hyphenate = %q", got)
+	}
+	if got := h.Hyphenate("a", "-"); got != "a" {
+		t.Errorf("Hyphenate = %q", got)
+	}
+}
+
+func TestNewUnsupported(t *testing.T) {
+	if _, ok := New(language.Japanese); ok {
+		t.Error("New(ja) reported patterns")
+	}
+}
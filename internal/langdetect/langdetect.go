@@ -0,0 +1,134 @@
+// Package langdetect guesses the language of a text from the scripts its
+// letters belong to and, within a script, from the frequency of common
+// function words.
+package langdetect
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/language"
+)
+
+// minLetters is the number of letters a text needs before a guess is made.
+const minLetters = 40
+
+// scriptLanguages lists the candidate languages of every script. Scripts
+// with a single candidate are decided by the script alone.
+var scriptLanguages = []struct {
+	script    *unicode.RangeTable
+	languages []string
+}{
+	{unicode.Latin, []string{"en", "de", "fr", "es", "it", "nl", "pt", "sv", "pl", "tr"}},
+	{unicode.Arabic, []string{"fa", "ar", "ur"}},
+	{unicode.Cyrillic, []string{"ru", "uk", "bg"}},
+	{unicode.Hebrew, []string{"he"}},
+	{unicode.Greek, []string{"el"}},
+	{unicode.Han, []string{"zh"}},
+	{unicode.Hangul, []string{"ko"}},
+	{unicode.Thai, []string{"th"}},
+	{unicode.Devanagari, []string{"hi"}},
+	{unicode.Armenian, []string{"hy"}},
+	{unicode.Georgian, []string{"ka"}},
+}
+
+// stopwords holds frequent function words of the languages that share a
+// script with others.
+var stopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "for", "with", "as", "was", "on", "are", "this", "be", "by", "you"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "zu", "den", "mit", "sich", "des", "auf", "für", "ein", "eine", "dem", "auch", "wird"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "du", "que", "pour", "dans", "pas", "qui", "sur", "au", "avec", "sont", "ce"},
+	"es": {"el", "los", "las", "del", "que", "y", "en", "por", "una", "con", "para", "es", "se", "su", "al", "lo", "como", "más"},
+	"it": {"il", "di", "che", "la", "per", "non", "sono", "una", "del", "della", "gli", "con", "è", "nel", "anche", "le", "da", "si"},
+	"nl": {"de", "het", "een", "en", "van", "is", "niet", "dat", "op", "te", "zijn", "voor", "met", "ook", "aan", "wordt", "naar", "bij"},
+	"pt": {"o", "os", "que", "não", "do", "da", "em", "um", "uma", "para", "com", "é", "no", "na", "dos", "se", "mais", "como"},
+	"sv": {"och", "att", "det", "som", "är", "en", "på", "för", "av", "med", "inte", "till", "den", "har", "om", "ett", "jag", "kan"},
+	"pl": {"i", "w", "nie", "się", "na", "że", "jest", "do", "to", "z", "jak", "ale", "co", "tak", "od", "po", "dla", "oraz"},
+	"tr": {"ve", "bir", "bu", "da", "de", "için", "ile", "olarak", "çok", "daha", "ne", "gibi", "olan", "ama", "kadar", "sonra", "değil", "her"},
+	"fa": {"و", "در", "به", "از", "که", "این", "را", "با", "است", "برای", "آن", "یک", "می", "شود", "هم", "تا", "بر", "نیز"},
+	"ar": {"في", "من", "على", "إلى", "أن", "التي", "الذي", "هذا", "عن", "مع", "كان", "هذه", "ما", "لا", "أو", "قد", "كل", "بين"},
+	"ur": {"کے", "میں", "کی", "ہے", "اور", "کو", "سے", "کا", "نے", "یہ", "پر", "ہیں", "کہ", "بھی", "تھا", "ایک", "لیے", "ہو"},
+	"ru": {"и", "в", "не", "на", "что", "с", "по", "как", "это", "из", "для", "он", "его", "но", "от", "к", "так", "все"},
+	"uk": {"і", "в", "не", "на", "що", "з", "до", "як", "це", "та", "для", "від", "його", "але", "є", "у", "ми", "так"},
+	"bg": {"и", "в", "на", "не", "да", "се", "за", "от", "е", "с", "че", "по", "са", "като", "това", "но", "към", "си"},
+}
+
+// Detect guesses the language of text. It reports false when the text is
+// too short or no language stands out.
+func Detect(text string) (language.Tag, bool) {
+	// Count letters per script, kana decides between Chinese and Japanese
+	counts := make([]int, len(scriptLanguages))
+	letters, kana := 0, 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.In(r, unicode.Hiragana, unicode.Katakana) {
+			kana++
+			continue
+		}
+		for i, s := range scriptLanguages {
+			if unicode.Is(s.script, r) {
+				counts[i]++
+				break
+			}
+		}
+	}
+	if letters < minLetters {
+		return language.Und, false
+	}
+	if kana*10 > letters {
+		return language.Japanese, true
+	}
+
+	best := 0
+	for i := range counts {
+		if counts[i] > counts[best] {
+			best = i
+		}
+	}
+	if counts[best]*2 < letters {
+		return language.Und, false
+	}
+
+	candidates := scriptLanguages[best].languages
+	if len(candidates) == 1 {
+		return language.MustParse(candidates[0]), true
+	}
+	code, ok := byStopwords(text, candidates)
+	if !ok {
+		return language.Und, false
+	}
+	return language.MustParse(code), true
+}
+
+// byStopwords picks the candidate language whose function words occur most
+// often in text.
+func byStopwords(text string, candidates []string) (string, bool) {
+	words := make(map[string]int)
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '‌'
+	}) {
+		words[w]++
+	}
+
+	best, bestScore, secondScore := "", 0, 0
+	for _, code := range candidates {
+		score := 0
+		for _, w := range stopwords[code] {
+			score += words[w]
+		}
+		switch {
+		case score > bestScore:
+			best, bestScore, secondScore = code, score, bestScore
+		case score > secondScore:
+			secondScore = score
+		}
+	}
+	// Demand a clear winner rather than a coin toss between neighbours
+	if bestScore == 0 || bestScore*4 < secondScore*5 {
+		return "", false
+	}
+	return best, true
+}
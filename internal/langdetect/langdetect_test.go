@@ -0,0 +1,57 @@
+package langdetect
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"English", "The quick brown fox jumps over the lazy dog, and this is the story of the fox that was on the hill.", "en"},
+		{"German", "Der schnelle braune Fuchs springt über den faulen Hund, und das ist nicht die Geschichte des Fuchses.", "de"},
+		{"French", "Le renard brun rapide saute par-dessus le chien paresseux, et les chiens ne sont pas contents du tout.", "fr"},
+		{"Spanish", "El rápido zorro marrón salta sobre el perro perezoso, y los perros de la casa se quedan con el dueño.", "es"},
+		{"Dutch", "De snelle bruine vos springt over de luie hond, en het is niet de eerste keer dat dit gebeurt bij ons.", "nl"},
+		{"Persian", "روباه قهوه‌ای سریع از روی سگ تنبل می‌پرد و این داستان روباهی است که در جنگل زندگی می‌کرد.", "fa"},
+		{"Arabic", "قفز الثعلب البني السريع فوق الكلب الكسول في الحديقة التي كانت على الطريق إلى المدينة.", "ar"},
+		{"Russian", "Быстрая коричневая лиса прыгает через ленивую собаку, и это не первый раз, что так и было в лесу.", "ru"},
+		{"Hebrew", "השועל החום המהיר קופץ מעל הכלב העצלן, וזה לא הסיפור הראשון על השועל הזה ביער.", "he"},
+		{"Greek", "Η γρήγορη καφέ αλεπού πηδάει πάνω από τον τεμπέλη σκύλο στον κήπο του σπιτιού.", "el"},
+		{"Japanese", "素早い茶色の狐は怠け者の犬を飛び越えます。これは森に住んでいた狐の物語です。ありがとうございました。", "ja"},
+		{"Chinese", "敏捷的棕色狐狸跳过了懒狗。这是一个住在森林里的狐狸的故事，它每天早上都在河边散步，看着太阳升起。", "zh"},
+		{"Latin script mostly", "The quick brown fox jumps over the lazy dog, and this is the story of the fox. Москва", "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Detect(tt.text)
+			if !ok || got.String() != tt.want {
+				t.Errorf("Detect = %v, %v, want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectUndecided(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"empty", ""},
+		{"too short", "Hello world, this is short."},
+		{"no letters", strings.Repeat("1 + 2 = 3; ", 20)},
+		{"no function words", strings.Repeat("Lorem ipsum dolor sit amet ", 5)},
+		{"no script stands out", strings.Repeat("abc абв αβγ אבג ", 5)},
+		{"tie between neighbours", strings.Repeat("the der ", 20)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, ok := Detect(tt.text); ok {
+				t.Errorf("Detect = %v, want no guess", got)
+			}
+		})
+	}
+}
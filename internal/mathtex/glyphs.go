@@ -0,0 +1,279 @@
+package mathtex
+
+import (
+	"math"
+	"strings"
+)
+
+// vectorGlyph draws a symbol missing from the Go fonts with strokes. Its
+// coordinates are in em, with y pointing up from the baseline.
+type vectorGlyph struct {
+	width float64
+	paths [][]point
+	dots  []point
+}
+
+// axisY is the height of the math axis of the Go fonts in em, which
+// relations and operators are centered on.
+const axisY = 0.3
+
+// vectorGlyphs holds the symbols drawn with strokes.
+var vectorGlyphs = map[string]vectorGlyph{
+	"∈": {width: 0.75, paths: [][]point{join(line(0.64, axisY+0.25, 0.4, axisY+0.25), arc(0.4, axisY, 0.25, 0.25, 90, 270), line(0.4, axisY-0.25, 0.64, axisY-0.25)), line(0.15, axisY, 0.64, axisY)}},
+	"∋": mirror(0.75, [][]point{join(line(0.64, axisY+0.25, 0.4, axisY+0.25), arc(0.4, axisY, 0.25, 0.25, 90, 270), line(0.4, axisY-0.25, 0.64, axisY-0.25)), line(0.15, axisY, 0.64, axisY)}),
+	"⊂": {width: 0.75, paths: [][]point{join(line(0.64, axisY+0.25, 0.4, axisY+0.25), arc(0.4, axisY, 0.25, 0.25, 90, 270), line(0.4, axisY-0.25, 0.64, axisY-0.25))}},
+	"⊃": mirror(0.75, [][]point{join(line(0.64, axisY+0.25, 0.4, axisY+0.25), arc(0.4, axisY, 0.25, 0.25, 90, 270), line(0.4, axisY-0.25, 0.64, axisY-0.25))}),
+	"⊆": {width: 0.75, paths: [][]point{join(line(0.64, axisY+0.3, 0.4, axisY+0.3), arc(0.4, axisY+0.1, 0.2, 0.2, 90, 270), line(0.4, axisY-0.1, 0.64, axisY-0.1)), line(0.15, axisY-0.28, 0.64, axisY-0.28)}},
+	"⊇": mirror(0.75, [][]point{join(line(0.64, axisY+0.3, 0.4, axisY+0.3), arc(0.4, axisY+0.1, 0.2, 0.2, 90, 270), line(0.4, axisY-0.1, 0.64, axisY-0.1)), line(0.15, axisY-0.28, 0.64, axisY-0.28)}),
+	"∀": {width: 0.7, paths: [][]point{{{0.08, 0.72}, {0.35, 0}, {0.62, 0.72}}, line(0.2, 0.4, 0.5, 0.4)}},
+	"∃": {width: 0.62, paths: [][]point{{{0.1, 0.72}, {0.5, 0.72}, {0.5, 0}, {0.1, 0}}, line(0.16, 0.36, 0.5, 0.36)}},
+	"∅": {width: 0.7, paths: [][]point{arc(0.35, 0.36, 0.24, 0.36, 0, 360), line(0.12, -0.06, 0.58, 0.78)}},
+	"⇒": {width: 1, paths: [][]point{line(0.1, axisY+0.09, 0.8, axisY+0.09), line(0.1, axisY-0.09, 0.8, axisY-0.09), {{0.65, axisY + 0.25}, {0.9, axisY}, {0.65, axisY - 0.25}}}},
+	"⇐": mirror(1, [][]point{line(0.1, axisY+0.09, 0.8, axisY+0.09), line(0.1, axisY-0.09, 0.8, axisY-0.09), {{0.65, axisY + 0.25}, {0.9, axisY}, {0.65, axisY - 0.25}}}),
+	"⇔": {width: 1.1, paths: [][]point{line(0.2, axisY+0.09, 0.9, axisY+0.09), line(0.2, axisY-0.09, 0.9, axisY-0.09), {{0.35, axisY + 0.25}, {0.1, axisY}, {0.35, axisY - 0.25}}, {{0.75, axisY + 0.25}, {1, axisY}, {0.75, axisY - 0.25}}}},
+	"↦": {width: 1, paths: [][]point{line(0.1, axisY+0.15, 0.1, axisY-0.15), line(0.1, axisY, 0.9, axisY), {{0.72, axisY + 0.15}, {0.9, axisY}, {0.72, axisY - 0.15}}}},
+	"∇": {width: 0.75, paths: [][]point{{{0.05, 0.72}, {0.7, 0.72}, {0.375, 0}, {0.05, 0.72}}}},
+	"△": {width: 0.75, paths: [][]point{{{0.05, 0}, {0.7, 0}, {0.375, 0.72}, {0.05, 0}}}},
+	"∧": {width: 0.7, paths: [][]point{{{0.1, axisY - 0.27}, {0.35, axisY + 0.3}, {0.6, axisY - 0.27}}}},
+	"∨": {width: 0.7, paths: [][]point{{{0.1, axisY + 0.3}, {0.35, axisY - 0.27}, {0.6, axisY + 0.3}}}},
+	"⊥": {width: 0.75, paths: [][]point{line(0.08, 0, 0.67, 0), line(0.375, 0, 0.375, 0.68)}},
+	"∥": {width: 0.4, paths: [][]point{line(0.13, -0.2, 0.13, 0.75), line(0.27, -0.2, 0.27, 0.75)}},
+	"⊕": {width: 0.8, paths: [][]point{arc(0.4, axisY, 0.3, 0.3, 0, 360), line(0.1, axisY, 0.7, axisY), line(0.4, axisY-0.3, 0.4, axisY+0.3)}},
+	"⊗": {width: 0.8, paths: [][]point{arc(0.4, axisY, 0.3, 0.3, 0, 360), line(0.19, axisY-0.21, 0.61, axisY+0.21), line(0.19, axisY+0.21, 0.61, axisY-0.21)}},
+	"⨁": {width: 0.8, paths: [][]point{arc(0.4, axisY, 0.3, 0.3, 0, 360), line(0.1, axisY, 0.7, axisY), line(0.4, axisY-0.3, 0.4, axisY+0.3)}},
+	"⨂": {width: 0.8, paths: [][]point{arc(0.4, axisY, 0.3, 0.3, 0, 360), line(0.19, axisY-0.21, 0.61, axisY+0.21), line(0.19, axisY+0.21, 0.61, axisY-0.21)}},
+	"∐": {width: 0.9, paths: [][]point{line(0.1, 0, 0.8, 0), line(0.22, 0, 0.22, 0.72), line(0.68, 0, 0.68, 0.72), line(0.12, 0.72, 0.32, 0.72), line(0.58, 0.72, 0.78, 0.72)}},
+	"∠": {width: 0.75, paths: [][]point{{{0.65, 0.62}, {0.08, 0}, {0.68, 0}}}},
+	"∝": {width: 0.8, paths: [][]point{join(line(0.72, axisY-0.2, 0.456, axisY+0.085), arc(0.3, axisY, 0.18, 0.17, 30, 330), line(0.456, axisY-0.085, 0.72, axisY+0.2))}},
+	"≪": {width: 1, paths: [][]point{{{0.5, axisY + 0.25}, {0.1, axisY}, {0.5, axisY - 0.25}}, {{0.9, axisY + 0.25}, {0.5, axisY}, {0.9, axisY - 0.25}}}},
+	"≫": mirror(1, [][]point{{{0.5, axisY + 0.25}, {0.1, axisY}, {0.5, axisY - 0.25}}, {{0.9, axisY + 0.25}, {0.5, axisY}, {0.9, axisY - 0.25}}}),
+	"∼": {width: 0.8, paths: [][]point{wave(axisY)}},
+	"≃": {width: 0.8, paths: [][]point{wave(axisY + 0.1), line(0.1, axisY-0.12, 0.7, axisY-0.12)}},
+	"≅": {width: 0.8, paths: [][]point{wave(axisY + 0.2), line(0.1, axisY, 0.7, axisY), line(0.1, axisY-0.18, 0.7, axisY-0.18)}},
+	"∓": {width: 0.75, paths: [][]point{line(0.1, axisY+0.3, 0.65, axisY+0.3), line(0.1, axisY-0.05, 0.65, axisY-0.05), line(0.375, axisY-0.3, 0.375, axisY+0.2)}},
+	"ℵ": {width: 0.7, paths: [][]point{line(0.12, 0.72, 0.58, 0), {{0.32, 0.32}, {0.15, 0.14}, {0.15, 0}}, {{0.42, 0.42}, {0.58, 0.56}, {0.58, 0.72}}}},
+	"⋮": {width: 0.3, dots: []point{{0.15, 0.1}, {0.15, 0.38}, {0.15, 0.66}}},
+	"⋱": {width: 0.9, dots: []point{{0.15, 0.66}, {0.45, 0.38}, {0.75, 0.1}}},
+	"⋯": {width: 0.9, dots: []point{{0.15, axisY}, {0.45, axisY}, {0.75, axisY}}},
+}
+
+// negated maps negated relations to the relation they are drawn from.
+var negated = map[string]string{
+	"∉": "∈", "≮": "<", "≯": ">", "≰": "≤", "≱": "≥", "≢": "≡",
+	"⊄": "⊂", "⊈": "⊆", "≁": "∼", "≉": "≈",
+}
+
+// glyph lays out a symbol from the fonts or from strokes, and reports
+// whether it can be drawn.
+func (r *renderer) glyph(text string, f int, size float64) (box, bool) {
+	if hasGlyphs(fonts[f], text) {
+		return r.text(text, f, size), true
+	}
+	if g, ok := vectorGlyphs[text]; ok {
+		return g.box(size), true
+	}
+	base, ok := negated[text]
+	if !ok {
+		base, ok = strings.CutSuffix(text, "\u0338")
+	}
+	if ok && base != "" {
+		if b, ok := r.glyph(base, f, size); ok {
+			return slashed(b, size), true
+		}
+	}
+	if text == "∮" {
+		if b, ok := r.glyph("∫", f, size); ok {
+			return circled(b, size), true
+		}
+	}
+	return box{}, false
+}
+
+func (g vectorGlyph) box(size float64) box {
+	t := 0.07
+	b := box{w: g.width * size}
+	for _, path := range g.paths {
+		for _, p := range path {
+			b.asc = max(b.asc, (p.y+t/2)*size)
+			b.desc = max(b.desc, -(p.y-t/2)*size)
+		}
+	}
+	for _, p := range g.dots {
+		b.asc = max(b.asc, (p.y+t)*size)
+	}
+	b.draw = func(c *canvas, x, y float64) {
+		for _, path := range g.paths {
+			pts := make([]point, len(path))
+			for i, p := range path {
+				pts[i] = point{x + p.x*size, y - p.y*size}
+			}
+			c.stroke(t*size, pts)
+		}
+		for _, p := range g.dots {
+			c.disc(point{x + p.x*size, y - p.y*size}, t*size)
+		}
+	}
+	return b
+}
+
+// slashed draws a slash through a box, for negated relations.
+func slashed(b box, size float64) box {
+	draw := b.draw
+	b.draw = func(c *canvas, x, y float64) {
+		draw(c, x, y)
+		c.stroke(0.06*size, []point{{x + 0.2*b.w, y + b.desc + 0.05*size}, {x + 0.8*b.w, y - b.asc - 0.05*size}})
+	}
+	return b
+}
+
+// circled draws a small circle over the middle of a box, for contour
+// integrals.
+func circled(b box, size float64) box {
+	draw := b.draw
+	b.draw = func(c *canvas, x, y float64) {
+		draw(c, x, y)
+		center := point{x + b.w/2, y - (b.asc-b.desc)/2}
+		c.stroke(0.05*size, arc(center.x, center.y, 0.18*size, 0.18*size, 0, 360))
+	}
+	return b
+}
+
+// isDelimiter reports whether delimiterBox can draw d.
+func isDelimiter(d string) bool {
+	return strings.Contains("()[]{}|‖⟨⟩⌊⌋⌈⌉/", d) && d != ""
+}
+
+// delimiterBox draws a delimiter stretched to the given height and depth.
+// An empty delimiter leaves a small space.
+func delimiterBox(d string, asc, desc, size float64) box {
+	h := asc + desc
+	var w float64
+	switch d {
+	case "":
+		return box{w: 0.12 * size, asc: asc, desc: desc, class: Ord, draw: func(*canvas, float64, float64) {}}
+	case "(", ")":
+		w = 0.32*size + 0.04*h
+	case "{", "}":
+		w = 0.4*size + 0.03*h
+	case "⟨", "⟩":
+		w = 0.35*size + 0.05*h
+	case "|":
+		w = 0.25 * size
+	case "‖":
+		w = 0.35 * size
+	case "/":
+		w = 0.3*size + 0.2*h
+	default:
+		w = 0.3 * size
+	}
+
+	var paths [][]point
+	switch d {
+	case "(", ")":
+		paths = [][]point{quad(point{0.8, 0}, point{-0.36, 0.5}, point{0.8, 1})}
+	case "[", "]":
+		paths = [][]point{{{0.75, 0}, {0.3, 0}, {0.3, 1}, {0.75, 1}}}
+	case "{", "}":
+		paths = [][]point{join(
+			quad(point{0.85, 0}, point{0.45, 0}, point{0.45, 0.12}),
+			quad(point{0.45, 0.38}, point{0.45, 0.5}, point{0.1, 0.5}),
+			quad(point{0.1, 0.5}, point{0.45, 0.5}, point{0.45, 0.62}),
+			quad(point{0.45, 0.88}, point{0.45, 1}, point{0.85, 1}),
+		)}
+	case "|":
+		paths = [][]point{{{0.5, 0}, {0.5, 1}}}
+	case "‖":
+		paths = [][]point{{{0.35, 0}, {0.35, 1}}, {{0.65, 0}, {0.65, 1}}}
+	case "⟨", "⟩":
+		paths = [][]point{{{0.8, 0}, {0.2, 0.5}, {0.8, 1}}}
+	case "⌊", "⌋":
+		paths = [][]point{{{0.3, 0}, {0.3, 1}, {0.8, 1}}}
+	case "⌈", "⌉":
+		paths = [][]point{{{0.3, 1}, {0.3, 0}, {0.8, 0}}}
+	case "/":
+		paths = [][]point{{{0.85, 0}, {0.15, 1}}}
+	}
+	if strings.Contains(")]}⟩⌋⌉", d) {
+		for _, path := range paths {
+			for i := range path {
+				path[i].x = 1 - path[i].x
+			}
+		}
+	}
+
+	t := max(1, 0.06*size)
+	return box{
+		w:     w,
+		asc:   asc,
+		desc:  desc,
+		class: Ord,
+		draw: func(c *canvas, x, y float64) {
+			for _, path := range paths {
+				pts := make([]point, len(path))
+				for i, p := range path {
+					pts[i] = point{x + p.x*w, y - asc + t/2 + p.y*(h-t)}
+				}
+				c.stroke(t, pts)
+			}
+		},
+	}
+}
+
+// line returns the end points of a straight line.
+func line(x0, y0, x1, y1 float64) []point {
+	return []point{{x0, y0}, {x1, y1}}
+}
+
+// arc returns points along an elliptic arc from angle a0 to a1 in
+// degrees, counterclockwise.
+func arc(cx, cy, rx, ry, a0, a1 float64) []point {
+	const steps = 24
+	pts := make([]point, steps+1)
+	for i := range pts {
+		a := (a0 + (a1-a0)*float64(i)/steps) * math.Pi / 180
+		pts[i] = point{cx + rx*math.Cos(a), cy + ry*math.Sin(a)}
+	}
+	return pts
+}
+
+// quad returns points along a quadratic Bézier curve.
+func quad(p0, c, p1 point) []point {
+	const steps = 16
+	pts := make([]point, steps+1)
+	for i := range pts {
+		t := float64(i) / steps
+		u := 1 - t
+		pts[i] = point{u*u*p0.x + 2*u*t*c.x + t*t*p1.x, u*u*p0.y + 2*u*t*c.y + t*t*p1.y}
+	}
+	return pts
+}
+
+// wave returns a tilde centered at height y.
+func wave(y float64) []point {
+	const steps = 24
+	pts := make([]point, steps+1)
+	for i := range pts {
+		t := float64(i) / steps
+		pts[i] = point{0.1 + 0.6*t, y + 0.07*math.Sin(2*math.Pi*t)}
+	}
+	return pts
+}
+
+// join concatenates paths into one.
+func join(paths ...[]point) []point {
+	var pts []point
+	for _, p := range paths {
+		pts = append(pts, p...)
+	}
+	return pts
+}
+
+// mirror flips the paths of a glyph horizontally.
+func mirror(width float64, paths [][]point) vectorGlyph {
+	for _, path := range paths {
+		for i := range path {
+			path[i].x = width - path[i].x
+		}
+	}
+	return vectorGlyph{width: width, paths: paths}
+}
@@ -0,0 +1,236 @@
+package mathtex
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MathML writes a parsed formula as a MathML math element. The LaTeX
+// source is kept as alternative text and as an annotation; altimg, if
+// set, points at an image of the formula for readers without MathML
+// support.
+func MathML(n Node, tex string, display bool, altimg string) string {
+	w := &mathMLWriter{display: display}
+	w.sb.WriteString(`<math xmlns="http://www.w3.org/1998/Math/MathML"`)
+	if display {
+		w.sb.WriteString(` display="block"`)
+	}
+	w.attr("alttext", tex)
+	if altimg != "" {
+		w.attr("altimg", altimg)
+	}
+	w.sb.WriteString("><semantics>")
+	w.node(n)
+	w.sb.WriteString(`<annotation encoding="application/x-tex">`)
+	w.text(tex)
+	w.sb.WriteString("</annotation></semantics></math>")
+	return w.sb.String()
+}
+
+type mathMLWriter struct {
+	sb      strings.Builder
+	display bool
+}
+
+func (w *mathMLWriter) node(n Node) {
+	switch n := n.(type) {
+	case Row:
+		if len(n.Items) == 1 {
+			w.node(n.Items[0])
+			return
+		}
+		w.sb.WriteString("<mrow>")
+		for _, item := range n.Items {
+			w.node(item)
+		}
+		w.sb.WriteString("</mrow>")
+
+	case Symbol:
+		w.symbol(n)
+
+	case Scripts:
+		limits := false
+		if s, ok := n.Base.(Symbol); ok && w.display {
+			limits = s.Limits
+		}
+		tag := "msubsup"
+		switch {
+		case limits && n.Sup == nil:
+			tag = "munder"
+		case limits && n.Sub == nil:
+			tag = "mover"
+		case limits:
+			tag = "munderover"
+		case n.Sup == nil:
+			tag = "msub"
+		case n.Sub == nil:
+			tag = "msup"
+		}
+		w.sb.WriteString("<" + tag + ">")
+		w.node(n.Base)
+		if n.Sub != nil {
+			w.node(n.Sub)
+		}
+		if n.Sup != nil {
+			w.node(n.Sup)
+		}
+		w.sb.WriteString("</" + tag + ">")
+
+	case Frac:
+		if n.NoRule {
+			w.sb.WriteString(`<mfrac linethickness="0">`)
+		} else {
+			w.sb.WriteString("<mfrac>")
+		}
+		w.node(n.Num)
+		w.node(n.Den)
+		w.sb.WriteString("</mfrac>")
+
+	case Sqrt:
+		if n.Index == nil {
+			w.sb.WriteString("<msqrt>")
+			w.node(n.Body)
+			w.sb.WriteString("</msqrt>")
+			return
+		}
+		w.sb.WriteString("<mroot>")
+		w.node(n.Body)
+		w.node(n.Index)
+		w.sb.WriteString("</mroot>")
+
+	case Fenced:
+		w.sb.WriteString("<mrow>")
+		w.fence(n.Open)
+		w.node(n.Body)
+		w.fence(n.Close)
+		w.sb.WriteString("</mrow>")
+
+	case Accent:
+		if n.Under {
+			w.sb.WriteString(`<munder accentunder="true">`)
+		} else {
+			w.sb.WriteString(`<mover accent="true">`)
+		}
+		w.node(n.Body)
+		if n.Stretch {
+			w.sb.WriteString(`<mo stretchy="true">`)
+		} else {
+			w.sb.WriteString("<mo>")
+		}
+		w.text(n.Mark)
+		w.sb.WriteString("</mo>")
+		if n.Under {
+			w.sb.WriteString("</munder>")
+		} else {
+			w.sb.WriteString("</mover>")
+		}
+
+	case Space:
+		fmt.Fprintf(&w.sb, `<mspace width="%sem"/>`, strconv.FormatFloat(n.Em, 'f', 3, 64))
+
+	case Table:
+		align := make([]string, len(n.Align))
+		for i, a := range n.Align {
+			align[i] = map[byte]string{'l': "left", 'c': "center", 'r': "right"}[a]
+		}
+		w.sb.WriteString("<mtable")
+		w.attr("columnalign", strings.Join(align, " "))
+		w.sb.WriteString(">")
+		for _, row := range n.Rows {
+			w.sb.WriteString("<mtr>")
+			for _, cell := range row {
+				w.sb.WriteString("<mtd>")
+				w.node(cell)
+				w.sb.WriteString("</mtd>")
+			}
+			w.sb.WriteString("</mtr>")
+		}
+		w.sb.WriteString("</mtable>")
+	}
+}
+
+func (w *mathMLWriter) symbol(s Symbol) {
+	var tag, variant string
+	switch s.Kind {
+	case Number:
+		tag = "mn"
+	case Text:
+		tag = "mtext"
+	case Func:
+		tag = "mi"
+	case Ord:
+		r, _ := utf8.DecodeRuneInString(s.Text)
+		tag = "mo"
+		if unicode.IsLetter(r) || strings.ContainsRune("∞∂∇∅′", r) {
+			tag = "mi"
+		}
+	default:
+		tag = "mo"
+	}
+
+	switch s.Variant {
+	case Upright:
+		if tag == "mi" && utf8.RuneCountInString(s.Text) == 1 {
+			variant = "normal"
+		}
+	case Bold:
+		variant = "bold"
+	case DoubleStruck:
+		variant = "double-struck"
+	}
+
+	w.sb.WriteString("<" + tag)
+	if variant != "" {
+		w.attr("mathvariant", variant)
+	}
+	if s.Kind == Open || s.Kind == Close {
+		w.sb.WriteString(` stretchy="false"`)
+	}
+	if s.Kind == LargeOp && !s.Limits {
+		w.sb.WriteString(` movablelimits="false"`)
+	}
+	w.sb.WriteString(">")
+	w.text(s.Text)
+	w.sb.WriteString("</" + tag + ">")
+	if s.Kind == Func {
+		// Invisible function application
+		w.sb.WriteString("<mo>\u2061</mo>")
+	}
+}
+
+// fence writes a delimiter that grows with its content.
+func (w *mathMLWriter) fence(d string) {
+	if d == "" {
+		return
+	}
+	w.sb.WriteString(`<mo fence="true" stretchy="true">`)
+	w.text(d)
+	w.sb.WriteString("</mo>")
+}
+
+func (w *mathMLWriter) attr(name, value string) {
+	w.sb.WriteString(" " + name + `="`)
+	w.text(value)
+	w.sb.WriteString(`"`)
+}
+
+// text writes s escaped for use in XML text and attribute values.
+func (w *mathMLWriter) text(s string) {
+	for _, r := range s {
+		switch r {
+		case '&':
+			w.sb.WriteString("&amp;")
+		case '<':
+			w.sb.WriteString("&lt;")
+		case '>':
+			w.sb.WriteString("&gt;")
+		case '"':
+			w.sb.WriteString("&quot;")
+		default:
+			w.sb.WriteRune(r)
+		}
+	}
+}
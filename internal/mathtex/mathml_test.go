@@ -0,0 +1,82 @@
+package mathtex
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMathML(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		display bool
+		altimg  string
+		want    string
+	}{
+		{
+			name: "fraction",
+			src:  `\frac{a}{b}`,
+			want: `<mfrac><mi>a</mi><mi>b</mi></mfrac>`,
+		},
+		{
+			name: "scripts",
+			src:  `x_i^2`,
+			want: `<msubsup><mi>x</mi><mi>i</mi><mn>2</mn></msubsup>`,
+		},
+		{
+			name:    "limits in display style",
+			src:     `\sum_{i=1}^n`,
+			display: true,
+			want:    `<munderover><mo>∑</mo><mrow><mi>i</mi><mo>=</mo><mn>1</mn></mrow><mi>n</mi></munderover>`,
+		},
+		{
+			name: "limits inline",
+			src:  `\sum_{i=1}^n`,
+			want: `<msubsup><mo>∑</mo>`,
+		},
+		{
+			name: "fences",
+			src:  `\left. x \right|`,
+			want: `<mrow><mi>x</mi><mo fence="true" stretchy="true">|</mo></mrow>`,
+		},
+		{
+			name: "matrix",
+			src:  `\begin{pmatrix} a & b \\ c & d \end{pmatrix}`,
+			want: `<mtable columnalign="center center"><mtr><mtd><mi>a</mi></mtd><mtd><mi>b</mi></mtd></mtr><mtr><mtd><mi>c</mi></mtd><mtd><mi>d</mi></mtd></mtr></mtable>`,
+		},
+		{
+			name: "binomial",
+			src:  `\binom{n}{k}`,
+			want: `<mfrac linethickness="0"><mi>n</mi><mi>k</mi></mfrac>`,
+		},
+		{
+			name: "variant",
+			src:  `\mathbb{R}`,
+			want: `<mi mathvariant="double-struck">R</mi>`,
+		},
+		{
+			name: "escaped source",
+			src:  `a < b`,
+			want: `alttext="a &lt; b"><semantics><mrow><mi>a</mi><mo>&lt;</mo><mi>b</mi></mrow><annotation encoding="application/x-tex">a &lt; b</annotation>`,
+		},
+		{
+			name:    "block with image",
+			src:     `x`,
+			display: true,
+			altimg:  "math/1.png",
+			want:    `<math xmlns="http://www.w3.org/1998/Math/MathML" display="block" alttext="x" altimg="math/1.png">`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := Parse(tt.src)
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %v", tt.src, err)
+			}
+			got := MathML(n, tt.src, tt.display, tt.altimg)
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("MathML(%q) = %s, want it to contain %s", tt.src, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,664 @@
+// Package mathtex typesets the LaTeX math subset commonly found in
+// markdown documents. Formulas are parsed into a small tree that can be
+// written as MathML or rasterized into an image without any external
+// tools.
+package mathtex
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Kind classifies symbols for spacing and rendering.
+type Kind int
+
+const (
+	// Ord is an ordinary symbol, such as a variable.
+	Ord Kind = iota
+	// Number is a run of digits.
+	Number
+	// Bin is a binary operator such as +.
+	Bin
+	// Rel is a relation such as =.
+	Rel
+	// Punct is punctuation such as a comma.
+	Punct
+	// Open is an opening delimiter.
+	Open
+	// Close is a closing delimiter.
+	Close
+	// Func is a named function such as sin, set upright.
+	Func
+	// LargeOp is a big operator such as a sum or an integral.
+	LargeOp
+	// Text is upright text inside a formula.
+	Text
+)
+
+// Variant is the font variant of a symbol.
+type Variant int
+
+const (
+	// Normal sets letters in italic and everything else upright.
+	Normal Variant = iota
+	// Upright sets letters upright.
+	Upright
+	// Bold sets symbols in upright bold.
+	Bold
+	// DoubleStruck sets letters in blackboard bold.
+	DoubleStruck
+)
+
+// Node is an element of a parsed formula.
+type Node interface {
+	node()
+}
+
+// Row is a sequence of nodes set side by side.
+type Row struct {
+	Items []Node
+}
+
+// Symbol is a single identifier, number, operator or piece of text.
+type Symbol struct {
+	Text    string
+	Kind    Kind
+	Variant Variant
+	// Limits sets scripts of a large operator or function above and
+	// below it in display style.
+	Limits bool
+}
+
+// Scripts attaches a subscript and a superscript to a base. Either may
+// be nil.
+type Scripts struct {
+	Base, Sub, Sup Node
+}
+
+// Frac is a fraction, or a binomial coefficient without rule.
+type Frac struct {
+	Num, Den Node
+	NoRule   bool
+}
+
+// Sqrt is a square root, or an n-th root if Index is set.
+type Sqrt struct {
+	Body, Index Node
+}
+
+// Fenced is a subformula between delimiters that grow with it. An empty
+// delimiter is left out.
+type Fenced struct {
+	Open, Close string
+	Body        Node
+}
+
+// Accent places a mark above or, for underlines, below its body.
+type Accent struct {
+	Body Node
+	Mark string
+	// Stretch draws the mark as a rule across the whole body.
+	Stretch bool
+	Under   bool
+}
+
+// Space is horizontal space measured in em.
+type Space struct {
+	Em float64
+}
+
+// Table is a matrix or an alignment. Align holds the alignment of every
+// column: 'l', 'c' or 'r'.
+type Table struct {
+	Rows  [][]Node
+	Align []byte
+}
+
+func (Row) node()     {}
+func (Symbol) node()  {}
+func (Scripts) node() {}
+func (Frac) node()    {}
+func (Sqrt) node()    {}
+func (Fenced) node()  {}
+func (Accent) node()  {}
+func (Space) node()   {}
+func (Table) node()   {}
+
+// Parse parses a LaTeX formula without the surrounding dollar signs.
+func Parse(src string) (Node, error) {
+	p := &parser{src: src}
+	row, err := p.row("")
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q", p.src[p.pos:p.pos+1])
+	}
+	return row, nil
+}
+
+// parser is a recursive descent parser over the formula source.
+type parser struct {
+	src     string
+	pos     int
+	variant Variant
+	depth   int
+}
+
+// maxDepth bounds the nesting of groups.
+const maxDepth = 64
+
+// row parses nodes up to the end of the input or a terminator: "}" for
+// groups, "right" for \left, and "&" or "\\" inside environments, which
+// are given as "env".
+func (p *parser) row(until string) (Row, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return Row{}, fmt.Errorf("formula is nested too deeply")
+	}
+
+	var row Row
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			if until == "}" {
+				return row, fmt.Errorf("missing }")
+			}
+			if until == "right" {
+				return row, fmt.Errorf("\\left without \\right")
+			}
+			if until == "env" {
+				return row, fmt.Errorf("\\begin without \\end")
+			}
+			return row, nil
+		}
+		switch {
+		case p.peek('}'):
+			if until == "}" {
+				p.pos++
+			}
+			return row, nil
+		case until == "env" && (p.peek('&') || p.peekCommand("\\") || p.peekCommand("end")):
+			return row, nil
+		case p.peekCommand("right"):
+			if until != "right" {
+				return row, fmt.Errorf("\\right without \\left")
+			}
+			return row, nil
+		case p.peekCommand("end") && until != "env":
+			return row, fmt.Errorf("\\end without \\begin")
+		case p.peek('&'):
+			return row, fmt.Errorf("& outside of an environment")
+		}
+
+		atom, err := p.atom()
+		if err != nil {
+			return row, err
+		}
+		if atom != nil {
+			row.Items = append(row.Items, atom)
+		}
+	}
+}
+
+// atom parses a primary node with its scripts.
+func (p *parser) atom() (Node, error) {
+	base, err := p.primary()
+	if err != nil || base == nil {
+		return base, err
+	}
+
+	var sub, sup Node
+	for {
+		p.skipSpace()
+		switch {
+		case p.peek('^'), p.peek('_'):
+			c := p.src[p.pos]
+			p.pos++
+			arg, err := p.argument()
+			if err != nil {
+				return nil, err
+			}
+			if c == '^' {
+				if sup != nil {
+					return nil, fmt.Errorf("double superscript")
+				}
+				sup = arg
+			} else {
+				if sub != nil {
+					return nil, fmt.Errorf("double subscript")
+				}
+				sub = arg
+			}
+		case p.peek('\''):
+			primes := ""
+			for p.peek('\'') {
+				primes += "′"
+				p.pos++
+			}
+			if sup != nil {
+				return nil, fmt.Errorf("double superscript")
+			}
+			sup = Symbol{Text: primes, Kind: Ord}
+		case p.peekCommand("limits"), p.peekCommand("nolimits"):
+			name, _ := p.command()
+			if s, ok := base.(Symbol); ok {
+				s.Limits = name == "limits"
+				base = s
+			}
+		default:
+			if sub == nil && sup == nil {
+				return base, nil
+			}
+			return Scripts{Base: base, Sub: sub, Sup: sup}, nil
+		}
+	}
+}
+
+// argument parses the argument of a command or script: a group or a
+// single symbol.
+func (p *parser) argument() (Node, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return nil, fmt.Errorf("missing argument")
+	}
+	if p.peek('{') {
+		p.pos++
+		return p.row("}")
+	}
+	if p.peek('}') || p.peek('^') || p.peek('_') || p.peek('&') {
+		return nil, fmt.Errorf("missing argument")
+	}
+	return p.primary()
+}
+
+// primary parses a group, a command or a single character.
+func (p *parser) primary() (Node, error) {
+	if p.pos >= len(p.src) {
+		return nil, fmt.Errorf("missing argument")
+	}
+	c := p.src[p.pos]
+	switch {
+	case c == '{':
+		p.pos++
+		return p.row("}")
+	case c == '\\':
+		return p.commandNode()
+	case c == '^' || c == '_':
+		return nil, fmt.Errorf("missing base before %c", c)
+	case c == '~':
+		p.pos++
+		return Space{Em: 0.33}, nil
+	case isDigit(c) || (c == '.' && p.pos+1 < len(p.src) && isDigit(p.src[p.pos+1])):
+		start := p.pos
+		for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		return Symbol{Text: p.src[start:p.pos], Kind: Number, Variant: p.variant}, nil
+	}
+
+	r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += size
+	s := string(r)
+	switch {
+	case unicode.IsLetter(r):
+		return Symbol{Text: s, Kind: Ord, Variant: p.variant}, nil
+	case strings.ContainsRune("+*", r):
+		return Symbol{Text: s, Kind: Bin}, nil
+	case r == '-':
+		return Symbol{Text: "−", Kind: Bin}, nil
+	case strings.ContainsRune("=<>", r):
+		return Symbol{Text: s, Kind: Rel}, nil
+	case strings.ContainsRune(",;", r):
+		return Symbol{Text: s, Kind: Punct}, nil
+	case strings.ContainsRune("([", r):
+		return Symbol{Text: s, Kind: Open}, nil
+	case strings.ContainsRune(")]", r):
+		return Symbol{Text: s, Kind: Close}, nil
+	case r == ':':
+		return Symbol{Text: s, Kind: Rel}, nil
+	case r == '#' || r == '$' || r == '%':
+		return nil, fmt.Errorf("unexpected %c", r)
+	}
+	return Symbol{Text: s, Kind: Ord, Variant: p.variant}, nil
+}
+
+// commandNode parses a command and its arguments.
+func (p *parser) commandNode() (Node, error) {
+	name, err := p.command()
+	if err != nil {
+		return nil, err
+	}
+
+	if sym, ok := symbols[name]; ok {
+		return sym, nil
+	}
+	if text, ok := functions[name]; ok {
+		return Symbol{Text: text, Kind: Func, Limits: limitFunctions[name]}, nil
+	}
+	if em, ok := spaces[name]; ok {
+		return Space{Em: em}, nil
+	}
+	if mark, ok := accents[name]; ok {
+		body, err := p.argument()
+		if err != nil {
+			return nil, err
+		}
+		return Accent{Body: body, Mark: mark.mark, Stretch: mark.stretch, Under: mark.under}, nil
+	}
+	if variant, ok := variants[name]; ok {
+		saved := p.variant
+		p.variant = variant
+		body, err := p.argument()
+		p.variant = saved
+		return body, err
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac", "binom", "dbinom", "tbinom":
+		num, err := p.argument()
+		if err != nil {
+			return nil, err
+		}
+		den, err := p.argument()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(name, "binom") {
+			return Fenced{Open: "(", Close: ")", Body: Frac{Num: num, Den: den, NoRule: true}}, nil
+		}
+		return Frac{Num: num, Den: den}, nil
+
+	case "sqrt":
+		var index Node
+		p.skipSpace()
+		if p.peek('[') {
+			p.pos++
+			end := strings.IndexByte(p.src[p.pos:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ]")
+			}
+			index, err = Parse(p.src[p.pos : p.pos+end])
+			if err != nil {
+				return nil, err
+			}
+			p.pos += end + 1
+		}
+		body, err := p.argument()
+		if err != nil {
+			return nil, err
+		}
+		return Sqrt{Body: body, Index: index}, nil
+
+	case "left":
+		open, err := p.delimiter()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.row("right")
+		if err != nil {
+			return nil, err
+		}
+		p.command()
+		close, err := p.delimiter()
+		if err != nil {
+			return nil, err
+		}
+		return Fenced{Open: open, Close: close, Body: body}, nil
+
+	case "big", "Big", "bigg", "Bigg", "bigl", "Bigl", "biggl", "Biggl", "bigr", "Bigr", "biggr", "Biggr", "bigm", "Bigm":
+		d, err := p.delimiter()
+		if err != nil {
+			return nil, err
+		}
+		kind := Ord
+		switch {
+		case strings.HasSuffix(name, "l"):
+			kind = Open
+		case strings.HasSuffix(name, "r"):
+			kind = Close
+		}
+		return Symbol{Text: d, Kind: kind}, nil
+
+	case "text", "textrm", "textnormal", "mbox", "textit", "textbf", "operatorname":
+		p.skipSpace()
+		if !p.peek('{') {
+			return nil, fmt.Errorf("\\%s needs a {group}", name)
+		}
+		text, err := p.rawGroup()
+		if err != nil {
+			return nil, err
+		}
+		if name == "operatorname" {
+			return Symbol{Text: text, Kind: Func}, nil
+		}
+		return Symbol{Text: text, Kind: Text}, nil
+
+	case "not":
+		p.skipSpace()
+		next, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := next.(Symbol); ok {
+			if negated, ok := negations[s.Text]; ok {
+				return Symbol{Text: negated, Kind: Rel}, nil
+			}
+			return Symbol{Text: s.Text + "\u0338", Kind: Rel}, nil
+		}
+		return next, nil
+
+	case "begin":
+		return p.environment()
+
+	case "displaystyle", "textstyle", "scriptstyle", "scriptscriptstyle", "nonumber", "notag", "\\":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown command \\%s", name)
+}
+
+// environment parses \begin{name} ... \end{name}.
+func (p *parser) environment() (Node, error) {
+	name, err := p.rawGroup()
+	if err != nil {
+		return nil, err
+	}
+	open, close, align, ok := environments(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown environment %s", name)
+	}
+	if name == "array" {
+		// The column specification decides the alignment
+		spec, err := p.rawGroup()
+		if err != nil {
+			return nil, err
+		}
+		align = []byte(strings.Map(func(r rune) rune {
+			if r == 'l' || r == 'c' || r == 'r' {
+				return r
+			}
+			return -1
+		}, spec))
+	}
+
+	var table Table
+	var cells []Node
+	for {
+		cell, err := p.row("env")
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, cell)
+		switch {
+		case p.peek('&'):
+			p.pos++
+			continue
+		case p.peekCommand("\\"):
+			p.command()
+			table.Rows = append(table.Rows, cells)
+			cells = nil
+			continue
+		}
+		// \end
+		p.command()
+		end, err := p.rawGroup()
+		if err != nil {
+			return nil, err
+		}
+		if end != name {
+			return nil, fmt.Errorf("\\begin{%s} ended by \\end{%s}", name, end)
+		}
+		break
+	}
+	if len(cells) > 1 || (len(cells) == 1 && len(cells[0].(Row).Items) > 0) {
+		table.Rows = append(table.Rows, cells)
+	}
+
+	columns := 0
+	for _, row := range table.Rows {
+		columns = max(columns, len(row))
+	}
+	table.Align = make([]byte, columns)
+	for i := range table.Align {
+		switch {
+		case name == "aligned" || name == "align" || name == "align*" || name == "split":
+			table.Align[i] = "rl"[i%2]
+		case i < len(align):
+			table.Align[i] = align[i]
+		case len(align) > 0:
+			table.Align[i] = align[len(align)-1]
+		default:
+			table.Align[i] = 'c'
+		}
+	}
+	if open == "" && close == "" {
+		return table, nil
+	}
+	return Fenced{Open: open, Close: close, Body: table}, nil
+}
+
+// environments returns the delimiters and column alignment of a
+// supported environment.
+func environments(name string) (open, close string, align []byte, ok bool) {
+	switch name {
+	case "matrix", "smallmatrix", "array", "gathered", "gather", "gather*":
+		return "", "", nil, true
+	case "pmatrix":
+		return "(", ")", nil, true
+	case "bmatrix":
+		return "[", "]", nil, true
+	case "Bmatrix":
+		return "{", "}", nil, true
+	case "vmatrix":
+		return "|", "|", nil, true
+	case "Vmatrix":
+		return "‖", "‖", nil, true
+	case "cases":
+		return "{", "", []byte("ll"), true
+	case "aligned", "align", "align*", "split":
+		return "", "", nil, true
+	}
+	return "", "", nil, false
+}
+
+// delimiter parses the delimiter following \left, \right or \big.
+func (p *parser) delimiter() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return "", fmt.Errorf("missing delimiter")
+	}
+	if p.src[p.pos] != '\\' {
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.pos += size
+		switch r {
+		case '.':
+			return "", nil
+		case '(', ')', '[', ']', '|', '/', '<', '>':
+			return strings.NewReplacer("<", "⟨", ">", "⟩").Replace(string(r)), nil
+		}
+		return "", fmt.Errorf("invalid delimiter %q", string(r))
+	}
+	name, err := p.command()
+	if err != nil {
+		return "", err
+	}
+	if d, ok := delimiters[name]; ok {
+		return d, nil
+	}
+	return "", fmt.Errorf("invalid delimiter \\%s", name)
+}
+
+// command reads the name of the command at the current position.
+func (p *parser) command() (string, error) {
+	if !p.peek('\\') {
+		return "", fmt.Errorf("expected a command")
+	}
+	p.pos++
+	if p.pos >= len(p.src) {
+		return "", fmt.Errorf("lone backslash")
+	}
+	start := p.pos
+	for p.pos < len(p.src) && isASCIILetter(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		// Single character commands such as \{ or \,
+		_, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.pos += size
+	}
+	return p.src[start:p.pos], nil
+}
+
+// rawGroup reads the text of a {group} verbatim.
+func (p *parser) rawGroup() (string, error) {
+	p.skipSpace()
+	if !p.peek('{') {
+		return "", fmt.Errorf("expected {")
+	}
+	depth := 0
+	for i := p.pos; i < len(p.src); i++ {
+		switch p.src[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				text := p.src[p.pos+1 : i]
+				p.pos = i + 1
+				return text, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("missing }")
+}
+
+func (p *parser) peek(c byte) bool {
+	return p.pos < len(p.src) && p.src[p.pos] == c
+}
+
+// peekCommand reports whether the named command follows.
+func (p *parser) peekCommand(name string) bool {
+	rest := p.src[p.pos:]
+	if !strings.HasPrefix(rest, `\`+name) {
+		return false
+	}
+	after := rest[1+len(name):]
+	return !isASCIILetter(name[0]) || after == "" || !isASCIILetter(after[0])
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
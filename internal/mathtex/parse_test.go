@@ -0,0 +1,144 @@
+package mathtex
+
+import (
+	"reflect"
+	"testing"
+)
+
+func ord(s string) Symbol { return Symbol{Text: s} }
+func num(s string) Symbol { return Symbol{Text: s, Kind: Number} }
+func row(items ...Node) Row {
+	return Row{Items: items}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want Node
+	}{
+		{
+			name: "fraction",
+			src:  `\frac{a}{b}`,
+			want: row(Frac{Num: row(ord("a")), Den: row(ord("b"))}),
+		},
+		{
+			name: "binomial",
+			src:  `\binom{n}{k}`,
+			want: row(Fenced{Open: "(", Close: ")", Body: Frac{Num: row(ord("n")), Den: row(ord("k")), NoRule: true}}),
+		},
+		{
+			name: "scripts",
+			src:  `x_i^2`,
+			want: row(Scripts{Base: ord("x"), Sub: ord("i"), Sup: num("2")}),
+		},
+		{
+			name: "scripts in either order",
+			src:  `x^{2}_i`,
+			want: row(Scripts{Base: ord("x"), Sub: ord("i"), Sup: row(num("2"))}),
+		},
+		{
+			name: "limits of a large operator",
+			src:  `\sum_{i=1}^n`,
+			want: row(Scripts{
+				Base: Symbol{Text: "∑", Kind: LargeOp, Limits: true},
+				Sub:  row(ord("i"), Symbol{Text: "=", Kind: Rel}, num("1")),
+				Sup:  ord("n"),
+			}),
+		},
+		{
+			name: "left and right",
+			src:  `\left( x \right)`,
+			want: row(Fenced{Open: "(", Close: ")", Body: row(ord("x"))}),
+		},
+		{
+			name: "empty delimiter",
+			src:  `\left. x \right|`,
+			want: row(Fenced{Close: "|", Body: row(ord("x"))}),
+		},
+		{
+			name: "matrix",
+			src:  `\begin{pmatrix} a & b \\ c & d \end{pmatrix}`,
+			want: row(Fenced{Open: "(", Close: ")", Body: Table{
+				Rows:  [][]Node{{row(ord("a")), row(ord("b"))}, {row(ord("c")), row(ord("d"))}},
+				Align: []byte("cc"),
+			}}),
+		},
+		{
+			name: "root",
+			src:  `\sqrt[3]{x}`,
+			want: row(Sqrt{Body: row(ord("x")), Index: row(num("3"))}),
+		},
+		{
+			name: "number",
+			src:  `12.5`,
+			want: row(num("12.5")),
+		},
+		{
+			name: "function and text",
+			src:  `\sin x \text{if }`,
+			want: row(Symbol{Text: "sin", Kind: Func}, ord("x"), Symbol{Text: "if ", Kind: Text}),
+		},
+		{
+			name: "font variant",
+			src:  `\mathbb{R}`,
+			want: row(row(Symbol{Text: "R", Variant: DoubleStruck})),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.src)
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %v", tt.src, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q) = %#v, want %#v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`{a`, `missing }`},
+		{`a}`, `unexpected "}"`},
+		{`\frac{a}`, `missing argument`},
+		{`\left( a`, `\left without \right`},
+		{`a \right)`, `\right without \left`},
+		{`\begin{matrix} a`, `\begin without \end`},
+		{`\end{matrix}`, `\end without \begin`},
+		{`\begin{matrix} a \end{pmatrix}`, `\begin{matrix} ended by \end{pmatrix}`},
+		{`a & b`, `& outside of an environment`},
+		{`x^2^3`, `double superscript`},
+		{`^2`, `missing base before ^`},
+		{`\foo`, `unknown command \foo`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := Parse(tt.src)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("Parse(%q) error = %v, want %q", tt.src, err, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, src := range []string{
+		`\frac{a}{b}`, `x_i^2`, `\left( x \right)`, `\sqrt[3]{x}`,
+		`\begin{pmatrix} a & b \\ c & d \end{pmatrix}`, `\text{if } x`, `{{`,
+	} {
+		f.Add(src)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		n, err := Parse(src)
+		if err != nil {
+			return
+		}
+		// Every formula that parses can be written out
+		MathML(n, src, true, "")
+	})
+}
@@ -0,0 +1,736 @@
+package mathtex
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// MaxPixels is the largest number of pixels a formula is drawn with. The
+// rasterizer takes several bytes a pixel, and a formula no screen can show
+// whole is better kept as TeX.
+const MaxPixels = 8_000_000
+
+// Render rasterizes a parsed formula in black on white, with size pixels
+// to the em. It returns the image and its depth: the number of pixel rows
+// below the baseline, which is needed to align the image with the
+// surrounding text. Formulas larger than MaxPixels are an error.
+func Render(n Node, display bool, size float64) (*image.Gray, int, error) {
+	if err := loadFonts(); err != nil {
+		return nil, 0, err
+	}
+	r := &renderer{faces: make(map[faceKey]font.Face)}
+	defer r.close()
+
+	style := textStyle
+	if display {
+		style = displayStyle
+	}
+	b := r.layout(n, mathStyle{size: size, style: style})
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	if b.w <= 0 || b.asc+b.desc <= 0 {
+		return nil, 0, fmt.Errorf("formula is empty")
+	}
+
+	pad := math.Ceil(0.08 * size)
+	width := int(math.Ceil(b.w + 2*pad))
+	height := int(math.Ceil(b.asc+b.desc+2*pad)) + 1
+	baseline := math.Round(pad + b.asc)
+	if float64(width)*float64(height) > MaxPixels {
+		return nil, 0, fmt.Errorf("formula of %d×%d pixels is larger than the limit of %d megapixels", width, height, MaxPixels/1_000_000)
+	}
+
+	c := &canvas{
+		img: image.NewGray(image.Rect(0, 0, width, height)),
+		ras: vector.NewRasterizer(width, height),
+	}
+	draw.Draw(c.img, c.img.Bounds(), image.White, image.Point{}, draw.Src)
+	b.draw(c, pad, baseline)
+	c.ras.Draw(c.img, c.img.Bounds(), image.Black, image.Point{})
+	return c.img, height - int(baseline), nil
+}
+
+// The Go fonts set every formula: regular for upright symbols, italic for
+// variables and bold for \mathbf.
+var (
+	fontsOnce sync.Once
+	fontsErr  error
+	fonts     [3]*sfnt.Font
+	// axis is the height of the math axis, the center of fraction rules
+	// and operators such as +, in em.
+	axis float64
+)
+
+const (
+	regularFont = iota
+	italicFont
+	boldFont
+)
+
+func loadFonts() error {
+	fontsOnce.Do(func() {
+		for i, ttf := range [][]byte{goregular.TTF, goitalic.TTF, gobold.TTF} {
+			if fonts[i], fontsErr = opentype.Parse(ttf); fontsErr != nil {
+				fontsErr = fmt.Errorf("parse font: %w", fontsErr)
+				return
+			}
+		}
+		face, err := opentype.NewFace(fonts[regularFont], &opentype.FaceOptions{Size: 1000, DPI: 72})
+		if err != nil {
+			fontsErr = fmt.Errorf("load font: %w", err)
+			return
+		}
+		defer face.Close()
+		bounds, _ := font.BoundString(face, "+")
+		axis = -float64(bounds.Min.Y+bounds.Max.Y) / 2 / 64 / 1000
+	})
+	return fontsErr
+}
+
+// TeX styles, which decide the size of scripts and fractions.
+const (
+	displayStyle = iota
+	textStyle
+	scriptStyle
+	scriptScriptStyle
+)
+
+// mathStyle is the style a node is set in. size is the em of the style
+// in pixels.
+type mathStyle struct {
+	size  float64
+	style int
+}
+
+// script returns the style of scripts attached to a node in s.
+func (s mathStyle) script() mathStyle {
+	switch s.style {
+	case displayStyle, textStyle:
+		return mathStyle{size: s.size * 0.7, style: scriptStyle}
+	case scriptStyle:
+		return mathStyle{size: s.size * 0.5 / 0.7, style: scriptScriptStyle}
+	}
+	return s
+}
+
+// fraction returns the style of the numerator and denominator of a
+// fraction set in s.
+func (s mathStyle) fraction() mathStyle {
+	if s.style == displayStyle {
+		return mathStyle{size: s.size, style: textStyle}
+	}
+	return s.script()
+}
+
+// box is a laid out node: its width, its height above and depth below the
+// baseline, and how to draw it with the baseline at y.
+type box struct {
+	w, asc, desc float64
+	class        Kind
+	draw         func(c *canvas, x, y float64)
+}
+
+// canvas is the image a formula is drawn on. Text is drawn right away
+// while strokes are collected and filled at the end.
+type canvas struct {
+	img *image.Gray
+	ras *vector.Rasterizer
+}
+
+type faceKey struct {
+	font int
+	size float64
+}
+
+type renderer struct {
+	faces map[faceKey]font.Face
+	err   error
+}
+
+func (r *renderer) close() {
+	for _, face := range r.faces {
+		face.Close()
+	}
+}
+
+func (r *renderer) face(f int, size float64) font.Face {
+	key := faceKey{font: f, size: math.Round(size*4) / 4}
+	if face, ok := r.faces[key]; ok {
+		return face
+	}
+	face, err := opentype.NewFace(fonts[f], &opentype.FaceOptions{Size: key.size, DPI: 72, Hinting: font.HintingNone})
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("load font: %w", err)
+	}
+	r.faces[key] = face
+	return face
+}
+
+func (r *renderer) layout(n Node, s mathStyle) box {
+	switch n := n.(type) {
+	case Row:
+		return r.row(n.Items, s, false)
+	case Symbol:
+		return r.symbol(n, s)
+	case Scripts:
+		return r.scripts(n, s)
+	case Frac:
+		return r.frac(n, s)
+	case Sqrt:
+		return r.sqrt(n, s)
+	case Fenced:
+		return r.fenced(n, s)
+	case Accent:
+		return r.accent(n, s)
+	case Space:
+		return box{w: n.Em * s.size, class: Text, draw: func(*canvas, float64, float64) {}}
+	case Table:
+		return r.table(n, s)
+	}
+	return box{draw: func(*canvas, float64, float64) {}}
+}
+
+// spacing holds the space between adjacent classes in 1/18 em, after
+// TeX. Medium and thick spaces are left out in scripts.
+var spacing = map[[2]Kind]float64{
+	{Ord, LargeOp}: 3, {LargeOp, Ord}: 3, {LargeOp, LargeOp}: 3, {Close, LargeOp}: 3,
+	{Ord, Bin}: 4, {Bin, Ord}: 4, {Bin, LargeOp}: 4, {Bin, Open}: 4, {Close, Bin}: 4,
+	{Ord, Rel}: 5, {Rel, Ord}: 5, {Rel, LargeOp}: 5, {Rel, Open}: 5, {Close, Rel}: 5, {LargeOp, Rel}: 5,
+	{Punct, Ord}: 3, {Punct, LargeOp}: 3, {Punct, Rel}: 3, {Punct, Open}: 3, {Punct, Close}: 3, {Punct, Punct}: 3,
+}
+
+// class maps the kind of a node to the class used for spacing.
+func class(k Kind) Kind {
+	switch k {
+	case Number, Text:
+		return Ord
+	case Func:
+		return LargeOp
+	}
+	return k
+}
+
+// row sets items side by side. leadingOrd spaces a leading relation as
+// if something came before it, as in the second column of an alignment.
+func (r *renderer) row(items []Node, s mathStyle, leadingOrd bool) box {
+	boxes := make([]box, 0, len(items))
+	for _, item := range items {
+		boxes = append(boxes, r.layout(item, s))
+	}
+
+	prev := Kind(-1)
+	if leadingOrd {
+		prev = Ord
+	}
+	offsets := make([]float64, len(boxes))
+	var row box
+	for i := range boxes {
+		b := &boxes[i]
+		cur := b.class
+		if cur == Bin {
+			// A binary operator without a left operand is a unary sign
+			switch prev {
+			case -1, Bin, Rel, Open, Punct, LargeOp:
+				cur = Ord
+			}
+			if i+1 == len(boxes) {
+				cur = Ord
+			}
+		}
+		if cur != Text && prev != Text && prev != -1 {
+			if mu := spacing[[2]Kind{prev, cur}]; mu == 3 || s.style < scriptStyle {
+				row.w += mu / 18 * s.size
+			}
+		}
+		offsets[i] = row.w
+		row.w += b.w
+		row.asc = max(row.asc, b.asc)
+		row.desc = max(row.desc, b.desc)
+		if cur != Text {
+			prev = cur
+		}
+	}
+
+	row.class = Ord
+	if len(boxes) == 1 {
+		row.class = boxes[0].class
+	}
+	row.draw = func(c *canvas, x, y float64) {
+		for i, b := range boxes {
+			b.draw(c, x+offsets[i], y)
+		}
+	}
+	return row
+}
+
+// replacements stand in for symbols missing from the Go fonts.
+var replacements = strings.NewReplacer(
+	"ϵ", "ε", "ϱ", "ρ", "ϕ", "φ", "ϑ", "θ", "ϖ", "π", "∣", "|", "∗", "*", "∖", "\\",
+	"∘", "◦", "⋃", "∪", "⋂", "∩", "≔", ":=", "∬", "∫∫", "∭", "∫∫∫", "ℜ", "Re", "ℑ", "Im",
+)
+
+func (r *renderer) symbol(sym Symbol, s mathStyle) box {
+	text := replacements.Replace(sym.Text)
+	size := s.size
+	f := regularFont
+	switch {
+	case sym.Variant == Bold:
+		f = boldFont
+	case sym.Kind == Ord && sym.Variant == Normal && utf8.RuneCountInString(text) == 1 && isLetter(text):
+		f = italicFont
+	case sym.Kind == LargeOp && s.style == displayStyle:
+		size *= 1.6
+	case sym.Kind == LargeOp:
+		size *= 1.2
+	}
+
+	b, ok := r.glyph(text, f, size)
+	switch {
+	case ok && f == italicFont:
+		// Italic correction, so the letter does not touch what follows
+		b.w += 0.06 * size
+	case !ok && isDelimiter(text):
+		half := 0.5 * s.size
+		b = delimiterBox(text, axis*s.size+half, half-axis*s.size, s.size)
+	case !ok:
+		if r.err == nil {
+			r.err = fmt.Errorf("cannot draw %q", sym.Text)
+		}
+		return box{draw: func(*canvas, float64, float64) {}}
+	}
+	if sym.Variant == DoubleStruck {
+		b = doubleStruck(b, size)
+	}
+	if sym.Kind == LargeOp {
+		b = centerOnAxis(b, s.size)
+	}
+	b.class = class(sym.Kind)
+	return b
+}
+
+// text lays out a string set in one font.
+func (r *renderer) text(text string, f int, size float64) box {
+	face := r.face(f, size)
+	if face == nil {
+		return box{draw: func(*canvas, float64, float64) {}}
+	}
+	bounds, advance := font.BoundString(face, text)
+	return box{
+		w:    fromFixed(advance),
+		asc:  max(-fromFixed(bounds.Min.Y), 0),
+		desc: max(fromFixed(bounds.Max.Y), 0),
+		draw: func(c *canvas, x, y float64) {
+			d := font.Drawer{Dst: c.img, Src: image.Black, Face: face, Dot: fixed.Point26_6{X: toFixed(x), Y: toFixed(y)}}
+			d.DrawString(text)
+		},
+	}
+}
+
+// doubleStruck imitates blackboard bold by drawing a letter twice.
+func doubleStruck(b box, size float64) box {
+	shift := 0.08 * size
+	draw := b.draw
+	b.w += shift
+	b.draw = func(c *canvas, x, y float64) {
+		draw(c, x, y)
+		draw(c, x+shift, y)
+	}
+	return b
+}
+
+// centerOnAxis moves a box vertically so it is centered on the math axis.
+func centerOnAxis(b box, size float64) box {
+	shift := axis*size - (b.asc-b.desc)/2
+	draw := b.draw
+	b.asc += shift
+	b.desc -= shift
+	b.draw = func(c *canvas, x, y float64) { draw(c, x, y-shift) }
+	return b
+}
+
+func (r *renderer) scripts(n Scripts, s mathStyle) box {
+	base := r.layout(n.Base, s)
+	ss := s.script()
+	var sub, sup box
+	if n.Sub != nil {
+		sub = r.layout(n.Sub, ss)
+	}
+	if n.Sup != nil {
+		sup = r.layout(n.Sup, ss)
+	}
+
+	if sym, ok := n.Base.(Symbol); ok && sym.Limits && s.style == displayStyle {
+		return limits(base, sub, sup, n.Sub != nil, n.Sup != nil, s.size)
+	}
+
+	// Shifts of the script baselines from the base baseline
+	up := max(0.42*s.size, base.asc-0.4*ss.size, sup.desc+0.25*s.size)
+	down := max(0.2*s.size, base.desc+0.1*ss.size, sub.asc-0.4*s.size)
+	if sym, ok := n.Sup.(Symbol); ok && strings.Trim(sym.Text, "′") == "" {
+		// Primes are raised in the font already
+		up = max(base.asc-sup.asc+0.05*s.size, 0)
+	} else if n.Sub != nil && n.Sup != nil {
+		if gap := (up - sup.desc) - (sub.asc - down); gap < 0.15*s.size {
+			down += 0.15*s.size - gap
+		}
+	}
+
+	b := box{w: base.w, asc: base.asc, desc: base.desc, class: base.class}
+	scriptX := base.w
+	if n.Sup != nil {
+		b.asc = max(b.asc, up+sup.asc)
+	}
+	if n.Sub != nil {
+		b.desc = max(b.desc, down+sub.desc)
+	}
+	b.w += max(sub.w, sup.w) + 0.05*s.size
+	b.draw = func(c *canvas, x, y float64) {
+		base.draw(c, x, y)
+		if n.Sup != nil {
+			sup.draw(c, x+scriptX, y-up)
+		}
+		if n.Sub != nil {
+			sub.draw(c, x+scriptX, y+down)
+		}
+	}
+	return b
+}
+
+// limits stacks scripts above and below a large operator.
+func limits(base, sub, sup box, hasSub, hasSup bool, size float64) box {
+	gap := 0.15 * size
+	w := max(base.w, sub.w, sup.w)
+	b := box{w: w, asc: base.asc, desc: base.desc, class: base.class}
+	if hasSup {
+		b.asc += gap + sup.desc + sup.asc
+	}
+	if hasSub {
+		b.desc += gap + sub.asc + sub.desc
+	}
+	b.draw = func(c *canvas, x, y float64) {
+		base.draw(c, x+(w-base.w)/2, y)
+		if hasSup {
+			sup.draw(c, x+(w-sup.w)/2, y-base.asc-gap-sup.desc)
+		}
+		if hasSub {
+			sub.draw(c, x+(w-sub.w)/2, y+base.desc+gap+sub.asc)
+		}
+	}
+	return b
+}
+
+func (r *renderer) frac(n Frac, s mathStyle) box {
+	fs := s.fraction()
+	num := r.layout(n.Num, fs)
+	den := r.layout(n.Den, fs)
+
+	rule := max(1, 0.05*s.size)
+	gap := 0.1 * s.size
+	if s.style == displayStyle {
+		gap = 0.18 * s.size
+	}
+	if n.NoRule {
+		gap *= 1.5
+	}
+	a := axis * s.size
+	up := a + rule/2 + gap + num.desc
+	down := den.asc + gap + rule/2 - a
+	pad := 0.1 * s.size
+	w := max(num.w, den.w) + 2*pad
+
+	return box{
+		w:     w,
+		asc:   up + num.asc,
+		desc:  down + den.desc,
+		class: Ord,
+		draw: func(c *canvas, x, y float64) {
+			num.draw(c, x+(w-num.w)/2, y-up)
+			den.draw(c, x+(w-den.w)/2, y+down)
+			if !n.NoRule {
+				c.rect(x+pad/2, y-a-rule/2, x+w-pad/2, y-a+rule/2)
+			}
+		},
+	}
+}
+
+func (r *renderer) sqrt(n Sqrt, s mathStyle) box {
+	body := r.layout(n.Body, s)
+	t := max(1, 0.05*s.size)
+	gap := 0.12 * s.size
+	top := max(body.asc, 0.7*s.size) + gap + t
+	bottom := max(body.desc, 0.05*s.size)
+	h := top + bottom
+	sign := 0.45*s.size + 0.08*h
+
+	var index box
+	indent := 0.0
+	if n.Index != nil {
+		index = r.layout(n.Index, s.script().script())
+		indent = max(0, index.w-0.5*sign)
+	}
+	w := indent + sign + body.w + 0.1*s.size
+
+	return box{
+		w:     w,
+		asc:   max(top+t/2, 0.6*h-bottom+index.asc+index.desc),
+		desc:  bottom,
+		class: Ord,
+		draw: func(c *canvas, x, y float64) {
+			x0 := x + indent
+			c.stroke(t, []point{
+				{x0, y + bottom - 0.45*h},
+				{x0 + 0.2*sign, y + bottom - 0.55*h},
+				{x0 + 0.5*sign, y + bottom},
+				{x0 + 0.9*sign, y - top + t/2},
+				{x0 + sign + body.w + 0.1*s.size, y - top + t/2},
+			})
+			body.draw(c, x0+sign, y)
+			if n.Index != nil {
+				index.draw(c, x0+0.45*sign-index.w, y+bottom-0.6*h-index.desc)
+			}
+		},
+	}
+}
+
+func (r *renderer) fenced(n Fenced, s mathStyle) box {
+	body := r.layout(n.Body, s)
+	a := axis * s.size
+	half := max(body.asc-a, body.desc+a, 0.5*s.size) + 0.05*s.size
+	open := delimiterBox(n.Open, a+half, half-a, s.size)
+	close := delimiterBox(n.Close, a+half, half-a, s.size)
+	return box{
+		w:     open.w + body.w + close.w,
+		asc:   max(body.asc, open.asc),
+		desc:  max(body.desc, open.desc),
+		class: Ord,
+		draw: func(c *canvas, x, y float64) {
+			open.draw(c, x, y)
+			body.draw(c, x+open.w, y)
+			close.draw(c, x+open.w+body.w, y)
+		},
+	}
+}
+
+func (r *renderer) accent(n Accent, s mathStyle) box {
+	body := r.layout(n.Body, s)
+	b := body
+	b.class = Ord
+	t := max(1, 0.05*s.size)
+	gap := 0.08 * s.size
+
+	if n.Stretch {
+		if n.Under {
+			b.desc += gap + t
+		} else {
+			b.asc = max(b.asc, 0.5*s.size) + gap + t
+		}
+		b.draw = func(c *canvas, x, y float64) {
+			body.draw(c, x, y)
+			if n.Under {
+				c.rect(x, y+body.desc+gap, x+body.w, y+body.desc+gap+t)
+			} else {
+				c.rect(x, y-b.asc, x+body.w, y-b.asc+t)
+			}
+		}
+		return b
+	}
+
+	markSize := s.size
+	if n.Mark == "→" || n.Mark == "←" {
+		markSize *= 0.7
+	}
+	mark, ok := r.glyph(n.Mark, regularFont, markSize)
+	if !ok {
+		if r.err == nil {
+			r.err = fmt.Errorf("cannot draw accent %q", n.Mark)
+		}
+		return b
+	}
+	// Place the ink of the mark just above the body
+	bottom := max(body.asc, 0.5*s.size) + gap/2
+	shift := bottom + mark.desc
+	b.asc = shift + mark.asc
+	b.w = max(body.w, mark.w)
+	b.draw = func(c *canvas, x, y float64) {
+		body.draw(c, x+(b.w-body.w)/2, y)
+		mark.draw(c, x+(b.w-mark.w)/2, y-shift)
+	}
+	return b
+}
+
+func (r *renderer) table(n Table, s mathStyle) box {
+	if s.style == displayStyle {
+		s.style = textStyle
+	}
+	columns := len(n.Align)
+	cells := make([][]box, len(n.Rows))
+	widths := make([]float64, columns)
+	ascs := make([]float64, len(n.Rows))
+	descs := make([]float64, len(n.Rows))
+	for i, row := range n.Rows {
+		cells[i] = make([]box, columns)
+		ascs[i], descs[i] = 0.75*s.size, 0.3*s.size
+		for j := range columns {
+			var items []Node
+			if j < len(row) {
+				items = row[j].(Row).Items
+			}
+			b := r.row(items, s, j > 0 && alignPair(n.Align, j))
+			cells[i][j] = b
+			widths[j] = max(widths[j], b.w)
+			ascs[i] = max(ascs[i], b.asc)
+			descs[i] = max(descs[i], b.desc)
+		}
+	}
+
+	// Column positions, without gaps inside pairs of aligned columns
+	xs := make([]float64, columns)
+	w := 0.0
+	for j := range columns {
+		if j > 0 && !alignPair(n.Align, j) {
+			w += 0.8 * s.size
+		}
+		xs[j] = w
+		w += widths[j]
+	}
+	// Row baselines from the top
+	ys := make([]float64, len(n.Rows))
+	h := 0.0
+	for i := range n.Rows {
+		if i > 0 {
+			h += 0.25 * s.size
+		}
+		ys[i] = h + ascs[i]
+		h += ascs[i] + descs[i]
+	}
+
+	a := axis * s.size
+	asc := h/2 + a
+	return box{
+		w:     w,
+		asc:   asc,
+		desc:  h - asc,
+		class: Ord,
+		draw: func(c *canvas, x, y float64) {
+			for i := range cells {
+				for j, cell := range cells[i] {
+					cx := xs[j]
+					switch n.Align[j] {
+					case 'c':
+						cx += (widths[j] - cell.w) / 2
+					case 'r':
+						cx += widths[j] - cell.w
+					}
+					cell.draw(c, x+cx, y-asc+ys[i])
+				}
+			}
+		},
+	}
+}
+
+// alignPair reports whether column j is the left aligned half of a pair
+// of columns, as in the aligned environment.
+func alignPair(align []byte, j int) bool {
+	return j%2 == 1 && align[j-1] == 'r' && align[j] == 'l'
+}
+
+// point is a position on the canvas.
+type point struct{ x, y float64 }
+
+// stroke draws a polyline with round joins and caps.
+func (c *canvas) stroke(width float64, pts []point) {
+	for i, p := range pts {
+		c.disc(p, width/2)
+		if i == 0 {
+			continue
+		}
+		q := pts[i-1]
+		dx, dy := p.x-q.x, p.y-q.y
+		l := math.Hypot(dx, dy)
+		if l == 0 {
+			continue
+		}
+		nx, ny := -dy/l*width/2, dx/l*width/2
+		c.polygon([]point{{q.x + nx, q.y + ny}, {p.x + nx, p.y + ny}, {p.x - nx, p.y - ny}, {q.x - nx, q.y - ny}})
+	}
+}
+
+// disc fills a circle.
+func (c *canvas) disc(center point, radius float64) {
+	const sides = 16
+	pts := make([]point, sides)
+	for i := range pts {
+		a := 2 * math.Pi * float64(i) / sides
+		pts[i] = point{center.x + radius*math.Cos(a), center.y + radius*math.Sin(a)}
+	}
+	c.polygon(pts)
+}
+
+// rect fills a rectangle.
+func (c *canvas) rect(x0, y0, x1, y1 float64) {
+	c.polygon([]point{{x0, y0}, {x1, y0}, {x1, y1}, {x0, y1}})
+}
+
+// polygon fills a polygon. The rasterizer adds up the coverage of
+// overlapping shapes by their orientation, so every polygon is added
+// clockwise to make overlaps merge instead of cancel out.
+func (c *canvas) polygon(pts []point) {
+	area := 0.0
+	for i, p := range pts {
+		q := pts[(i+1)%len(pts)]
+		area += p.x*q.y - q.x*p.y
+	}
+	if area < 0 {
+		for i, j := 0, len(pts)-1; i < j; i, j = i+1, j-1 {
+			pts[i], pts[j] = pts[j], pts[i]
+		}
+	}
+	c.ras.MoveTo(float32(pts[0].x), float32(pts[0].y))
+	for _, p := range pts[1:] {
+		c.ras.LineTo(float32(p.x), float32(p.y))
+	}
+	c.ras.ClosePath()
+}
+
+// hasGlyphs reports whether f has a glyph for every rune of s.
+func hasGlyphs(f *sfnt.Font, s string) bool {
+	var buf sfnt.Buffer
+	for _, r := range s {
+		if r == ' ' {
+			continue
+		}
+		if i, err := f.GlyphIndex(&buf, r); err != nil || i == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func isLetter(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsLetter(r)
+}
+
+func fromFixed(v fixed.Int26_6) float64 {
+	return float64(v) / 64
+}
+
+func toFixed(v float64) fixed.Int26_6 {
+	return fixed.Int26_6(math.Round(v * 64))
+}
@@ -0,0 +1,65 @@
+package mathtex
+
+import (
+	"image"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	render := func(src string, display bool) (*image.Gray, int) {
+		t.Helper()
+		n, err := Parse(src)
+		if err != nil {
+			t.Fatalf("Parse(%q) error: %v", src, err)
+		}
+		img, depth, err := Render(n, display, 20)
+		if err != nil {
+			t.Fatalf("Render(%q) error: %v", src, err)
+		}
+		return img, depth
+	}
+
+	x, xDepth := render(`x`, false)
+	if w, h := x.Bounds().Dx(), x.Bounds().Dy(); w < 5 || w > 40 || h < 10 || h > 40 {
+		t.Errorf("x is %d×%d pixels at 20 pixels to the em", w, h)
+	}
+	if xDepth < 0 || xDepth >= x.Bounds().Dy() {
+		t.Errorf("x has depth %d in %d rows", xDepth, x.Bounds().Dy())
+	}
+	if !hasInk(x) {
+		t.Errorf("x is blank")
+	}
+
+	frac, fracDepth := render(`\frac{x}{y}`, true)
+	if frac.Bounds().Dy() <= x.Bounds().Dy() {
+		t.Errorf("fraction is %d rows high, no more than x with %d", frac.Bounds().Dy(), x.Bounds().Dy())
+	}
+	if fracDepth <= xDepth {
+		t.Errorf("fraction has depth %d, no more than x with %d", fracDepth, xDepth)
+	}
+
+	sum, _ := render(`x+x+x`, false)
+	if sum.Bounds().Dx() <= 3*x.Bounds().Dx()/2 {
+		t.Errorf("x+x+x is %d pixels wide, x is %d", sum.Bounds().Dx(), x.Bounds().Dx())
+	}
+}
+
+func TestRenderTooLarge(t *testing.T) {
+	n, err := Parse(strings.Repeat("x+", 3000) + "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Render(n, false, 400); err == nil || !strings.Contains(err.Error(), "megapixels") {
+		t.Errorf("Render error = %v, want the pixel limit", err)
+	}
+}
+
+func hasInk(img *image.Gray) bool {
+	for _, p := range img.Pix {
+		if p < 128 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package mathtex
+
+// symbols maps commands to the symbols they stand for.
+var symbols = map[string]Symbol{
+	// Lowercase Greek
+	"alpha": {Text: "α"}, "beta": {Text: "β"}, "gamma": {Text: "γ"}, "delta": {Text: "δ"},
+	"epsilon": {Text: "ϵ"}, "varepsilon": {Text: "ε"}, "zeta": {Text: "ζ"}, "eta": {Text: "η"},
+	"theta": {Text: "θ"}, "vartheta": {Text: "ϑ"}, "iota": {Text: "ι"}, "kappa": {Text: "κ"},
+	"lambda": {Text: "λ"}, "mu": {Text: "μ"}, "nu": {Text: "ν"}, "xi": {Text: "ξ"},
+	"omicron": {Text: "ο"}, "pi": {Text: "π"}, "varpi": {Text: "ϖ"}, "rho": {Text: "ρ"},
+	"varrho": {Text: "ϱ"}, "sigma": {Text: "σ"}, "varsigma": {Text: "ς"}, "tau": {Text: "τ"},
+	"upsilon": {Text: "υ"}, "phi": {Text: "ϕ"}, "varphi": {Text: "φ"}, "chi": {Text: "χ"},
+	"psi": {Text: "ψ"}, "omega": {Text: "ω"},
+
+	// Uppercase Greek is set upright
+	"Gamma": {Text: "Γ", Variant: Upright}, "Delta": {Text: "Δ", Variant: Upright},
+	"Theta": {Text: "Θ", Variant: Upright}, "Lambda": {Text: "Λ", Variant: Upright},
+	"Xi": {Text: "Ξ", Variant: Upright}, "Pi": {Text: "Π", Variant: Upright},
+	"Sigma": {Text: "Σ", Variant: Upright}, "Upsilon": {Text: "Υ", Variant: Upright},
+	"Phi": {Text: "Φ", Variant: Upright}, "Psi": {Text: "Ψ", Variant: Upright},
+	"Omega": {Text: "Ω", Variant: Upright},
+
+	// Letter-like symbols
+	"infty": {Text: "∞"}, "partial": {Text: "∂"}, "nabla": {Text: "∇"}, "ell": {Text: "ℓ"},
+	"hbar": {Text: "ħ"}, "emptyset": {Text: "∅"}, "varnothing": {Text: "∅"}, "aleph": {Text: "ℵ"},
+	"forall": {Text: "∀"}, "exists": {Text: "∃"}, "neg": {Text: "¬"}, "lnot": {Text: "¬"},
+	"angle": {Text: "∠"}, "triangle": {Text: "△"}, "prime": {Text: "′"}, "degree": {Text: "°"},
+	"Re": {Text: "ℜ"}, "Im": {Text: "ℑ"},
+
+	// Binary operators
+	"pm": {Text: "±", Kind: Bin}, "mp": {Text: "∓", Kind: Bin}, "times": {Text: "×", Kind: Bin},
+	"div": {Text: "÷", Kind: Bin}, "cdot": {Text: "·", Kind: Bin}, "ast": {Text: "∗", Kind: Bin},
+	"circ": {Text: "∘", Kind: Bin}, "bullet": {Text: "•", Kind: Bin}, "cup": {Text: "∪", Kind: Bin},
+	"cap": {Text: "∩", Kind: Bin}, "setminus": {Text: "∖", Kind: Bin}, "wedge": {Text: "∧", Kind: Bin},
+	"land": {Text: "∧", Kind: Bin}, "vee": {Text: "∨", Kind: Bin}, "lor": {Text: "∨", Kind: Bin},
+	"oplus": {Text: "⊕", Kind: Bin}, "otimes": {Text: "⊗", Kind: Bin},
+
+	// Relations
+	"leq": {Text: "≤", Kind: Rel}, "le": {Text: "≤", Kind: Rel}, "geq": {Text: "≥", Kind: Rel},
+	"ge": {Text: "≥", Kind: Rel}, "neq": {Text: "≠", Kind: Rel}, "ne": {Text: "≠", Kind: Rel},
+	"approx": {Text: "≈", Kind: Rel}, "equiv": {Text: "≡", Kind: Rel}, "sim": {Text: "∼", Kind: Rel},
+	"simeq": {Text: "≃", Kind: Rel}, "cong": {Text: "≅", Kind: Rel}, "propto": {Text: "∝", Kind: Rel},
+	"ll": {Text: "≪", Kind: Rel}, "gg": {Text: "≫", Kind: Rel}, "in": {Text: "∈", Kind: Rel},
+	"notin": {Text: "∉", Kind: Rel}, "ni": {Text: "∋", Kind: Rel}, "subset": {Text: "⊂", Kind: Rel},
+	"subseteq": {Text: "⊆", Kind: Rel}, "supset": {Text: "⊃", Kind: Rel}, "supseteq": {Text: "⊇", Kind: Rel},
+	"perp": {Text: "⊥", Kind: Rel}, "parallel": {Text: "∥", Kind: Rel}, "mid": {Text: "∣", Kind: Rel},
+	"to": {Text: "→", Kind: Rel}, "rightarrow": {Text: "→", Kind: Rel}, "leftarrow": {Text: "←", Kind: Rel},
+	"gets": {Text: "←", Kind: Rel}, "leftrightarrow": {Text: "↔", Kind: Rel}, "mapsto": {Text: "↦", Kind: Rel},
+	"Rightarrow": {Text: "⇒", Kind: Rel}, "Leftarrow": {Text: "⇐", Kind: Rel},
+	"Leftrightarrow": {Text: "⇔", Kind: Rel}, "implies": {Text: "⇒", Kind: Rel},
+	"iff": {Text: "⇔", Kind: Rel}, "uparrow": {Text: "↑", Kind: Rel}, "downarrow": {Text: "↓", Kind: Rel},
+	"coloneqq": {Text: "≔", Kind: Rel},
+
+	// Large operators
+	"sum": {Text: "∑", Kind: LargeOp, Limits: true}, "prod": {Text: "∏", Kind: LargeOp, Limits: true},
+	"coprod": {Text: "∐", Kind: LargeOp, Limits: true}, "bigcup": {Text: "⋃", Kind: LargeOp, Limits: true},
+	"bigcap": {Text: "⋂", Kind: LargeOp, Limits: true}, "bigoplus": {Text: "⨁", Kind: LargeOp, Limits: true},
+	"bigotimes": {Text: "⨂", Kind: LargeOp, Limits: true}, "int": {Text: "∫", Kind: LargeOp},
+	"iint": {Text: "∬", Kind: LargeOp}, "iiint": {Text: "∭", Kind: LargeOp}, "oint": {Text: "∮", Kind: LargeOp},
+
+	// Delimiters and punctuation
+	"{": {Text: "{", Kind: Open}, "}": {Text: "}", Kind: Close}, "langle": {Text: "⟨", Kind: Open},
+	"rangle": {Text: "⟩", Kind: Close}, "lfloor": {Text: "⌊", Kind: Open}, "rfloor": {Text: "⌋", Kind: Close},
+	"lceil": {Text: "⌈", Kind: Open}, "rceil": {Text: "⌉", Kind: Close}, "vert": {Text: "|"},
+	"Vert": {Text: "‖"}, "|": {Text: "‖"}, "lvert": {Text: "|", Kind: Open}, "rvert": {Text: "|", Kind: Close},
+	"ldots": {Text: "…", Kind: Punct}, "dots": {Text: "…", Kind: Punct}, "cdots": {Text: "⋯"},
+	"vdots": {Text: "⋮"}, "ddots": {Text: "⋱"}, "colon": {Text: ":", Kind: Punct},
+	"$": {Text: "$"}, "%": {Text: "%"}, "&": {Text: "&"}, "#": {Text: "#"}, "_": {Text: "_"},
+}
+
+// delimiters maps the commands allowed after \left and \right to the
+// delimiters they stand for.
+var delimiters = map[string]string{
+	"{": "{", "}": "}", "lbrace": "{", "rbrace": "}", "langle": "⟨", "rangle": "⟩",
+	"lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉", "vert": "|", "lvert": "|",
+	"rvert": "|", "Vert": "‖", "lVert": "‖", "rVert": "‖", "|": "‖", "lbrack": "[", "rbrack": "]",
+}
+
+// negations maps relations to their negated form for \not.
+var negations = map[string]string{
+	"=": "≠", "∈": "∉", "≡": "≢", "<": "≮", ">": "≯", "≤": "≰", "≥": "≱",
+	"⊂": "⊄", "⊆": "⊈", "∼": "≁", "≈": "≉",
+}
+
+// functions maps function commands to their names.
+var functions = map[string]string{
+	"sin": "sin", "cos": "cos", "tan": "tan", "cot": "cot", "sec": "sec", "csc": "csc",
+	"arcsin": "arcsin", "arccos": "arccos", "arctan": "arctan", "sinh": "sinh",
+	"cosh": "cosh", "tanh": "tanh", "coth": "coth", "log": "log", "ln": "ln", "lg": "lg",
+	"exp": "exp", "det": "det", "dim": "dim", "ker": "ker", "gcd": "gcd", "deg": "deg",
+	"arg": "arg", "hom": "hom", "lim": "lim", "liminf": "lim inf", "limsup": "lim sup",
+	"max": "max", "min": "min", "sup": "sup", "inf": "inf", "Pr": "Pr", "argmax": "arg max",
+	"argmin": "arg min", "mod": "mod", "bmod": "mod",
+}
+
+// limitFunctions lists the functions whose subscripts go below them in
+// display style.
+var limitFunctions = map[string]bool{
+	"lim": true, "liminf": true, "limsup": true, "max": true, "min": true, "sup": true,
+	"inf": true, "Pr": true, "det": true, "gcd": true, "argmax": true, "argmin": true,
+}
+
+// spaces maps spacing commands to their width in em.
+var spaces = map[string]float64{
+	",": 3.0 / 18, "thinspace": 3.0 / 18, ":": 4.0 / 18, ">": 4.0 / 18, "medspace": 4.0 / 18,
+	";": 5.0 / 18, "thickspace": 5.0 / 18, "!": -3.0 / 18, "negthinspace": -3.0 / 18,
+	" ": 0.33, "quad": 1, "qquad": 2,
+}
+
+// accents maps accent commands to their marks.
+var accents = map[string]struct {
+	mark           string
+	stretch, under bool
+}{
+	"hat": {mark: "^"}, "widehat": {mark: "^"}, "check": {mark: "ˇ"}, "tilde": {mark: "~"},
+	"widetilde": {mark: "~"}, "acute": {mark: "´"}, "grave": {mark: "`"}, "dot": {mark: "˙"},
+	"ddot": {mark: "¨"}, "breve": {mark: "˘"}, "vec": {mark: "→"},
+	"bar": {mark: "¯", stretch: true}, "overline": {mark: "¯", stretch: true},
+	"underline":      {mark: "_", stretch: true, under: true},
+	"overrightarrow": {mark: "→"}, "overleftarrow": {mark: "←"},
+}
+
+// variants maps font commands to the variant they select.
+var variants = map[string]Variant{
+	"mathrm": Upright, "mathup": Upright, "mathsf": Upright, "mathtt": Upright,
+	"mathit": Normal, "mathnormal": Normal, "mathcal": Normal, "mathscr": Normal,
+	"mathbf": Bold, "boldsymbol": Bold, "bm": Bold, "mathbb": DoubleStruck,
+}
@@ -29,7 +29,7 @@ func New(cfg config.Config, logger *ravandlog.Logger) *echo.Echo {
 	})
 
 	// Conversion endpoint
-	convertHandler := handler.NewConvertHandler(logger)
+	convertHandler := handler.NewConvertHandler(cfg, logger)
 	e.POST("/convert", convertHandler.Convert)
 
 	return e
@@ -0,0 +1,288 @@
+// Package tableimg draws tables as images, for readers whose screens are
+// too narrow to lay out wide tables as text.
+package tableimg
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// Align is the horizontal alignment of the text of a cell.
+type Align int
+
+// Cell alignments.
+const (
+	Left Align = iota
+	Center
+	Right
+)
+
+// Cell is a cell of a table.
+type Cell struct {
+	Text string
+	// Header sets the cell in bold on a grey background.
+	Header bool
+	Align  Align
+	// Span is the number of columns the cell covers, 1 if zero.
+	Span int
+}
+
+// Layout measures, in em.
+const (
+	// maxColumnWidth is the width text wraps at inside a cell.
+	maxColumnWidth = 14
+	padX           = 0.4
+	padY           = 0.25
+	lineHeight     = 1.3
+)
+
+// headerGray is the background of header cells, light enough to keep the
+// text readable on e-ink screens.
+var headerGray = color.Gray{Y: 0xe0}
+
+// MaxPixels is the largest number of pixels a table is drawn with. Longer
+// or wider tables are better laid out as text.
+const MaxPixels = 8_000_000
+
+// Render draws the rows of a table as a ruled grid in black on white, with
+// size pixels to the em. Text the Go fonts have no glyphs for, such as
+// most non-Latin scripts, and tables larger than MaxPixels are an error
+// rather than drawn.
+func Render(rows [][]Cell, size float64) (*image.Gray, error) {
+	if err := loadFonts(); err != nil {
+		return nil, err
+	}
+	faces := [2]font.Face{}
+	for i, f := range fonts {
+		face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return nil, fmt.Errorf("load font: %w", err)
+		}
+		defer face.Close()
+		faces[i] = face
+	}
+
+	columns := 0
+	for _, row := range rows {
+		n := 0
+		for _, cell := range row {
+			if r, ok := missingGlyph(fonts[regularFont], cell.Text); ok {
+				return nil, fmt.Errorf("no glyph for %q", r)
+			}
+			n += span(cell)
+		}
+		columns = max(columns, n)
+	}
+	if columns == 0 {
+		return nil, fmt.Errorf("table is empty")
+	}
+
+	// Size the columns after the cells that cover a single column, then
+	// widen the last column under wider spanning cells
+	pad := math.Ceil(padX * size)
+	wrapAt := maxColumnWidth * size
+	widths := make([]float64, columns)
+	natural := func(cell Cell) float64 {
+		face := faces[faceOf(cell)]
+		w := math.Min(measure(face, cell.Text), wrapAt)
+		for _, word := range strings.Fields(cell.Text) {
+			w = math.Max(w, measure(face, word))
+		}
+		return math.Ceil(w + 2*pad)
+	}
+	for _, row := range rows {
+		col := 0
+		for _, cell := range row {
+			if span(cell) == 1 && col < columns {
+				widths[col] = math.Max(widths[col], natural(cell))
+			}
+			col += span(cell)
+		}
+	}
+	for _, row := range rows {
+		col := 0
+		for _, cell := range row {
+			end := min(col+span(cell), columns)
+			if span(cell) > 1 {
+				if extra := natural(cell) - sum(widths[col:end]); extra > 0 {
+					widths[end-1] += extra
+				}
+			}
+			col = end
+		}
+	}
+
+	// Wrap the text of every cell to the width it ended up with
+	leading := math.Ceil(lineHeight * size)
+	padV := math.Ceil(padY * size)
+	lines := make([][][]string, len(rows))
+	heights := make([]float64, len(rows))
+	for i, row := range rows {
+		col := 0
+		maxLines := 1
+		for _, cell := range row {
+			end := min(col+span(cell), columns)
+			wrapped := wrap(faces[faceOf(cell)], cell.Text, sum(widths[col:end])-2*pad)
+			lines[i] = append(lines[i], wrapped)
+			maxLines = max(maxLines, len(wrapped))
+			col = end
+		}
+		heights[i] = float64(maxLines)*leading + 2*padV
+	}
+
+	width := int(math.Ceil(sum(widths))) + 1
+	height := int(math.Ceil(sum(heights))) + 1
+	if float64(width)*float64(height) > MaxPixels {
+		return nil, fmt.Errorf("table of %d×%d pixels is larger than the limit of %d megapixels", width, height, MaxPixels/1_000_000)
+	}
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	ascent := float64(faces[regularFont].Metrics().Ascent) / 64
+	descent := float64(faces[regularFont].Metrics().Descent) / 64
+	y := 0.0
+	for i, row := range rows {
+		x := 0.0
+		col := 0
+		for j, cell := range row {
+			end := min(col+span(cell), columns)
+			w := sum(widths[col:end])
+			cellRect := image.Rect(int(x), int(y), int(x+w), int(y+heights[i]))
+			if cell.Header {
+				draw.Draw(img, cellRect, image.NewUniform(headerGray), image.Point{}, draw.Src)
+			}
+			strokeRect(img, cellRect)
+
+			face := faces[faceOf(cell)]
+			d := &font.Drawer{Dst: img, Src: image.Black, Face: face}
+			baseline := y + padV + (leading+ascent-descent)/2
+			for _, line := range lines[i][j] {
+				lineX := x + pad
+				switch cell.Align {
+				case Center:
+					lineX = x + (w-measure(face, line))/2
+				case Right:
+					lineX = x + w - pad - measure(face, line)
+				}
+				d.Dot = fixed.Point26_6{X: fixed.Int26_6(lineX * 64), Y: fixed.Int26_6(math.Round(baseline) * 64)}
+				d.DrawString(line)
+				baseline += leading
+			}
+			x += w
+			col = end
+		}
+		for ; col < columns; col++ {
+			strokeRect(img, image.Rect(int(x), int(y), int(x+widths[col]), int(y+heights[i])))
+			x += widths[col]
+		}
+		y += heights[i]
+	}
+	return img, nil
+}
+
+// The Go fonts set every table: bold for header cells, regular otherwise.
+var (
+	fontsOnce sync.Once
+	fontsErr  error
+	fonts     [2]*sfnt.Font
+)
+
+const (
+	regularFont = iota
+	boldFont
+)
+
+func loadFonts() error {
+	fontsOnce.Do(func() {
+		for i, ttf := range [][]byte{goregular.TTF, gobold.TTF} {
+			if fonts[i], fontsErr = opentype.Parse(ttf); fontsErr != nil {
+				fontsErr = fmt.Errorf("parse font: %w", fontsErr)
+				return
+			}
+		}
+	})
+	return fontsErr
+}
+
+func faceOf(cell Cell) int {
+	if cell.Header {
+		return boldFont
+	}
+	return regularFont
+}
+
+func span(cell Cell) int {
+	return max(cell.Span, 1)
+}
+
+func sum(xs []float64) float64 {
+	s := 0.0
+	for _, x := range xs {
+		s += x
+	}
+	return s
+}
+
+// measure returns the advance of s in pixels.
+func measure(face font.Face, s string) float64 {
+	return float64(font.MeasureString(face, s)) / 64
+}
+
+// wrap breaks text into lines no wider than width where it can, at
+// spaces. Words wider than width get a line of their own.
+func wrap(face font.Face, text string, width float64) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line == "" {
+			line = word
+			continue
+		}
+		if measure(face, line+" "+word) > width {
+			lines = append(lines, line)
+			line = word
+			continue
+		}
+		line += " " + word
+	}
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// strokeRect draws the one pixel border of r. The right and bottom edges
+// lie just outside r, where the next cells start, so neighbours share them.
+func strokeRect(img *image.Gray, r image.Rectangle) {
+	black := image.Black
+	draw.Draw(img, image.Rect(r.Min.X, r.Min.Y, r.Max.X+1, r.Min.Y+1), black, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(r.Min.X, r.Max.Y, r.Max.X+1, r.Max.Y+1), black, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y+1), black, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(r.Max.X, r.Min.Y, r.Max.X+1, r.Max.Y+1), black, image.Point{}, draw.Src)
+}
+
+// missingGlyph returns the first character of s the font has no glyph for.
+func missingGlyph(f *sfnt.Font, s string) (rune, bool) {
+	var buf sfnt.Buffer
+	for _, r := range s {
+		if r == ' ' {
+			continue
+		}
+		if i, err := f.GlyphIndex(&buf, r); err != nil || i == 0 {
+			return r, true
+		}
+	}
+	return 0, false
+}
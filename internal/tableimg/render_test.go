@@ -0,0 +1,74 @@
+package tableimg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	header := []Cell{{Text: "Name", Header: true}, {Text: "Value", Header: true}}
+	row := []Cell{{Text: "a"}, {Text: "1", Align: Right}}
+
+	small, err := Render([][]Cell{header, row}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, h := small.Bounds().Dx(), small.Bounds().Dy()
+	if w < 80 || w > 400 || h < 40 || h > 200 {
+		t.Errorf("two by two table is %d×%d pixels at 20 pixels to the em", w, h)
+	}
+	if small.GrayAt(0, 0).Y != 0 || small.GrayAt(2, 2) != headerGray || small.GrayAt(2, h-3).Y != 0xff {
+		t.Errorf("table is not a ruled grid with grey headers on white")
+	}
+
+	// More rows make the table longer, long text wraps instead of
+	// widening it without bound
+	longer, err := Render([][]Cell{header, row, row, row}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longer.Bounds().Dx() != w || longer.Bounds().Dy() <= h {
+		t.Errorf("four rows are %v, two are %v", longer.Bounds(), small.Bounds())
+	}
+	long := []Cell{{Text: strings.Repeat("word ", 40)}, {Text: "1"}}
+	wrapped, err := Render([][]Cell{header, long}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.Bounds().Dx() > 2*20*maxColumnWidth || wrapped.Bounds().Dy() <= h {
+		t.Errorf("table with a long cell is %v", wrapped.Bounds())
+	}
+
+	// A spanning cell covers the columns below it
+	spanned, err := Render([][]Cell{{{Text: "Both", Header: true, Span: 2}}, row}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spanned.Bounds().Dx() >= w {
+		t.Errorf("table with a spanning header is %v, with two headers %v", spanned.Bounds(), small.Bounds())
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	many := make([][]Cell, 20000)
+	for i := range many {
+		many[i] = []Cell{{Text: "row"}, {Text: "of"}, {Text: "a long table"}}
+	}
+	tests := []struct {
+		name string
+		rows [][]Cell
+		want string
+	}{
+		{"empty", nil, "table is empty"},
+		{"no cells", [][]Cell{{}}, "table is empty"},
+		{"missing glyphs", [][]Cell{{{Text: "سلام"}}}, "no glyph for 'س'"},
+		{"too large", many, "megapixels"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Render(tt.rows, 20); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}